@@ -21,8 +21,12 @@ type Client interface {
 	JobStatus(context.Context, job.ID) (job.Status, error)
 	SyncStatus(ctx context.Context, ref string) ([]string, error)
 	UpdatePolicies(context.Context, policy.Updates, update.Cause) (job.ID, error)
+	UpdatePoliciesBySpec(context.Context, update.PolicyUpdatesBySpec, update.Cause) (job.ID, error)
+	UpdateFreeze(context.Context, update.FreezeSpec, update.Cause) (job.ID, error)
+	Rollback(context.Context, update.RollbackSpec, update.Cause) (job.ID, error)
 	Export(context.Context) ([]byte, error)
 	PublicSSHKey(ctx context.Context, regenerate bool) (ssh.PublicKey, error)
+	GitRepoConfig(context.Context) (flux.GitConfig, error)
 }
 
 // API for daemons connecting to an upstream service
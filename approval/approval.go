@@ -0,0 +1,73 @@
+// Package approval has the interface for putting releases to an
+// external gate (e.g., a vulnerability scanner, or a change
+// management system) before they are written to the repo.
+package approval
+
+import (
+	"context"
+
+	"github.com/weaveworks/flux"
+	"github.com/weaveworks/flux/update"
+)
+
+// Decision is what the gate says about an update to a controller.
+type Decision string
+
+const (
+	// Approve lets the update go ahead
+	Approve Decision = "approve"
+	// Reject refuses the update; the reason is reported
+	Reject Decision = "reject"
+	// Defer holds the update back for now, so it may be tried again
+	// later
+	Defer Decision = "defer"
+)
+
+// Request describes the updates a release proposes to make.
+type Request struct {
+	// The kind of release, e.g., "latest_images" or "automated"
+	Type  update.ReleaseType `json:"type"`
+	Cause update.Cause       `json:"cause"`
+	// One entry for each controller to be updated
+	Updates []ControllerUpdate `json:"updates"`
+}
+
+// ControllerUpdate gives the image changes proposed for a controller.
+type ControllerUpdate struct {
+	ID         flux.ResourceID          `json:"id"`
+	Containers []update.ContainerUpdate `json:"containers"`
+}
+
+// Response is what the gate decided. The decision given at the top
+// level applies to any controllers not given a verdict of their own.
+type Response struct {
+	Decision    Decision  `json:"decision"`
+	Reason      string    `json:"reason,omitempty"`
+	Controllers []Verdict `json:"controllers,omitempty"`
+}
+
+// Verdict is the decision for a particular controller.
+type Verdict struct {
+	ID       flux.ResourceID `json:"id"`
+	Decision Decision        `json:"decision"`
+	Reason   string          `json:"reason,omitempty"`
+}
+
+// For gives the verdict for the controller. If there's no decision
+// at all for it, the update is deferred.
+func (r Response) For(id flux.ResourceID) Verdict {
+	for _, v := range r.Controllers {
+		if v.ID == id {
+			return v
+		}
+	}
+	if r.Decision == "" {
+		return Verdict{ID: id, Decision: Defer, Reason: "no decision given"}
+	}
+	return Verdict{ID: id, Decision: r.Decision, Reason: r.Reason}
+}
+
+// Gate reviews the updates proposed by a release.
+type Gate interface {
+	Review(context.Context, Request) (Response, error)
+}
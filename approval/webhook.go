@@ -0,0 +1,68 @@
+package approval
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Webhook is a gate that posts the request, as JSON, to an HTTP
+// endpoint, and expects a response in JSON in return.
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+var _ Gate = &Webhook{}
+
+func NewWebhook(url string) *Webhook {
+	return &Webhook{
+		URL:    url,
+		Client: http.DefaultClient,
+	}
+}
+
+func (w *Webhook) Review(ctx context.Context, req Request) (Response, error) {
+	var res Response
+	body, err := json.Marshal(req)
+	if err != nil {
+		return res, errors.Wrap(err, "encoding approval request")
+	}
+	httpReq, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return res, errors.Wrap(err, "constructing approval request")
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq = httpReq.WithContext(ctx)
+
+	httpRes, err := w.Client.Do(httpReq)
+	if err != nil {
+		return res, errors.Wrap(err, "executing approval request")
+	}
+	defer httpRes.Body.Close()
+	if httpRes.StatusCode != http.StatusOK {
+		resBody, _ := ioutil.ReadAll(httpRes.Body)
+		return res, fmt.Errorf("approval webhook responded %s: %s", httpRes.Status, resBody)
+	}
+	if err := json.NewDecoder(httpRes.Body).Decode(&res); err != nil {
+		return res, errors.Wrap(err, "decoding approval response")
+	}
+	switch res.Decision {
+	case "", Approve, Reject, Defer:
+	default:
+		return res, fmt.Errorf("unknown decision %q from approval webhook", res.Decision)
+	}
+	for _, v := range res.Controllers {
+		switch v.Decision {
+		case Approve, Reject, Defer:
+		default:
+			return res, fmt.Errorf("unknown decision %q for %s from approval webhook", v.Decision, v.ID)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,83 @@
+package approval
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/weaveworks/flux"
+	"github.com/weaveworks/flux/update"
+)
+
+func TestWebhookReview(t *testing.T) {
+	api := flux.MustParseResourceID("default:deployment/api")
+	web := flux.MustParseResourceID("default:deployment/web")
+	db := flux.MustParseResourceID("default:deployment/db")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(req.Updates) != 3 {
+			t.Errorf("expected 3 updates in request, got %d", len(req.Updates))
+		}
+		if req.Cause.User != "jane" {
+			t.Errorf("expected cause to be passed on, got %+v", req.Cause)
+		}
+		json.NewEncoder(w).Encode(Response{
+			Decision: Approve,
+			Controllers: []Verdict{
+				{ID: web, Decision: Reject, Reason: "CVE-2018-0001"},
+				{ID: db, Decision: Defer},
+			},
+		})
+	}))
+	defer server.Close()
+
+	res, err := NewWebhook(server.URL).Review(context.Background(), Request{
+		Type:  "latest_images",
+		Cause: update.Cause{User: "jane"},
+		Updates: []ControllerUpdate{
+			{ID: api}, {ID: web}, {ID: db},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for id, expected := range map[flux.ResourceID]Decision{
+		api: Approve,
+		web: Reject,
+		db:  Defer,
+	} {
+		if v := res.For(id); v.Decision != expected {
+			t.Errorf("%s: expected %q, got %q", id, expected, v.Decision)
+		}
+	}
+	if v := res.For(web); v.Reason != "CVE-2018-0001" {
+		t.Errorf("expected reason for rejection, got %q", v.Reason)
+	}
+}
+
+func TestWebhookReviewFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	if _, err := NewWebhook(server.URL).Review(context.Background(), Request{}); err == nil {
+		t.Error("expected error from failing webhook")
+	}
+}
+
+func TestResponseForMissingDecision(t *testing.T) {
+	id := flux.MustParseResourceID("default:deployment/api")
+	if v := (Response{}).For(id); v.Decision != Defer {
+		t.Errorf("expected no decision to mean defer, got %q", v.Decision)
+	}
+}
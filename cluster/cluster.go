@@ -25,6 +25,14 @@ type Cluster interface {
 	PublicSSHKey(regenerate bool) (ssh.PublicKey, error)
 }
 
+// The statuses a controller can report, as far as rolling out its
+// definition goes.
+const (
+	StatusUnknown  = "unknown"
+	StatusReady    = "ready"
+	StatusUpdating = "updating"
+)
+
 // Controller describes a platform resource that declares versioned images.
 type Controller struct {
 	ID     flux.ResourceID
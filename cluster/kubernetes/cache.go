@@ -0,0 +1,365 @@
+package kubernetes
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics/prometheus"
+	"github.com/pkg/errors"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+
+	fluxmetrics "github.com/weaveworks/flux/metrics"
+)
+
+var (
+	// The watches informers use are expected to be closed by the API
+	// server every so often (and restarted), so a steady trickle of
+	// restarts is normal; lots suggests trouble.
+	watchRestarts = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Namespace: "flux",
+		Subsystem: "cluster_cache",
+		Name:      "watch_restarts_total",
+		Help:      "Count of restarts of the watches keeping the cluster cache up to date.",
+	}, []string{fluxmetrics.LabelResourceKind})
+)
+
+// The key for namespaces in metrics
+const namespaceKind = "namespace"
+
+// clusterCache keeps an in-memory view of the namespaces and
+// workloads in the cluster, using shared informers, so that listing
+// them needn't query the API server every time.
+type clusterCache struct {
+	namespaces cache.SharedIndexInformer
+	mu         sync.RWMutex
+	// informers for each resource kind that the API server supports
+	kinds map[string]cache.SharedIndexInformer
+	// kinds the API server supports, but which aren't cached, since
+	// their informers didn't sync in time
+	dropped map[string]bool
+	// closing one of these stops the informer for that kind
+	dropc map[string]chan struct{}
+	stop  chan struct{}
+}
+
+// StartCache starts keeping an in-memory view of namespaces and
+// workloads, which is used in preference to querying the API server
+// once it has been populated (as reported by Ping). Informers are
+// only run for the kinds of resource the API server supports. If an
+// informer hasn't synced within syncTimeout (e.g., because fluxd
+// isn't allowed to list or watch that kind), it is stopped and that
+// kind is looked up with the API server instead; if it's namespaces
+// that don't sync, the cache is given up altogether. The cache stops
+// with the cluster.
+func (c *Cluster) StartCache(resync, syncTimeout time.Duration) error {
+	cc := &clusterCache{
+		kinds:   map[string]cache.SharedIndexInformer{},
+		dropped: map[string]bool{},
+		dropc:   map[string]chan struct{}{},
+		stop:    make(chan struct{}),
+	}
+	cc.namespaces = newInformer(namespaceKind, &cache.ListWatch{
+		ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
+			return c.client.Namespaces().List(options)
+		},
+		WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
+			return c.client.Namespaces().Watch(options)
+		},
+	}, &apiv1.Namespace{}, resync)
+
+	for kind, resourceKind := range resourceKinds {
+		served, err := c.serves(resourceKind)
+		if err != nil {
+			return errors.Wrapf(err, "finding out whether API server supports %s", kind)
+		}
+		if !served {
+			c.logger.Log("cache", "skip", "kind", kind, "reason", "not supported by API server")
+			continue
+		}
+		lw, obj := resourceKind.listWatch(c)
+		cc.kinds[kind] = newInformer(kind, lw, obj, resync)
+	}
+
+	go cc.namespaces.Run(cc.stop)
+	for kind, informer := range cc.kinds {
+		cc.run(kind, informer)
+	}
+
+	c.cacheMu.Lock()
+	c.cache = cc
+	c.cacheMu.Unlock()
+	if syncTimeout > 0 {
+		go c.dropUnsynced(cc, syncTimeout)
+	}
+	return nil
+}
+
+// run runs the informer for a kind until either the cache is stopped,
+// or the kind is dropped.
+func (cc *clusterCache) run(kind string, informer cache.SharedIndexInformer) {
+	dropc := make(chan struct{})
+	cc.dropc[kind] = dropc
+	go func() {
+		stop := make(chan struct{})
+		go informer.Run(stop)
+		select {
+		case <-cc.stop:
+		case <-dropc:
+		}
+		close(stop)
+	}()
+}
+
+// dropUnsynced waits for the cache to sync, for up to the timeout
+// given, then drops the kinds that haven't synced so that the rest of
+// the cache can be used (and Ping doesn't fail forever).
+func (c *Cluster) dropUnsynced(cc *clusterCache, timeout time.Duration) {
+	expired := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() { close(expired) })
+	defer timer.Stop()
+
+	if !cache.WaitForCacheSync(expired, cc.namespaces.HasSynced) {
+		// Stopping the cluster stops the cache while holding
+		// cacheMu, so this won't stop it a second time.
+		c.cacheMu.Lock()
+		defer c.cacheMu.Unlock()
+		select {
+		case <-cc.stop:
+			return
+		default:
+		}
+		c.logger.Log("cache", "disabled", "kind", namespaceKind, "reason", fmt.Sprintf("not synced within %s; perhaps fluxd is not allowed to list or watch it", timeout))
+		if c.cache == cc {
+			c.cache = nil
+		}
+		cc.stopInformers()
+		return
+	}
+	for kind, informer := range cc.informers() {
+		if cache.WaitForCacheSync(expired, informer.HasSynced) {
+			continue
+		}
+		select {
+		case <-cc.stop:
+			return
+		default:
+		}
+		c.logger.Log("cache", "skip", "kind", kind, "reason", fmt.Sprintf("not synced within %s; perhaps fluxd is not allowed to list or watch it", timeout))
+		cc.drop(kind)
+	}
+}
+
+// informers gives the informers for the kinds being cached.
+func (cc *clusterCache) informers() map[string]cache.SharedIndexInformer {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	informers := make(map[string]cache.SharedIndexInformer, len(cc.kinds))
+	for kind, informer := range cc.kinds {
+		informers[kind] = informer
+	}
+	return informers
+}
+
+// drop stops caching the kind given, so that it's looked up with the
+// API server instead.
+func (cc *clusterCache) drop(kind string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if _, ok := cc.kinds[kind]; !ok {
+		return
+	}
+	delete(cc.kinds, kind)
+	cc.dropped[kind] = true
+	close(cc.dropc[kind])
+}
+
+// serves says whether the API server supports the kind of resource
+// given.
+func (c *Cluster) serves(resourceKind resourceKind) (bool, error) {
+	groupVersion, resource := resourceKind.apiResource()
+	resources, err := c.client.ServerResourcesForGroupVersion(groupVersion)
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil || resources == nil {
+		return false, err
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == resource {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func newInformer(kind string, lw *cache.ListWatch, obj runtime.Object, resync time.Duration) cache.SharedIndexInformer {
+	var mu sync.Mutex
+	var started bool
+	watchFunc := lw.WatchFunc
+	lw.WatchFunc = func(options meta_v1.ListOptions) (watch.Interface, error) {
+		mu.Lock()
+		if started {
+			watchRestarts.With(fluxmetrics.LabelResourceKind, kind).Add(1)
+		}
+		started = true
+		mu.Unlock()
+		return watchFunc(options)
+	}
+	return cache.NewSharedIndexInformer(lw, obj, resync, cache.Indexers{
+		cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+	})
+}
+
+// readyCache gives the cluster cache if it has been started and has
+// been populated, or nil otherwise.
+func (c *Cluster) readyCache() *clusterCache {
+	c.cacheMu.RLock()
+	cc := c.cache
+	c.cacheMu.RUnlock()
+	if cc == nil || cc.notSynced() != nil {
+		return nil
+	}
+	return cc
+}
+
+// cacheStatus gives an error if the cache has been started, but is
+// not yet populated.
+func (c *Cluster) cacheStatus() error {
+	c.cacheMu.RLock()
+	cc := c.cache
+	c.cacheMu.RUnlock()
+	if cc == nil {
+		return nil
+	}
+	return cc.notSynced()
+}
+
+// notSynced gives an error naming something not yet in the cache, or
+// nil if everything is.
+func (cc *clusterCache) notSynced() error {
+	if !cc.namespaces.HasSynced() {
+		return fmt.Errorf("cluster cache: namespaces not yet synced")
+	}
+	for kind, informer := range cc.informers() {
+		if !informer.HasSynced() {
+			return fmt.Errorf("cluster cache: %s not yet synced", kind)
+		}
+	}
+	return nil
+}
+
+func (cc *clusterCache) stopInformers() {
+	close(cc.stop)
+}
+
+func (cc *clusterCache) listNamespaces() []apiv1.Namespace {
+	objs := cc.namespaces.GetStore().List()
+	namespaces := make([]apiv1.Namespace, 0, len(objs))
+	for _, obj := range objs {
+		if ns, ok := obj.(*apiv1.Namespace); ok {
+			namespaces = append(namespaces, *ns)
+		}
+	}
+	return namespaces
+}
+
+// informer gives the informer for the kind given, if there is one,
+// and whether the kind is cached at all -- it isn't if it was
+// dropped. A kind that's not supported by the API server counts as
+// cached, with nothing in it.
+func (cc *clusterCache) informer(kind string) (cache.SharedIndexInformer, bool) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	return cc.kinds[kind], !cc.dropped[kind]
+}
+
+// podControllers gives the cached controllers of the kind given in a
+// namespace, and whether the kind is cached.
+func (cc *clusterCache) podControllers(kind string, resourceKind resourceKind, namespace string) ([]podController, bool, error) {
+	informer, cached := cc.informer(kind)
+	if informer == nil {
+		// Either not supported by the API server, or not cached
+		return nil, cached, nil
+	}
+	objs, err := informer.GetIndexer().ByIndex(cache.NamespaceIndex, namespace)
+	if err != nil {
+		return nil, true, err
+	}
+	podControllers := make([]podController, 0, len(objs))
+	for _, obj := range objs {
+		pc, ok := resourceKind.makePodController(obj)
+		if !ok {
+			continue
+		}
+		podControllers = append(podControllers, pc)
+	}
+	return podControllers, true, nil
+}
+
+// podController gives the cached controller of the kind given, and
+// whether it was found.
+func (cc *clusterCache) podController(kind string, resourceKind resourceKind, namespace, name string) (podController, bool, error) {
+	informer, _ := cc.informer(kind)
+	if informer == nil {
+		return podController{}, false, nil
+	}
+	obj, exists, err := informer.GetIndexer().GetByKey(namespace + "/" + name)
+	if err != nil || !exists {
+		return podController{}, false, err
+	}
+	pc, ok := resourceKind.makePodController(obj)
+	return pc, ok, nil
+}
+
+// --- used by the Cluster methods, with or without the cache
+
+// namespaces lists the namespaces in the cluster.
+func (c *Cluster) namespaces() ([]apiv1.Namespace, error) {
+	if cc := c.readyCache(); cc != nil {
+		return cc.listNamespaces(), nil
+	}
+	list, err := c.client.Namespaces().List(meta_v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// podControllers lists the controllers of the kind given in a
+// namespace. If the API server doesn't support the kind, there are
+// none. Kinds dropped from the cache are listed with the API server.
+func (c *Cluster) podControllers(kind string, resourceKind resourceKind, namespace string) ([]podController, error) {
+	if cc := c.readyCache(); cc != nil {
+		if podControllers, cached, err := cc.podControllers(kind, resourceKind, namespace); cached {
+			return podControllers, err
+		}
+	}
+	podControllers, err := resourceKind.getPodControllers(c, namespace)
+	if isNotFound(err) {
+		// Kind not supported by API server, skip
+		return nil, nil
+	}
+	return podControllers, err
+}
+
+// podController gets the controller named. Anything not (yet) in
+// the cache is looked up with the API server, so the error is the
+// same as it would be without a cache.
+func (c *Cluster) podController(kind string, resourceKind resourceKind, namespace, name string) (podController, error) {
+	if cc := c.readyCache(); cc != nil {
+		pc, found, err := cc.podController(kind, resourceKind, namespace, name)
+		if err != nil {
+			return podController{}, err
+		}
+		if found {
+			return pc, nil
+		}
+	}
+	return resourceKind.getPodController(c, namespace, name)
+}
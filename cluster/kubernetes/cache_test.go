@@ -0,0 +1,172 @@
+package kubernetes
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+	apiext "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/weaveworks/flux"
+)
+
+func staticListWatch(list runtime.Object) *cache.ListWatch {
+	return &cache.ListWatch{
+		ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
+			return list, nil
+		},
+		WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
+			return watch.NewFake(), nil
+		},
+	}
+}
+
+// A cluster with a cache populated from the lists given, and no
+// client; so, anything not answered from the cache will panic.
+func cachedCluster(t *testing.T, namespaces *apiv1.NamespaceList, deployments *apiext.DeploymentList) (*Cluster, func()) {
+	cc := &clusterCache{
+		namespaces: newInformer(namespaceKind, staticListWatch(namespaces), &apiv1.Namespace{}, 0),
+		kinds: map[string]cache.SharedIndexInformer{
+			"deployment": newInformer("deployment", staticListWatch(deployments), &apiext.Deployment{}, 0),
+		},
+		stop: make(chan struct{}),
+	}
+	go cc.namespaces.Run(cc.stop)
+	for _, informer := range cc.kinds {
+		go informer.Run(cc.stop)
+	}
+
+	timeout := make(chan struct{})
+	timer := time.AfterFunc(5*time.Second, func() { close(timeout) })
+	defer timer.Stop()
+	if !cache.WaitForCacheSync(timeout, cc.namespaces.HasSynced, cc.kinds["deployment"].HasSynced) {
+		cc.stopInformers()
+		t.Fatal("timed out waiting for cache to sync")
+	}
+
+	c := &Cluster{logger: log.NewNopLogger(), cache: cc}
+	return c, cc.stopInformers
+}
+
+func TestCachedControllers(t *testing.T) {
+	replicas := int32(1)
+	namespaces := &apiv1.NamespaceList{
+		Items: []apiv1.Namespace{
+			{ObjectMeta: meta_v1.ObjectMeta{Name: "default"}},
+			{ObjectMeta: meta_v1.ObjectMeta{Name: "empty"}},
+		},
+	}
+	deployments := &apiext.DeploymentList{
+		Items: []apiext.Deployment{
+			{
+				ObjectMeta: meta_v1.ObjectMeta{Name: "helloworld", Namespace: "default"},
+				Spec: apiext.DeploymentSpec{
+					Replicas: &replicas,
+					Template: apiv1.PodTemplateSpec{
+						Spec: apiv1.PodSpec{
+							Containers: []apiv1.Container{
+								{Name: "greeter", Image: "quay.io/weaveworks/helloworld:master-a000001"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	c, stop := cachedCluster(t, namespaces, deployments)
+	defer stop()
+
+	if err := c.cacheStatus(); err != nil {
+		t.Errorf("expected cache to be synced, got %v", err)
+	}
+
+	id := flux.MustParseResourceID("default:deployment/helloworld")
+	all, err := c.AllControllers("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].ID != id {
+		t.Fatalf("expected only %s, got %#v", id, all)
+	}
+	if containers := all[0].Containers.Containers; len(containers) != 1 || containers[0].Image != "quay.io/weaveworks/helloworld:master-a000001" {
+		t.Errorf("unexpected containers: %#v", containers)
+	}
+
+	if none, err := c.AllControllers("empty"); err != nil {
+		t.Error(err)
+	} else if len(none) != 0 {
+		t.Errorf("expected no controllers in namespace empty, got %#v", none)
+	}
+
+	some, err := c.SomeControllers([]flux.ResourceID{id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(some) != 1 || some[0].ID != id {
+		t.Errorf("expected %s, got %#v", id, some)
+	}
+
+	export, err := c.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"kind: Namespace", "name: empty", "kind: Deployment", "name: helloworld"} {
+		if !strings.Contains(string(export), expected) {
+			t.Errorf("expected export to contain %q:\n%s", expected, export)
+		}
+	}
+
+	images := c.ImagesToFetch()
+	if len(images) != 1 {
+		t.Errorf("expected one image to fetch, got %#v", images)
+	}
+}
+
+func TestCacheDropsUnsyncedKinds(t *testing.T) {
+	namespaces := &apiv1.NamespaceList{
+		Items: []apiv1.Namespace{{ObjectMeta: meta_v1.ObjectMeta{Name: "default"}}},
+	}
+	cc := &clusterCache{
+		namespaces: newInformer(namespaceKind, staticListWatch(namespaces), &apiv1.Namespace{}, 0),
+		kinds:      map[string]cache.SharedIndexInformer{},
+		dropped:    map[string]bool{},
+		dropc:      map[string]chan struct{}{},
+		stop:       make(chan struct{}),
+	}
+	// Listing deployments always fails, as it would if fluxd weren't
+	// allowed to
+	forbidden := newInformer("deployment", &cache.ListWatch{
+		ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
+			return nil, errors.New("forbidden")
+		},
+		WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
+			return nil, errors.New("forbidden")
+		},
+	}, &apiext.Deployment{}, 0)
+	cc.kinds["deployment"] = forbidden
+	cc.run("deployment", forbidden)
+	go cc.namespaces.Run(cc.stop)
+	c := &Cluster{logger: log.NewNopLogger(), cache: cc}
+	defer cc.stopInformers()
+
+	if err := c.cacheStatus(); err == nil {
+		t.Fatal("expected cache not to be synced")
+	}
+	c.dropUnsynced(cc, 500*time.Millisecond)
+	if err := c.cacheStatus(); err != nil {
+		t.Errorf("expected cache to be synced once deployments are dropped, got %v", err)
+	}
+	if _, cached := cc.informer("deployment"); cached {
+		t.Error("expected deployments not to be cached")
+	}
+	if c.readyCache() == nil {
+		t.Error("expected the rest of the cache to be used")
+	}
+}
@@ -2,13 +2,14 @@ package kubernetes
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"sync"
 
 	k8syaml "github.com/ghodss/yaml"
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/discovery"
 	k8sclient "k8s.io/client-go/kubernetes"
@@ -21,14 +22,15 @@ import (
 
 	"github.com/weaveworks/flux"
 	"github.com/weaveworks/flux/cluster"
+	kresource "github.com/weaveworks/flux/cluster/kubernetes/resource"
 	"github.com/weaveworks/flux/registry"
 	"github.com/weaveworks/flux/ssh"
 )
 
 const (
-	StatusUnknown  = "unknown"
-	StatusReady    = "ready"
-	StatusUpdating = "updating"
+	StatusUnknown  = cluster.StatusUnknown
+	StatusReady    = cluster.StatusReady
+	StatusUpdating = cluster.StatusUpdating
 )
 
 type extendedClient struct {
@@ -87,9 +89,12 @@ func isAddon(obj namespacedLabeled) bool {
 
 // --- /add ons
 
+// Applier carries out the changes to individual resources that make
+// up a sync. It may be called from several goroutines at once, and
+// should give up when the context is done.
 type Applier interface {
-	Delete(logger log.Logger, def *apiObject) error
-	Apply(logger log.Logger, def *apiObject) error
+	Delete(ctx context.Context, logger log.Logger, def *apiObject) error
+	Apply(ctx context.Context, logger log.Logger, def *apiObject) error
 }
 
 // Cluster is a handle to a Kubernetes API server.
@@ -101,6 +106,14 @@ type Cluster struct {
 	version    string // string response for the version command.
 	logger     log.Logger
 	sshKeyRing ssh.KeyRing
+
+	// SyncOptions govern how Sync carries out actions; set them
+	// before the cluster is used, if at all.
+	SyncOptions SyncOptions
+
+	// set when StartCache is called
+	cacheMu sync.RWMutex
+	cache   *clusterCache
 }
 
 // NewCluster returns a usable cluster. Host should be of the form
@@ -131,6 +144,11 @@ func NewCluster(clientset k8sclient.Interface,
 // the cluster. A stopped cluster cannot be restarted.
 func (c *Cluster) Stop() {
 	close(c.actionc)
+	c.cacheMu.RLock()
+	defer c.cacheMu.RUnlock()
+	if c.cache != nil {
+		c.cache.stopInformers()
+	}
 }
 
 func (c *Cluster) loop() {
@@ -154,7 +172,7 @@ func (c *Cluster) SomeControllers(ids []flux.ResourceID) (res []cluster.Controll
 			return nil, fmt.Errorf("Unsupported kind %v", kind)
 		}
 
-		podController, err := resourceKind.getPodController(c, ns, name)
+		podController, err := c.podController(kind, resourceKind, ns, name)
 		if err != nil {
 			return nil, err
 		}
@@ -169,26 +187,21 @@ func (c *Cluster) SomeControllers(ids []flux.ResourceID) (res []cluster.Controll
 // AllControllers returns all controllers matching the criteria; that is, in
 // the namespace (or any namespace if that argument is empty)
 func (c *Cluster) AllControllers(namespace string) (res []cluster.Controller, err error) {
-	namespaces, err := c.client.Namespaces().List(meta_v1.ListOptions{})
+	namespaces, err := c.namespaces()
 	if err != nil {
 		return nil, errors.Wrap(err, "getting namespaces")
 	}
 
 	var allControllers []cluster.Controller
-	for _, ns := range namespaces.Items {
+	for _, ns := range namespaces {
 		if namespace != "" && ns.Name != namespace {
 			continue
 		}
 
 		for kind, resourceKind := range resourceKinds {
-			podControllers, err := resourceKind.getPodControllers(c, ns.Name)
+			podControllers, err := c.podControllers(kind, resourceKind, ns.Name)
 			if err != nil {
-				if se, ok := err.(*apierrors.StatusError); ok && se.ErrStatus.Reason == meta_v1.StatusReasonNotFound {
-					// Kind not supported by API server, skip
-					continue
-				} else {
-					return nil, err
-				}
+				return nil, err
 			}
 
 			for _, podController := range podControllers {
@@ -203,72 +216,32 @@ func (c *Cluster) AllControllers(namespace string) (res []cluster.Controller, er
 	return allControllers, nil
 }
 
-// Sync performs the given actions on resources. Operations are
-// asynchronous, but serialised.
-func (c *Cluster) Sync(spec cluster.SyncDef) error {
-	errc := make(chan error)
-	logger := log.With(c.logger, "method", "Sync")
-	c.actionc <- func() {
-		errs := cluster.SyncError{}
-		for _, action := range spec.Actions {
-			logger := log.With(logger, "resource", action.ResourceID)
-			if len(action.Delete) > 0 {
-				obj, err := definitionObj(action.Delete)
-				if err == nil {
-					err = c.applier.Delete(logger, obj)
-				}
-				if err != nil {
-					errs[action.ResourceID] = err
-					continue
-				}
-			}
-			if len(action.Apply) > 0 {
-				obj, err := definitionObj(action.Apply)
-				if err == nil {
-					err = c.applier.Apply(logger, obj)
-				}
-				if err != nil {
-					errs[action.ResourceID] = err
-					continue
-				}
-			}
-		}
-		if len(errs) > 0 {
-			errc <- errs
-		} else {
-			errc <- nil
-		}
-	}
-	return <-errc
-}
-
+// Ping checks the API server can be reached and, if the cache has
+// been started, that it has been populated.
 func (c *Cluster) Ping() error {
-	_, err := c.client.ServerVersion()
-	return err
+	if _, err := c.client.ServerVersion(); err != nil {
+		return err
+	}
+	return c.cacheStatus()
 }
 
 // Export exports cluster resources
 func (c *Cluster) Export() ([]byte, error) {
 	var config bytes.Buffer
-	list, err := c.client.Namespaces().List(meta_v1.ListOptions{})
+	namespaces, err := c.namespaces()
 	if err != nil {
 		return nil, errors.Wrap(err, "getting namespaces")
 	}
-	for _, ns := range list.Items {
+	for _, ns := range namespaces {
 		err := appendYAML(&config, "v1", "Namespace", ns)
 		if err != nil {
 			return nil, errors.Wrap(err, "marshalling namespace to YAML")
 		}
 
-		for _, resourceKind := range resourceKinds {
-			podControllers, err := resourceKind.getPodControllers(c, ns.Name)
+		for kind, resourceKind := range resourceKinds {
+			podControllers, err := c.podControllers(kind, resourceKind, ns.Name)
 			if err != nil {
-				if se, ok := err.(*apierrors.StatusError); ok && se.ErrStatus.Reason == meta_v1.StatusReasonNotFound {
-					// Kind not supported by API server, skip
-					continue
-				} else {
-					return nil, err
-				}
+				return nil, err
 			}
 
 			for _, pc := range podControllers {
@@ -363,21 +336,17 @@ func mergeCredentials(c *Cluster, namespace string, podTemplate apiv1.PodTemplat
 func (c *Cluster) ImagesToFetch() registry.ImageCreds {
 	allImageCreds := make(registry.ImageCreds)
 
-	namespaces, err := c.client.Namespaces().List(meta_v1.ListOptions{})
+	namespaces, err := c.namespaces()
 	if err != nil {
 		c.logger.Log("err", errors.Wrap(err, "getting namespaces"))
 		return allImageCreds
 	}
 
-	for _, ns := range namespaces.Items {
+	for _, ns := range namespaces {
 		for kind, resourceKind := range resourceKinds {
-			podControllers, err := resourceKind.getPodControllers(c, ns.Name)
+			podControllers, err := c.podControllers(kind, resourceKind, ns.Name)
 			if err != nil {
-				if se, ok := err.(*apierrors.StatusError); ok && se.ErrStatus.Reason == meta_v1.StatusReasonNotFound {
-					// Kind not supported by API server, skip
-				} else {
-					c.logger.Log("err", errors.Wrapf(err, "getting kind %s for namespace %s", kind, ns.Name))
-				}
+				c.logger.Log("err", errors.Wrapf(err, "getting kind %s for namespace %s", kind, ns.Name))
 				continue
 			}
 
@@ -408,3 +377,42 @@ func definitionObj(bytes []byte) (*apiObject, error) {
 	obj := apiObject{bytes: bytes}
 	return &obj, yaml.Unmarshal(bytes, &obj)
 }
+
+// applyObj gives the object to apply for a sync action, with the
+// checksum, if there is one, recorded in an annotation.
+func applyObj(action cluster.SyncAction) (*apiObject, error) {
+	def := []byte(action.Apply)
+	if action.Checksum != "" {
+		var doc yaml.MapSlice
+		if err := yaml.Unmarshal(def, &doc); err != nil {
+			return nil, err
+		}
+		doc = setIn(doc, action.Checksum, "metadata", "annotations", kresource.ChecksumAnnotation)
+		var err error
+		if def, err = yaml.Marshal(doc); err != nil {
+			return nil, err
+		}
+	}
+	return definitionObj(def)
+}
+
+// setIn sets the value at the path given in a YAML document, creating
+// any maps along the way that aren't there already.
+func setIn(doc yaml.MapSlice, value interface{}, path ...string) yaml.MapSlice {
+	for i := range doc {
+		if doc[i].Key != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			doc[i].Value = value
+		} else {
+			inner, _ := doc[i].Value.(yaml.MapSlice)
+			doc[i].Value = setIn(inner, value, path[1:]...)
+		}
+		return doc
+	}
+	if len(path) == 1 {
+		return append(doc, yaml.MapItem{Key: path[0], Value: value})
+	}
+	return append(doc, yaml.MapItem{Key: path[0], Value: setIn(nil, value, path[1:]...)})
+}
@@ -4,9 +4,12 @@ package kubernetes
 // adequate. Starting with Sync.
 
 import (
+	"context"
 	"errors"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	discovery "k8s.io/client-go/discovery"
@@ -32,6 +35,7 @@ import (
 	storagev1beta1 "k8s.io/client-go/kubernetes/typed/storage/v1beta1"
 
 	"github.com/weaveworks/flux/cluster"
+	kresource "github.com/weaveworks/flux/cluster/kubernetes/resource"
 )
 
 type command struct {
@@ -183,22 +187,53 @@ func (m *mockClientset) Storage() storagev1.StorageV1Interface {
 }
 
 type mockApplier struct {
+	mu        sync.Mutex
 	commands  []command
+	applied   [][]byte
 	applyErr  error
 	createErr error
 	deleteErr error
+	// if given, returned by the first applies, in turn, instead of
+	// applyErr
+	applyErrs []error
 }
 
-func (m *mockApplier) Apply(logger log.Logger, obj *apiObject) error {
+func (m *mockApplier) Apply(ctx context.Context, logger log.Logger, obj *apiObject) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.commands = append(m.commands, command{"apply", string(obj.Metadata.Name)})
+	m.applied = append(m.applied, obj.bytes)
+	if len(m.applyErrs) > 0 {
+		err := m.applyErrs[0]
+		m.applyErrs = m.applyErrs[1:]
+		return err
+	}
 	return m.applyErr
 }
 
-func (m *mockApplier) Delete(logger log.Logger, obj *apiObject) error {
+func (m *mockApplier) Delete(ctx context.Context, logger log.Logger, obj *apiObject) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.commands = append(m.commands, command{"delete", string(obj.Metadata.Name)})
 	return m.deleteErr
 }
 
+func namespaceDef(name string) []byte {
+	return []byte(`---
+kind: Namespace
+metadata:
+  name: ` + name + `
+`)
+}
+
+func definitionDef(name string) []byte {
+	return []byte(`---
+kind: CustomResourceDefinition
+metadata:
+  name: ` + name + `
+`)
+}
+
 func deploymentDef(name string) []byte {
 	return []byte(`---
 kind: Deployment
@@ -310,3 +345,113 @@ func TestSkipOnError(t *testing.T) {
 		t.Errorf("expected commands:\n%#v\ngot:\n%#v", expected, mock.commands)
 	}
 }
+
+func TestSyncRecordsChecksum(t *testing.T) {
+	kube, mock := setup(t)
+	if err := kube.Sync(cluster.SyncDef{
+		Actions: []cluster.SyncAction{
+			cluster.SyncAction{
+				ResourceID: "test-ns:deployment/checksummed",
+				Apply:      deploymentDef("checksummed"),
+				Checksum:   "abc123",
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(mock.applied) != 1 {
+		t.Fatalf("expected one resource applied, got %d", len(mock.applied))
+	}
+
+	resources, err := kresource.ParseMultidoc(mock.applied[0], "applied")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, ok := resources["test-ns:deployment/checksummed"]
+	if !ok {
+		t.Fatalf("expected the deployment to be applied, got:\n%s", mock.applied[0])
+	}
+	if sum := res.(interface {
+		SyncChecksum() string
+	}).SyncChecksum(); sum != "abc123" {
+		t.Errorf("expected checksum %q to be recorded, got %q", "abc123", sum)
+	}
+	if len(res.Policy()) != 0 {
+		t.Errorf("expected the checksum not to be taken as a policy, got %v", res.Policy())
+	}
+}
+
+// Test that namespaces are created before anything else is applied,
+// and that deletes come first, even when there are several workers.
+func TestSyncTiers(t *testing.T) {
+	kube, mock := setup(t)
+	kube.SyncOptions.Workers = 4
+
+	if err := kube.Sync(cluster.SyncDef{
+		Actions: []cluster.SyncAction{
+			cluster.SyncAction{ResourceID: "a", Apply: deploymentDef("a")},
+			cluster.SyncAction{ResourceID: "b", Apply: deploymentDef("b")},
+			cluster.SyncAction{ResourceID: "new-ns", Apply: namespaceDef("new-ns")},
+			cluster.SyncAction{ResourceID: "c", Apply: deploymentDef("c")},
+			cluster.SyncAction{ResourceID: "widgets", Apply: definitionDef("widgets")},
+			cluster.SyncAction{ResourceID: "old-ns", Delete: namespaceDef("old-ns")},
+			cluster.SyncAction{ResourceID: "old-widgets", Delete: definitionDef("old-widgets")},
+			cluster.SyncAction{ResourceID: "gone", Delete: deploymentDef("gone")},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mock.commands) != 8 {
+		t.Fatalf("expected eight commands, got %#v", mock.commands)
+	}
+	expected := []command{
+		command{"delete", "gone"},
+		command{"delete", "old-widgets"},
+		command{"delete", "old-ns"},
+		command{"apply", "new-ns"},
+		command{"apply", "widgets"},
+	}
+	if !reflect.DeepEqual(expected, mock.commands[:5]) {
+		t.Errorf("expected commands to start:\n%#v\ngot:\n%#v", expected, mock.commands)
+	}
+	for _, c := range mock.commands[5:] {
+		if c.action != "apply" || c.def == "new-ns" || c.def == "widgets" {
+			t.Errorf("expected the deployments to be applied last, got %#v", mock.commands)
+		}
+	}
+}
+
+// Test that an action that fails for a transient reason is retried,
+// and one that fails for any other reason is not.
+func TestSyncRetries(t *testing.T) {
+	kube, mock := setup(t)
+	kube.SyncOptions = SyncOptions{Retries: 2, Backoff: time.Millisecond}
+	conflict := errors.New("running kubectl: Error from server (Conflict): the object has been modified")
+	mock.applyErrs = []error{conflict, conflict}
+
+	if err := kube.Sync(cluster.SyncDef{
+		Actions: []cluster.SyncAction{
+			cluster.SyncAction{ResourceID: "retried", Apply: deploymentDef("retried")},
+		},
+	}); err != nil {
+		t.Fatalf("expected sync to succeed on the third attempt, got %v", err)
+	}
+	if len(mock.commands) != 3 {
+		t.Errorf("expected three attempts, got %#v", mock.commands)
+	}
+
+	mock.commands = nil
+	mock.applyErrs = []error{errors.New("running kubectl: error validating data")}
+	err := kube.Sync(cluster.SyncDef{
+		Actions: []cluster.SyncAction{
+			cluster.SyncAction{ResourceID: "invalid", Apply: deploymentDef("invalid")},
+		},
+	})
+	if errs, ok := err.(cluster.SyncError); !ok || errs["invalid"] == nil {
+		t.Errorf("expected sync error for %q, got %#v", "invalid", err)
+	}
+	if len(mock.commands) != 1 {
+		t.Errorf("expected a single attempt, got %#v", mock.commands)
+	}
+}
@@ -154,9 +154,15 @@ func (m *Manifests) ServicesWithPolicies(root string) (policy.ResourceMap, error
 		return nil, err
 	}
 
+	defaults, err := namespaceDefaults(root)
+	if err != nil {
+		return nil, err
+	}
+
 	result := map[flux.ResourceID]policy.Set{}
 	err = iterateManifests(all, func(s flux.ResourceID, m Manifest) error {
-		ps, err := policiesFrom(m)
+		ns, _, _ := s.Components()
+		ps, err := policiesFrom(m, defaults[ns])
 		if err != nil {
 			return err
 		}
@@ -191,8 +197,15 @@ func iterateManifests(services map[flux.ResourceID][]string, f func(flux.Resourc
 	return nil
 }
 
-func policiesFrom(m Manifest) (policy.Set, error) {
+// policiesFrom reads the policies from the annotations of the
+// manifest, on top of the defaults given. A boolean policy annotated
+// with anything other than "true" switches the policy off, even if it
+// is on by default.
+func policiesFrom(m Manifest, defaults policy.Set) (policy.Set, error) {
 	var policies policy.Set
+	for p, v := range defaults {
+		policies = policies.Set(p, v)
+	}
 	for k, v := range m.Metadata.AnnotationsOrNil() {
 		if !strings.HasPrefix(k, resource.PolicyPrefix) {
 			continue
@@ -200,6 +213,7 @@ func policiesFrom(m Manifest) (policy.Set, error) {
 		p := policy.Policy(strings.TrimPrefix(k, resource.PolicyPrefix))
 		if policy.Boolean(p) {
 			if v != "true" {
+				policies = policies.Without(p)
 				continue
 			}
 			policies = policies.Add(p)
@@ -209,3 +223,31 @@ func policiesFrom(m Manifest) (policy.Set, error) {
 	}
 	return policies, nil
 }
+
+// namespaceDefaults gives the policies annotated on each namespace
+// defined under root, which are the defaults for the controllers in
+// that namespace. The ignore policy is not passed down, since on a
+// namespace it means the namespace itself is not to be synced.
+func namespaceDefaults(root string) (map[string]policy.Set, error) {
+	objects, err := resource.Load(root)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading resources")
+	}
+	defaults := map[string]policy.Set{}
+	for _, obj := range objects {
+		_, kind, name := obj.ResourceID().Components()
+		if kind != "namespace" {
+			continue
+		}
+		manifest, err := parseManifest(obj.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		ps, err := policiesFrom(manifest, nil)
+		if err != nil {
+			return nil, err
+		}
+		defaults[name] = ps.Without(policy.Ignore)
+	}
+	return defaults, nil
+}
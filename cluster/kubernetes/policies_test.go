@@ -2,9 +2,14 @@ package kubernetes
 
 import (
 	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"text/template"
 
+	"github.com/weaveworks/flux"
+	"github.com/weaveworks/flux/cluster/kubernetes/testfiles"
 	"github.com/weaveworks/flux/policy"
 )
 
@@ -137,3 +142,65 @@ func templToString(t *testing.T, templ *template.Template, data interface{}) str
 	}
 	return out.String()
 }
+
+func TestServicesWithPoliciesNamespaceDefaults(t *testing.T) {
+	dir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	files := map[string]string{
+		"namespace.yaml": `apiVersion: v1
+kind: Namespace
+metadata:
+  name: payments
+  annotations:
+    flux.weave.works/automated: "true"
+    flux.weave.works/ignore: "true"
+    flux.weave.works/tag.app: "glob:master-*"
+`,
+		"api.yaml": `apiVersion: extensions/v1beta1
+kind: Deployment
+metadata:
+  name: api
+  namespace: payments
+`,
+		"web.yaml": `apiVersion: extensions/v1beta1
+kind: Deployment
+metadata:
+  name: web
+  namespace: payments
+  annotations:
+    flux.weave.works/automated: "false"
+    flux.weave.works/tag.app: "semver:*"
+`,
+		"other.yaml": `apiVersion: extensions/v1beta1
+kind: Deployment
+metadata:
+  name: other
+  namespace: default
+`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	services, err := (&Manifests{}).ServicesWithPolicies(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := policy.ResourceMap{
+		flux.MustParseResourceID("payments:deployment/api"): policy.Set{
+			policy.Automated:        "true",
+			policy.TagPrefix("app"): "glob:master-*",
+		},
+		flux.MustParseResourceID("payments:deployment/web"): policy.Set{
+			policy.TagPrefix("app"): "semver:*",
+		},
+		flux.MustParseResourceID("default:deployment/other"): nil,
+	}
+	if !reflect.DeepEqual(expected, services) {
+		t.Errorf("expected:\n%#v\ngot:\n%#v", expected, services)
+	}
+}
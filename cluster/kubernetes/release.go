@@ -2,6 +2,7 @@ package kubernetes
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os/exec"
@@ -49,15 +50,15 @@ func (c *Kubectl) connectArgs() []string {
 	return args
 }
 
-func (c *Kubectl) kubectlCommand(args ...string) *exec.Cmd {
-	cmd := exec.Command(c.exe, append(c.connectArgs(), args...)...)
+func (c *Kubectl) kubectlCommand(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, c.exe, append(c.connectArgs(), args...)...)
 	cmd.Stdout = c.stdout
 	cmd.Stderr = c.stderr
 	return cmd
 }
 
-func (c *Kubectl) doCommand(logger log.Logger, newDefinition []byte, args ...string) error {
-	cmd := c.kubectlCommand(args...)
+func (c *Kubectl) doCommand(ctx context.Context, logger log.Logger, newDefinition []byte, args ...string) error {
+	cmd := c.kubectlCommand(ctx, args...)
 	cmd.Stdin = bytes.NewReader(newDefinition)
 	stderr := &bytes.Buffer{}
 	cmd.Stderr = stderr
@@ -66,7 +67,10 @@ func (c *Kubectl) doCommand(logger log.Logger, newDefinition []byte, args ...str
 
 	begin := time.Now()
 	err := cmd.Run()
-	if err != nil {
+	if ctx.Err() != nil {
+		// kubectl was killed, so won't have said why
+		err = errors.Wrap(ctx.Err(), "running kubectl")
+	} else if err != nil {
 		err = errors.Wrap(errors.New(strings.TrimSpace(stderr.String())), "running kubectl")
 	}
 
@@ -74,10 +78,10 @@ func (c *Kubectl) doCommand(logger log.Logger, newDefinition []byte, args ...str
 	return err
 }
 
-func (c *Kubectl) Delete(logger log.Logger, obj *apiObject) error {
-	return c.doCommand(logger, obj.bytes, "--namespace", obj.namespaceOrDefault(), "delete", "-f", "-")
+func (c *Kubectl) Delete(ctx context.Context, logger log.Logger, obj *apiObject) error {
+	return c.doCommand(ctx, logger, obj.bytes, "--namespace", obj.namespaceOrDefault(), "delete", "-f", "-")
 }
 
-func (c *Kubectl) Apply(logger log.Logger, obj *apiObject) error {
-	return c.doCommand(logger, obj.bytes, "--namespace", obj.namespaceOrDefault(), "apply", "-f", "-")
+func (c *Kubectl) Apply(ctx context.Context, logger log.Logger, obj *apiObject) error {
+	return c.doCommand(ctx, logger, obj.bytes, "--namespace", obj.namespaceOrDefault(), "apply", "-f", "-")
 }
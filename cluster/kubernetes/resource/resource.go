@@ -13,6 +13,10 @@ import (
 
 const (
 	PolicyPrefix = "flux.weave.works/"
+	// ChecksumAnnotation records, on resources applied by fluxd, the
+	// checksum of the definition they were applied from. It's not a
+	// policy, though it has the same prefix.
+	ChecksumAnnotation = PolicyPrefix + "sync-checksum"
 )
 
 // -- unmarshaling code for specific object and field types
@@ -25,6 +29,7 @@ type baseObject struct {
 	Meta   struct {
 		Namespace   string            `yaml:"namespace"`
 		Name        string            `yaml:"name"`
+		Labels      map[string]string `yaml:"labels,omitempty"`
 		Annotations map[string]string `yaml:"annotations,omitempty"`
 	} `yaml:"metadata"`
 }
@@ -46,6 +51,9 @@ func (o *baseObject) debyte() {
 func (o baseObject) Policy() policy.Set {
 	set := policy.Set{}
 	for k, v := range o.Meta.Annotations {
+		if k == ChecksumAnnotation {
+			continue
+		}
 		if strings.HasPrefix(k, PolicyPrefix) {
 			p := strings.TrimPrefix(k, PolicyPrefix)
 			if v == "true" {
@@ -58,6 +66,10 @@ func (o baseObject) Policy() policy.Set {
 	return set
 }
 
+func (o baseObject) Labels() map[string]string {
+	return o.Meta.Labels
+}
+
 func (o baseObject) Source() string {
 	return o.source
 }
@@ -66,6 +78,12 @@ func (o baseObject) Bytes() []byte {
 	return o.bytes
 }
 
+// SyncChecksum gives the checksum recorded when the resource was
+// applied, if it was applied by fluxd.
+func (o baseObject) SyncChecksum() string {
+	return o.Meta.Annotations[ChecksumAnnotation]
+}
+
 func unmarshalObject(source string, bytes []byte) (resource.Resource, error) {
 	var base = baseObject{source: source, bytes: bytes}
 	if err := yaml.Unmarshal(bytes, &base); err != nil {
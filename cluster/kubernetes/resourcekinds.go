@@ -4,10 +4,13 @@ import (
 	"fmt"
 
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
 	apiv1 "k8s.io/client-go/pkg/api/v1"
 	apiapps "k8s.io/client-go/pkg/apis/apps/v1beta1"
 	apibatch "k8s.io/client-go/pkg/apis/batch/v2alpha1"
 	apiext "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/tools/cache"
 
 	"github.com/weaveworks/flux"
 	"github.com/weaveworks/flux/cluster"
@@ -19,6 +22,12 @@ import (
 type resourceKind interface {
 	getPodController(c *Cluster, namespace, name string) (podController, error)
 	getPodControllers(c *Cluster, namespace string) ([]podController, error)
+	// For the cluster cache: where the API server serves the kind,
+	// how to list and watch it in all namespaces, and how to make a
+	// podController from what's cached.
+	apiResource() (groupVersion, resource string)
+	listWatch(c *Cluster) (*cache.ListWatch, runtime.Object)
+	makePodController(obj interface{}) (podController, bool)
 }
 
 var (
@@ -92,6 +101,29 @@ func (dk *deploymentKind) getPodControllers(c *Cluster, namespace string) ([]pod
 	return podControllers, nil
 }
 
+func (dk *deploymentKind) apiResource() (string, string) {
+	return "extensions/v1beta1", "deployments"
+}
+
+func (dk *deploymentKind) listWatch(c *Cluster) (*cache.ListWatch, runtime.Object) {
+	return &cache.ListWatch{
+		ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
+			return c.client.Deployments(meta_v1.NamespaceAll).List(options)
+		},
+		WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
+			return c.client.Deployments(meta_v1.NamespaceAll).Watch(options)
+		},
+	}, &apiext.Deployment{}
+}
+
+func (dk *deploymentKind) makePodController(obj interface{}) (podController, bool) {
+	deployment, ok := obj.(*apiext.Deployment)
+	if !ok {
+		return podController{}, false
+	}
+	return makeDeploymentPodController(deployment), true
+}
+
 func makeDeploymentPodController(deployment *apiext.Deployment) podController {
 	var status string
 	objectMeta, deploymentStatus := deployment.ObjectMeta, deployment.Status
@@ -145,6 +177,29 @@ func (dk *daemonSetKind) getPodControllers(c *Cluster, namespace string) ([]podC
 	return podControllers, nil
 }
 
+func (dk *daemonSetKind) apiResource() (string, string) {
+	return "extensions/v1beta1", "daemonsets"
+}
+
+func (dk *daemonSetKind) listWatch(c *Cluster) (*cache.ListWatch, runtime.Object) {
+	return &cache.ListWatch{
+		ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
+			return c.client.DaemonSets(meta_v1.NamespaceAll).List(options)
+		},
+		WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
+			return c.client.DaemonSets(meta_v1.NamespaceAll).Watch(options)
+		},
+	}, &apiext.DaemonSet{}
+}
+
+func (dk *daemonSetKind) makePodController(obj interface{}) (podController, bool) {
+	daemonSet, ok := obj.(*apiext.DaemonSet)
+	if !ok {
+		return podController{}, false
+	}
+	return makeDaemonSetPodController(daemonSet), true
+}
+
 func makeDaemonSetPodController(daemonSet *apiext.DaemonSet) podController {
 	var status string
 	objectMeta, daemonSetStatus := daemonSet.ObjectMeta, daemonSet.Status
@@ -197,6 +252,29 @@ func (dk *statefulSetKind) getPodControllers(c *Cluster, namespace string) ([]po
 	return podControllers, nil
 }
 
+func (dk *statefulSetKind) apiResource() (string, string) {
+	return "apps/v1beta1", "statefulsets"
+}
+
+func (dk *statefulSetKind) listWatch(c *Cluster) (*cache.ListWatch, runtime.Object) {
+	return &cache.ListWatch{
+		ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
+			return c.client.StatefulSets(meta_v1.NamespaceAll).List(options)
+		},
+		WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
+			return c.client.StatefulSets(meta_v1.NamespaceAll).Watch(options)
+		},
+	}, &apiapps.StatefulSet{}
+}
+
+func (dk *statefulSetKind) makePodController(obj interface{}) (podController, bool) {
+	statefulSet, ok := obj.(*apiapps.StatefulSet)
+	if !ok {
+		return podController{}, false
+	}
+	return makeStatefulSetPodController(statefulSet), true
+}
+
 func makeStatefulSetPodController(statefulSet *apiapps.StatefulSet) podController {
 	var status string
 	objectMeta, statefulSetStatus := statefulSet.ObjectMeta, statefulSet.Status
@@ -249,6 +327,29 @@ func (dk *cronJobKind) getPodControllers(c *Cluster, namespace string) ([]podCon
 	return podControllers, nil
 }
 
+func (dk *cronJobKind) apiResource() (string, string) {
+	return "batch/v2alpha1", "cronjobs"
+}
+
+func (dk *cronJobKind) listWatch(c *Cluster) (*cache.ListWatch, runtime.Object) {
+	return &cache.ListWatch{
+		ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
+			return c.client.CronJobs(meta_v1.NamespaceAll).List(options)
+		},
+		WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
+			return c.client.CronJobs(meta_v1.NamespaceAll).Watch(options)
+		},
+	}, &apibatch.CronJob{}
+}
+
+func (dk *cronJobKind) makePodController(obj interface{}) (podController, bool) {
+	cronJob, ok := obj.(*apibatch.CronJob)
+	if !ok {
+		return podController{}, false
+	}
+	return makeCronJobPodController(cronJob), true
+}
+
 func makeCronJobPodController(cronJob *apibatch.CronJob) podController {
 	return podController{
 		apiVersion:  "batch/v2alpha1",
@@ -0,0 +1,259 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/prometheus"
+	"github.com/pkg/errors"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/weaveworks/flux/cluster"
+	fluxmetrics "github.com/weaveworks/flux/metrics"
+)
+
+// SyncOptions govern how a sync is carried out. The zero value
+// means carrying out one action at a time, with no timeout and no
+// retries.
+type SyncOptions struct {
+	// How many actions may be carried out at once
+	Workers int
+	// How long an attempt at an action may take; zero means no limit
+	Timeout time.Duration
+	// How many times to retry an action that failed for a reason
+	// that is likely to pass (a conflict, a server error, or
+	// throttling)
+	Retries int
+	// How long to wait before the first retry; this doubles for
+	// each retry after
+	Backoff time.Duration
+}
+
+// Actions are carried out in tiers, so that e.g., a namespace exists
+// before anything is applied in it, and a custom resource definition
+// exists before the custom resources it defines. All the actions in a
+// tier are finished before those in the next tier are started; within
+// a tier, they are independent of one another and may be carried out
+// concurrently.
+const (
+	tierDelete = iota
+	tierDeleteDefinition
+	tierDeleteNamespace
+	tierApplyNamespace
+	tierApplyDefinition
+	tierApply
+	numTiers
+)
+
+const (
+	namespaceObjectKind  = "Namespace"
+	definitionObjectKind = "CustomResourceDefinition"
+)
+
+const (
+	actionDelete = "delete"
+	actionApply  = "apply"
+)
+
+// Applying a resource with kubectl takes a second or so; much longer,
+// and it's likely being retried.
+var syncActionDuration = prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+	Namespace: "flux",
+	Subsystem: "cluster",
+	Name:      "sync_action_duration_seconds",
+	Help:      "Duration of applying or deleting a resource in a sync, including any retries, in seconds.",
+	Buckets:   []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 20, 30, 60},
+}, []string{fluxmetrics.LabelAction, fluxmetrics.LabelSuccess})
+
+// syncAction is a cluster.SyncAction with its definitions parsed. If
+// there is both something to delete and something to apply, they are
+// done in that order, as one unit.
+type syncAction struct {
+	id            string
+	delete, apply *apiObject
+}
+
+func (a syncAction) tier() int {
+	switch {
+	case a.apply != nil && a.apply.Kind == namespaceObjectKind:
+		return tierApplyNamespace
+	case a.apply != nil && a.apply.Kind == definitionObjectKind:
+		return tierApplyDefinition
+	case a.apply != nil:
+		return tierApply
+	case a.delete != nil && a.delete.Kind == namespaceObjectKind:
+		return tierDeleteNamespace
+	case a.delete != nil && a.delete.Kind == definitionObjectKind:
+		return tierDeleteDefinition
+	default:
+		return tierDelete
+	}
+}
+
+// Sync performs the given actions on resources. Syncs are
+// serialised, but the actions within a sync may be carried out
+// concurrently, according to the SyncOptions; see the tiers above
+// for the order in which they are carried out.
+func (c *Cluster) Sync(spec cluster.SyncDef) error {
+	errc := make(chan error)
+	logger := log.With(c.logger, "method", "Sync")
+	c.actionc <- func() {
+		errs := cluster.SyncError{}
+		var tiers [numTiers][]syncAction
+		for _, action := range spec.Actions {
+			a, err := parseSyncAction(action)
+			if err != nil {
+				errs[action.ResourceID] = err
+				continue
+			}
+			tiers[a.tier()] = append(tiers[a.tier()], a)
+		}
+
+		var mu sync.Mutex
+		for _, actions := range tiers {
+			c.runActions(actions, logger, func(id string, err error) {
+				mu.Lock()
+				errs[id] = err
+				mu.Unlock()
+			})
+		}
+
+		if len(errs) > 0 {
+			errc <- errs
+		} else {
+			errc <- nil
+		}
+	}
+	return <-errc
+}
+
+func parseSyncAction(action cluster.SyncAction) (syncAction, error) {
+	a := syncAction{id: action.ResourceID}
+	var err error
+	if len(action.Delete) > 0 {
+		if a.delete, err = definitionObj(action.Delete); err != nil {
+			return a, err
+		}
+	}
+	if len(action.Apply) > 0 {
+		if a.apply, err = applyObj(action); err != nil {
+			return a, err
+		}
+	}
+	return a, nil
+}
+
+// runActions carries out the actions given using a bounded number of
+// workers, and returns when they are all done. Actions are taken in
+// the order given, so with a single worker they are carried out in
+// that order.
+func (c *Cluster) runActions(actions []syncAction, logger log.Logger, fail func(id string, err error)) {
+	workers := c.SyncOptions.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(actions) {
+		workers = len(actions)
+	}
+
+	work := make(chan syncAction)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for a := range work {
+				if err := c.doAction(a, log.With(logger, "resource", a.id)); err != nil {
+					fail(a.id, err)
+				}
+			}
+		}()
+	}
+	for _, a := range actions {
+		work <- a
+	}
+	close(work)
+	wg.Wait()
+}
+
+func (c *Cluster) doAction(a syncAction, logger log.Logger) error {
+	if a.delete != nil {
+		if err := c.attempt(actionDelete, a.delete, c.applier.Delete, logger); err != nil {
+			return err
+		}
+	}
+	if a.apply != nil {
+		return c.attempt(actionApply, a.apply, c.applier.Apply, logger)
+	}
+	return nil
+}
+
+// attempt carries out an action on a resource, retrying it with
+// backoff if it fails for a transient reason, and records how long
+// it took overall.
+func (c *Cluster) attempt(action string, obj *apiObject, do func(context.Context, log.Logger, *apiObject) error, logger log.Logger) error {
+	opts := c.SyncOptions
+	backoff := opts.Backoff
+	begin := time.Now()
+	var err error
+	attempts := 0
+	for {
+		attempts++
+		ctx, cancel := context.Background(), func() {}
+		if opts.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		}
+		err = do(ctx, logger, obj)
+		cancel()
+		if err == nil || attempts > opts.Retries || !isTransient(err) {
+			break
+		}
+		logger.Log("action", action, "attempt", attempts, "err", err, "retry-in", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	took := time.Since(begin)
+	syncActionDuration.With(
+		fluxmetrics.LabelAction, action,
+		fluxmetrics.LabelSuccess, fmt.Sprint(err == nil),
+	).Observe(took.Seconds())
+	logger.Log("action", action, "took", took, "attempts", attempts, "err", err)
+	return err
+}
+
+// Reasons given by the API server for failures that may well not
+// happen if the request is made again. kubectl reports these as
+// "Error from server (<reason>): ...".
+var transientReasons = []meta_v1.StatusReason{
+	meta_v1.StatusReasonConflict,
+	meta_v1.StatusReasonServerTimeout,
+	meta_v1.StatusReasonTimeout,
+	meta_v1.StatusReasonInternalError,
+	"ServiceUnavailable",
+	"TooManyRequests",
+}
+
+// isTransient says whether an error from carrying out an action is
+// worth retrying. Errors from the API server are judged by their
+// status; otherwise, by what kubectl printed.
+func isTransient(err error) bool {
+	if status, ok := errors.Cause(err).(apierrors.APIStatus); ok {
+		s := status.Status()
+		return s.Reason == meta_v1.StatusReasonConflict || s.Code == 429 || s.Code >= 500
+	}
+	msg := err.Error()
+	for _, reason := range transientReasons {
+		if strings.Contains(msg, "("+string(reason)+")") {
+			return true
+		}
+	}
+	// A conflict when applying doesn't always come with a reason
+	return strings.Contains(msg, "the object has been modified")
+}
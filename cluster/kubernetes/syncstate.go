@@ -0,0 +1,70 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+)
+
+// The key in the ConfigMap's data holding the revision
+const syncRevisionKey = "revision"
+
+// ConfigMapSyncState records the revision last synced in a ConfigMap,
+// so that fluxd needn't write to the git repo to keep track. It
+// implements sync.State; other state can be kept alongside, under
+// other keys, with Get and Set.
+type ConfigMapSyncState struct {
+	ConfigMapAPI v1core.ConfigMapInterface
+	Name         string
+}
+
+func (s ConfigMapSyncState) GetRevision(ctx context.Context) (string, error) {
+	revision, _, err := s.Get(ctx, syncRevisionKey)
+	return revision, err
+}
+
+func (s ConfigMapSyncState) UpdateMarker(ctx context.Context, revision string) error {
+	return s.Set(ctx, syncRevisionKey, revision)
+}
+
+// Get gives the value recorded for the key, and whether there is one.
+func (s ConfigMapSyncState) Get(ctx context.Context, key string) (string, bool, error) {
+	configMap, err := s.ConfigMapAPI.Get(s.Name, meta_v1.GetOptions{})
+	if isNotFound(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	value, ok := configMap.Data[key]
+	return value, ok, nil
+}
+
+// Set records the value for the key, creating the ConfigMap if
+// necessary.
+func (s ConfigMapSyncState) Set(ctx context.Context, key, value string) error {
+	patch, err := json.Marshal(map[string]map[string]string{
+		"data": {key: value},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.ConfigMapAPI.Patch(s.Name, types.StrategicMergePatchType, patch)
+	if isNotFound(err) {
+		_, err = s.ConfigMapAPI.Create(&apiv1.ConfigMap{
+			ObjectMeta: meta_v1.ObjectMeta{Name: s.Name},
+			Data:       map[string]string{key: value},
+		})
+	}
+	return err
+}
+
+func isNotFound(err error) bool {
+	se, ok := err.(*apierrors.StatusError)
+	return ok && se.ErrStatus.Reason == meta_v1.StatusReasonNotFound
+}
@@ -29,15 +29,20 @@ type Manifests interface {
 	ServicesWithPolicies(path string) (policy.ResourceMap, error)
 }
 
+// NamespaceID gives the ID used to refer to a namespace itself, e.g.,
+// to set default policies for the controllers in it.
+func NamespaceID(namespace string) flux.ResourceID {
+	return flux.MakeResourceID(namespace, "namespace", namespace)
+}
+
 // UpdateManifest looks for the manifest for a given service, reads
 // its contents, applies f(contents), and writes the results back to
 // the file.
 func UpdateManifest(m Manifests, root string, serviceID flux.ResourceID, f func(manifest []byte) ([]byte, error)) error {
-	services, err := m.FindDefinedServices(root)
+	paths, err := manifestPaths(m, root, serviceID)
 	if err != nil {
 		return err
 	}
-	paths := services[serviceID]
 	if len(paths) == 0 {
 		return ErrNoResourceFilesFoundForService
 	}
@@ -61,3 +66,30 @@ func UpdateManifest(m Manifests, root string, serviceID flux.ResourceID, f func(
 	}
 	return ioutil.WriteFile(paths[0], newDef, fi.Mode())
 }
+
+// manifestPaths gives the files defining the resource. Namespaces
+// aren't found as services, so they are looked up by name among all
+// the resources.
+func manifestPaths(m Manifests, root string, id flux.ResourceID) ([]string, error) {
+	_, kind, name := id.Components()
+	if kind != "namespace" {
+		services, err := m.FindDefinedServices(root)
+		if err != nil {
+			return nil, err
+		}
+		return services[id], nil
+	}
+
+	resources, err := m.LoadManifests(root)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, res := range resources {
+		_, resKind, resName := res.ResourceID().Components()
+		if resKind == "namespace" && resName == name {
+			paths = append(paths, res.Source())
+		}
+	}
+	return paths, nil
+}
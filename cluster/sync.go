@@ -20,6 +20,9 @@ type SyncAction struct {
 	ResourceID string
 	Delete     ResourceDef
 	Apply      ResourceDef
+	// Checksum, if given, is to be recorded on the resource applied,
+	// so that later syncs can tell whether its definition has changed
+	Checksum string
 }
 
 type SyncDef struct {
@@ -8,9 +8,27 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"github.com/weaveworks/flux"
 	"github.com/weaveworks/flux/update"
 )
 
+// parseControllerSpec parses a controller given on the command line,
+// which is either an ID or a pattern for IDs. In either case the
+// namespace is optional, and defaults to the namespace given.
+func parseControllerSpec(namespace, controller string) (update.ResourceSpec, error) {
+	if strings.ContainsAny(controller, "*?[") {
+		if !strings.Contains(controller, ":") {
+			controller = namespace + ":" + controller
+		}
+		return update.ParseResourceSpec(controller)
+	}
+	id, err := flux.ParseResourceIDOptionalNamespace(namespace, controller)
+	if err != nil {
+		return "", err
+	}
+	return update.MakeResourceSpec(id), nil
+}
+
 func AddCauseFlags(cmd *cobra.Command, opts *update.Cause) {
 	authorInfo := getUserGitconfig()
 	username := getCommitAuthor(authorInfo)
@@ -10,6 +10,7 @@ type controllerAutomateOpts struct {
 	*rootOpts
 	namespace  string
 	controller string
+	selector   string
 	outputOpts
 	cause update.Cause
 
@@ -34,6 +35,7 @@ func (opts *controllerAutomateOpts) Command() *cobra.Command {
 	AddCauseFlags(cmd, &opts.cause)
 	cmd.Flags().StringVarP(&opts.namespace, "namespace", "n", "default", "Controller namespace")
 	cmd.Flags().StringVarP(&opts.controller, "controller", "c", "", "Controller to automate")
+	cmd.Flags().StringVarP(&opts.selector, "selector", "l", "", "Automate the controllers with labels matching this selector, e.g., team=payments")
 
 	// Deprecated
 	cmd.Flags().StringVarP(&opts.service, "service", "s", "", "Service to automate")
@@ -51,6 +53,7 @@ func (opts *controllerAutomateOpts) RunE(cmd *cobra.Command, args []string) erro
 		outputOpts: opts.outputOpts,
 		namespace:  opts.namespace,
 		controller: opts.controller,
+		selector:   opts.selector,
 		cause:      opts.cause,
 		automate:   true,
 	}
@@ -26,8 +26,17 @@ func await(ctx context.Context, stdout, stderr io.Writer, client api.Client, job
 	if metadata.Result != nil {
 		update.PrintResults(stdout, metadata.Result, verbose)
 	}
-	if metadata.Revision != "" {
+	if metadata.Revision != "" && metadata.PullRequest == "" {
 		fmt.Fprintf(stderr, "Commit pushed:\t%s\n", metadata.ShortRevision())
+		if verbose && metadata.PushRetries > 0 {
+			fmt.Fprintf(stderr, "Push retries:\t%d\n", metadata.PushRetries)
+		}
+	}
+	if metadata.PullRequest != "" {
+		// The change won't be applied until the pull request is
+		// merged, so there's no sense waiting for it.
+		fmt.Fprintf(stderr, "Pull request opened:\t%s\n", metadata.PullRequest)
+		return nil
 	}
 	if metadata.Result == nil {
 		fmt.Fprintf(stderr, "Nothing to do\n")
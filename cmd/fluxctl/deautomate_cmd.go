@@ -10,6 +10,7 @@ type controllerDeautomateOpts struct {
 	*rootOpts
 	namespace  string
 	controller string
+	selector   string
 	outputOpts
 	cause update.Cause
 
@@ -34,6 +35,7 @@ func (opts *controllerDeautomateOpts) Command() *cobra.Command {
 	AddCauseFlags(cmd, &opts.cause)
 	cmd.Flags().StringVarP(&opts.namespace, "namespace", "n", "default", "Controller namespace")
 	cmd.Flags().StringVarP(&opts.controller, "controller", "c", "", "Controller to deautomate")
+	cmd.Flags().StringVarP(&opts.selector, "selector", "l", "", "Deautomate the controllers with labels matching this selector, e.g., team=payments")
 
 	// Deprecated
 	cmd.Flags().StringVarP(&opts.service, "service", "s", "", "Service to deautomate")
@@ -51,6 +53,7 @@ func (opts *controllerDeautomateOpts) RunE(cmd *cobra.Command, args []string) er
 		outputOpts: opts.outputOpts,
 		namespace:  opts.namespace,
 		controller: opts.controller,
+		selector:   opts.selector,
 		cause:      opts.cause,
 		deautomate: true,
 	}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/weaveworks/flux/update"
+)
+
+type freezeOpts struct {
+	*rootOpts
+	cause  update.Cause
+	frozen bool
+}
+
+func newFreeze(parent *rootOpts) *freezeOpts {
+	return &freezeOpts{rootOpts: parent, frozen: true}
+}
+
+func newUnfreeze(parent *rootOpts) *freezeOpts {
+	return &freezeOpts{rootOpts: parent, frozen: false}
+}
+
+func (opts *freezeOpts) Command() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "freeze",
+		Short: "Suspend all automated releases, e.g., during a change freeze.",
+		Example: makeExample(
+			"fluxctl freeze --message='Black Friday'",
+		),
+		RunE: opts.RunE,
+	}
+	if !opts.frozen {
+		cmd.Use = "unfreeze"
+		cmd.Short = "Resume automated releases after a freeze."
+		cmd.Example = makeExample("fluxctl unfreeze")
+	}
+	AddCauseFlags(cmd, &opts.cause)
+	return cmd
+}
+
+func (opts *freezeOpts) RunE(cmd *cobra.Command, args []string) error {
+	if len(args) > 0 {
+		return errorWantedNoArgs
+	}
+
+	ctx := context.Background()
+	jobID, err := opts.API.UpdateFreeze(ctx, update.FreezeSpec{Frozen: opts.frozen}, opts.cause)
+	if err != nil {
+		return err
+	}
+	if _, err := awaitJob(ctx, opts.API, jobID); err != nil {
+		return err
+	}
+	if opts.frozen {
+		fmt.Fprintln(cmd.OutOrStdout(), "Automated releases are frozen")
+	} else {
+		fmt.Fprintln(cmd.OutOrStdout(), "Automated releases have resumed")
+	}
+	return nil
+}
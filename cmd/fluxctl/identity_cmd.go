@@ -5,6 +5,8 @@ import (
 	"fmt"
 
 	"github.com/spf13/cobra"
+
+	"github.com/weaveworks/flux"
 )
 
 type identityOpts struct {
@@ -12,6 +14,7 @@ type identityOpts struct {
 	regenerate  bool
 	fingerprint bool
 	visual      bool
+	knownHosts  bool
 }
 
 func newIdentity(parent *rootOpts) *identityOpts {
@@ -21,12 +24,13 @@ func newIdentity(parent *rootOpts) *identityOpts {
 func (opts *identityOpts) Command() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "identity",
-		Short: "Display SSH public key",
+		Short: "Display SSH public key, or which credentials are used for the git repo",
 		RunE:  opts.RunE,
 	}
 	cmd.Flags().BoolVarP(&opts.regenerate, "regenerate", "r", false, `Generate a new identity`)
 	cmd.Flags().BoolVarP(&opts.fingerprint, "fingerprint", "l", false, `Show fingerprint of public key`)
 	cmd.Flags().BoolVarP(&opts.visual, "visual", "v", false, `Show ASCII art representation with fingerprint (implies -l)`)
+	cmd.Flags().BoolVar(&opts.knownHosts, "known-hosts", false, `Show the SSH host keys the daemon accepts for the git repo`)
 	return cmd
 }
 
@@ -37,6 +41,34 @@ func (opts *identityOpts) RunE(_ *cobra.Command, args []string) error {
 
 	ctx := context.Background()
 
+	if opts.knownHosts {
+		if opts.regenerate {
+			return newUsageError("--known-hosts cannot be used with --regenerate")
+		}
+		config, err := opts.API.GitRepoConfig(ctx)
+		if err != nil {
+			return err
+		}
+		if len(config.KnownHosts) == 0 {
+			fmt.Println("The daemon has not been given a known_hosts file, so uses whatever host keys its image provides.")
+			return nil
+		}
+		for _, h := range config.KnownHosts {
+			fmt.Println(h)
+		}
+		return nil
+	}
+
+	// Older daemons and services don't report how they authenticate
+	// to the git repo; carry on and show the key, as before.
+	if config, err := opts.API.GitRepoConfig(ctx); err == nil && config.Auth == flux.GitAuthHTTPS {
+		if opts.regenerate {
+			return newUsageError("the daemon uses HTTPS credentials for the git repo, so there is no SSH key to regenerate")
+		}
+		fmt.Printf("The daemon authenticates to %s using the HTTPS credentials it has been given; no SSH key is used.\n", config.Remote.URL)
+		return nil
+	}
+
 	publicSSHKey, err := opts.API.PublicSSHKey(ctx, opts.regenerate)
 	if err != nil {
 		return err
@@ -53,16 +53,16 @@ func (opts *controllerListOpts) RunE(cmd *cobra.Command, args []string) error {
 	sort.Sort(controllerStatusByName(controllers))
 
 	w := newTabwriter()
-	fmt.Fprintf(w, "CONTROLLER\tCONTAINER\tIMAGE\tRELEASE\tPOLICY\n")
+	fmt.Fprintf(w, "CONTROLLER\tCONTAINER\tIMAGE\tRELEASE\tPOLICY\tLOCK\n")
 	for _, controller := range controllers {
 		if len(controller.Containers) > 0 {
 			c := controller.Containers[0]
-			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", controller.ID, c.Name, c.Current.ID, controller.Status, policies(controller))
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", controller.ID, c.Name, c.Current.ID, controller.Status, containerPolicies(controller, c), lockDetails(controller))
 			for _, c := range controller.Containers[1:] {
-				fmt.Fprintf(w, "\t%s\t%s\t\t\n", c.Name, c.Current.ID)
+				fmt.Fprintf(w, "\t%s\t%s\t\t%s\t\n", c.Name, c.Current.ID, containerPolicies(controller, c))
 			}
 		} else {
-			fmt.Fprintf(w, "%s\t\t\t\t\n", controller.ID)
+			fmt.Fprintf(w, "%s\t\t\t\t\t%s\n", controller.ID, lockDetails(controller))
 		}
 	}
 	w.Flush()
@@ -83,6 +83,23 @@ func (s controllerStatusByName) Swap(a, b int) {
 	s[a], s[b] = s[b], s[a]
 }
 
+// containerPolicies gives the policies in effect for a container;
+// older daemons don't report these, in which case fall back to the
+// policies for the controller as a whole.
+func containerPolicies(s flux.ControllerStatus, c flux.Container) string {
+	if c.Policies == nil {
+		return policies(s)
+	}
+	var ps []string
+	for _, p := range []policy.Policy{policy.Automated, policy.Locked, policy.Ignore} {
+		if _, ok := c.Policies[string(p)]; ok {
+			ps = append(ps, string(p))
+		}
+	}
+	sort.Strings(ps)
+	return strings.Join(ps, ",")
+}
+
 func policies(s flux.ControllerStatus) string {
 	var ps []string
 	if s.Automated {
@@ -97,3 +114,22 @@ func policies(s flux.ControllerStatus) string {
 	sort.Strings(ps)
 	return strings.Join(ps, ",")
 }
+
+// lockDetails says who locked a controller, until when, and why, as
+// far as is known.
+func lockDetails(s flux.ControllerStatus) string {
+	if !s.Locked {
+		return ""
+	}
+	var details []string
+	if user := s.Policies[string(policy.LockedUser)]; user != "" {
+		details = append(details, "by "+user)
+	}
+	if until := s.Policies[string(policy.LockedUntil)]; until != "" {
+		details = append(details, "until "+until)
+	}
+	if msg := s.Policies[string(policy.LockedMsg)]; msg != "" {
+		details = append(details, fmt.Sprintf("%q", msg))
+	}
+	return strings.Join(details, " ")
+}
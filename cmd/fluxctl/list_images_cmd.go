@@ -16,6 +16,7 @@ type controllerShowOpts struct {
 	*rootOpts
 	namespace  string
 	controller string
+	selector   string
 	limit      int
 
 	// Deprecated
@@ -28,13 +29,17 @@ func newControllerShow(parent *rootOpts) *controllerShowOpts {
 
 func (opts *controllerShowOpts) Command() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:     "list-images",
-		Short:   "Show the deployed and available images for a controller.",
-		Example: makeExample("fluxctl list-images --namespace default --controller=deployment/foo"),
-		RunE:    opts.RunE,
+		Use:   "list-images",
+		Short: "Show the deployed and available images for a controller.",
+		Example: makeExample(
+			"fluxctl list-images --namespace default --controller=deployment/foo",
+			"fluxctl list-images --selector=team=payments",
+		),
+		RunE: opts.RunE,
 	}
 	cmd.Flags().StringVarP(&opts.namespace, "namespace", "n", "default", "Controller namespace")
-	cmd.Flags().StringVarP(&opts.controller, "controller", "c", "", "Show images for this controller")
+	cmd.Flags().StringVarP(&opts.controller, "controller", "c", "", "Show images for this controller, or controllers matching this pattern")
+	cmd.Flags().StringVar(&opts.selector, "selector", "", "Show images for the controllers with labels matching this selector, e.g., team=payments (unlike other commands, there is no -l for this, since it is --limit)")
 	cmd.Flags().IntVarP(&opts.limit, "limit", "l", 10, "Number of images to show (0 for all)")
 
 	// Deprecated
@@ -52,15 +57,22 @@ func (opts *controllerShowOpts) RunE(cmd *cobra.Command, args []string) error {
 		return errorWantedNoArgs
 	}
 
+	if opts.controller != "" && opts.selector != "" {
+		return newUsageError("please supply only one of --controller or --selector")
+	}
+
 	var resourceSpec update.ResourceSpec
-	if len(opts.controller) == 0 {
+	var err error
+	switch {
+	case opts.selector != "":
+		resourceSpec, err = update.MakeLabelSpec(opts.selector)
+	case opts.controller != "":
+		resourceSpec, err = parseControllerSpec(opts.namespace, opts.controller)
+	default:
 		resourceSpec = update.ResourceSpecAll
-	} else {
-		id, err := flux.ParseResourceIDOptionalNamespace(opts.namespace, opts.controller)
-		if err != nil {
-			return err
-		}
-		resourceSpec = update.MakeResourceSpec(id)
+	}
+	if err != nil {
+		return err
 	}
 
 	ctx := context.Background()
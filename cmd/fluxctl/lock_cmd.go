@@ -1,6 +1,8 @@
 package main
 
 import (
+	"time"
+
 	"github.com/spf13/cobra"
 
 	"github.com/weaveworks/flux/update"
@@ -10,6 +12,8 @@ type controllerLockOpts struct {
 	*rootOpts
 	namespace  string
 	controller string
+	selector   string
+	lockFor    time.Duration
 	outputOpts
 	cause update.Cause
 
@@ -27,6 +31,7 @@ func (opts *controllerLockOpts) Command() *cobra.Command {
 		Short: "Lock a controller, so it cannot be deployed.",
 		Example: makeExample(
 			"fluxctl lock --controller=deployment/helloworld",
+			"fluxctl lock --controller=deployment/helloworld --for=2h -m 'Investigating outage'",
 		),
 		RunE: opts.RunE,
 	}
@@ -34,6 +39,8 @@ func (opts *controllerLockOpts) Command() *cobra.Command {
 	AddCauseFlags(cmd, &opts.cause)
 	cmd.Flags().StringVarP(&opts.namespace, "namespace", "n", "default", "Controller namespace")
 	cmd.Flags().StringVarP(&opts.controller, "controller", "c", "", "Controller to lock")
+	cmd.Flags().StringVarP(&opts.selector, "selector", "l", "", "Lock the controllers with labels matching this selector, e.g., team=payments")
+	cmd.Flags().DurationVar(&opts.lockFor, "for", 0, "Unlock the controller again automatically after this long, e.g., 2h")
 
 	// Deprecated
 	cmd.Flags().StringVarP(&opts.service, "service", "s", "", "Service to lock")
@@ -52,8 +59,10 @@ func (opts *controllerLockOpts) RunE(cmd *cobra.Command, args []string) error {
 		outputOpts: opts.outputOpts,
 		namespace:  opts.namespace,
 		controller: opts.controller,
+		selector:   opts.selector,
 		cause:      opts.cause,
 		lock:       true,
+		lockFor:    opts.lockFor,
 	}
 	return policyOpts.RunE(cmd, args)
 }
@@ -4,10 +4,14 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/weaveworks/flux"
+	"github.com/weaveworks/flux/cluster"
+	"github.com/weaveworks/flux/job"
 	"github.com/weaveworks/flux/policy"
+	"github.com/weaveworks/flux/schedule"
 	"github.com/weaveworks/flux/update"
 )
 
@@ -17,11 +21,18 @@ type controllerPolicyOpts struct {
 
 	namespace  string
 	controller string
+	selector   string
+	nsDefault  bool
+	container  string
 	tagAll     string
 	tags       []string
+	window     string
+	minAge     string
 
 	automate, deautomate bool
 	lock, unlock         bool
+	lockFor              time.Duration
+	canary, noCanary     bool
 
 	cause update.Cause
 
@@ -46,12 +57,44 @@ Surrounding these with single-quotes are recommended to avoid shell expansion.
 
 If both --tag-all and --tag are specified, --tag-all will apply to all
 containers which aren't explicitly named.
+
+A deployment window restricts automated releases to the times given by a
+cron-like schedule, e.g., '* 9-16 * * mon-fri' for office hours. The
+schedule can start with a time zone, e.g., 'TZ=Europe/London * 9-16 * * mon-fri',
+and several can be separated with semicolons. Use --window='*' to remove
+the window.
+
+If --container is given, automation and locking apply only to that
+container, e.g., so that a sidecar is left alone while the rest of the
+controller is automated. Deautomating or unlocking a container
+overrides automation or a lock on the controller as a whole.
+
+Controllers marked with --canary are released to first in staged
+releases (see 'fluxctl release --canary'); automated releases are
+staged whenever they include a canary.
+
+Instead of naming a controller, you can change the policies of all the
+controllers with labels matching a selector, given with --selector; or
+use a pattern for the controller, e.g., --controller='deployment/api-*'.
+
+With --namespace-default, the policies are set on the namespace given
+by --namespace, and apply to all the controllers in it, unless a
+controller has its own policy, e.g., --deautomate to opt out of
+automation the namespace has by default.
         `,
 		Example: makeExample(
 			"fluxctl policy --controller=deployment/foo --automate",
 			"fluxctl policy --controller=deployment/foo --lock",
+			"fluxctl policy --controller=deployment/foo --lock --lock-for=2h",
 			"fluxctl policy --controller=deployment/foo --tag='bar=1.*' --tag='baz=2.*'",
 			"fluxctl policy --controller=deployment/foo --tag-all='master-*' --tag='bar=1.*'",
+			"fluxctl policy --controller=deployment/foo --container=proxy --lock",
+			"fluxctl policy --controller=deployment/foo --window='TZ=Europe/London * 9-16 * * mon-fri'",
+			"fluxctl policy --controller=deployment/foo --min-age=30m",
+			"fluxctl policy --controller=deployment/foo --canary",
+			"fluxctl policy --selector=team=payments --automate",
+			"fluxctl policy --controller='deployment/api-*' --lock",
+			"fluxctl policy --namespace=payments --namespace-default --automate",
 		),
 		RunE: opts.RunE,
 	}
@@ -60,13 +103,21 @@ containers which aren't explicitly named.
 	AddCauseFlags(cmd, &opts.cause)
 	flags := cmd.Flags()
 	flags.StringVarP(&opts.namespace, "namespace", "n", "default", "Controller namespace")
-	flags.StringVarP(&opts.controller, "controller", "c", "", "Controller to modify")
+	flags.StringVarP(&opts.controller, "controller", "c", "", "Controller to modify, or a pattern for controllers")
+	flags.StringVarP(&opts.selector, "selector", "l", "", "Modify the controllers with labels matching this selector, e.g., team=payments")
+	flags.BoolVar(&opts.nsDefault, "namespace-default", false, "Modify the default policies for controllers in the namespace, rather than a controller")
+	flags.StringVar(&opts.container, "container", "", "Confine automation and locking to this container")
 	flags.StringVar(&opts.tagAll, "tag-all", "", "Tag filter pattern to apply to all containers")
 	flags.StringSliceVar(&opts.tags, "tag", nil, "Tag filter container/pattern pairs")
+	flags.StringVar(&opts.window, "window", "", "Deployment window for automated releases, as a cron-like schedule")
+	flags.StringVar(&opts.minAge, "min-age", "", "Minimum age of images before they are released automatically, e.g., 30m; 0 to remove")
 	flags.BoolVar(&opts.automate, "automate", false, "Automate controller")
 	flags.BoolVar(&opts.deautomate, "deautomate", false, "Deautomate controller")
 	flags.BoolVar(&opts.lock, "lock", false, "Lock controller")
 	flags.BoolVar(&opts.unlock, "unlock", false, "Unlock controller")
+	flags.DurationVar(&opts.lockFor, "lock-for", 0, "When locking, unlock again automatically after this long, e.g., 2h")
+	flags.BoolVar(&opts.canary, "canary", false, "Make controller a canary, released to first in staged releases")
+	flags.BoolVar(&opts.noCanary, "no-canary", false, "Stop controller being a canary")
 
 	// Deprecated
 	flags.StringVarP(&opts.service, "service", "s", "", "Service to modify")
@@ -82,8 +133,11 @@ func (opts *controllerPolicyOpts) RunE(cmd *cobra.Command, args []string) error
 	if len(args) > 0 {
 		return errorWantedNoArgs
 	}
-	if opts.controller == "" {
-		return newUsageError("-c, --controller is required")
+	if err := checkExactlyOne("-c, --controller, -l, --selector or --namespace-default", opts.controller != "", opts.selector != "", opts.nsDefault); err != nil {
+		return err
+	}
+	if opts.nsDefault && opts.container != "" {
+		return newUsageError("--container cannot be used with --namespace-default")
 	}
 	if opts.automate && opts.deautomate {
 		return newUsageError("automate and deautomate both specified")
@@ -91,22 +145,51 @@ func (opts *controllerPolicyOpts) RunE(cmd *cobra.Command, args []string) error
 	if opts.lock && opts.unlock {
 		return newUsageError("lock and unlock both specified")
 	}
+	if opts.canary && opts.noCanary {
+		return newUsageError("canary and no-canary both specified")
+	}
+	if opts.lockFor < 0 {
+		return newUsageError("lock duration must be positive")
+	}
+	if opts.lockFor > 0 && !opts.lock {
+		return newUsageError("a lock duration can only be given when locking")
+	}
 
-	resourceID, err := flux.ParseResourceIDOptionalNamespace(opts.namespace, opts.controller)
+	var spec update.ResourceSpec
+	var err error
+	switch {
+	case opts.nsDefault:
+		spec = update.MakeResourceSpec(cluster.NamespaceID(opts.namespace))
+	case opts.selector != "":
+		spec, err = update.MakeLabelSpec(opts.selector)
+	default:
+		spec, err = parseControllerSpec(opts.namespace, opts.controller)
+	}
 	if err != nil {
 		return err
 	}
 
-	update, err := calculatePolicyChanges(opts)
+	changes, err := calculatePolicyChanges(opts)
 	if err != nil {
 		return err
 	}
 
 	ctx := context.Background()
 
-	jobID, err := opts.API.UpdatePolicies(ctx, policy.Updates{
-		resourceID: update,
-	}, opts.cause)
+	var jobID job.ID
+	if spec.IsSelection() {
+		jobID, err = opts.API.UpdatePoliciesBySpec(ctx, update.PolicyUpdatesBySpec{
+			spec: changes,
+		}, opts.cause)
+	} else {
+		var resourceID flux.ResourceID
+		if resourceID, err = spec.AsID(); err != nil {
+			return err
+		}
+		jobID, err = opts.API.UpdatePolicies(ctx, policy.Updates{
+			resourceID: changes,
+		}, opts.cause)
+	}
 	if err != nil {
 		return err
 	}
@@ -114,10 +197,15 @@ func (opts *controllerPolicyOpts) RunE(cmd *cobra.Command, args []string) error
 }
 
 func calculatePolicyChanges(opts *controllerPolicyOpts) (policy.Update, error) {
+	if opts.container != "" {
+		return calculateContainerPolicyChanges(opts)
+	}
+
 	add := policy.Set{}
 	if opts.automate {
 		add = add.Add(policy.Automated)
 	}
+	remove := policy.Set{}
 	if opts.lock {
 		add = add.Add(policy.Locked)
 		if opts.cause.User != "" {
@@ -125,9 +213,15 @@ func calculatePolicyChanges(opts *controllerPolicyOpts) (policy.Update, error) {
 				Set(policy.LockedUser, opts.cause.User).
 				Set(policy.LockedMsg, opts.cause.Message)
 		}
+		if opts.lockFor > 0 {
+			add = add.Set(policy.LockedUntil, time.Now().Add(opts.lockFor).UTC().Format(time.RFC3339))
+		} else {
+			// Locking again without a duration makes the lock
+			// permanent
+			remove = remove.Add(policy.LockedUntil)
+		}
 	}
 
-	remove := policy.Set{}
 	if opts.deautomate {
 		remove = remove.Add(policy.Automated)
 	}
@@ -135,12 +229,42 @@ func calculatePolicyChanges(opts *controllerPolicyOpts) (policy.Update, error) {
 		remove = remove.
 			Add(policy.Locked).
 			Add(policy.LockedMsg).
-			Add(policy.LockedUser)
+			Add(policy.LockedUser).
+			Add(policy.LockedUntil)
+	}
+	if opts.canary {
+		add = add.Add(policy.Canary)
+	}
+	if opts.noCanary {
+		remove = remove.Add(policy.Canary)
 	}
 	if opts.tagAll != "" {
 		add = add.Set(policy.TagAll, "glob:"+opts.tagAll)
 	}
 
+	switch opts.window {
+	case "":
+	case "*":
+		remove = remove.Add(policy.Window)
+	default:
+		if _, err := schedule.Parse(opts.window); err != nil {
+			return policy.Update{}, newUsageError(fmt.Sprintf("invalid --window: %s", err))
+		}
+		add = add.Set(policy.Window, opts.window)
+	}
+
+	if opts.minAge != "" {
+		minAge, err := time.ParseDuration(opts.minAge)
+		if err != nil {
+			return policy.Update{}, newUsageError(fmt.Sprintf("invalid --min-age: %s", err))
+		}
+		if minAge > 0 {
+			add = add.Set(policy.MinAge, minAge.String())
+		} else {
+			remove = remove.Add(policy.MinAge)
+		}
+	}
+
 	for _, tagPair := range opts.tags {
 		parts := strings.Split(tagPair, "=")
 		if len(parts) != 2 {
@@ -156,7 +280,39 @@ func calculatePolicyChanges(opts *controllerPolicyOpts) (policy.Update, error) {
 	}
 
 	return policy.Update{
-		Add:    add,
-		Remove: remove,
+		Add: add,
+	}, nil
+}
+
+// calculateContainerPolicyChanges is calculatePolicyChanges for when
+// the changes are to be scoped to a single container.
+func calculateContainerPolicyChanges(opts *controllerPolicyOpts) (policy.Update, error) {
+	if opts.tagAll != "" || len(opts.tags) > 0 {
+		return policy.Update{}, newUsageError("--tag and --tag-all cannot be used with --container; use --tag='container=pattern' instead")
+	}
+	if opts.window != "" || opts.minAge != "" || opts.canary || opts.noCanary {
+		return policy.Update{}, newUsageError("--window, --min-age and --canary apply to the whole controller, so cannot be used with --container")
+	}
+
+	add := policy.Set{}
+	automated := policy.ContainerPolicy(policy.Automated, opts.container)
+	locked := policy.ContainerPolicy(policy.Locked, opts.container)
+	if opts.automate {
+		add = add.Add(automated)
+	}
+	if opts.deautomate {
+		// Set this explicitly, so that it overrides the controller
+		// being automated
+		add = add.Set(automated, "false")
+	}
+	if opts.lock {
+		add = add.Add(locked)
+	}
+	if opts.unlock {
+		// As above, so that it overrides the controller being locked
+		add = add.Set(locked, "false")
+	}
+	return policy.Update{
+		Add: add,
 	}, nil
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/spf13/cobra"
 
@@ -14,10 +15,15 @@ type controllerReleaseOpts struct {
 	*rootOpts
 	namespace      string
 	controllers    []string
+	selector       string
 	allControllers bool
 	image          string
 	allImages      bool
 	exclude        []string
+	containers     []string
+	canary         bool
+	namespaceOrder []string
+	soak           time.Duration
 	dryRun         bool
 	outputOpts
 	cause update.Cause
@@ -38,6 +44,11 @@ func (opts *controllerReleaseOpts) Command() *cobra.Command {
 			"fluxctl release -n default --controller=deployment/foo --update-image=library/hello:v2",
 			"fluxctl release --all --update-image=library/hello:v2",
 			"fluxctl release --controller=default:deployment/foo --update-all-images",
+			"fluxctl release --controller=default:deployment/foo --container=app --update-all-images",
+			"fluxctl release --all --update-image=library/hello:v2 --canary --soak=10m",
+			"fluxctl release --all --update-image=library/hello:v2 --namespace-order=staging,prod",
+			"fluxctl release --selector=team=payments --update-all-images",
+			"fluxctl release --controller='prod:deployment/api-*' --update-all-images",
 		),
 		RunE: opts.RunE,
 	}
@@ -45,11 +56,16 @@ func (opts *controllerReleaseOpts) Command() *cobra.Command {
 	AddOutputFlags(cmd, &opts.outputOpts)
 	AddCauseFlags(cmd, &opts.cause)
 	cmd.Flags().StringVarP(&opts.namespace, "namespace", "n", "default", "controller namespace")
-	cmd.Flags().StringSliceVarP(&opts.controllers, "controller", "c", []string{}, "list of controllers to release <kind>/<name>")
+	cmd.Flags().StringSliceVarP(&opts.controllers, "controller", "c", []string{}, "list of controllers to release <kind>/<name>, or patterns for controllers, e.g., 'deployment/api-*'")
+	cmd.Flags().StringVarP(&opts.selector, "selector", "l", "", "release the controllers with labels matching this selector, e.g., team=payments")
 	cmd.Flags().BoolVar(&opts.allControllers, "all", false, "release all controllers")
 	cmd.Flags().StringVarP(&opts.image, "update-image", "i", "", "update a specific image")
 	cmd.Flags().BoolVar(&opts.allImages, "update-all-images", false, "update all images to latest versions")
 	cmd.Flags().StringSliceVar(&opts.exclude, "exclude", []string{}, "exclude a controller")
+	cmd.Flags().StringSliceVar(&opts.containers, "container", []string{}, "only release to the containers named")
+	cmd.Flags().BoolVar(&opts.canary, "canary", false, "release to controllers with the canary policy first, and to the rest only once the canaries are ready")
+	cmd.Flags().StringSliceVar(&opts.namespaceOrder, "namespace-order", []string{}, "release to the controllers in each namespace given in turn, each once those before are ready; controllers in other namespaces are released to last")
+	cmd.Flags().DurationVar(&opts.soak, "soak", 0, "with --canary or --namespace-order, how long the controllers released to must stay ready before releasing to the rest (default given by fluxd)")
 	cmd.Flags().BoolVar(&opts.dryRun, "dry-run", false, "do not release anything; just report back what would have been done")
 
 	// Deprecated
@@ -72,8 +88,18 @@ func (opts *controllerReleaseOpts) RunE(cmd *cobra.Command, args []string) error
 		return err
 	}
 
-	if len(opts.controllers) <= 0 && !opts.allControllers {
-		return newUsageError("please supply either --all, or at least one --controller=<controller>")
+	if opts.canary && len(opts.namespaceOrder) > 0 {
+		return newUsageError("only one of --canary and --namespace-order can be given")
+	}
+	if opts.soak != 0 && !opts.canary && len(opts.namespaceOrder) == 0 {
+		return newUsageError("--soak only makes sense with --canary or --namespace-order")
+	}
+
+	if len(opts.controllers) <= 0 && opts.selector == "" && !opts.allControllers {
+		return newUsageError("please supply either --all, --selector=<selector>, or at least one --controller=<controller>")
+	}
+	if opts.allControllers && (len(opts.controllers) > 0 || opts.selector != "") {
+		return newUsageError("--all cannot be used with --controller or --selector")
 	}
 
 	var controllers []update.ResourceSpec
@@ -81,11 +107,18 @@ func (opts *controllerReleaseOpts) RunE(cmd *cobra.Command, args []string) error
 		controllers = []update.ResourceSpec{update.ResourceSpecAll}
 	} else {
 		for _, controller := range opts.controllers {
-			id, err := flux.ParseResourceIDOptionalNamespace(opts.namespace, controller)
+			spec, err := parseControllerSpec(opts.namespace, controller)
+			if err != nil {
+				return err
+			}
+			controllers = append(controllers, spec)
+		}
+		if opts.selector != "" {
+			spec, err := update.MakeLabelSpec(opts.selector)
 			if err != nil {
 				return err
 			}
-			controllers = append(controllers, update.MakeResourceSpec(id))
+			controllers = append(controllers, spec)
 		}
 	}
 
@@ -126,10 +159,14 @@ func (opts *controllerReleaseOpts) RunE(cmd *cobra.Command, args []string) error
 	ctx := context.Background()
 
 	jobID, err := opts.API.UpdateImages(ctx, update.ReleaseSpec{
-		ServiceSpecs: controllers,
-		ImageSpec:    image,
-		Kind:         kind,
-		Excludes:     excludes,
+		ServiceSpecs:   controllers,
+		ImageSpec:      image,
+		Kind:           kind,
+		Excludes:       excludes,
+		Containers:     opts.containers,
+		Canary:         opts.canary,
+		NamespaceOrder: opts.namespaceOrder,
+		Soak:           opts.soak,
 	}, opts.cause)
 	if err != nil {
 		return err
@@ -31,6 +31,16 @@ func TestReleaseCommand_CLIConversion(t *testing.T) {
 			"image":   string(update.ImageSpecLatest),
 			"kind":    string(update.ReleaseKindExecute),
 		}},
+		{[]string{"--update-all-images", "--controller=deployment/api-*"}, map[string]string{
+			"service": "default:deployment/api-*",
+			"image":   string(update.ImageSpecLatest),
+			"kind":    string(update.ReleaseKindExecute),
+		}},
+		{[]string{"--update-all-images", "--selector=team=payments"}, map[string]string{
+			"service": "label:team=payments",
+			"image":   string(update.ImageSpecLatest),
+			"kind":    string(update.ReleaseKindExecute),
+		}},
 		{[]string{"--update-all-images", "--all", "--exclude=deployment/test,deployment/yeah"}, map[string]string{
 			"service": string(update.ResourceSpecAll),
 			"image":   string(update.ImageSpecLatest),
@@ -69,6 +79,8 @@ func TestReleaseCommand_InputFailures(t *testing.T) {
 		{[]string{"--update-all-images"}, "Should error when not specifying controller spec"},
 		{[]string{"--controller=invalid&controller", "--update-all-images"}, "Should error with invalid controller"},
 		{[]string{"subcommand"}, "Should error when given subcommand"},
+		{[]string{"--selector==payments", "--update-all-images"}, "Should error with invalid selector"},
+		{[]string{"--all", "--selector=team=payments", "--update-all-images"}, "Should error with --all and --selector"},
 	} {
 		testArgs(t, v.args, true, v.msg)
 	}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+
+	"github.com/spf13/cobra"
+
+	"github.com/weaveworks/flux"
+	"github.com/weaveworks/flux/update"
+)
+
+type controllerRollbackOpts struct {
+	*rootOpts
+	namespace  string
+	controller string
+	toRevision string
+	steps      int
+	outputOpts
+	cause update.Cause
+}
+
+func newControllerRollback(parent *rootOpts) *controllerRollbackOpts {
+	return &controllerRollbackOpts{rootOpts: parent}
+}
+
+func (opts *controllerRollbackOpts) Command() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rollback",
+		Short: "Roll a controller back to the images it had before a previous release, and lock it.",
+		Example: makeExample(
+			"fluxctl rollback --controller=deployment/helloworld",
+			"fluxctl rollback --controller=deployment/helloworld --steps=2 -m 'Memory leak in v2 and v3'",
+			"fluxctl rollback --controller=default:deployment/helloworld --to-revision=7a2b3c1",
+		),
+		RunE: opts.RunE,
+	}
+	AddOutputFlags(cmd, &opts.outputOpts)
+	AddCauseFlags(cmd, &opts.cause)
+	cmd.Flags().StringVarP(&opts.namespace, "namespace", "n", "default", "Controller namespace")
+	cmd.Flags().StringVarP(&opts.controller, "controller", "c", "", "Controller to roll back")
+	cmd.Flags().StringVar(&opts.toRevision, "to-revision", "", "Roll back to before the release made in this commit")
+	cmd.Flags().IntVar(&opts.steps, "steps", 0, "Number of releases to roll back (default 1)")
+	return cmd
+}
+
+func (opts *controllerRollbackOpts) RunE(cmd *cobra.Command, args []string) error {
+	if len(args) > 0 {
+		return errorWantedNoArgs
+	}
+	if opts.controller == "" {
+		return newUsageError("-c, --controller is required")
+	}
+	if opts.toRevision != "" && opts.steps != 0 {
+		return newUsageError("please supply only one of --to-revision or --steps")
+	}
+	if opts.steps < 0 {
+		return newUsageError("--steps must be positive")
+	}
+
+	id, err := flux.ParseResourceIDOptionalNamespace(opts.namespace, opts.controller)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	jobID, err := opts.API.Rollback(ctx, update.RollbackSpec{
+		ServiceID:  id,
+		ToRevision: opts.toRevision,
+		Steps:      opts.steps,
+	}, opts.cause)
+	if err != nil {
+		return err
+	}
+	return await(ctx, cmd.OutOrStdout(), cmd.OutOrStderr(), opts.API, jobID, true, opts.verbose)
+}
@@ -66,6 +66,9 @@ func (opts *rootOpts) Command() *cobra.Command {
 		newControllerLock(opts).Command(),
 		newControllerUnlock(opts).Command(),
 		newControllerPolicy(opts).Command(),
+		newControllerRollback(opts).Command(),
+		newFreeze(opts).Command(),
+		newUnfreeze(opts).Command(),
 		newSave(opts).Command(),
 		newIdentity(opts).Command(),
 	)
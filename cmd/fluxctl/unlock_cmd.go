@@ -10,6 +10,7 @@ type controllerUnlockOpts struct {
 	*rootOpts
 	namespace  string
 	controller string
+	selector   string
 	outputOpts
 	cause update.Cause
 
@@ -34,6 +35,7 @@ func (opts *controllerUnlockOpts) Command() *cobra.Command {
 	AddCauseFlags(cmd, &opts.cause)
 	cmd.Flags().StringVarP(&opts.namespace, "namespace", "n", "default", "Controller namespace")
 	cmd.Flags().StringVarP(&opts.controller, "controller", "c", "", "Controller to unlock")
+	cmd.Flags().StringVarP(&opts.selector, "selector", "l", "", "Unlock the controllers with labels matching this selector, e.g., team=payments")
 
 	// Deprecate
 	cmd.Flags().StringVarP(&opts.service, "service", "s", "", "Service to unlock")
@@ -51,6 +53,7 @@ func (opts *controllerUnlockOpts) RunE(cmd *cobra.Command, args []string) error
 		outputOpts: opts.outputOpts,
 		namespace:  opts.namespace,
 		controller: opts.controller,
+		selector:   opts.selector,
 		cause:      opts.cause,
 		unlock:     true,
 	}
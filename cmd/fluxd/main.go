@@ -8,8 +8,11 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"regexp"
+	"strings"
 	"sync"
 	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -22,11 +25,15 @@ import (
 	"context"
 
 	"github.com/weaveworks/flux"
+	"github.com/weaveworks/flux/approval"
 	"github.com/weaveworks/flux/cluster"
 	"github.com/weaveworks/flux/cluster/kubernetes"
 	"github.com/weaveworks/flux/daemon"
 	"github.com/weaveworks/flux/event"
+	"github.com/weaveworks/flux/forge"
 	"github.com/weaveworks/flux/git"
+	"github.com/weaveworks/flux/git/webhook"
+	"github.com/weaveworks/flux/gpg"
 	transport "github.com/weaveworks/flux/http"
 	daemonhttp "github.com/weaveworks/flux/http/daemon"
 	"github.com/weaveworks/flux/job"
@@ -34,7 +41,11 @@ import (
 	registryMemcache "github.com/weaveworks/flux/registry/cache"
 	registryMiddleware "github.com/weaveworks/flux/registry/middleware"
 	"github.com/weaveworks/flux/remote"
+	"github.com/weaveworks/flux/schedule"
+	"github.com/weaveworks/flux/service/integrations/github"
 	"github.com/weaveworks/flux/ssh"
+	fluxsync "github.com/weaveworks/flux/sync"
+	"github.com/weaveworks/flux/update"
 )
 
 var version string
@@ -68,9 +79,15 @@ func main() {
 	}
 	// This mirrors how kubectl extracts information from the environment.
 	var (
-		listenAddr        = fs.StringP("listen", "l", ":3030", "Listen address where /metrics and API will be served")
-		kubernetesKubectl = fs.String("kubernetes-kubectl", "", "Optional, explicit path to kubectl tool")
-		versionFlag       = fs.Bool("version", false, "Get version number")
+		listenAddr                 = fs.StringP("listen", "l", ":3030", "Listen address where /metrics and API will be served")
+		kubernetesKubectl          = fs.String("kubernetes-kubectl", "", "Optional, explicit path to kubectl tool")
+		kubernetesCache            = fs.Bool("kubernetes-cache", true, "keep an in-memory view of namespaces and workloads, updated by watching the API server, rather than listing them every time they're needed")
+		kubernetesCacheSyncTimeout = fs.Duration("kubernetes-cache-sync-timeout", time.Minute, "how long to wait for each kind of resource to be populated in the in-memory view; kinds not populated by then (e.g., because fluxd isn't allowed to watch them) are listed from the API server instead")
+		// Applying resources when syncing
+		kubernetesSyncWorkers = fs.Int("kubernetes-sync-workers", 4, "how many resources may be applied at once when syncing; namespaces, then custom resource definitions, are always applied before anything else")
+		kubernetesSyncTimeout = fs.Duration("kubernetes-sync-timeout", time.Minute, "how long an attempt at applying or deleting a resource may take; zero means no limit")
+		kubernetesSyncRetries = fs.Int("kubernetes-sync-retries", 3, "how many times to retry applying or deleting a resource when it fails for a transient reason (a conflict, a server error, or throttling)")
+		versionFlag           = fs.Bool("version", false, "Get version number")
 		// Git repo & key etc.
 		gitURL       = fs.String("git-url", "", "URL of git repo with Kubernetes manifests; e.g., git@github.com:weaveworks/flux-example")
 		gitBranch    = fs.String("git-branch", "master", "branch of git repo to use for Kubernetes manifests")
@@ -80,10 +97,32 @@ func main() {
 		gitSetAuthor = fs.Bool("git-set-author", false, "If set, the author of git commits will reflect the user who initiated the commit and will differ from the git committer.")
 		gitLabel     = fs.String("git-label", "", "label to keep track of sync progress; overrides both --git-sync-tag and --git-notes-ref")
 		// Old git config; still used if --git-label is not supplied, but --git-label is preferred.
-		gitSyncTag  = fs.String("git-sync-tag", defaultGitSyncTag, "tag to use to mark sync progress for this cluster")
-		gitNotesRef = fs.String("git-notes-ref", defaultGitNotesRef, "ref to use for keeping commit annotations in git notes")
+		gitSyncTag       = fs.String("git-sync-tag", defaultGitSyncTag, "tag to use to mark sync progress for this cluster")
+		gitNotesRef      = fs.String("git-notes-ref", defaultGitNotesRef, "ref to use for keeping commit annotations in git notes")
+		syncStateKind    = fs.String("sync-state", fluxsync.GitTagState, "where to record the revision last synced: \"git\" moves the sync tag in the repo; \"kubernetes\" uses a ConfigMap, named after the sync tag, in fluxd's namespace, so the repo can be read-only")
+		syncFullInterval = fs.Duration("sync-full-interval", time.Hour, "how often to apply every resource, rather than only those changed since they were last applied (judged by a checksum recorded on each resource); only namespaces and workloads are skipped when unchanged, other kinds are applied at every sync; zero means every sync applies everything")
+		syncPerCommit    = fs.Bool("sync-per-commit", false, "sync new commits one at a time, oldest first, so that a commit that fails to sync doesn't hold up later commits (e.g., ones that fix it)")
 
+		gitReadOnly     = fs.Bool("git-readonly", false, "never commit or push to the git repo, so a read-only deploy key can be used; releases, policy changes and automated releases are refused, and sync progress is recorded in the cluster (see --sync-state)")
 		gitPollInterval = fs.Duration("git-poll-interval", 5*time.Minute, "period at which to poll git repo for new commits")
+		gitCredentials  = fs.String("git-https-credentials", "", "directory holding username and token (or password) files, e.g., a mounted secret, to authenticate with for an https --git-url")
+		gitBackend      = fs.String("git-backend", git.ExecBackend, "how to do git operations: \"exec\" runs the git binary; \"go\" does them in-process, needing no git or ssh binaries")
+		gitCloneDepth   = fs.Int("git-clone-depth", 0, "if greater than zero, clone only this many commits of history, fetching more when needed; needs the exec git backend")
+		gitSparse       = fs.Bool("git-sparse-checkout", false, "check out only the files under --git-path; needs the exec git backend")
+		// commit signing and verification
+		gitTrustedKeys  = fs.String("git-trusted-keys", "", "file or directory of GPG public keys, e.g., a mounted secret; if given, only commits signed by one of these keys are synced, and --sync-state defaults to kubernetes (the sync tag, which anyone who can push can move, is not allowed)")
+		gitGPGKeyImport = fs.String("git-gpg-key-import", "", "file or directory of GPG keys to import into gpg at startup, e.g., the secret key for --git-signing-key")
+		gitSigningKey   = fs.String("git-signing-key", "", "ID of the GPG key to sign commits and the sync tag with; needs the exec git backend")
+		// commit messages
+		gitCommitTemplateRelease  = fs.String("git-commit-template-release", "", "Go template for the message of release commits; see the docs for what it can refer to")
+		gitCommitTemplateAuto     = fs.String("git-commit-template-auto-release", "", "Go template for the message of automated release commits")
+		gitCommitTemplatePolicy   = fs.String("git-commit-template-policy", "", "Go template for the message of policy change commits")
+		gitCommitTemplateRollback = fs.String("git-commit-template-rollback", "", "Go template for the message of rollback commits")
+		gitCommitTrailers         = fs.Bool("git-commit-trailers", false, "end commit messages with a Flux-Job-ID trailer, and a Flux-Ticket trailer for each ticket reference (see --git-commit-ticket-pattern) in the message given with the update")
+		gitCommitTicketPattern    = fs.String("git-commit-ticket-pattern", `[A-Z][A-Z0-9]+-[0-9]+`, "regular expression for ticket references to add as trailers")
+		gitCommitURLTemplate      = fs.String("git-commit-url-template", "", "URL of a commit in the git host's web interface, with {revision} standing for the commit's revision; if given, sync events link to the commits synced")
+		// push webhooks
+		gitWebhookSecret = fs.String("git-webhook-secret", "", "secret that push webhooks from the git host must be signed with (or, for GitLab, give as the token); if set, webhooks are accepted at /api/flux/v6/git-push and trigger a sync")
 		// registry
 		memcachedHostname    = fs.String("memcached-hostname", "", "Hostname for memcached service to use when caching chunks. If empty, no memcached will be used.")
 		memcachedTimeout     = fs.Duration("memcached-timeout", time.Second, "Maximum time to wait before giving up on memcached requests.")
@@ -93,6 +132,21 @@ func main() {
 		registryRPS          = fs.Int("registry-rps", 200, "maximum registry requests per second per host")
 		registryBurst        = fs.Int("registry-burst", defaultRemoteConnections, "maximum number of warmer connections to remote and memcache")
 
+		// automation
+		automationWindow  = fs.String("automation-window", "", "cron-like schedule of when automated releases may happen, for controllers without a window policy; e.g., 'TZ=Europe/London * 9-16 * * mon-fri'")
+		automationFrozen  = fs.Bool("automation-frozen", false, "start with automated releases suspended, unless fluxctl freeze or unfreeze has been used since (which needs --sync-state=kubernetes, so the freeze can be recorded in the sync state ConfigMap)")
+		automationMaxRate = fs.Int("automation-max-releases-per-hour", 0, "maximum number of automated releases to a controller in any hour; 0 means no limit. Releases are counted across restarts only when fluxd has somewhere to keep state, i.e., the sync state ConfigMap")
+		canarySoak        = fs.Duration("canary-soak", 5*time.Minute, "how long canaries must stay ready, in a staged release, before the remaining controllers are released to")
+		namespaceOrder    = fs.StringSlice("automation-namespace-order", nil, "if given, automated releases are staged by namespace, in this order (e.g., staging,prod), rather than to canaries first")
+
+		// pull requests
+		forgeKind   = fs.String("forge", "", "if set to 'github', propose changes as pull requests to the git repo rather than pushing them to the branch")
+		forgeToken  = fs.String("forge-token", "", "token to use for authenticating with the forge when opening pull requests")
+		forgeAPIURL = fs.String("forge-api-url", "", "base URL of the forge API, e.g., for GitHub Enterprise; defaults to the public API")
+
+		// approval of releases
+		approvalWebhookURL = fs.String("approval-webhook-url", "", "if set, the updates in each release are posted to this URL for approval before being committed")
+
 		// k8s-secret backed ssh keyring configuration
 		k8sSecretName            = fs.String("k8s-secret-name", "flux-git-deploy", "Name of the k8s secret used to store the private SSH key")
 		k8sSecretVolumeMountPath = fs.String("k8s-secret-volume-mount-path", "/etc/fluxd/ssh", "Mount location of the k8s secret storing the private SSH key")
@@ -100,6 +154,8 @@ func main() {
 		// SSH key generation
 		sshKeyBits = optionalVar(fs, &ssh.KeyBitsValue{}, "ssh-keygen-bits", "-b argument to ssh-keygen (default unspecified)")
 		sshKeyType = optionalVar(fs, &ssh.KeyTypeValue{}, "ssh-keygen-type", "-t argument to ssh-keygen (default unspecified)")
+		// SSH host keys
+		sshKnownHosts = fs.String("ssh-known-hosts", "", "path to a known_hosts file, e.g., mounted from a ConfigMap; if given, git hosts must present a key listed there")
 
 		upstreamURL = fs.String("connect", "", "Connect to an upstream service e.g., Weave Cloud, at this base address")
 		token       = fs.String("token", "", "Authentication token for upstream service")
@@ -141,12 +197,100 @@ func main() {
 		}
 	}
 
+	var defaultWindow schedule.Schedule
+	if *automationWindow != "" {
+		var err error
+		defaultWindow, err = schedule.Parse(*automationWindow)
+		if err != nil {
+			logger.Log("flag", "automation-window", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	var forgeClient forge.Client
+	switch *forgeKind {
+	case "":
+	case "github":
+		pulls, err := github.NewPullRequests(*forgeToken, *gitURL, *forgeAPIURL)
+		if err != nil {
+			logger.Log("flag", "forge", "err", err)
+			os.Exit(1)
+		}
+		forgeClient = pulls
+	default:
+		logger.Log("flag", "forge", "err", fmt.Sprintf("unknown forge %q; expected 'github'", *forgeKind))
+		os.Exit(1)
+	}
+
+	if *gitReadOnly {
+		if !fs.Changed("sync-state") {
+			*syncStateKind = fluxsync.KubernetesState
+		} else if *syncStateKind == fluxsync.GitTagState {
+			logger.Log("flag", "sync-state", "err", "--git-readonly needs somewhere other than the repo to record sync progress")
+			os.Exit(1)
+		}
+	}
+	// Anyone who can push to the repo can move the sync tag, so it
+	// can't be trusted to say which commits were verified.
+	if *gitTrustedKeys != "" {
+		if !fs.Changed("sync-state") {
+			*syncStateKind = fluxsync.KubernetesState
+		} else if *syncStateKind == fluxsync.GitTagState {
+			logger.Log("flag", "sync-state", "err", "--git-trusted-keys needs sync progress to be recorded somewhere other than the repo")
+			os.Exit(1)
+		}
+	}
+	switch *syncStateKind {
+	case fluxsync.GitTagState, fluxsync.KubernetesState:
+	default:
+		logger.Log("flag", "sync-state", "err", fmt.Sprintf("unknown sync state %q; expected %q or %q", *syncStateKind, fluxsync.GitTagState, fluxsync.KubernetesState))
+		os.Exit(1)
+	}
+
+	commitTemplates := daemon.CommitTemplates{
+		Messages: map[string]*template.Template{},
+		Trailers: *gitCommitTrailers,
+	}
+	for _, t := range []struct {
+		flag, updateType, text string
+	}{
+		{"git-commit-template-release", update.Images, *gitCommitTemplateRelease},
+		{"git-commit-template-auto-release", update.Auto, *gitCommitTemplateAuto},
+		{"git-commit-template-policy", update.Policy, *gitCommitTemplatePolicy},
+		{"git-commit-template-rollback", update.Rollback, *gitCommitTemplateRollback},
+	} {
+		if t.text == "" {
+			continue
+		}
+		tmpl, err := daemon.ParseCommitTemplate(t.updateType, t.text)
+		if err != nil {
+			logger.Log("flag", t.flag, "err", err)
+			os.Exit(1)
+		}
+		commitTemplates.Messages[t.updateType] = tmpl
+	}
+	if *gitCommitTicketPattern != "" {
+		pattern, err := regexp.Compile(*gitCommitTicketPattern)
+		if err != nil {
+			logger.Log("flag", "git-commit-ticket-pattern", "err", err)
+			os.Exit(1)
+		}
+		commitTemplates.TicketPattern = pattern
+	}
+
+	var gate approval.Gate
+	if *approvalWebhookURL != "" {
+		gate = approval.NewWebhook(*approvalWebhookURL)
+	}
+
 	// Platform component.
 	var clusterVersion string
 	var sshKeyRing ssh.KeyRing
 	var k8s cluster.Cluster
 	var image_creds func() registry.ImageCreds
 	var k8sManifests cluster.Manifests
+	var syncState fluxsync.State
+	var stateStore daemon.StateStore
 	{
 		restClientConfig, err := rest.InClusterConfig()
 		if err != nil {
@@ -189,6 +333,17 @@ func main() {
 			os.Exit(1)
 		}
 
+		if *syncStateKind == fluxsync.KubernetesState {
+			configMapState := kubernetes.ConfigMapSyncState{
+				ConfigMapAPI: clientset.Core().ConfigMaps(string(namespace)),
+				Name:         *gitSyncTag,
+			}
+			syncState = configMapState
+			// A freeze is kept in the same ConfigMap, so it lasts
+			// across restarts too.
+			stateStore = configMapState
+		}
+
 		publicKey, privateKeyPath := sshKeyRing.KeyPair()
 
 		logger := log.With(logger, "component", "platform")
@@ -214,6 +369,13 @@ func main() {
 			logger.Log("err", err)
 			os.Exit(1)
 		}
+		k8s_inst.SyncOptions = kubernetes.SyncOptions{
+			Workers: *kubernetesSyncWorkers,
+			Timeout: *kubernetesSyncTimeout,
+			Retries: *kubernetesSyncRetries,
+			Backoff: time.Second,
+		}
+		logger.Log("sync-workers", *kubernetesSyncWorkers, "sync-timeout", *kubernetesSyncTimeout, "sync-retries", *kubernetesSyncRetries)
 
 		if err := k8s_inst.Ping(); err != nil {
 			logger.Log("ping", err)
@@ -221,6 +383,14 @@ func main() {
 			logger.Log("ping", true)
 		}
 
+		if *kubernetesCache {
+			if err := k8s_inst.StartCache(0, *kubernetesCacheSyncTimeout); err != nil {
+				logger.Log("cache", "disabled", "err", err)
+			} else {
+				logger.Log("cache", "started")
+			}
+		}
+
 		image_creds = k8s_inst.ImagesToFetch
 		k8s = k8s_inst
 		// There is only one way we currently interpret a repo of
@@ -292,9 +462,51 @@ func main() {
 		logger.Log("err", err)
 		os.Exit(1)
 	}
+	backend, err := git.NewBackend(*gitBackend)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+	if *gitTrustedKeys != "" {
+		if _, err := gpg.ReadKeyRing(*gitTrustedKeys); err != nil {
+			logger.Log("flag", "git-trusted-keys", "err", err)
+			os.Exit(1)
+		}
+	}
+	if *gitGPGKeyImport != "" {
+		if err := gpg.ImportKeys(*gitGPGKeyImport); err != nil {
+			logger.Log("flag", "git-gpg-key-import", "err", err)
+			os.Exit(1)
+		}
+	}
+	if (*gitCloneDepth > 0 || *gitSparse) && *gitBackend != git.ExecBackend {
+		logger.Log("flag", "git-clone-depth", "err", "shallow and sparse clones need --git-backend="+git.ExecBackend)
+		os.Exit(1)
+	}
+	if *gitSigningKey != "" && *gitBackend != git.ExecBackend {
+		logger.Log("flag", "git-signing-key", "err", "signing needs --git-backend="+git.ExecBackend)
+		os.Exit(1)
+	}
+	if *sshKnownHosts != "" {
+		if _, err := ssh.ReadKnownHosts(*sshKnownHosts); err != nil {
+			logger.Log("flag", "ssh-known-hosts", "err", err)
+			os.Exit(1)
+		}
+	}
+	var gitCreds git.Credentials
+	if *gitCredentials != "" {
+		if !strings.HasPrefix(*gitURL, "https://") && !strings.HasPrefix(*gitURL, "http://") {
+			logger.Log("flag", "git-https-credentials", "err", "credentials can only be used with an https --git-url")
+			os.Exit(1)
+		}
+		gitCreds = git.SecretCredentials{Dir: *gitCredentials}
+	}
+	// Don't report any credentials included in the URL
+	reportedRemoteConfig := gitRemoteConfig
+	reportedRemoteConfig.URL = git.RedactURL(gitRemoteConfig.URL)
 	// Indirect reference to a daemon, initially of the NotReady variety
 	notReadyDaemon := daemon.NewNotReadyDaemon(
-		version, k8s, gitRemoteConfig, errors.New("waiting to clone repo"))
+		version, k8s, reportedRemoteConfig, errors.New("waiting to clone repo"))
 
 	daemonRef := daemon.NewRef(notReadyDaemon)
 
@@ -338,6 +550,9 @@ func main() {
 		mux.Handle("/metrics", promhttp.Handler())
 		handler := daemonhttp.NewHandler(daemonRef, daemonhttp.NewRouter())
 		mux.Handle("/api/flux/", http.StripPrefix("/api/flux", handler))
+		if *gitWebhookSecret != "" {
+			mux.Handle("/api/flux/v6/git-push", webhook.NewHandler(*gitWebhookSecret, daemonRef, log.With(logger, "component", "webhook")))
+		}
 		logger.Log("addr", *listenAddr)
 		errc <- http.ListenAndServe(*listenAddr, mux)
 	}()
@@ -356,13 +571,19 @@ func main() {
 		repo = git.Repo{
 			GitRemoteConfig: gitRemoteConfig,
 			KeyRing:         sshKeyRing,
+			Credentials:     gitCreds,
+			KnownHosts:      *sshKnownHosts,
+			Backend:         backend,
+			Depth:           *gitCloneDepth,
+			Sparse:          *gitSparse,
 		}
 		gitConfig := git.Config{
-			SyncTag:   *gitSyncTag,
-			NotesRef:  *gitNotesRef,
-			UserName:  *gitUser,
-			UserEmail: *gitEmail,
-			SetAuthor: *gitSetAuthor,
+			SyncTag:    *gitSyncTag,
+			NotesRef:   *gitNotesRef,
+			UserName:   *gitUser,
+			UserEmail:  *gitEmail,
+			SetAuthor:  *gitSetAuthor,
+			SigningKey: *gitSigningKey,
 		}
 
 		for checkout == nil {
@@ -385,8 +606,17 @@ func main() {
 					"user", *gitUser,
 					"email", *gitEmail,
 					"sync-tag", *gitSyncTag,
+					"sync-state", *syncStateKind,
+					"sync-per-commit", *syncPerCommit,
+					"sync-full-interval", *syncFullInterval,
+					"readonly", *gitReadOnly,
+					"clone-depth", *gitCloneDepth,
+					"sparse-checkout", *gitSparse,
 					"notes-ref", *gitNotesRef,
-					"set-author", *gitSetAuthor)
+					"set-author", *gitSetAuthor,
+					"signing-key", *gitSigningKey,
+					"trusted-keys", *gitTrustedKeys,
+					"auth", repo.AuthMode())
 				checkout = working
 			}
 		}
@@ -409,10 +639,25 @@ func main() {
 		Jobs:           jobs,
 		JobStatusCache: &job.StatusCache{Size: 100},
 
-		EventWriter: eventWriter,
-		Logger:      log.With(logger, "component", "daemon"), LoopVars: &daemon.LoopVars{
-			GitPollInterval:      *gitPollInterval,
-			RegistryPollInterval: *registryPollInterval,
+		EventWriter:       eventWriter,
+		Forge:             forgeClient,
+		Gate:              gate,
+		SyncState:         syncState,
+		StateStore:        stateStore,
+		CommitTemplates:   commitTemplates,
+		CommitURLTemplate: *gitCommitURLTemplate,
+		ReadOnly:          *gitReadOnly,
+		Logger:            log.With(logger, "component", "daemon"), LoopVars: &daemon.LoopVars{
+			GitPollInterval:             *gitPollInterval,
+			RegistryPollInterval:        *registryPollInterval,
+			DefaultWindow:               defaultWindow,
+			Frozen:                      *automationFrozen,
+			MaxAutomatedReleasesPerHour: *automationMaxRate,
+			CanarySoak:                  *canarySoak,
+			NamespaceOrder:              *namespaceOrder,
+			TrustedKeys:                 *gitTrustedKeys,
+			SyncPerCommit:               *syncPerCommit,
+			FullSyncInterval:            *syncFullInterval,
 		},
 	}
 
@@ -0,0 +1,88 @@
+package daemon
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/weaveworks/flux"
+	"github.com/weaveworks/flux/event"
+	"github.com/weaveworks/flux/update"
+)
+
+// rejected gives the controllers in the result whose updates were
+// rejected by the approval gate.
+func rejected(result update.Result) []flux.ResourceID {
+	var ids []flux.ResourceID
+	for id, r := range result {
+		if strings.HasPrefix(r.Error, update.Rejected) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// logRejections logs an event for each controller whose update was
+// rejected by the approval gate.
+func (d *Daemon) logRejections(result update.Result, logger log.Logger) {
+	now := time.Now().UTC()
+	for _, id := range rejected(result) {
+		if err := d.LogEvent(event.Event{
+			ServiceIDs: []flux.ResourceID{id},
+			Type:       event.EventReleaseRejected,
+			StartedAt:  now,
+			EndedAt:    now,
+			LogLevel:   event.LogLevelWarn,
+			Message:    fmt.Sprintf("Release to %s %s", id, result[id].Error),
+		}); err != nil {
+			logger.Log("err", err)
+		}
+	}
+}
+
+// How long an image rejected by the approval gate for an automated
+// release is held back before it's put to the gate again, since the
+// gate may come to a different decision (e.g., once a vulnerability
+// has been waived)
+const rejectionTTL = time.Hour
+
+// recordRejectedImages notes the image updates rejected by the
+// approval gate in an automated release, so they aren't put to the
+// gate again each time images are polled.
+func (d *Daemon) recordRejectedImages(changes *update.Automated, result update.Result) {
+	d.automatedMu.Lock()
+	defer d.automatedMu.Unlock()
+	if d.rejectedImages == nil {
+		d.rejectedImages = map[proposal]time.Time{}
+	}
+	now := time.Now()
+	for _, id := range rejected(result) {
+		for _, change := range changes.Changes {
+			if change.ServiceID == id {
+				d.rejectedImages[proposal{change.ServiceID, change.Container.Name, change.ImageID}] = now
+			}
+		}
+	}
+}
+
+// pruneRejectedImages forgets the rejections that have run their
+// course, and those of images that are no longer the candidates to be
+// released, e.g., because a newer image has come along.
+func (d *Daemon) pruneRejectedImages(candidates map[proposal]bool, now time.Time) {
+	d.automatedMu.Lock()
+	defer d.automatedMu.Unlock()
+	for p, at := range d.rejectedImages {
+		if !candidates[p] || now.Sub(at) >= rejectionTTL {
+			delete(d.rejectedImages, p)
+		}
+	}
+}
+
+func (d *Daemon) rejectedImage(service flux.ResourceID, container string, image flux.ImageID) bool {
+	d.automatedMu.Lock()
+	defer d.automatedMu.Unlock()
+	at, ok := d.rejectedImages[proposal{service, container, image}]
+	return ok && time.Since(at) < rejectionTTL
+}
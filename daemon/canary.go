@@ -0,0 +1,447 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+
+	"github.com/weaveworks/flux"
+	"github.com/weaveworks/flux/cluster"
+	"github.com/weaveworks/flux/event"
+	"github.com/weaveworks/flux/git"
+	"github.com/weaveworks/flux/policy"
+	"github.com/weaveworks/flux/release"
+	"github.com/weaveworks/flux/update"
+)
+
+const (
+	defaultCanaryPollInterval   = 5 * time.Second
+	defaultCanaryRolloutTimeout = 5 * time.Minute
+)
+
+// errStopped is returned when waiting on canaries is cut short
+// because the daemon is stopping.
+var errStopped = errors.New("stopped waiting for canaries")
+
+// stageRelease decides whether a release should be staged, and if so,
+// returns the changes confined to the stage to be done now, the
+// changes for the stage after that (or nil, if it's the last), and
+// how long the controllers released to should soak before the next
+// stage. If the release isn't to be staged, the changes returned are
+// nil.
+func (d *Daemon) stageRelease(c release.Changes, working *git.Checkout) (release.Changes, release.Changes, time.Duration, error) {
+	switch c := c.(type) {
+	case update.ReleaseSpec:
+		if !c.Canary && len(c.NamespaceOrder) == 0 || c.Kind != update.ReleaseKindExecute {
+			return nil, nil, 0, nil
+		}
+		soak := c.Soak
+		if soak == 0 {
+			soak = d.CanarySoak
+		}
+		this, next := c, c
+		this.Stage, next.Stage = stages(c.Stage, c.NamespaceOrder)
+		if next.Stage == "" {
+			return this, nil, soak, nil
+		}
+		return this, next, soak, nil
+	case *update.Automated:
+		if c.Stage == "" {
+			staged, err := d.stageAutomated(c, working)
+			if err != nil || !staged {
+				return nil, nil, 0, err
+			}
+		}
+		this, next := *c, *c
+		if c.Stage == "" && len(d.NamespaceOrder) > 0 {
+			this.NamespaceOrder, next.NamespaceOrder = d.NamespaceOrder, d.NamespaceOrder
+		}
+		this.Stage, next.Stage = stages(c.Stage, this.NamespaceOrder)
+		if next.Stage == "" {
+			return &this, nil, d.CanarySoak, nil
+		}
+		return &this, &next, d.CanarySoak, nil
+	}
+	return nil, nil, 0, nil
+}
+
+// stageAutomated says whether an automated release is to be staged:
+// either because automated releases are staged by namespace, or
+// because any of the controllers to be updated is a canary.
+func (d *Daemon) stageAutomated(c *update.Automated, working *git.Checkout) (bool, error) {
+	if len(d.NamespaceOrder) > 0 {
+		return true, nil
+	}
+	services, err := d.Manifests.ServicesWithPolicies(working.ManifestDir())
+	if err != nil {
+		return false, errors.Wrap(err, "getting service policies")
+	}
+	canarySet := services.OnlyWithPolicy(policy.Canary)
+	for _, change := range c.Changes {
+		if _, ok := canarySet[change.ServiceID]; ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// stages gives the stage to be done now, for a release at the stage
+// given (which is the empty stage if it's not started), and the stage
+// after that.
+func stages(stage update.Stage, namespaces []string) (update.Stage, update.Stage) {
+	if stage == "" {
+		stage = update.NextStage("", namespaces)
+	}
+	return stage, update.NextStage(stage, namespaces)
+}
+
+// stageOf gives the stage of a staged release.
+func stageOf(c release.Changes) update.Stage {
+	switch c := c.(type) {
+	case update.ReleaseSpec:
+		return c.Stage
+	case *update.Automated:
+		return c.Stage
+	}
+	return ""
+}
+
+// awaitingCanary gives the controllers in the result that were held
+// back to be released after the canaries, or in a later stage.
+func awaitingCanary(result update.Result) []flux.ResourceID {
+	var ids []flux.ResourceID
+	for id, r := range result {
+		if r.Error == update.AwaitingCanary || r.Error == update.AwaitingStage {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// succeeded gives the controllers successfully updated in the result.
+func succeeded(result update.Result) []flux.ResourceID {
+	var ids []flux.ResourceID
+	for id, r := range result {
+		if r.Status == update.ReleaseStatusSuccess {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// holdForCanaries records the automated changes to controllers that
+// are waiting on canaries (or an earlier stage), so that they aren't
+// released in the meantime by another automated release.
+func (d *Daemon) holdForCanaries(changes *update.Automated, waiting []flux.ResourceID) {
+	d.automatedMu.Lock()
+	defer d.automatedMu.Unlock()
+	if d.canaryHeld == nil {
+		d.canaryHeld = map[proposal]bool{}
+	}
+	for _, change := range changes.Changes {
+		for _, id := range waiting {
+			if change.ServiceID == id {
+				d.canaryHeld[proposal{change.ServiceID, change.Container.Name, change.ImageID}] = true
+			}
+		}
+	}
+}
+
+func (d *Daemon) releaseHeld(changes *update.Automated) {
+	d.automatedMu.Lock()
+	defer d.automatedMu.Unlock()
+	for _, change := range changes.Changes {
+		delete(d.canaryHeld, proposal{change.ServiceID, change.Container.Name, change.ImageID})
+	}
+}
+
+func (d *Daemon) heldForCanaries(service flux.ResourceID, container string, image flux.ImageID) bool {
+	d.automatedMu.Lock()
+	defer d.automatedMu.Unlock()
+	return d.canaryHeld[proposal{service, container, image}]
+}
+
+// failCanaries lets go of the automated changes held for canaries
+// that failed, and records them as failed, so they aren't released
+// automatically to the remaining controllers (a newer image will
+// be). Only the latest failure for each container is kept.
+func (d *Daemon) failCanaries(changes *update.Automated, logger log.Logger) {
+	d.automatedMu.Lock()
+	if d.canaryFailed == nil {
+		d.canaryFailed = map[proposal]bool{}
+	}
+	for _, change := range changes.Changes {
+		failed := proposal{change.ServiceID, change.Container.Name, change.ImageID}
+		delete(d.canaryHeld, failed)
+		for p := range d.canaryFailed {
+			if p.service == failed.service && p.container == failed.container {
+				delete(d.canaryFailed, p)
+			}
+		}
+		d.canaryFailed[failed] = true
+	}
+	var record []failedImage
+	for p := range d.canaryFailed {
+		record = append(record, failedImage{p.service, p.container, p.image})
+	}
+	d.automatedMu.Unlock()
+
+	if err := d.storeState(failedCanariesStateKey, record); err != nil {
+		logger.Log("operation", "record-failed-canaries", "err", err)
+	}
+}
+
+func (d *Daemon) failedInCanary(service flux.ResourceID, container string, image flux.ImageID) bool {
+	d.automatedMu.Lock()
+	defer d.automatedMu.Unlock()
+	return d.canaryFailed[proposal{service, container, image}]
+}
+
+// releaseAfterCanaries waits for the canaries (or the controllers in
+// an earlier stage) released in the given revision to prove
+// themselves, then queues the next stage of the release. If the
+// canaries don't become ready, or stop being ready while soaking, the
+// release is abandoned and an event is logged to say so. The pending
+// stage is recorded, so it can be picked up again after a restart,
+// until it's either queued or abandoned; if the daemon stops in the
+// meantime, it's left to be resumed.
+func (d *Daemon) releaseAfterCanaries(stop <-chan struct{}, wg *sync.WaitGroup, key string, spec update.Spec, next release.Changes, revision string, canaries []flux.ResourceID, soak time.Duration, logger log.Logger) {
+	defer wg.Done()
+	logger = log.With(logger, "canary-revision", revision)
+	started := time.Now().UTC()
+	err := d.awaitCanaries(stop, revision, canaries, soak)
+	if err == errStopped {
+		return
+	}
+	defer d.forgetStagedRelease(key, logger)
+	if err != nil {
+		logger.Log("msg", "abandoning staged release", "err", err)
+		if auto, ok := next.(*update.Automated); ok {
+			d.failCanaries(auto, logger)
+		}
+		if err := d.LogEvent(event.Event{
+			ServiceIDs: canaries,
+			Type:       event.EventCanaryFailed,
+			StartedAt:  started,
+			EndedAt:    time.Now().UTC(),
+			LogLevel:   event.LogLevelError,
+			Message:    fmt.Sprintf("Canary release in %.7s failed; not releasing to remaining controllers: %s", revision, err),
+		}); err != nil {
+			logger.Log("err", err)
+		}
+		return
+	}
+
+	if auto, ok := next.(*update.Automated); ok {
+		// Whether the next stage can be released is decided afresh
+		now := time.Now()
+		auto.Now = now
+		auto.Frozen = d.frozen()
+		auto.RecentReleases = d.recentAutomatedReleases(now)
+		d.releaseHeld(auto)
+	}
+	spec.Spec = next
+	id := d.queueJob(d.release(spec, next))
+	logger.Log("msg", "canaries are ready; releasing to next stage", "stage", stageOf(next), "job", id)
+}
+
+// A staged release waiting on its canaries, as recorded so it
+// survives a restart
+type stagedRelease struct {
+	// Spec is for the next stage
+	Spec     update.Spec
+	Revision string
+	Canaries []flux.ResourceID
+	// Held are the controllers with automated changes held back
+	Held []flux.ResourceID `json:",omitempty"`
+	Soak time.Duration
+}
+
+// An image that failed in a canary release, as recorded
+type failedImage struct {
+	Service   flux.ResourceID
+	Container string
+	Image     flux.ImageID
+}
+
+// The keys under which staged releases and failed canary images are
+// recorded
+const (
+	stagedReleasesStateKey = "staged-releases"
+	failedCanariesStateKey = "failed-canary-images"
+)
+
+// awaitNextStage records the next stage of a release, then waits for
+// the canaries in the background before queueing it.
+func (d *Daemon) awaitNextStage(stop <-chan struct{}, wg *sync.WaitGroup, key string, staged stagedRelease, next release.Changes, logger log.Logger) {
+	d.stagesMu.Lock()
+	err := d.updateStagedReleases(func(pending map[string]stagedRelease) {
+		pending[key] = staged
+	})
+	d.stagesMu.Unlock()
+	if err != nil {
+		logger.Log("operation", "record-staged-release", "err", err)
+	}
+	wg.Add(1)
+	go d.releaseAfterCanaries(stop, wg, key, staged.Spec, next, staged.Revision, staged.Canaries, staged.Soak, logger)
+}
+
+func (d *Daemon) forgetStagedRelease(key string, logger log.Logger) {
+	d.stagesMu.Lock()
+	defer d.stagesMu.Unlock()
+	if err := d.updateStagedReleases(func(pending map[string]stagedRelease) {
+		delete(pending, key)
+	}); err != nil {
+		logger.Log("operation", "forget-staged-release", "err", err)
+	}
+}
+
+// updateStagedReleases changes the record of staged releases; it
+// must be called with stagesMu held.
+func (d *Daemon) updateStagedReleases(change func(map[string]stagedRelease)) error {
+	pending := map[string]stagedRelease{}
+	if _, err := d.loadState(stagedReleasesStateKey, &pending); err != nil {
+		return err
+	}
+	change(pending)
+	return d.storeState(stagedReleasesStateKey, pending)
+}
+
+// resumeStagedReleases picks up the staged releases, and the images
+// that failed in canary releases, recorded before a restart.
+func (d *Daemon) resumeStagedReleases(stop <-chan struct{}, wg *sync.WaitGroup, logger log.Logger) {
+	var failed []failedImage
+	if _, err := d.loadState(failedCanariesStateKey, &failed); err != nil {
+		logger.Log("operation", "restore-failed-canaries", "err", err)
+	}
+	d.automatedMu.Lock()
+	for _, f := range failed {
+		if d.canaryFailed == nil {
+			d.canaryFailed = map[proposal]bool{}
+		}
+		d.canaryFailed[proposal{f.Service, f.Container, f.Image}] = true
+	}
+	d.automatedMu.Unlock()
+
+	pending := map[string]stagedRelease{}
+	d.stagesMu.Lock()
+	_, err := d.loadState(stagedReleasesStateKey, &pending)
+	d.stagesMu.Unlock()
+	if err != nil {
+		logger.Log("operation", "restore-staged-releases", "err", err)
+		return
+	}
+	for key, staged := range pending {
+		var next release.Changes
+		switch c := staged.Spec.Spec.(type) {
+		case update.ReleaseSpec:
+			next = c
+		case update.Automated:
+			next = &c
+			d.holdForCanaries(&c, staged.Held)
+		default:
+			logger.Log("operation", "restore-staged-releases", "err", fmt.Errorf("unexpected changes %T for staged release %s", c, key))
+			continue
+		}
+		staged.Spec.Spec = next
+		logger.Log("msg", "resuming staged release", "canary-revision", staged.Revision, "stage", stageOf(next))
+		wg.Add(1)
+		go d.releaseAfterCanaries(stop, wg, key, staged.Spec, next, staged.Revision, staged.Canaries, staged.Soak, logger)
+	}
+}
+
+// awaitCanaries waits for the revision to be applied to the cluster,
+// and for the canaries to become ready; then checks they stay ready
+// for the soak period. If stop is closed in the meantime, it returns
+// errStopped.
+func (d *Daemon) awaitCanaries(stop <-chan struct{}, revision string, canaries []flux.ResourceID, soak time.Duration) error {
+	pollInterval, rolloutTimeout := d.CanaryPollInterval, d.CanaryRolloutTimeout
+	if pollInterval == 0 {
+		pollInterval = defaultCanaryPollInterval
+	}
+	if rolloutTimeout == 0 {
+		rolloutTimeout = defaultCanaryRolloutTimeout
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	tick := func() error {
+		select {
+		case <-stop:
+			return errStopped
+		case <-ticker.C:
+			return nil
+		}
+	}
+
+	deadline := time.Now().Add(rolloutTimeout)
+	for {
+		pending, err := d.SyncStatus(context.Background(), revision)
+		if err == nil && len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return errors.New("timed out waiting for canary release to be applied")
+		}
+		if err := tick(); err != nil {
+			return err
+		}
+	}
+
+	for {
+		waiting, err := d.notReady(canaries)
+		if err != nil {
+			return err
+		}
+		if waiting == "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for canary to become ready: %s", waiting)
+		}
+		if err := tick(); err != nil {
+			return err
+		}
+	}
+
+	soaked := time.Now().Add(soak)
+	for time.Now().Before(soaked) {
+		if err := tick(); err != nil {
+			return err
+		}
+		waiting, err := d.notReady(canaries)
+		if err != nil {
+			return err
+		}
+		if waiting != "" {
+			return fmt.Errorf("canary stopped being ready: %s", waiting)
+		}
+	}
+	return nil
+}
+
+// notReady describes the first of the controllers that is not ready,
+// or returns an empty string if they are all ready.
+func (d *Daemon) notReady(ids []flux.ResourceID) (string, error) {
+	controllers, err := d.Cluster.SomeControllers(ids)
+	if err != nil {
+		return "", errors.Wrap(err, "checking canaries")
+	}
+	statuses := map[flux.ResourceID]string{}
+	for _, c := range controllers {
+		statuses[c.ID] = c.Status
+	}
+	for _, id := range ids {
+		status, ok := statuses[id]
+		if !ok {
+			return fmt.Sprintf("%s not found in cluster", id), nil
+		}
+		if status != cluster.StatusReady {
+			return fmt.Sprintf("%s has status %q", id, status), nil
+		}
+	}
+	return "", nil
+}
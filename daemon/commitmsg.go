@@ -0,0 +1,122 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+
+	"github.com/weaveworks/flux"
+	"github.com/weaveworks/flux/job"
+	"github.com/weaveworks/flux/update"
+)
+
+// Trailers added to commit messages, when asked for
+const (
+	jobIDTrailer  = "Flux-Job-ID"
+	ticketTrailer = "Flux-Ticket"
+)
+
+// CommitTemplates customise the messages of the commits fluxd makes;
+// the zero value leaves them as they are.
+type CommitTemplates struct {
+	// Messages holds a template for the message of each type of
+	// update (update.Images, update.Auto, update.Policy and
+	// update.Rollback). Where there's no template for a type, the
+	// message is as it would otherwise be.
+	Messages map[string]*template.Template
+	// If Trailers is set, messages end with a Flux-Job-ID trailer,
+	// and a Flux-Ticket trailer for each match of TicketPattern (if
+	// given) in the message supplied with the update.
+	Trailers      bool
+	TicketPattern *regexp.Regexp
+}
+
+// CommitMessageData is what commit message templates are executed
+// with.
+type CommitMessageData struct {
+	JobID job.ID
+	// Type is the type of update, e.g., "image" or "policy".
+	Type  string
+	Cause update.Cause
+	// Controllers are those changed by the update, and Images the
+	// images they were changed to use, if any.
+	Controllers []flux.ResourceID
+	Images      []flux.ImageID
+	Result      update.Result
+	// Default is the message that would be used without a template.
+	Default string
+}
+
+// ParseCommitTemplate parses a template for a commit message; see
+// CommitMessageData for what it can refer to.
+func ParseCommitTemplate(updateType, text string) (*template.Template, error) {
+	return template.New(updateType).Parse(text)
+}
+
+// commitMessage gives the message for the commit of an update,
+// according to the templates and trailers configured.
+func (d *Daemon) commitMessage(jobID job.ID, spec update.Spec, result update.Result, defaultMsg string) (string, error) {
+	msg := defaultMsg
+	if tmpl, ok := d.CommitTemplates.Messages[spec.Type]; ok {
+		controllers := succeeded(result)
+		flux.ResourceIDs(controllers).Sort()
+		data := CommitMessageData{
+			JobID:       jobID,
+			Type:        spec.Type,
+			Cause:       spec.Cause,
+			Controllers: controllers,
+			Images:      releasedImages(result),
+			Result:      result,
+			Default:     defaultMsg,
+		}
+		buf := &bytes.Buffer{}
+		if err := tmpl.Execute(buf, data); err != nil {
+			return "", errors.Wrapf(err, "executing commit template for %s", spec.Type)
+		}
+		msg = buf.String()
+	}
+	if !d.CommitTemplates.Trailers {
+		return msg, nil
+	}
+
+	trailers := []string{fmt.Sprintf("%s: %s", jobIDTrailer, jobID)}
+	if d.CommitTemplates.TicketPattern != nil {
+		seen := map[string]bool{}
+		for _, ticket := range d.CommitTemplates.TicketPattern.FindAllString(spec.Cause.Message, -1) {
+			if !seen[ticket] {
+				seen[ticket] = true
+				trailers = append(trailers, fmt.Sprintf("%s: %s", ticketTrailer, ticket))
+			}
+		}
+	}
+	return strings.TrimRight(msg, "\n") + "\n\n" + strings.Join(trailers, "\n") + "\n", nil
+}
+
+// releasedImages gives the images that controllers were successfully
+// updated to use.
+func releasedImages(result update.Result) []flux.ImageID {
+	seen := map[string]flux.ImageID{}
+	for _, r := range result {
+		if r.Status != update.ReleaseStatusSuccess {
+			continue
+		}
+		for _, u := range r.PerContainer {
+			seen[u.Target.String()] = u.Target
+		}
+	}
+	var keys []string
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	images := make([]flux.ImageID, len(keys))
+	for i, k := range keys {
+		images[i] = seen[k]
+	}
+	return images
+}
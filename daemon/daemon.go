@@ -5,14 +5,17 @@ import (
 	"context"
 	"fmt"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 
 	"github.com/weaveworks/flux"
+	"github.com/weaveworks/flux/approval"
 	"github.com/weaveworks/flux/cluster"
 	"github.com/weaveworks/flux/event"
+	"github.com/weaveworks/flux/forge"
 	"github.com/weaveworks/flux/git"
 	"github.com/weaveworks/flux/guid"
 	"github.com/weaveworks/flux/job"
@@ -20,6 +23,8 @@ import (
 	"github.com/weaveworks/flux/registry"
 	"github.com/weaveworks/flux/release"
 	"github.com/weaveworks/flux/remote"
+	"github.com/weaveworks/flux/ssh"
+	fluxsync "github.com/weaveworks/flux/sync"
 	"github.com/weaveworks/flux/update"
 )
 
@@ -30,6 +35,16 @@ const (
 	// a (generous) threshold for considering a job stuck and
 	// abandoning it
 	defaultJobTimeout = 60 * time.Second
+	// Branches for pull requests are named with this, then the job ID
+	pullRequestBranchPrefix = "flux/"
+	// How many times to rebase and push again when someone else has
+	// pushed to the branch first, and how long to wait before the
+	// first retry (doubling thereafter).
+	maxPushRetries   = 3
+	pushRetryBackoff = 500 * time.Millisecond
+	// How many times to redo a job from scratch when its commit can't
+	// be rebased on upstream.
+	maxJobRecomputes = 2
 )
 
 // Combine these things to form Devasta^Wan implementation of
@@ -44,7 +59,32 @@ type Daemon struct {
 	Jobs           *job.Queue
 	JobStatusCache *job.StatusCache
 	EventWriter    event.EventWriter
-	Logger         log.Logger
+	// If Forge is set, changes are proposed as pull requests rather
+	// than pushed directly to the branch.
+	Forge forge.Client
+	// If Gate is set, the updates in releases must be approved by it
+	// before they are committed.
+	Gate approval.Gate
+	// SyncState records the revision last synced; if not set, it's
+	// the sync tag in the repo.
+	SyncState fluxsync.State
+	// StateStore keeps what has been changed through the API and
+	// should outlast fluxd, e.g., a freeze on automated releases; if
+	// not set, freezing isn't allowed, and the rest is forgotten on
+	// restart.
+	StateStore StateStore
+	// CommitTemplates customise the messages of commits.
+	CommitTemplates CommitTemplates
+	// CommitURLTemplate, if given, is the URL of a commit, with
+	// "{revision}" standing for the commit's revision; e.g., to link
+	// to commits from sync events.
+	CommitURLTemplate string
+	// If ReadOnly is set, nothing is committed or pushed to the
+	// repo: updates that would need to are refused, and automated
+	// releases and lock expiry don't happen. SyncState must then be
+	// something other than the sync tag.
+	ReadOnly bool
+	Logger   log.Logger
 	// bookkeeping
 	*LoopVars
 }
@@ -81,9 +121,13 @@ func (d *Daemon) ListServices(ctx context.Context, namespace string) ([]flux.Con
 	var res []flux.ControllerStatus
 	for _, service := range clusterServices {
 		policies := services[service.ID]
+		containers := containers2containers(service.ContainersOrNil())
+		for i := range containers {
+			containers[i].Policies = policies.ForContainer(containers[i].Name).ToStringMap()
+		}
 		res = append(res, flux.ControllerStatus{
 			ID:         service.ID,
-			Containers: containers2containers(service.ContainersOrNil()),
+			Containers: containers,
 			Status:     service.Status,
 			Automated:  policies.Contains(policy.Automated),
 			Locked:     policies.Contains(policy.Locked),
@@ -99,15 +143,28 @@ func (d *Daemon) ListServices(ctx context.Context, namespace string) ([]flux.Con
 func (d *Daemon) ListImages(ctx context.Context, spec update.ResourceSpec) ([]flux.ImageStatus, error) {
 	var services []cluster.Controller
 	var err error
-	if spec == update.ResourceSpecAll {
+	switch {
+	case spec == update.ResourceSpecAll:
 		services, err = d.Cluster.AllControllers("")
-	} else {
+	case spec.IsSelection():
+		var ids []flux.ResourceID
+		d.Checkout.RLock()
+		ids, err = d.selectControllers(d.Checkout.ManifestDir(), spec)
+		d.Checkout.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		services, err = d.Cluster.SomeControllers(ids)
+	default:
 		id, err := spec.AsID()
 		if err != nil {
 			return nil, errors.Wrap(err, "treating service spec as ID")
 		}
 		services, err = d.Cluster.SomeControllers([]flux.ResourceID{id})
 	}
+	if err != nil {
+		return nil, errors.Wrap(err, "getting controllers from cluster")
+	}
 
 	images, err := update.CollectAvailableImages(d.Registry, services, d.Logger)
 	if err != nil {
@@ -128,9 +185,18 @@ func (d *Daemon) ListImages(ctx context.Context, spec update.ResourceSpec) ([]fl
 
 // Let's use the CommitEventMetadata as a convenient transport for the
 // results of a job; if no commit was made (e.g., if it was a dry
-// run), leave the revision field empty.
+// run), leave the revision field empty. If committing fails, return
+// the metadata along with the error, so that the push retries made
+// are counted.
 type DaemonJobFunc func(ctx context.Context, jobID job.ID, working *git.Checkout, logger log.Logger) (*event.CommitEventMetadata, error)
 
+func pushRetries(metadata *event.CommitEventMetadata) int {
+	if metadata == nil {
+		return 0
+	}
+	return metadata.PushRetries
+}
+
 // Must cancel the context once this job is complete
 func (d *Daemon) queueJob(do DaemonJobFunc) job.ID {
 	id := job.ID(guid.New())
@@ -150,14 +216,55 @@ func (d *Daemon) queueJob(do DaemonJobFunc) job.ID {
 				d.JobStatusCache.SetStatus(id, job.Status{StatusString: job.StatusFailed, Err: err.Error()})
 				return err
 			}
-			defer working.Clean()
+			// (working may be replaced below, so clean up whichever
+			// it is at the end)
+			defer func() {
+				if working != nil {
+					working.Clean()
+				}
+			}()
 			metadata, err := do(ctx, id, working, logger)
+			retries := pushRetries(metadata)
+			// If the commit conflicted with what someone else
+			// pushed, the update must be worked out again from the
+			// new state of the branch. Each time the job is redone
+			// counts as a retry, as well as the retries within it.
+			recomputed := false
+			for recomputes := 1; git.IsRebaseConflict(err) && recomputes <= maxJobRecomputes; recomputes++ {
+				logger.Log("info", "commit conflicts with upstream; redoing job", "attempt", recomputes)
+				if err = d.Checkout.Pull(ctx); err != nil {
+					break
+				}
+				working.Clean()
+				if working, err = d.Checkout.WorkingClone(ctx); err != nil {
+					break
+				}
+				metadata, err = do(ctx, id, working, logger)
+				retries += 1 + pushRetries(metadata)
+				recomputed = true
+			}
+			if recomputed && err == git.ErrNoChanges && metadata != nil {
+				// Whatever conflicted already made the same
+				// change, so there's nothing left to commit.
+				logger.Log("info", "change already made upstream; nothing to commit")
+				metadata.Revision, metadata.PullRequest, err = "", "", nil
+			}
+			if metadata != nil {
+				metadata.PushRetries = retries
+			}
 			if err != nil {
 				d.JobStatusCache.SetStatus(id, job.Status{StatusString: job.StatusFailed, Err: err.Error()})
 				return err
 			}
 			d.JobStatusCache.SetStatus(id, job.Status{StatusString: job.StatusSucceeded, Result: *metadata})
 			logger.Log("revision", metadata.Revision)
+			if metadata.PullRequest != "" {
+				// Nothing has happened yet, as far as the branch
+				// we're syncing is concerned; the commit will be
+				// seen by the sync once it's merged.
+				logger.Log("pullrequest", metadata.PullRequest)
+				return nil
+			}
 			if metadata.Revision != "" {
 				var serviceIDs []flux.ResourceID
 				for id, result := range metadata.Result {
@@ -188,11 +295,30 @@ func (d *Daemon) UpdateManifests(ctx context.Context, spec update.Spec) (job.ID,
 	if spec.Type == "" {
 		return id, errors.New("no type in update spec")
 	}
+	if d.ReadOnly && writesToRepo(spec) {
+		return id, ErrReadOnly
+	}
 	switch s := spec.Spec.(type) {
 	case release.Changes:
 		return d.queueJob(d.release(spec, s)), nil
 	case policy.Updates:
+		for _, u := range s {
+			if err := u.Add.CheckContainerPolicies(); err != nil {
+				return id, err
+			}
+		}
 		return d.queueJob(d.updatePolicy(spec, s)), nil
+	case update.FreezeSpec:
+		return d.updateFreeze(ctx, spec, s)
+	case update.RollbackSpec:
+		return d.queueJob(d.rollback(spec, s)), nil
+	case update.PolicyUpdatesBySpec:
+		for _, u := range s {
+			if err := u.Add.CheckContainerPolicies(); err != nil {
+				return id, err
+			}
+		}
+		return d.queueJob(d.updatePoliciesBySpec(spec, s)), nil
 	default:
 		return id, fmt.Errorf(`unknown update type "%s"`, spec.Type)
 	}
@@ -250,6 +376,20 @@ func (d *Daemon) updatePolicy(spec update.Spec, updates policy.Updates) DaemonJo
 				return nil, err
 			}
 		}
+
+		overridden, err := d.overrideInheritedPolicies(working.ManifestDir(), updates)
+		if err != nil {
+			return nil, err
+		}
+		for _, serviceID := range overridden {
+			if metadata.Result[serviceID].Status != update.ReleaseStatusSuccess {
+				serviceIDs = append(serviceIDs, serviceID)
+			}
+			metadata.Result[serviceID] = update.ControllerResult{
+				Status: update.ReleaseStatusSuccess,
+			}
+		}
+
 		if len(serviceIDs) == 0 {
 			return metadata, nil
 		}
@@ -258,66 +398,270 @@ func (d *Daemon) updatePolicy(spec update.Spec, updates policy.Updates) DaemonJo
 		if d.Checkout.Config.SetAuthor {
 			commitAuthor = spec.Cause.User
 		}
-		commitAction := &git.CommitAction{Author: commitAuthor, Message: policyCommitMessage(updates, spec.Cause)}
-		if err := working.CommitAndPush(ctx, commitAction, &git.Note{JobID: jobID, Spec: spec}); err != nil {
-			// On the chance pushing failed because it was not
-			// possible to fast-forward, ask for a sync so the
-			// next attempt is more likely to succeed.
-			d.askForSync()
+		commitMsg, err := d.commitMessage(jobID, spec, metadata.Result, policyCommitMessage(updates, spec.Cause))
+		if err != nil {
 			return nil, err
 		}
-		if anythingAutomated {
+		commitAction := &git.CommitAction{Author: commitAuthor, Message: commitMsg}
+		metadata.Revision, metadata.PullRequest, metadata.PushRetries, err = d.commitAndPush(ctx, working, commitAction, &git.Note{JobID: jobID, Spec: spec})
+		if err != nil {
+			return metadata, err
+		}
+		if anythingAutomated && metadata.PullRequest == "" {
 			d.askForImagePoll()
 		}
+		return metadata, nil
+	}
+}
+
+// overrideInheritedPolicies switches off, explicitly, any boolean
+// policies removed from controllers that are still in effect because
+// they are inherited from the namespace. It returns the controllers
+// that were changed.
+func (d *Daemon) overrideInheritedPolicies(dir string, updates policy.Updates) ([]flux.ResourceID, error) {
+	var removing bool
+	for _, u := range updates {
+		for p := range u.Remove {
+			removing = removing || policy.Boolean(p)
+		}
+	}
+	if !removing {
+		return nil, nil
+	}
 
-		var err error
-		metadata.Revision, err = working.HeadRevision(ctx)
-		if err != nil {
+	services, err := d.Manifests.ServicesWithPolicies(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting service policies")
+	}
+	var overridden []flux.ResourceID
+	for serviceID, u := range updates {
+		if _, kind, _ := serviceID.Components(); kind == "namespace" {
+			continue
+		}
+		off := policy.Set{}
+		for p := range u.Remove {
+			if policy.Boolean(p) && services[serviceID].Contains(p) {
+				off = off.Set(p, "false")
+			}
+		}
+		if len(off) == 0 {
+			continue
+		}
+		if err := cluster.UpdateManifest(d.Manifests, dir, serviceID, func(def []byte) ([]byte, error) {
+			return d.Manifests.UpdatePolicies(def, policy.Update{Add: off})
+		}); err != nil {
 			return nil, err
 		}
-		return metadata, nil
+		overridden = append(overridden, serviceID)
 	}
+	return overridden, nil
 }
 
 func (d *Daemon) release(spec update.Spec, c release.Changes) DaemonJobFunc {
 	return func(ctx context.Context, jobID job.ID, working *git.Checkout, logger log.Logger) (*event.CommitEventMetadata, error) {
+		// The job may be redone, so start from the changes as given
+		// each time.
+		c, spec := c, spec
+		// Patterns and label selectors are resolved against the
+		// manifests as they are now; the spec recorded in the note is
+		// left as it was given.
+		if rs, ok := c.(update.ReleaseSpec); ok {
+			expanded, err := d.expandReleaseSpec(working.ManifestDir(), rs)
+			if err != nil {
+				return nil, err
+			}
+			c = expanded
+		}
+
 		rc := release.NewReleaseContext(d.Cluster, d.Manifests, d.Registry, working)
-		result, err := release.Release(rc, c, logger)
-		if err != nil {
-			return nil, err
+		if d.Gate != nil {
+			rc.RequireApproval(d.Gate, spec.Cause)
 		}
 
-		var revision string
+		// Staged releases don't make sense when changes are proposed
+		// rather than applied.
+		var stage, next release.Changes
+		var soak time.Duration
+		if d.Forge == nil {
+			var err error
+			if stage, next, soak, err = d.stageRelease(c, working); err != nil {
+				return nil, err
+			}
+		}
+
+		var result update.Result
+		var canaryIDs []flux.ResourceID
+		var err error
+		if stage != nil {
+			for {
+				result, err = release.Release(rc, stage, logger)
+				if err != nil {
+					return nil, err
+				}
+				canaryIDs = succeeded(result)
+				if _, byNamespace := stageOf(stage).Namespace(); len(canaryIDs) > 0 || next == nil || !byNamespace {
+					break
+				}
+				// Nothing to release to in this namespace, so go
+				// straight on to the next
+				if stage, next, soak, err = d.stageRelease(next, working); err != nil {
+					return nil, err
+				}
+			}
+			if len(canaryIDs) == 0 && stageOf(stage) == update.StageCanaries {
+				// No canaries to release to; release to
+				// everything at once
+				result = nil
+			} else {
+				c, spec.Spec = stage, stage
+			}
+			if len(canaryIDs) == 0 || len(awaitingCanary(result)) == 0 {
+				// Nothing to stage; either nothing has been
+				// changed, or there's nothing to release after.
+				next = nil
+			}
+		}
+		if result == nil {
+			result, err = release.Release(rc, c, logger)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var revision, pullRequest string
+		var retries int
 		if c.ReleaseKind() == update.ReleaseKindExecute {
-			commitMsg := spec.Cause.Message
-			if commitMsg == "" {
-				commitMsg = c.CommitMessage()
+			d.logRejections(result, logger)
+			if auto, ok := c.(*update.Automated); ok {
+				d.recordRejectedImages(auto, result)
+			}
+			if len(succeeded(result)) == 0 {
+				// Nothing was changed, so there's nothing to
+				// commit; the results say why.
+				return &event.CommitEventMetadata{
+					Spec:   &spec,
+					Result: result,
+				}, nil
+			}
+			defaultMsg := spec.Cause.Message
+			if defaultMsg == "" {
+				defaultMsg = c.CommitMessage()
+			}
+			commitMsg, err := d.commitMessage(jobID, spec, result, defaultMsg)
+			if err != nil {
+				return nil, err
 			}
 			commitAuthor := ""
 			if d.Checkout.Config.SetAuthor {
 				commitAuthor = spec.Cause.User
 			}
 			commitAction := &git.CommitAction{Author: commitAuthor, Message: commitMsg}
-			if err := working.CommitAndPush(ctx, commitAction, &git.Note{JobID: jobID, Spec: spec, Result: result}); err != nil {
-				// On the chance pushing failed because it was not
-				// possible to fast-forward, ask for a sync so the
-				// next attempt is more likely to succeed.
-				d.askForSync()
-				return nil, err
-			}
-			revision, err = working.HeadRevision(ctx)
+			revision, pullRequest, retries, err = d.commitAndPush(ctx, working, commitAction, &git.Note{JobID: jobID, Spec: spec, Result: result})
 			if err != nil {
-				return nil, err
+				return &event.CommitEventMetadata{
+					Spec:        &spec,
+					Result:      result,
+					PushRetries: retries,
+				}, err
+			}
+			if auto, ok := c.(*update.Automated); ok {
+				d.recordAutomatedRelease(result, time.Now(), logger)
+				if pullRequest != "" {
+					d.recordProposedImages(auto, result)
+				}
+				if next != nil {
+					d.holdForCanaries(auto, awaitingCanary(result))
+				}
+			}
+			if next != nil {
+				nextSpec := spec
+				nextSpec.Spec = next
+				d.awaitNextStage(d.loopStop, d.loopWG, string(jobID), stagedRelease{
+					Spec:     nextSpec,
+					Revision: revision,
+					Canaries: canaryIDs,
+					Held:     awaitingCanary(result),
+					Soak:     soak,
+				}, next, logger)
 			}
 		}
 		return &event.CommitEventMetadata{
-			Revision: revision,
-			Spec:     &spec,
-			Result:   result,
+			Revision:    revision,
+			Spec:        &spec,
+			Result:      result,
+			PullRequest: pullRequest,
+			PushRetries: retries,
 		}, nil
 	}
 }
 
+// commitAndPush commits the changes in the working clone, and either
+// pushes them to the branch, or if there's a forge to use, pushes
+// them to a new branch and opens a pull request. It returns the
+// revision of the commit, the URL of the pull request if there is
+// one, and the number of times pushing was retried.
+func (d *Daemon) commitAndPush(ctx context.Context, working *git.Checkout, commitAction *git.CommitAction, note *git.Note) (string, string, int, error) {
+	if d.Forge == nil {
+		retries, err := d.pushWithRetries(ctx, working, func() error {
+			return working.CommitAndPush(ctx, commitAction, note)
+		})
+		if err != nil {
+			// Whatever went wrong, it's likely the next attempt
+			// will need to see the latest commits.
+			d.askForSync()
+			return "", "", retries, err
+		}
+		revision, err := working.HeadRevision(ctx)
+		return revision, "", retries, err
+	}
+
+	branch := pullRequestBranchPrefix + string(note.JobID)
+	note.Branch = branch
+	if err := working.CommitAndPushBranch(ctx, commitAction, note, branch); err != nil {
+		return "", "", 0, err
+	}
+	revision, err := working.HeadRevision(ctx)
+	if err != nil {
+		return "", "", 0, err
+	}
+	title := strings.SplitN(commitAction.Message, "\n", 2)[0]
+	url, err := d.Forge.OpenPullRequest(ctx, forge.PullRequest{
+		Title: title,
+		Body:  fmt.Sprintf("%s\n\nProposed by flux (job %s).", commitAction.Message, note.JobID),
+		Head:  branch,
+		Base:  working.Branch(),
+	})
+	if err != nil {
+		return "", "", 0, errors.Wrapf(err, "opening pull request for branch %s", branch)
+	}
+	d.recordPullRequest(note.JobID, url)
+	return revision, url, 0, nil
+}
+
+// pushWithRetries calls push, and if that fails because someone else
+// pushed to the branch in the meantime, rebases the working clone and
+// pushes again, backing off between attempts. It returns the number
+// of retries. If the rebase conflicts, the error says so (see
+// git.IsRebaseConflict), so the job can be redone.
+func (d *Daemon) pushWithRetries(ctx context.Context, working *git.Checkout, push func() error) (int, error) {
+	err := push()
+	backoff := pushRetryBackoff
+	retries := 0
+	for ; git.IsNonFastForward(err) && retries < maxPushRetries; retries++ {
+		select {
+		case <-ctx.Done():
+			return retries, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if err = working.Rebase(ctx); err != nil {
+			return retries + 1, err
+		}
+		err = working.Push(ctx)
+	}
+	return retries, err
+}
+
 // Tell the daemon to synchronise the cluster with the manifests in
 // the git repo. This has an error return value because upstream there
 // may be comms difficulties or other sources of problems; here, we
@@ -364,6 +708,12 @@ func (d *Daemon) JobStatus(ctx context.Context, jobID job.ID) (job.Status, error
 		}
 	}
 
+	// A job that opened a pull request won't have a commit on the
+	// branch until the pull request is merged
+	if status, ok := d.pullRequestStatus(jobID); ok {
+		return status, nil
+	}
+
 	return job.Status{}, unknownJobError(jobID)
 }
 
@@ -373,7 +723,17 @@ func (d *Daemon) JobStatus(ctx context.Context, jobID job.ID) (job.Status, error
 // you'll get all the commits yet to be applied. If you send a hash
 // and it's applied _past_ it, you'll get an empty list.
 func (d *Daemon) SyncStatus(ctx context.Context, commitRef string) ([]string, error) {
-	commits, err := d.Checkout.CommitsBetween(ctx, d.Checkout.SyncTag, commitRef)
+	syncedRev, err := d.syncState().GetRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var commits []git.Commit
+	if syncedRev == "" {
+		// Nothing has been synced yet
+		commits, err = d.Checkout.CommitsBefore(ctx, commitRef)
+	} else {
+		commits, err = d.Checkout.CommitsBetween(ctx, syncedRev, commitRef)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -386,14 +746,34 @@ func (d *Daemon) SyncStatus(ctx context.Context, commitRef string) ([]string, er
 	return revs, nil
 }
 
+// syncState gives where the revision last synced is recorded.
+func (d *Daemon) syncState() fluxsync.State {
+	if d.SyncState != nil {
+		return d.SyncState
+	}
+	return git.TagSyncState{Checkout: d.Checkout}
+}
+
 func (d *Daemon) GitRepoConfig(ctx context.Context, regenerate bool) (flux.GitConfig, error) {
 	publicSSHKey, err := d.Cluster.PublicSSHKey(regenerate)
 	if err != nil {
 		return flux.GitConfig{}, err
 	}
+	gitRemote := d.Repo.GitRemoteConfig
+	gitRemote.URL = git.RedactURL(gitRemote.URL)
+	var knownHosts []ssh.KnownHost
+	if d.Repo.KnownHosts != "" {
+		// Read afresh, so that changes to the file are reflected
+		knownHosts, err = ssh.ReadKnownHosts(d.Repo.KnownHosts)
+		if err != nil {
+			return flux.GitConfig{}, err
+		}
+	}
 	return flux.GitConfig{
-		Remote:       d.Repo.GitRemoteConfig,
+		Remote:       gitRemote,
 		PublicSSHKey: publicSSHKey,
+		Auth:         d.Repo.AuthMode(),
+		KnownHosts:   knownHosts,
 	}, nil
 }
 
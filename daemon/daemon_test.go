@@ -3,12 +3,19 @@ package daemon
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
 	"testing"
+	"text/template"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -19,12 +26,14 @@ import (
 	kresource "github.com/weaveworks/flux/cluster/kubernetes/resource"
 	"github.com/weaveworks/flux/cluster/kubernetes/testfiles"
 	"github.com/weaveworks/flux/event"
+	"github.com/weaveworks/flux/forge"
 	"github.com/weaveworks/flux/git"
 	"github.com/weaveworks/flux/git/gittest"
 	"github.com/weaveworks/flux/job"
 	"github.com/weaveworks/flux/policy"
 	"github.com/weaveworks/flux/registry"
 	"github.com/weaveworks/flux/resource"
+	"github.com/weaveworks/flux/service/integrations/github"
 	"github.com/weaveworks/flux/update"
 )
 
@@ -251,6 +260,66 @@ func TestDaemon_Release(t *testing.T) {
 
 }
 
+// When I release an image that's already running, I expect the job
+// to succeed without committing anything
+func TestDaemon_ReleaseNothingToDo(t *testing.T) {
+	d, clean, _, _ := mockDaemon(t)
+	defer clean()
+	w := newWait(t)
+
+	ctx := context.Background()
+	id := updateManifest(ctx, t, d, update.Spec{
+		Type: update.Images,
+		Spec: update.ReleaseSpec{
+			Kind:         update.ReleaseKindExecute,
+			ServiceSpecs: []update.ResourceSpec{update.ResourceSpecAll},
+			ImageSpec:    currentHelloImage,
+		},
+	})
+	stat := w.ForJobSucceeded(d, id)
+	if stat.Result.Revision != "" {
+		t.Errorf("expected no revision for a release with nothing to do, got %q", stat.Result.Revision)
+	}
+	if len(stat.Result.Result) == 0 {
+		t.Error("expected results saying why nothing was released")
+	}
+	for id, r := range stat.Result.Result {
+		if r.Status == update.ReleaseStatusSuccess {
+			t.Errorf("expected nothing released, but %s was", id)
+		}
+	}
+}
+
+// When a job's commit conflicts, and redoing it finds the change has
+// already been made, I expect it to succeed without a revision, and
+// to count all the retries
+func TestDaemon_JobRecomputedToNoChanges(t *testing.T) {
+	d, clean, _, _ := mockDaemon(t)
+	defer clean()
+	w := newWait(t)
+
+	attempts := 0
+	id := d.queueJob(func(ctx context.Context, jobID job.ID, working *git.Checkout, logger log.Logger) (*event.CommitEventMetadata, error) {
+		attempts++
+		if attempts == 1 {
+			return &event.CommitEventMetadata{PushRetries: 2}, git.ErrRebaseConflict
+		}
+		return &event.CommitEventMetadata{PushRetries: 1}, git.ErrNoChanges
+	})
+	stat := w.ForJobSucceeded(d, id)
+	if attempts != 2 {
+		t.Errorf("expected job to be done twice, but it was done %d time(s)", attempts)
+	}
+	if stat.Result.Revision != "" {
+		t.Errorf("expected no revision, got %q", stat.Result.Revision)
+	}
+	// two in the first attempt, one for redoing it, and one in the
+	// second attempt
+	if stat.Result.PushRetries != 4 {
+		t.Errorf("expected 4 push retries, got %d", stat.Result.PushRetries)
+	}
+}
+
 // When I update a policy, I expect it to add to the queue
 // When I update a policy, it should add an annotation to the manifest
 func TestDaemon_PolicyUpdate(t *testing.T) {
@@ -277,6 +346,382 @@ func TestDaemon_PolicyUpdate(t *testing.T) {
 	}, "Waiting for new annotation")
 }
 
+// Policy updates given by pattern should apply to the controllers
+// matching it, and only those
+func TestDaemon_PolicyUpdateBySpec(t *testing.T) {
+	d, clean, _, _ := mockDaemon(t)
+	defer clean()
+	w := newWait(t)
+
+	ctx := context.Background()
+	id := updateManifest(ctx, t, d, update.Spec{
+		Type: update.PolicyBySpec,
+		Spec: update.PolicyUpdatesBySpec{
+			"default:deployment/hello*": {
+				Add: policy.Set{}.Add(policy.Automated),
+			},
+		},
+	})
+	w.ForJobSucceeded(d, id)
+
+	if err := d.Checkout.Pull(ctx); err != nil {
+		t.Fatal(err)
+	}
+	d.Checkout.RLock()
+	m, err := d.Manifests.LoadManifests(d.Checkout.ManifestDir())
+	d.Checkout.RUnlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for resID, res := range m {
+		automated := res.Policy().Contains(policy.Automated)
+		if resID == svc && !automated {
+			t.Errorf("expected %s to be automated", resID)
+		}
+		if resID != svc && automated {
+			t.Errorf("did not expect %s to be automated", resID)
+		}
+	}
+
+	// A pattern matching nothing is an error, rather than a no-op
+	id = updateManifest(ctx, t, d, update.Spec{
+		Type: update.PolicyBySpec,
+		Spec: update.PolicyUpdatesBySpec{
+			"default:deployment/nothing-*": {
+				Add: policy.Set{}.Add(policy.Automated),
+			},
+		},
+	})
+	w.Eventually(func() bool {
+		stat, _ := d.JobStatus(ctx, id)
+		return stat.StatusString == job.StatusFailed
+	}, "Waiting for job to fail")
+}
+
+// When a lock has expired, the daemon should unlock the controller
+func TestDaemon_UnlockExpired(t *testing.T) {
+	d, clean, _, _ := mockDaemon(t)
+	defer clean()
+	w := newWait(t)
+
+	// The lock runs out later than the daemon will look for expired
+	// locks of its own accord, so only the unlock below happens
+	ctx := context.Background()
+	expiry := time.Now().Add(time.Hour).UTC()
+	id := updateManifest(ctx, t, d, update.Spec{
+		Type: update.Policy,
+		Spec: policy.Updates{
+			flux.MustParseResourceID(svc): {
+				Add: policy.Set{
+					policy.Locked:      "true",
+					policy.LockedUntil: expiry.Format(time.RFC3339),
+				},
+			},
+		},
+	})
+	w.ForJobSucceeded(d, id)
+
+	locked := func() bool {
+		if err := d.Checkout.Pull(ctx); err != nil {
+			t.Fatal(err)
+		}
+		d.Checkout.RLock()
+		defer d.Checkout.RUnlock()
+		services, err := d.Manifests.ServicesWithPolicies(d.Checkout.ManifestDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return services[flux.MustParseResourceID(svc)].Contains(policy.Locked)
+	}
+	if !locked() {
+		t.Fatal("expected controller to be locked")
+	}
+
+	later := expiry.Add(time.Minute)
+	id, err := d.unlockExpired(later, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == "" {
+		t.Fatal("expected a job to unlock the controller")
+	}
+	// The unlock is under way, so it isn't queued again
+	again, err := d.unlockExpired(later, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != "" {
+		t.Fatal("expected the unlock not to be queued again")
+	}
+	w.ForJobSucceeded(d, id)
+	w.Eventually(func() bool { return !locked() }, "Waiting for lock to be removed")
+}
+
+// When a lock given as a default for a namespace has expired, the
+// daemon should unlock the namespace, rather than override the lock
+// on each controller
+func TestDaemon_UnlockExpiredNamespace(t *testing.T) {
+	d, clean, _, _ := mockDaemon(t)
+	defer clean()
+	w := newWait(t)
+
+	ctx := context.Background()
+	working, err := d.Checkout.WorkingClone(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer working.Clean()
+	namespace := "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: " + ns + "\n"
+	path := filepath.Join(working.ManifestDir(), "namespace.yaml")
+	if err := ioutil.WriteFile(path, []byte(namespace), 0666); err != nil {
+		t.Fatal(err)
+	}
+	// Commits only include files already known to git
+	if out, err := exec.Command("git", "-C", working.Dir, "add", path).CombinedOutput(); err != nil {
+		t.Fatal(err, string(out))
+	}
+	if err := working.CommitAndPush(ctx, &git.CommitAction{Message: "Add namespace"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Checkout.Pull(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	expiry := time.Now().Add(time.Hour).UTC()
+	id := updateManifest(ctx, t, d, update.Spec{
+		Type: update.Policy,
+		Spec: policy.Updates{
+			cluster.NamespaceID(ns): {
+				Add: policy.Set{
+					policy.Locked:      "true",
+					policy.LockedUntil: expiry.Format(time.RFC3339),
+				},
+			},
+		},
+	})
+	w.ForJobSucceeded(d, id)
+
+	// gives whether the controller is locked, and its own policies
+	locked := func() (bool, policy.Set) {
+		if err := d.Checkout.Pull(ctx); err != nil {
+			t.Fatal(err)
+		}
+		d.Checkout.RLock()
+		defer d.Checkout.RUnlock()
+		services, err := d.Manifests.ServicesWithPolicies(d.Checkout.ManifestDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resources, err := d.Manifests.LoadManifests(d.Checkout.ManifestDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return services[flux.MustParseResourceID(svc)].Contains(policy.Locked), resources[svc].Policy()
+	}
+	if ok, _ := locked(); !ok {
+		t.Fatal("expected controller to inherit the namespace's lock")
+	}
+
+	id, err = d.unlockExpired(expiry.Add(time.Minute), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == "" {
+		t.Fatal("expected a job to unlock the namespace")
+	}
+	w.ForJobSucceeded(d, id)
+	w.Eventually(func() bool { ok, _ := locked(); return !ok }, "Waiting for lock to be removed")
+	if _, own := locked(); own.Contains(policy.Locked) {
+		t.Errorf("expected the controller's own policies to be left alone, got %v", own)
+	}
+}
+
+// A proposed image update is forgotten once the image is in the
+// checkout, however the pull request was merged
+func TestDaemon_PruneProposedImages(t *testing.T) {
+	d, clean, _, _ := mockDaemon(t)
+	defer clean()
+
+	id := flux.MustParseResourceID(svc)
+	current, latest := mustParseImageID(t, currentHelloImage), mustParseImageID(t, newHelloImage)
+	d.proposedImages = map[proposal]bool{
+		proposal{id, container, current}: true,
+		proposal{id, container, latest}:  true,
+	}
+	d.pruneProposedImages(log.NewNopLogger())
+	if d.alreadyProposed(id, container, current) {
+		t.Error("expected the image in the checkout to be forgotten")
+	}
+	if !d.alreadyProposed(id, container, latest) {
+		t.Error("expected the image not in the checkout to be remembered")
+	}
+}
+
+// An image rejected by the approval gate is held back only until
+// the rejection runs its course, or the image is no longer the one
+// that would be released
+func TestDaemon_PruneRejectedImages(t *testing.T) {
+	d, clean, _, _ := mockDaemon(t)
+	defer clean()
+
+	id := flux.MustParseResourceID(svc)
+	current, latest := mustParseImageID(t, currentHelloImage), mustParseImageID(t, newHelloImage)
+	now := time.Now()
+	d.automatedMu.Lock()
+	d.rejectedImages = map[proposal]time.Time{
+		proposal{id, container, current}:      now,
+		proposal{id, container, latest}:       now,
+		proposal{id, "sidecar", latest}:       now.Add(-rejectionTTL),
+		proposal{id, "other-sidecar", latest}: now,
+	}
+	d.automatedMu.Unlock()
+	if d.rejectedImage(id, "sidecar", latest) {
+		t.Error("expected an expired rejection not to hold back the image")
+	}
+
+	d.pruneRejectedImages(map[proposal]bool{
+		proposal{id, container, latest}: true,
+		proposal{id, "sidecar", latest}: true,
+	}, now)
+	if !d.rejectedImage(id, container, latest) {
+		t.Error("expected the rejection of the candidate image to be remembered")
+	}
+	d.automatedMu.Lock()
+	defer d.automatedMu.Unlock()
+	if len(d.rejectedImages) != 1 {
+		t.Errorf("expected only the rejection of the candidate image to be kept, got %v", d.rejectedImages)
+	}
+}
+
+// When changes are proposed as pull requests, the job result and
+// status should give the URL of the pull request
+func TestDaemon_PullRequest(t *testing.T) {
+	const url = "https://github.com/weaveworks/flux-example/pull/1"
+	var opened forge.PullRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var pr struct {
+			Head, Base string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&pr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opened.Head, opened.Base = pr.Head, pr.Base
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"number": 1, "html_url": "` + url + `"}`))
+	}))
+	defer server.Close()
+	prs, err := github.NewPullRequests("token", "git@github.com:weaveworks/flux-example", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, clean, _, _ := mockDaemon(t, func(d *Daemon) { d.Forge = prs })
+	defer clean()
+	w := newWait(t)
+
+	ctx := context.Background()
+	id := updatePolicy(ctx, t, d)
+	stat := w.ForJobSucceeded(d, id)
+	if stat.Result.PullRequest != url {
+		t.Errorf("expected job result to have pull request %q, got %q", url, stat.Result.PullRequest)
+	}
+	if opened.Head != pullRequestBranchPrefix+string(id) || opened.Base != "master" {
+		t.Errorf("expected pull request from %s to master, got %+v", pullRequestBranchPrefix+string(id), opened)
+	}
+
+	// Once the job has dropped out of the cache, its status still
+	// gives the pull request, since it hasn't been merged
+	d.JobStatusCache = &job.StatusCache{Size: 100}
+	stat, err = d.JobStatus(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.StatusString != job.StatusSucceeded || stat.Result.PullRequest != url {
+		t.Errorf("expected job status to be succeeded with pull request %q, got %+v", url, stat)
+	}
+}
+
+// When I roll back a release, the controller should go back to its
+// previous image, and be locked
+func TestDaemon_Rollback(t *testing.T) {
+	d, clean, _, _ := mockDaemon(t)
+	defer clean()
+	w := newWait(t)
+
+	ctx := context.Background()
+	released := w.ForJobSucceeded(d, updateImage(ctx, d, t))
+	// Make sure the release has been pulled into the daemon's checkout
+	w.ForSyncStatus(d, released.Result.Revision, 0)
+
+	id := updateManifest(ctx, t, d, update.Spec{
+		Type:  update.Rollback,
+		Cause: update.Cause{User: "test", Message: "broken"},
+		Spec: update.RollbackSpec{
+			ServiceID: flux.MustParseResourceID(svc),
+		},
+	})
+	stat := w.ForJobSucceeded(d, id)
+	result := stat.Result.Result[flux.MustParseResourceID(svc)]
+	if len(result.PerContainer) != 1 || result.PerContainer[0].Target.String() != currentHelloImage {
+		t.Fatalf("expected rollback to %s, got %#v", currentHelloImage, result)
+	}
+
+	if err := d.Checkout.Pull(ctx); err != nil {
+		t.Fatal(err)
+	}
+	d.Checkout.RLock()
+	defer d.Checkout.RUnlock()
+	services, err := d.Manifests.ServicesWithPolicies(d.Checkout.ManifestDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies := services[flux.MustParseResourceID(svc)]
+	if !policies.Contains(policy.Locked) {
+		t.Error("expected controller to be locked after rollback")
+	}
+	if msg, _ := policies.Get(policy.LockedMsg); msg != "rolled back: broken" {
+		t.Errorf("expected lock message to record the cause, got %q", msg)
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(d.Checkout.ManifestDir(), "helloworld-deploy.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(contents), currentHelloImage) {
+		t.Errorf("expected manifest to have image %s after rollback", currentHelloImage)
+	}
+}
+
+func TestDaemon_RollbackTwice(t *testing.T) {
+	d, clean, _, _ := mockDaemon(t)
+	defer clean()
+	w := newWait(t)
+
+	ctx := context.Background()
+	rollback := update.Spec{
+		Type:  update.Rollback,
+		Cause: update.Cause{User: "test"},
+		Spec: update.RollbackSpec{
+			ServiceID: flux.MustParseResourceID(svc),
+		},
+	}
+	w.ForJobSucceeded(d, updateImage(ctx, d, t))
+	if err := d.Checkout.Pull(ctx); err != nil {
+		t.Fatal(err)
+	}
+	w.ForJobSucceeded(d, updateManifest(ctx, t, d, rollback))
+	if err := d.Checkout.Pull(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rolling back a rollback goes back to the image released before
+	stat := w.ForJobSucceeded(d, updateManifest(ctx, t, d, rollback))
+	result := stat.Result.Result[flux.MustParseResourceID(svc)]
+	if len(result.PerContainer) != 1 || result.PerContainer[0].Target.String() != newHelloImage {
+		t.Fatalf("expected second rollback to %s, got %#v", newHelloImage, result)
+	}
+}
+
 // When I call sync status, it should return a commit showing the sync
 // that is about to take place. Then it should return empty once it is
 // complete
@@ -299,6 +744,45 @@ func TestDaemon_SyncStatus(t *testing.T) {
 	w.ForSyncStatus(d, stat.Result.Revision, 0)
 }
 
+// A staged release should go ahead only if the canaries become
+// ready, and stay ready
+func TestDaemon_AwaitCanaries(t *testing.T) {
+	d, clean, k8s, _ := mockDaemon(t, func(d *Daemon) {
+		d.CanaryPollInterval, d.CanaryRolloutTimeout = 10*time.Millisecond, 100*time.Millisecond
+	})
+	defer clean()
+	w := newWait(t)
+
+	ctx := context.Background()
+	id := updateImage(ctx, d, t)
+	stat := w.ForJobSucceeded(d, id)
+	w.ForSyncStatus(d, stat.Result.Revision, 0)
+
+	canaries := []flux.ResourceID{flux.MustParseResourceID(svc)}
+	withStatus := func(status string) {
+		k8s.SomeServicesFunc = func([]flux.ResourceID) ([]cluster.Controller, error) {
+			return []cluster.Controller{{ID: flux.MustParseResourceID(svc), Status: status}}, nil
+		}
+	}
+
+	withStatus(cluster.StatusUpdating)
+	if err := d.awaitCanaries(nil, stat.Result.Revision, canaries, 0); err == nil {
+		t.Error("expected error waiting for canary that is not ready")
+	}
+
+	// Waiting is cut short if the daemon is stopping
+	stop := make(chan struct{})
+	close(stop)
+	if err := d.awaitCanaries(stop, stat.Result.Revision, canaries, 0); err != errStopped {
+		t.Errorf("expected errStopped when stopping, got %v", err)
+	}
+
+	withStatus(cluster.StatusReady)
+	if err := d.awaitCanaries(nil, stat.Result.Revision, canaries, 50*time.Millisecond); err != nil {
+		t.Errorf("expected ready canary to pass, got error: %s", err)
+	}
+}
+
 // When I restart fluxd, there won't be any jobs in the cache
 func TestDaemon_JobStatusWithNoCache(t *testing.T) {
 	d, clean, _, _ := mockDaemon(t)
@@ -319,7 +803,181 @@ func TestDaemon_JobStatusWithNoCache(t *testing.T) {
 	w.ForJobSucceeded(d, id)
 }
 
-func mockDaemon(t *testing.T) (*Daemon, func(), *cluster.Mock, *mockEventWriter) {
+type mockStateStore map[string]string
+
+func (s mockStateStore) Get(_ context.Context, key string) (string, bool, error) {
+	value, ok := s[key]
+	return value, ok, nil
+}
+
+func (s mockStateStore) Set(_ context.Context, key, value string) error {
+	s[key] = value
+	return nil
+}
+
+// A freeze is refused if there's nowhere to record it, and otherwise
+// takes effect straight away
+func TestDaemon_Freeze(t *testing.T) {
+	d, clean, _, _ := mockDaemon(t)
+	defer clean()
+
+	ctx := context.Background()
+	freeze := update.Spec{
+		Type:  update.Freeze,
+		Cause: update.Cause{User: "test"},
+		Spec:  update.FreezeSpec{Frozen: true},
+	}
+	if _, err := d.UpdateManifests(ctx, freeze); err != ErrNoStateStore {
+		t.Errorf("expected ErrNoStateStore, got %v", err)
+	}
+
+	store := mockStateStore{}
+	d.StateStore = store
+	id, err := d.UpdateManifests(ctx, freeze)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := d.JobStatus(ctx, id); err != nil || stat.StatusString != job.StatusSucceeded {
+		t.Errorf("expected freeze job to have succeeded, got %+v, %v", stat, err)
+	}
+	if !d.frozen() || store[frozenStateKey] != "true" {
+		t.Errorf("expected freeze to be in effect and recorded, got frozen %v, recorded %q", d.frozen(), store[frozenStateKey])
+	}
+}
+
+// When fluxd is read-only, updates that would commit are refused, but
+// images can still be listed and releases planned
+func TestDaemon_ReadOnly(t *testing.T) {
+	d, clean, _, _ := mockDaemon(t, func(d *Daemon) { d.ReadOnly = true })
+	defer clean()
+
+	ctx := context.Background()
+	for _, spec := range []update.Spec{
+		{
+			Type: update.Images,
+			Spec: update.ReleaseSpec{
+				Kind:         update.ReleaseKindExecute,
+				ServiceSpecs: []update.ResourceSpec{update.ResourceSpecAll},
+				ImageSpec:    newHelloImage,
+			},
+		},
+		{
+			Type: update.Policy,
+			Spec: policy.Updates{
+				flux.MustParseResourceID("default:deployment/helloworld"): {
+					Add: policy.Set{policy.Locked: "true"},
+				},
+			},
+		},
+	} {
+		if _, err := d.UpdateManifests(ctx, spec); err != ErrReadOnly {
+			t.Errorf("%s: expected ErrReadOnly, got %v", spec.Type, err)
+		}
+	}
+
+	w := newWait(t)
+	w.ForJobSucceeded(d, updateManifest(ctx, t, d, update.Spec{
+		Type: update.Images,
+		Spec: update.ReleaseSpec{
+			Kind:         update.ReleaseKindPlan,
+			ServiceSpecs: []update.ResourceSpec{update.ResourceSpecAll},
+			ImageSpec:    newHelloImage,
+		},
+	}))
+
+	if _, err := d.ListImages(ctx, update.ResourceSpecAll); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDaemon_CommitMessage(t *testing.T) {
+	tmpl, err := ParseCommitTemplate(update.Images, "release({{range .Controllers}}{{.}}{{end}}): {{range .Images}}{{.}}{{end}}\n\n{{.Default}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Daemon{CommitTemplates: CommitTemplates{
+		Messages:      map[string]*template.Template{update.Images: tmpl},
+		Trailers:      true,
+		TicketPattern: regexp.MustCompile(`[A-Z]+-[0-9]+`),
+	}}
+	spec := update.Spec{
+		Type:  update.Images,
+		Cause: update.Cause{Message: "Fixes OPS-12 and OPS-7 (and OPS-12 again)"},
+	}
+	result := update.Result{
+		flux.MustParseResourceID(svc): update.ControllerResult{
+			Status: update.ReleaseStatusSuccess,
+			PerContainer: []update.ContainerUpdate{{
+				Container: container,
+				Current:   mustParseImageID(t, currentHelloImage),
+				Target:    mustParseImageID(t, newHelloImage),
+			}},
+		},
+		flux.MustParseResourceID("default:deployment/other"): update.ControllerResult{
+			Status: update.ReleaseStatusSkipped,
+		},
+	}
+
+	msg, err := d.commitMessage(job.ID("job-1"), spec, result, spec.Cause.Message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `release(default:deployment/helloworld): quay.io/weaveworks/helloworld:2
+
+Fixes OPS-12 and OPS-7 (and OPS-12 again)
+
+Flux-Job-ID: job-1
+Flux-Ticket: OPS-12
+Flux-Ticket: OPS-7
+`
+	if msg != expected {
+		t.Errorf("expected message:\n%s\ngot:\n%s", expected, msg)
+	}
+
+	// Without a template for the type, the default message is used
+	spec.Type = update.Policy
+	d.CommitTemplates.Trailers = false
+	if msg, err := d.commitMessage(job.ID("job-2"), spec, result, "Lock helloworld"); err != nil || msg != "Lock helloworld" {
+		t.Errorf("expected default message, got %q, %v", msg, err)
+	}
+}
+
+func TestNewerImage(t *testing.T) {
+	var images []flux.Image
+	for _, s := range []string{"repo:v3", "repo:dev-2", "repo:v2", "repo:dev-1", "repo:v1"} {
+		images = append(images, flux.Image{ID: mustParseImageID(t, "quay.io/weaveworks/"+s)})
+	}
+	for _, c := range []struct {
+		pattern, current, candidate string
+		newer                       bool
+	}{
+		{"*", "repo:v2", "repo:v1", true},
+		{"*", "repo:v2", "repo:v3", false},
+		// A current image that doesn't match the pattern isn't
+		// compared at all
+		{"v*", "repo:dev-2", "repo:v2", false},
+		{"dev-*", "repo:dev-2", "repo:dev-1", true},
+	} {
+		current := mustParseImageID(t, "quay.io/weaveworks/"+c.current)
+		candidate := mustParseImageID(t, "quay.io/weaveworks/"+c.candidate)
+		if got := newerImage(images, c.pattern, current, candidate); got != c.newer {
+			t.Errorf("pattern %q, current %s, candidate %s: expected newer to be %v", c.pattern, c.current, c.candidate, c.newer)
+		}
+	}
+}
+
+func mustParseImageID(t *testing.T, s string) flux.ImageID {
+	id, err := flux.ParseImageID(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// mockDaemon makes a daemon for testing, and starts its loops. Any
+// configure funcs given are applied to the daemon before the loops
+// start.
+func mockDaemon(t *testing.T, configure ...func(*Daemon)) (*Daemon, func(), *cluster.Mock, *mockEventWriter) {
 	logger := log.NewNopLogger()
 
 	singleService := cluster.Controller{
@@ -427,6 +1085,9 @@ func mockDaemon(t *testing.T) (*Daemon, func(), *cluster.Mock, *mockEventWriter)
 		Logger:         logger,
 		LoopVars:       &LoopVars{},
 	}
+	for _, f := range configure {
+		f(d)
+	}
 
 	wg.Add(1)
 	go d.GitPollLoop(shutdown, wg, logger)
@@ -0,0 +1,94 @@
+package daemon
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+
+	fluxerr "github.com/weaveworks/flux/errors"
+	"github.com/weaveworks/flux/event"
+	"github.com/weaveworks/flux/guid"
+	"github.com/weaveworks/flux/job"
+	"github.com/weaveworks/flux/update"
+)
+
+// The key under which a freeze is recorded
+const frozenStateKey = "automation-frozen"
+
+func (d *Daemon) frozen() bool {
+	d.frozenMu.RLock()
+	defer d.frozenMu.RUnlock()
+	return d.Frozen
+}
+
+// restoreFreeze picks up a freeze (or thaw) recorded before a
+// restart, which takes precedence over the freeze given at start-up.
+func (d *Daemon) restoreFreeze(logger log.Logger) {
+	if d.StateStore == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), gitOpTimeout)
+	value, ok, err := d.StateStore.Get(ctx, frozenStateKey)
+	cancel()
+	if err != nil {
+		logger.Log("operation", "restore-freeze", "err", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	frozen, err := strconv.ParseBool(value)
+	if err != nil {
+		logger.Log("operation", "restore-freeze", "err", err)
+		return
+	}
+	d.frozenMu.Lock()
+	d.Frozen = frozen
+	d.frozenMu.Unlock()
+	logger.Log("frozen", frozen, "restored", "true")
+}
+
+// ErrNoStateStore is returned for a freeze or unfreeze when there's
+// nowhere to record it, since it would be forgotten on restart.
+var ErrNoStateStore = &fluxerr.Error{
+	Type: fluxerr.User,
+	Err:  errors.New("fluxd has nowhere to record a freeze, so it would not last across restarts"),
+	Help: `Freezing needs somewhere to keep state
+
+Automated releases can only be frozen and unfrozen when fluxd keeps its
+state in the cluster, so that a freeze isn't quietly lifted when fluxd
+restarts. To start fluxd with automation frozen regardless, use
+--automation-frozen.
+
+`,
+}
+
+// updateFreeze suspends or resumes automated releases. This doesn't
+// touch the repo, so rather than being queued, it's done straight
+// away; the job ID returned is for a job that has already succeeded,
+// so it can be awaited like any other update.
+func (d *Daemon) updateFreeze(ctx context.Context, spec update.Spec, freeze update.FreezeSpec) (job.ID, error) {
+	if d.StateStore == nil {
+		return "", ErrNoStateStore
+	}
+	if err := d.StateStore.Set(ctx, frozenStateKey, strconv.FormatBool(freeze.Frozen)); err != nil {
+		return "", err
+	}
+	d.frozenMu.Lock()
+	d.Frozen = freeze.Frozen
+	d.frozenMu.Unlock()
+	d.Logger.Log("frozen", freeze.Frozen, "user", spec.Cause.User)
+	if !freeze.Frozen {
+		// Catch up on anything that's been held back
+		d.askForImagePoll()
+	}
+
+	id := job.ID(guid.New())
+	d.JobStatusCache.SetStatus(id, job.Status{
+		StatusString: job.StatusSucceeded,
+		Result:       event.CommitEventMetadata{Spec: &spec},
+	})
+	return id, nil
+}
@@ -1,18 +1,27 @@
 package daemon
 
 import (
+	"bytes"
 	"context"
+	"io/ioutil"
 	"strings"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
+	glob "github.com/ryanuber/go-glob"
 
 	"github.com/weaveworks/flux"
+	"github.com/weaveworks/flux/event"
 	"github.com/weaveworks/flux/policy"
 	"github.com/weaveworks/flux/update"
 )
 
 func (d *Daemon) pollForNewImages(logger log.Logger) {
+	if d.ReadOnly {
+		// Automated releases would have to be committed
+		return
+	}
 	logger.Log("msg", "polling images")
 
 	// One day we may use this for operations other than the call at the end
@@ -27,6 +36,8 @@ func (d *Daemon) pollForNewImages(logger log.Logger) {
 		logger.Log("msg", "no automated services")
 		return
 	}
+	d.pruneProposedImages(logger)
+
 	// Find images to check
 	services, err := d.Cluster.SomeControllers(candidateServices.ToSlice())
 	if err != nil {
@@ -40,11 +51,24 @@ func (d *Daemon) pollForNewImages(logger log.Logger) {
 		return
 	}
 
-	changes := &update.Automated{}
+	now := time.Now()
+	changes := &update.Automated{
+		DefaultWindow:      d.DefaultWindow,
+		Frozen:             d.frozen(),
+		Now:                now,
+		RecentReleases:     d.recentAutomatedReleases(now),
+		MaxReleasesPerHour: d.MaxAutomatedReleasesPerHour,
+	}
+	// the image each container would be updated to
+	candidates := map[proposal]bool{}
 	for _, service := range services {
 		for _, container := range service.ContainersOrNil() {
 			logger := log.With(logger, "service", service.ID, "container", container.Name, "currentimage", container.Image)
 
+			if !containerAutomated(candidateServices, service.ID, container.Name) {
+				continue
+			}
+
 			currentImageID, err := flux.ParseImageID(container.Image)
 			if err != nil {
 				logger.Log("error", err)
@@ -55,18 +79,295 @@ func (d *Daemon) pollForNewImages(logger log.Logger) {
 			repo := currentImageID.Repository()
 			logger.Log("repo", repo, "pattern", pattern)
 
-			if latest := imageMap.LatestImage(repo, pattern); latest != nil && latest.ID != currentImageID {
+			minAge, err := getMinAge(candidateServices, service.ID)
+			if err != nil {
+				logger.Log("error", err)
+				continue
+			}
+			latest := imageMap.LatestImage(repo, pattern)
+			if minAge > 0 {
+				soaked := imageMap.LatestImageCreatedBefore(repo, pattern, now.Add(-minAge))
+				if latest != nil && latest.ID != currentImageID && (soaked == nil || soaked.ID != latest.ID) {
+					changes.Defer(service.ID, update.NotOldEnough)
+					logger.Log("msg", "image not old enough to release", "newimage", latest.ID, "minage", minAge)
+				}
+				latest = soaked
+			}
+			if latest != nil {
+				candidates[proposal{service.ID, container.Name, latest.ID}] = true
+			}
+
+			if latest != nil && d.heldForCanaries(service.ID, container.Name, latest.ID) {
+				changes.Defer(service.ID, update.AwaitingCanary)
+				logger.Log("msg", "image waiting on canary release", "newimage", latest.ID)
+				continue
+			}
+			if latest != nil && d.failedInCanary(service.ID, container.Name, latest.ID) {
+				logger.Log("msg", "image failed in canary release", "newimage", latest.ID)
+				continue
+			}
+			if latest != nil && d.rejectedImage(service.ID, container.Name, latest.ID) {
+				logger.Log("msg", "image rejected by approval gate", "newimage", latest.ID)
+				continue
+			}
+			if latest != nil && d.alreadyProposed(service.ID, container.Name, latest.ID) {
+				logger.Log("msg", "image already proposed in a pull request", "newimage", latest.ID)
+				continue
+			}
+			if latest != nil && minAge > 0 && newerImage(imageMap[repo], pattern, currentImageID, latest.ID) {
+				logger.Log("msg", "image old enough to release is older than current image", "newimage", latest.ID)
+				continue
+			}
+			if latest != nil && latest.ID != currentImageID {
 				changes.Add(service.ID, container, latest.ID)
 				logger.Log("msg", "added image to changes", "newimage", latest.ID)
 			}
 		}
 	}
 
+	d.pruneRejectedImages(candidates, now)
+
 	if len(changes.Changes) > 0 {
+		// Any deferrals are reported in the results of the release
+		d.reportedDeferred = ""
 		d.UpdateManifests(ctx, update.Spec{Type: update.Auto, Spec: changes})
+	} else if len(changes.Deferred) > 0 {
+		logger.Log("msg", "new images held back", "services", len(changes.Deferred))
+		d.logDeferred(changes, logger)
+	} else {
+		d.reportedDeferred = ""
+	}
+}
+
+// logDeferred logs an event for an automated release that was held
+// back altogether, with the reasons in its results as they would be
+// for a release that went ahead for other controllers. The same
+// deferrals aren't reported again on each poll.
+func (d *Daemon) logDeferred(changes *update.Automated, logger log.Logger) {
+	result := update.Result{}
+	changes.MarkDeferred(result)
+	var ids flux.ResourceIDs
+	for id := range result {
+		ids = append(ids, id)
+	}
+	ids.Sort()
+
+	var key string
+	for _, id := range ids {
+		key += id.String() + ": " + changes.Deferred[id] + "\n"
+	}
+	if key == d.reportedDeferred {
+		return
+	}
+	d.reportedDeferred = key
+
+	now := time.Now().UTC()
+	if err := d.LogEvent(event.Event{
+		ServiceIDs: ids,
+		Type:       event.EventAutoRelease,
+		StartedAt:  now,
+		EndedAt:    now,
+		LogLevel:   event.LogLevelInfo,
+		Metadata: &event.AutoReleaseEventMetadata{
+			ReleaseEventCommon: event.ReleaseEventCommon{
+				Result: result,
+			},
+			Spec: *changes,
+		},
+	}); err != nil {
+		logger.Log("err", err)
 	}
 }
 
+// getMinAge gives the minimum age for images to be released
+// automatically to a service, or zero if there's no minimum.
+func getMinAge(services policy.ResourceMap, service flux.ResourceID) (time.Duration, error) {
+	value, ok := services[service].Get(policy.MinAge)
+	if !ok {
+		return 0, nil
+	}
+	minAge, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parsing %s policy %q", policy.MinAge, value)
+	}
+	return minAge, nil
+}
+
+// newerImage says whether the current image comes before the
+// candidate in the list of images (which is in descending order of
+// latestness), among those with tags matching the pattern; i.e.,
+// whether releasing the candidate would be a downgrade. This can
+// happen when the latest images are held back because they're too
+// new.
+func newerImage(images []flux.Image, pattern string, current, candidate flux.ImageID) bool {
+	for _, image := range images {
+		_, _, tag := image.ID.Components()
+		// As when finding the latest image, a "latest" tag only
+		// counts if it's asked for.
+		if !strings.EqualFold(pattern, "latest") && strings.EqualFold(tag, "latest") {
+			continue
+		}
+		if !glob.Glob(pattern, tag) {
+			continue
+		}
+		switch image.ID {
+		case current:
+			return true
+		case candidate:
+			return false
+		}
+	}
+	return false
+}
+
+// The key under which the times of recent automated releases are
+// recorded
+const automatedReleasesStateKey = "automated-releases"
+
+// recentAutomatedReleases counts the automated releases made to each
+// controller in the hour before the time given.
+func (d *Daemon) recentAutomatedReleases(now time.Time) map[flux.ResourceID]int {
+	d.automatedMu.Lock()
+	defer d.automatedMu.Unlock()
+	counts := map[flux.ResourceID]int{}
+	for id, times := range d.recentAutomated {
+		var recent []time.Time
+		for _, t := range times {
+			if now.Sub(t) < time.Hour {
+				recent = append(recent, t)
+			}
+		}
+		if len(recent) == 0 {
+			delete(d.recentAutomated, id)
+			continue
+		}
+		d.recentAutomated[id] = recent
+		counts[id] = len(recent)
+	}
+	return counts
+}
+
+// recordAutomatedRelease notes the controllers successfully updated
+// by an automated release, for rate limiting. The record is kept in
+// the StateStore, if there is one, so that the limit holds across
+// restarts.
+func (d *Daemon) recordAutomatedRelease(result update.Result, at time.Time, logger log.Logger) {
+	d.automatedMu.Lock()
+	if d.recentAutomated == nil {
+		d.recentAutomated = map[flux.ResourceID][]time.Time{}
+	}
+	for id, r := range result {
+		if r.Status == update.ReleaseStatusSuccess {
+			d.recentAutomated[id] = append(d.recentAutomated[id], at)
+		}
+	}
+	record := map[flux.ResourceID][]time.Time{}
+	for id, times := range d.recentAutomated {
+		record[id] = times
+	}
+	d.automatedMu.Unlock()
+
+	if err := d.storeState(automatedReleasesStateKey, record); err != nil {
+		logger.Log("operation", "record-automated-releases", "err", err)
+	}
+}
+
+// restoreAutomatedReleases picks up the automated releases recorded
+// before a restart, so they still count towards the hourly limit.
+func (d *Daemon) restoreAutomatedReleases(logger log.Logger) {
+	record := map[flux.ResourceID][]time.Time{}
+	if _, err := d.loadState(automatedReleasesStateKey, &record); err != nil {
+		logger.Log("operation", "restore-automated-releases", "err", err)
+		return
+	}
+	d.automatedMu.Lock()
+	defer d.automatedMu.Unlock()
+	if d.recentAutomated == nil {
+		d.recentAutomated = map[flux.ResourceID][]time.Time{}
+	}
+	for id, times := range record {
+		d.recentAutomated[id] = append(d.recentAutomated[id], times...)
+	}
+}
+
+// A proposal is an image update that has been proposed in a pull
+// request.
+type proposal struct {
+	service   flux.ResourceID
+	container string
+	image     flux.ImageID
+}
+
+// recordProposedImages notes the image updates proposed in a pull
+// request by an automated release, so they aren't proposed again
+// each time images are polled.
+func (d *Daemon) recordProposedImages(changes *update.Automated, result update.Result) {
+	d.automatedMu.Lock()
+	defer d.automatedMu.Unlock()
+	if d.proposedImages == nil {
+		d.proposedImages = map[proposal]bool{}
+	}
+	for _, change := range changes.Changes {
+		if result[change.ServiceID].Status == update.ReleaseStatusSuccess {
+			d.proposedImages[proposal{change.ServiceID, change.Container.Name, change.ImageID}] = true
+		}
+	}
+}
+
+// pruneProposedImages forgets the proposed image updates that are
+// now in the checkout. How the pull request was merged (e.g., whether
+// it was squashed) doesn't matter; only that the manifest has the
+// image.
+func (d *Daemon) pruneProposedImages(logger log.Logger) {
+	d.automatedMu.Lock()
+	var proposals []proposal
+	for p := range d.proposedImages {
+		proposals = append(proposals, p)
+	}
+	d.automatedMu.Unlock()
+	if len(proposals) == 0 {
+		return
+	}
+
+	d.Checkout.RLock()
+	files, err := d.Manifests.FindDefinedServices(d.Checkout.ManifestDir())
+	var merged []proposal
+	if err == nil {
+		for _, p := range proposals {
+			for _, path := range files[p.service] {
+				def, err := ioutil.ReadFile(path)
+				if err != nil {
+					continue
+				}
+				// If updating to the image changes nothing, the
+				// manifest has it already
+				updated, err := d.Manifests.UpdateDefinition(def, p.container, p.image)
+				if err == nil && bytes.Equal(def, updated) {
+					merged = append(merged, p)
+					break
+				}
+			}
+		}
+	}
+	d.Checkout.RUnlock()
+	if err != nil {
+		logger.Log("operation", "prune-proposed-images", "err", err)
+		return
+	}
+
+	d.automatedMu.Lock()
+	defer d.automatedMu.Unlock()
+	for _, p := range merged {
+		delete(d.proposedImages, p)
+	}
+}
+
+func (d *Daemon) alreadyProposed(service flux.ResourceID, container string, image flux.ImageID) bool {
+	d.automatedMu.Lock()
+	defer d.automatedMu.Unlock()
+	return d.proposedImages[proposal{service, container, image}]
+}
+
 func getTagPattern(services policy.ResourceMap, service flux.ResourceID, container string) string {
 	policies := services[service]
 	if pattern, ok := policies.Get(policy.TagPrefix(container)); ok {
@@ -75,12 +376,31 @@ func getTagPattern(services policy.ResourceMap, service flux.ResourceID, contain
 	return "*"
 }
 
+// containerAutomated says whether a particular container should be
+// considered for automated updates, taking into account policies
+// scoped to that container.
+func containerAutomated(services policy.ResourceMap, service flux.ResourceID, container string) bool {
+	policies := services[service].ForContainer(container)
+	return policies.Contains(policy.Automated) &&
+		!policies.Contains(policy.Locked) &&
+		!policies.Contains(policy.Ignore)
+}
+
 func (d *Daemon) unlockedAutomatedServices() (policy.ResourceMap, error) {
 	services, err := d.Manifests.ServicesWithPolicies(d.Checkout.ManifestDir())
 	if err != nil {
 		return nil, err
 	}
-	automatedServices := services.OnlyWithPolicy(policy.Automated)
-	lockedServices := services.OnlyWithPolicy(policy.Locked)
+	// Services with individual containers automated are candidates
+	// too; the containers are checked one by one later.
+	automatedServices := services.OnlyWithContainerPolicy(policy.Automated)
+	// Likewise, a locked service may have containers unlocked
+	// individually.
+	lockedServices := policy.ResourceMap{}
+	for id, policies := range services.OnlyWithPolicy(policy.Locked) {
+		if !policies.AnyContainerExempt(policy.Locked) {
+			lockedServices[id] = policies
+		}
+	}
 	return automatedServices.Without(lockedServices), nil
 }
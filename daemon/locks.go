@@ -0,0 +1,160 @@
+package daemon
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+
+	"github.com/weaveworks/flux"
+	"github.com/weaveworks/flux/cluster"
+	"github.com/weaveworks/flux/job"
+	"github.com/weaveworks/flux/policy"
+	"github.com/weaveworks/flux/resource"
+	"github.com/weaveworks/flux/update"
+)
+
+// The user recorded against unlocks done because a lock expired
+const lockExpiryUser = "flux"
+
+// An expired lock, as given by its controller (or namespace) and
+// expiry; a controller locked again has a different expiry, so is
+// unlocked afresh once that runs out.
+type expiredLock struct {
+	service flux.ResourceID
+	until   string
+}
+
+// unlockExpired queues a job to unlock any controllers with locks
+// that have expired. A lock given as a default for a namespace is
+// removed from the namespace, rather than from each of its
+// controllers; and a controller's own lock is left while its
+// namespace is still locked. It returns the ID of the job, or an
+// empty ID if there was nothing to unlock. Locks already being
+// unlocked are left out until they are gone from the checkout (or the
+// job failed), so that each sync doesn't queue the unlock again -- or
+// open another pull request for it.
+func (d *Daemon) unlockExpired(now time.Time, logger log.Logger) (job.ID, error) {
+	d.unlocksMu.Lock()
+	defer d.unlocksMu.Unlock()
+
+	d.Checkout.RLock()
+	services, err := d.Manifests.ServicesWithPolicies(d.Checkout.ManifestDir())
+	var resources map[string]resource.Resource
+	if err == nil {
+		resources, err = d.Manifests.LoadManifests(d.Checkout.ManifestDir())
+	}
+	d.Checkout.RUnlock()
+	if err != nil {
+		return "", errors.Wrap(err, "getting service policies")
+	}
+
+	updates := policy.Updates{}
+	expired := map[expiredLock]bool{}
+	unlock := func(id flux.ResourceID, until string) {
+		lock := expiredLock{id, until}
+		expired[lock] = true
+		if jobID, ok := d.pendingUnlocks[lock]; ok && !d.jobFailed(jobID) {
+			return
+		}
+		updates[id] = policy.Update{
+			Remove: policy.Set{}.
+				Add(policy.Locked).
+				Add(policy.LockedUser).
+				Add(policy.LockedMsg).
+				Add(policy.LockedUntil),
+		}
+	}
+
+	// namespace -> when its lock expires ("" if it has no expiry)
+	namespaceLocks := map[string]string{}
+	for _, res := range resources {
+		_, kind, name := res.ResourceID().Components()
+		if kind != "namespace" || !res.Policy().Contains(policy.Locked) {
+			continue
+		}
+		until, _ := res.Policy().Get(policy.LockedUntil)
+		namespaceLocks[name] = until
+		if ok, err := lockExpired(until, now); err != nil {
+			logger.Log("namespace", name, "err", err)
+		} else if ok {
+			unlock(cluster.NamespaceID(name), until)
+		}
+	}
+
+	for id, policies := range services.OnlyWithPolicy(policy.Locked) {
+		until, ok := policies.Get(policy.LockedUntil)
+		if !ok {
+			continue
+		}
+		ok, err := lockExpired(until, now)
+		if err != nil {
+			logger.Log("service", id, "err", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		// If the namespace is locked, either the controller inherits
+		// the lock, which is removed from the namespace, or it's
+		// still locked by the namespace in any case
+		ns, _, _ := id.Components()
+		if nsUntil, ok := namespaceLocks[ns]; ok {
+			if nsExpired, _ := lockExpired(nsUntil, now); nsUntil == until || !nsExpired {
+				continue
+			}
+		}
+		unlock(id, until)
+	}
+	// Forget the unlocks that have made it into the checkout
+	for lock := range d.pendingUnlocks {
+		if !expired[lock] {
+			delete(d.pendingUnlocks, lock)
+		}
+	}
+	if len(updates) == 0 {
+		return "", nil
+	}
+
+	logger.Log("msg", "unlocking controllers with expired locks", "services", len(updates))
+	jobID, err := d.UpdateManifests(context.Background(), update.Spec{
+		Type: update.Policy,
+		Cause: update.Cause{
+			User:    lockExpiryUser,
+			Message: "lock expired",
+		},
+		Spec: updates,
+	})
+	if err != nil {
+		return jobID, err
+	}
+	if d.pendingUnlocks == nil {
+		d.pendingUnlocks = map[expiredLock]job.ID{}
+	}
+	for lock := range expired {
+		if _, ok := updates[lock.service]; ok {
+			d.pendingUnlocks[lock] = jobID
+		}
+	}
+	return jobID, nil
+}
+
+// lockExpired says whether a lock that runs out at the time given
+// (which may be empty, for a lock that doesn't run out) has expired.
+func lockExpired(until string, now time.Time) (bool, error) {
+	if until == "" {
+		return false, nil
+	}
+	expiry, err := time.Parse(time.RFC3339, until)
+	if err != nil {
+		return false, errors.Wrapf(err, "parsing %s policy", policy.LockedUntil)
+	}
+	return !now.Before(expiry), nil
+}
+
+// jobFailed says whether the job given is known to have failed.
+func (d *Daemon) jobFailed(id job.ID) bool {
+	status, ok := d.JobStatusCache.Status(id)
+	return ok && status.StatusString == job.StatusFailed
+}
@@ -2,6 +2,9 @@ package daemon
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -15,9 +18,10 @@ import (
 	"github.com/weaveworks/flux"
 	"github.com/weaveworks/flux/event"
 	"github.com/weaveworks/flux/git"
+	"github.com/weaveworks/flux/job"
 	fluxmetrics "github.com/weaveworks/flux/metrics"
 	"github.com/weaveworks/flux/resource"
-	fluxsync "github.com/weaveworks/flux/sync"
+	"github.com/weaveworks/flux/schedule"
 	"github.com/weaveworks/flux/update"
 )
 
@@ -29,9 +33,64 @@ const (
 type LoopVars struct {
 	GitPollInterval      time.Duration
 	RegistryPollInterval time.Duration
-	syncSoon             chan struct{}
-	pollImagesSoon       chan struct{}
-	initOnce             sync.Once
+	// When automated releases may happen, for controllers without
+	// their own window; and, whether they are suspended altogether
+	// (which can be changed through the API).
+	DefaultWindow schedule.Schedule
+	Frozen        bool
+	// The most automated releases a controller may have in an hour;
+	// zero means no limit.
+	MaxAutomatedReleasesPerHour int
+	// How long canaries must stay ready, in a staged release, before
+	// the remaining controllers are released to.
+	CanarySoak time.Duration
+	// How often to check on canaries while waiting for them, and how
+	// long they have to be applied and become ready before a staged
+	// release is abandoned; if zero, 5s and 5m.
+	CanaryPollInterval   time.Duration
+	CanaryRolloutTimeout time.Duration
+	// If NamespaceOrder is set, automated releases are staged by
+	// namespace, in this order, rather than to canaries first.
+	NamespaceOrder []string
+	// If TrustedKeys is set, it's the path to the GPG keys commits
+	// must be signed with to be synced.
+	TrustedKeys string
+	// If SyncPerCommit is set, new commits are synced one at a time,
+	// so that one that fails doesn't hold up those after it.
+	SyncPerCommit bool
+	// If FullSyncInterval is set, syncs skip resources that haven't
+	// changed since they were last applied, except for a full sync
+	// at this interval. Otherwise, every sync applies everything.
+	FullSyncInterval time.Duration
+
+	// the loop's stop channel and wait group, for goroutines started
+	// by jobs (e.g., to wait on canaries) to stop along with it
+	loopStop chan struct{}
+	loopWG   *sync.WaitGroup
+
+	syncSoon        chan struct{}
+	pollImagesSoon  chan struct{}
+	initOnce        sync.Once
+	frozenMu        sync.RWMutex
+	automatedMu     sync.Mutex
+	recentAutomated map[flux.ResourceID][]time.Time
+	proposedImages  map[proposal]bool
+	pullRequestsMu  sync.Mutex
+	pullRequests    map[job.ID]string
+	canaryHeld      map[proposal]bool
+	canaryFailed    map[proposal]bool
+	stagesMu        sync.Mutex
+	rejectedImages  map[proposal]time.Time
+	unlocksMu       sync.Mutex
+	pendingUnlocks  map[expiredLock]job.ID
+	// the newest unverified commit an event has been logged for
+	reportedUnverified string
+	// the last sync failure an event has been logged for
+	reportedSyncFailure string
+	// the automated releases last reported as held back
+	reportedDeferred string
+	// when everything was last applied
+	lastFullSync time.Time
 }
 
 func (loop *LoopVars) ensureInit() {
@@ -65,6 +124,11 @@ func (d *Daemon) GitPollLoop(stop chan struct{}, wg *sync.WaitGroup, logger log.
 
 	imagePollTimer := time.NewTimer(d.RegistryPollInterval)
 
+	d.restoreFreeze(logger)
+	d.loopStop, d.loopWG = stop, wg
+	d.resumeStagedReleases(stop, wg, logger)
+	d.restoreAutomatedReleases(logger)
+
 	// Ask for a sync, and to poll images, straight away
 	d.askForSync()
 	d.askForImagePoll()
@@ -81,6 +145,14 @@ func (d *Daemon) GitPollLoop(stop chan struct{}, wg *sync.WaitGroup, logger log.
 			d.askForImagePoll()
 		case <-d.syncSoon:
 			pullThen(d.doSync)
+			// Having just pulled, it's a good time to check for
+			// locks that have run out (unless we can't commit the
+			// unlocking).
+			if !d.ReadOnly {
+				if _, err := d.unlockExpired(time.Now(), logger); err != nil {
+					logger.Log("operation", "unlock-expired", "err", err)
+				}
+			}
 		case <-gitPollTimer.C:
 			// Time to poll for new commits (unless we're already
 			// about to do that)
@@ -152,35 +224,61 @@ func (d *Daemon) doSync(logger log.Logger) (retErr error) {
 		defer working.Clean()
 	}
 
-	// TODO logging, metrics?
-	// Get a map of all resources defined in the repo
-	allResources, err := d.Manifests.LoadManifests(working.ManifestDir())
-	if err != nil {
-		return errors.Wrap(err, "loading resources from repo")
+	// Find out how far we got last time
+	var syncedRev string
+	{
+		var err error
+		ctx, cancel := context.WithTimeout(ctx, gitOpTimeout)
+		syncedRev, err = d.syncState().GetRevision(ctx)
+		cancel()
+		if err != nil {
+			return errors.Wrap(err, "reading sync state")
+		}
 	}
 
-	// TODO supply deletes argument from somewhere (command-line?)
-	if err := fluxsync.Sync(d.Manifests, allResources, d.Cluster, false, logger); err != nil {
-		logger.Log("err", err)
-		// TODO(michael): we should distinguish between "fully mostly
-		// succeeded" and "failed utterly", since we want to abandon
-		// this and not move the tag (and send a SyncFail event
-		// upstream?), if the latter. For now, it's presumed that any
-		// error returned is at worst a minor, partial failure (e.g.,
-		// a small number of resources failed to sync, for unimportant
-		// reasons)
+	// Only go as far as the commits signed by a trusted key
+	if d.TrustedKeys != "" {
+		rev, unverified, err := d.verifiedRevision(ctx, working, syncedRev)
+		if err != nil {
+			return errors.Wrap(err, "verifying commit signatures")
+		}
+		d.reportUnverified(unverified, logger)
+		if rev == "" {
+			// there's nothing signed by a trusted key to sync
+			return nil
+		}
+		if len(unverified) > 0 {
+			ctx, cancel := context.WithTimeout(ctx, gitOpTimeout)
+			err := working.CheckoutRevision(ctx, rev)
+			cancel()
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	// update notes and emit events for applied commits
+	var headRev string
+	{
+		var err error
+		ctx, cancel := context.WithTimeout(ctx, gitOpTimeout)
+		headRev, err = working.HeadRevision(ctx)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
 
 	var initialSync bool
 	var commits []git.Commit
 	{
 		var err error
 		ctx, cancel := context.WithTimeout(ctx, gitOpTimeout)
-		commits, err = working.CommitsBetween(ctx, working.SyncTag, "HEAD")
-		if isUnknownRevision(err) {
-			// No sync tag, grab all revisions
+		if syncedRev != "" {
+			commits, err = working.CommitsBetween(ctx, syncedRev, "HEAD")
+		}
+		if syncedRev == "" || isUnknownRevision(err) {
+			// No record of a sync (or of the revision recorded, if
+			// history has been rewritten), grab all revisions
 			initialSync = true
 			commits, err = working.CommitsBefore(ctx, "HEAD")
 		}
@@ -189,16 +287,50 @@ func (d *Daemon) doSync(logger log.Logger) (retErr error) {
 			return err
 		}
 	}
+	cs := d.syncedCommits(ctx, working, commits, initialSync, logger)
+
+	// Apply the manifests to the cluster. Stepping through the
+	// commits one by one only makes sense if there's a sync to step
+	// on from.
+	newRev := headRev
+	var syncErr error
+	if d.SyncPerCommit && !initialSync && len(commits) > 1 {
+		newRev, syncErr = d.syncEachCommit(ctx, working, cs, logger)
+		if newRev == "" {
+			return syncErr
+		}
+		if newRev != headRev {
+			// Report only what was synced
+			i := commitIndex(commits, newRev)
+			logger.Log("warning", "commits not synced", "revisions", revisionList(commits[:i]))
+			commits, cs = commits[i:], cs[i:]
+			ctx, cancel := context.WithTimeout(ctx, gitOpTimeout)
+			err := working.CheckoutRevision(ctx, newRev)
+			cancel()
+			if err != nil {
+				return err
+			}
+		}
+	} else if err := d.syncRevision(working, headRev, cs, logger); err != nil {
+		// Nothing was synced, so leave the sync state where it is
+		return err
+	}
+
+	// update notes and emit events for applied commits
 
 	// Figure out which service IDs changed in this release
 	changedResources := map[string]resource.Resource{}
 
 	if initialSync {
-		// no synctag, We are syncing everything from scratch
-		changedResources = allResources
+		// no sync recorded, We are syncing everything from scratch
+		var err error
+		changedResources, err = d.Manifests.LoadManifests(working.ManifestDir())
+		if err != nil {
+			return errors.Wrap(err, "loading resources from repo")
+		}
 	} else {
 		ctx, cancel := context.WithTimeout(ctx, gitOpTimeout)
-		changedFiles, err := working.ChangedFiles(ctx, working.SyncTag)
+		changedFiles, err := working.ChangedFiles(ctx, syncedRev)
 		if err == nil {
 			// We had some changed files, we're syncing a diff
 			changedResources, err = d.Manifests.LoadManifests(changedFiles...)
@@ -216,6 +348,7 @@ func (d *Daemon) doSync(logger log.Logger) (retErr error) {
 
 	var notes map[string]struct{}
 	{
+		var err error
 		ctx, cancel := context.WithTimeout(ctx, gitOpTimeout)
 		notes, err = working.NoteRevList(ctx)
 		cancel()
@@ -264,6 +397,10 @@ func (d *Daemon) doSync(logger log.Logger) (retErr error) {
 				break
 			}
 
+			if n.Branch != "" {
+				d.pullRequestMerged(n, commits[i].Revision, logger)
+			}
+
 			// Interpret some notes as events to send to the upstream
 			switch n.Spec.Type {
 			case update.Images:
@@ -306,6 +443,8 @@ func (d *Daemon) doSync(logger log.Logger) (retErr error) {
 			case update.Policy:
 				// Use this to mean any change to policy
 				includes[event.EventUpdatePolicy] = true
+			case update.Rollback:
+				includes[event.EventRollback] = true
 			default:
 				// Presume it's not something we're otherwise sending
 				// as an event
@@ -313,12 +452,7 @@ func (d *Daemon) doSync(logger log.Logger) (retErr error) {
 			}
 		}
 
-		cs := make([]event.Commit, len(commits))
-		for i, c := range commits {
-			cs[i].Revision = c.Revision
-			cs[i].Message = c.Message
-		}
-		if err = d.LogEvent(event.Event{
+		if err := d.LogEvent(event.Event{
 			ServiceIDs: serviceIDs.ToSlice(),
 			Type:       event.EventSync,
 			StartedAt:  started,
@@ -334,56 +468,122 @@ func (d *Daemon) doSync(logger log.Logger) (retErr error) {
 		}
 
 		for _, event := range noteEvents {
-			if err = d.LogEvent(event); err != nil {
+			if err := d.LogEvent(event); err != nil {
 				logger.Log("err", err)
 			}
 		}
 	}
 
-	// Move the tag and push it so we know how far we've gotten.
-	{
+	// Record the revision synced, so we know how far we've gotten.
+	if newRev != syncedRev {
 		ctx, cancel := context.WithTimeout(ctx, gitOpTimeout)
-		err := working.MoveTagAndPush(ctx, "HEAD", "Sync pointer")
-		cancel()
-		if err != nil {
-			return err
+		defer cancel()
+		if err := d.syncState().UpdateMarker(ctx, newRev); err != nil {
+			return errors.Wrap(err, "updating sync state")
 		}
 	}
 
-	// Pull the tag if it has changed
-	{
-		ctx, cancel := context.WithTimeout(ctx, gitOpTimeout)
-		if err := d.pullIfTagMoved(ctx, working, logger); err != nil {
-			logger.Log("err", errors.Wrap(err, "updating tag"))
+	return syncErr
+}
+
+// syncedCommits describes the commits synced, for the sync event.
+// Except for an initial sync (which may include the entire history of
+// the repo), each commit is given with the files it changed and the
+// resources defined in them. Failing to find those is not fatal,
+// since the sync has already happened; they're just left out.
+func (d *Daemon) syncedCommits(ctx context.Context, working *git.Checkout, commits []git.Commit, initialSync bool, logger log.Logger) []event.Commit {
+	cs := make([]event.Commit, len(commits))
+	for i, c := range commits {
+		cs[i] = event.Commit{
+			Revision:  c.Revision,
+			Message:   c.Message,
+			Author:    commitSignature(c.Author),
+			Committer: commitSignature(c.Committer),
+		}
+		if d.CommitURLTemplate != "" {
+			cs[i].URL = strings.Replace(d.CommitURLTemplate, "{revision}", c.Revision, -1)
+		}
+		if initialSync {
+			continue
 		}
+
+		filesCtx, cancel := context.WithTimeout(ctx, gitOpTimeout)
+		files, err := working.CommitFiles(filesCtx, c.Revision)
 		cancel()
-	}
+		if err != nil {
+			logger.Log("revision", c.Revision, "err", errors.Wrap(err, "finding files changed in commit"))
+			continue
+		}
+		cs[i].Files = files
 
-	return nil
+		resources, err := d.resourcesAt(ctx, working, c.Revision, files)
+		if err != nil {
+			logger.Log("revision", c.Revision, "err", errors.Wrap(err, "loading resources changed in commit"))
+			continue
+		}
+		if len(resources) == 0 {
+			continue
+		}
+		ids := flux.ResourceIDs{}
+		for _, r := range resources {
+			ids = append(ids, r.ResourceID())
+		}
+		ids.Sort()
+		cs[i].ServiceIDs = ids
+	}
+	return cs
 }
 
-func (d *Daemon) pullIfTagMoved(ctx context.Context, working *git.Checkout, logger log.Logger) error {
-	oldTagRev, err := d.Checkout.TagRevision(ctx, d.Checkout.SyncTag)
-	if err != nil && !strings.Contains(err.Error(), "unknown revision or path not in the working tree") {
-		return err
-	}
-	newTagRev, err := working.TagRevision(ctx, working.SyncTag)
+// resourcesAt loads the resources defined in the files given, as they
+// were at the revision given, by copying them out into a temporary
+// directory. Files not there at that revision (i.e., deleted by it)
+// are taken from its first parent instead, so the resources removed
+// are included.
+func (d *Daemon) resourcesAt(ctx context.Context, working *git.Checkout, rev string, files []string) (map[string]resource.Resource, error) {
+	dir, err := ioutil.TempDir("", "flux-commit")
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer os.RemoveAll(dir)
 
-	if oldTagRev != newTagRev {
-		logger.Log("tag", d.Checkout.SyncTag, "old", oldTagRev, "new", newTagRev)
-		if err := d.Checkout.Pull(ctx); err != nil {
-			return err
+	var paths []string
+	for _, f := range files {
+		ctx, cancel := context.WithTimeout(ctx, gitOpTimeout)
+		contents, err := working.FileAt(ctx, rev, f)
+		if git.IsFileNotFound(err) {
+			contents, err = working.FileAt(ctx, rev+"^", f)
+			// The parent may be out of reach in a shallow clone
+			if git.IsFileNotFound(err) || isUnknownRevision(err) {
+				cancel()
+				continue
+			}
+		}
+		cancel()
+		if err != nil {
+			return nil, err
 		}
+		path := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		return nil, nil
 	}
+	return d.Manifests.LoadManifests(paths...)
+}
 
-	return nil
+func commitSignature(s git.Signature) *event.CommitSignature {
+	if s.Name == "" && s.Email == "" {
+		return nil
+	}
+	return &event.CommitSignature{Name: s.Name, Email: s.Email, Time: s.When}
 }
 
 func isUnknownRevision(err error) bool {
-	return err != nil &&
-		(strings.Contains(err.Error(), "unknown revision or path not in the working tree.") ||
-			strings.Contains(err.Error(), "bad revision"))
+	return err != nil && errors.Cause(err) == git.ErrUnknownRevision
 }
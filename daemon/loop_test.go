@@ -1,8 +1,10 @@
 package daemon
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"sync"
@@ -272,3 +274,351 @@ func TestDoSync_WithNewCommit(t *testing.T) {
 		t.Errorf("Should have moved sync tag to HEAD (%s), but was moved to: %s")
 	}
 }
+
+type mockSyncState struct {
+	revision string
+}
+
+func (s *mockSyncState) GetRevision(ctx context.Context) (string, error) {
+	return s.revision, nil
+}
+
+func (s *mockSyncState) UpdateMarker(ctx context.Context, revision string) error {
+	s.revision = revision
+	return nil
+}
+
+func TestDoSync_SyncState(t *testing.T) {
+	d, cleanup := daemon(t)
+	defer cleanup()
+	state := &mockSyncState{}
+	d.SyncState = state
+	k8s.SyncFunc = func(def cluster.SyncDef) error { return nil }
+
+	if err := d.doSync(log.NewNopLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	// It records HEAD as synced, without making a tag
+	head, err := d.Checkout.HeadRevision(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.revision != head {
+		t.Errorf("expected synced revision to be %s, got %q", head, state.revision)
+	}
+	if err := d.Checkout.Pull(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Checkout.TagRevision(context.Background(), gitSyncTag); !isUnknownRevision(err) {
+		t.Errorf("expected no sync tag, got %v", err)
+	}
+
+	// Having synced HEAD, there's nothing yet to apply
+	if revs, err := d.SyncStatus(context.Background(), "HEAD"); err != nil {
+		t.Error(err)
+	} else if len(revs) != 0 {
+		t.Errorf("expected no revisions yet to be applied, got %v", revs)
+	}
+}
+
+// pushReplicas commits and pushes a change to the replicas of the
+// helloworld deployment, and gives the new HEAD.
+func pushReplicas(t *testing.T, d *Daemon, from, to string) string {
+	ctx := context.Background()
+	if err := cluster.UpdateManifest(k8s, d.Checkout.ManifestDir(), flux.MustParseResourceID("default:deployment/helloworld"), func(def []byte) ([]byte, error) {
+		return []byte(strings.Replace(string(def), "replicas: "+from, "replicas: "+to, -1)), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	commitAction := &git.CommitAction{Author: "", Message: "replicas " + to}
+	if err := d.Checkout.CommitAndPush(ctx, commitAction, nil); err != nil {
+		t.Fatal(err)
+	}
+	rev, err := d.Checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rev
+}
+
+func TestDoSync_CommitResources(t *testing.T) {
+	d, _, cleanup := syncedDaemon(t)
+	defer cleanup()
+
+	// Add a deployment in one commit, then rename it in the next;
+	// each commit should be reported with the resources as they
+	// were in it.
+	path := filepath.Join(d.Checkout.ManifestDir(), "helloworld-deploy.yaml")
+	addRevision := editAndPush(t, d, path, func(def string) string {
+		return def + `
+---
+apiVersion: extensions/v1beta1
+kind: Deployment
+metadata:
+  name: extra
+  namespace: default
+spec:
+  template:
+    spec:
+      containers:
+      - name: extra
+        image: quay.io/weaveworks/extra:1
+`
+	})
+	renameRevision := editAndPush(t, d, path, func(def string) string {
+		return strings.Replace(def, "name: extra\n  namespace", "name: renamed\n  namespace", 1)
+	})
+
+	k8s.SyncFunc = func(def cluster.SyncDef) error { return nil }
+	if err := d.doSync(log.NewNopLogger()); err != nil {
+		t.Fatal(err)
+	}
+	es := eventsOfType(t, event.EventSync)
+	if len(es) != 1 {
+		t.Fatalf("expected a sync event, got %#v", es)
+	}
+	expected := map[string]flux.ResourceID{
+		addRevision:    flux.MustParseResourceID("default:deployment/extra"),
+		renameRevision: flux.MustParseResourceID("default:deployment/renamed"),
+	}
+	for _, c := range es[0].Metadata.(*event.SyncEventMetadata).Commits {
+		id, ok := expected[c.Revision]
+		if !ok {
+			continue
+		}
+		delete(expected, c.Revision)
+		if !flux.ResourceIDs(c.ServiceIDs).Contains(id) || len(c.ServiceIDs) != 2 {
+			t.Errorf("expected commit %s to be reported with %s (and helloworld), got %v", c.Revision, id, c.ServiceIDs)
+		}
+	}
+	if len(expected) > 0 {
+		t.Errorf("expected commits to be reported: %v", expected)
+	}
+}
+
+func TestDoSync_CommitResourcesDeleted(t *testing.T) {
+	d, _, cleanup := syncedDaemon(t)
+	defer cleanup()
+
+	// A commit that removes a manifest should be reported with the
+	// resources it removed.
+	ctx := context.Background()
+	path := filepath.Join(d.Checkout.ManifestDir(), "helloworld-deploy.yaml")
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Checkout.CommitAndPush(ctx, &git.CommitAction{Message: "remove helloworld"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	removeRevision, err := d.Checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k8s.SyncFunc = func(def cluster.SyncDef) error { return nil }
+	if err := d.doSync(log.NewNopLogger()); err != nil {
+		t.Fatal(err)
+	}
+	es := eventsOfType(t, event.EventSync)
+	if len(es) != 1 {
+		t.Fatalf("expected a sync event, got %#v", es)
+	}
+	id := flux.MustParseResourceID("default:deployment/helloworld")
+	for _, c := range es[0].Metadata.(*event.SyncEventMetadata).Commits {
+		if c.Revision != removeRevision {
+			continue
+		}
+		if !flux.ResourceIDs(c.ServiceIDs).Contains(id) {
+			t.Errorf("expected commit %s to be reported with %s, got %v", c.Revision, id, c.ServiceIDs)
+		}
+		return
+	}
+	t.Errorf("expected commit %s to be reported", removeRevision)
+}
+
+func editAndPush(t *testing.T, d *Daemon, path string, edit func(string) string) string {
+	ctx := context.Background()
+	def, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(edit(string(def))), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Checkout.CommitAndPush(ctx, &git.CommitAction{Message: "edit " + filepath.Base(path)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	rev, err := d.Checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rev
+}
+
+// syncedDaemon gives a daemon which has synced the repo as it is,
+// recording that in the sync state returned.
+func syncedDaemon(t *testing.T) (*Daemon, *mockSyncState, func()) {
+	d, cleanup := daemon(t)
+	head, err := d.Checkout.HeadRevision(context.Background())
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	state := &mockSyncState{revision: head}
+	d.SyncState = state
+	return d, state, cleanup
+}
+
+func eventsOfType(t *testing.T, eventType string) []event.Event {
+	es, err := events.AllEvents(time.Time{}, -1, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []event.Event
+	for _, e := range es {
+		if e.Type == eventType {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+func TestDoSync_UtterFailure(t *testing.T) {
+	d, state, cleanup := syncedDaemon(t)
+	defer cleanup()
+	oldRevision := state.revision
+	pushReplicas(t, d, "5", "4")
+
+	k8s.SyncFunc = func(def cluster.SyncDef) error {
+		return errors.New("cluster unreachable")
+	}
+	if err := d.doSync(log.NewNopLogger()); err == nil {
+		t.Error("expected an error from an utterly failed sync")
+	}
+
+	// It doesn't move the sync state, nor report a sync
+	if state.revision != oldRevision {
+		t.Errorf("expected synced revision to stay at %s, got %s", oldRevision, state.revision)
+	}
+	if es := eventsOfType(t, event.EventSync); len(es) != 0 {
+		t.Errorf("expected no sync event, got %#v", es)
+	}
+	failed := eventsOfType(t, event.EventSyncFailed)
+	if len(failed) != 1 {
+		t.Fatalf("expected one sync failed event, got %#v", failed)
+	}
+	metadata := failed[0].Metadata.(*event.SyncFailedEventMetadata)
+	if !metadata.Utter || metadata.Error != "cluster unreachable" {
+		t.Errorf("unexpected sync failure: %#v", metadata)
+	}
+
+	// The same failure isn't reported again
+	d.doSync(log.NewNopLogger())
+	if failed := eventsOfType(t, event.EventSyncFailed); len(failed) != 1 {
+		t.Errorf("expected the failure to be reported once, got %d events", len(failed))
+	}
+}
+
+func TestDoSync_PartialFailure(t *testing.T) {
+	d, state, cleanup := syncedDaemon(t)
+	defer cleanup()
+	newRevision := pushReplicas(t, d, "5", "4")
+
+	helloworld := flux.MustParseResourceID("default:deployment/helloworld")
+	k8s.SyncFunc = func(def cluster.SyncDef) error {
+		return cluster.SyncError{helloworld.String(): errors.New("invalid spec")}
+	}
+	if err := d.doSync(log.NewNopLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rest was synced, so it moves the sync state
+	if state.revision != newRevision {
+		t.Errorf("expected synced revision to be %s, got %s", newRevision, state.revision)
+	}
+	if es := eventsOfType(t, event.EventSync); len(es) != 1 {
+		t.Errorf("expected a sync event, got %#v", es)
+	}
+	failed := eventsOfType(t, event.EventSyncFailed)
+	if len(failed) != 1 {
+		t.Fatalf("expected one sync failed event, got %#v", failed)
+	}
+	metadata := failed[0].Metadata.(*event.SyncFailedEventMetadata)
+	if metadata.Utter || len(metadata.Errors) != 1 {
+		t.Fatalf("unexpected sync failure: %#v", metadata)
+	}
+	resErr := metadata.Errors[0]
+	if resErr.ID != helloworld || resErr.Error != "invalid spec" {
+		t.Errorf("unexpected resource error: %#v", resErr)
+	}
+	if resErr.Commit == nil || resErr.Commit.Revision != newRevision {
+		t.Errorf("expected resource error to be put down to commit %s, got %#v", newRevision, resErr.Commit)
+	}
+}
+
+func TestDoSync_PerCommit(t *testing.T) {
+	d, state, cleanup := syncedDaemon(t)
+	defer cleanup()
+	d.SyncPerCommit = true
+	badRevision := pushReplicas(t, d, "5", "4")
+	fixRevision := pushReplicas(t, d, "4", "3")
+
+	// The first commit can't be synced at all, but the next can
+	syncCalled := 0
+	k8s.SyncFunc = func(def cluster.SyncDef) error {
+		syncCalled++
+		if syncCalled == 1 {
+			return errors.New("bad commit")
+		}
+		return nil
+	}
+	if err := d.doSync(log.NewNopLogger()); err != nil {
+		t.Fatal(err)
+	}
+	if syncCalled != 2 {
+		t.Errorf("expected a sync for each commit, got %d", syncCalled)
+	}
+	if state.revision != fixRevision {
+		t.Errorf("expected synced revision to be %s, got %s", fixRevision, state.revision)
+	}
+	failed := eventsOfType(t, event.EventSyncFailed)
+	if len(failed) != 1 {
+		t.Fatalf("expected one sync failed event, got %#v", failed)
+	}
+	if rev := failed[0].Metadata.(*event.SyncFailedEventMetadata).Revision; rev != badRevision {
+		t.Errorf("expected failure of %s to be reported, got %s", badRevision, rev)
+	}
+}
+
+func TestDoSync_PerCommitStopsAtFailure(t *testing.T) {
+	d, state, cleanup := syncedDaemon(t)
+	defer cleanup()
+	d.SyncPerCommit = true
+	goodRevision := pushReplicas(t, d, "5", "4")
+	pushReplicas(t, d, "4", "3")
+
+	// The newest commit can't be synced
+	syncCalled := 0
+	k8s.SyncFunc = func(def cluster.SyncDef) error {
+		syncCalled++
+		if syncCalled == 2 {
+			return errors.New("bad commit")
+		}
+		return nil
+	}
+	if err := d.doSync(log.NewNopLogger()); err == nil {
+		t.Error("expected an error, since HEAD could not be synced")
+	}
+	if state.revision != goodRevision {
+		t.Errorf("expected synced revision to be %s, got %s", goodRevision, state.revision)
+	}
+	es := eventsOfType(t, event.EventSync)
+	if len(es) != 1 {
+		t.Fatalf("expected a sync event, got %#v", es)
+	}
+	commits := es[0].Metadata.(*event.SyncEventMetadata).Commits
+	if len(commits) != 1 || commits[0].Revision != goodRevision {
+		t.Errorf("expected only %s to be reported as synced, got %#v", goodRevision, commits)
+	}
+}
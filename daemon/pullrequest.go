@@ -0,0 +1,59 @@
+package daemon
+
+import (
+	"github.com/go-kit/kit/log"
+
+	"github.com/weaveworks/flux/event"
+	"github.com/weaveworks/flux/git"
+	"github.com/weaveworks/flux/job"
+	"github.com/weaveworks/flux/update"
+)
+
+// recordPullRequest remembers the pull request opened by a job, of
+// whatever kind, until a sync sees it merged.
+func (d *Daemon) recordPullRequest(id job.ID, url string) {
+	d.pullRequestsMu.Lock()
+	defer d.pullRequestsMu.Unlock()
+	if d.pullRequests == nil {
+		d.pullRequests = map[job.ID]string{}
+	}
+	d.pullRequests[id] = url
+}
+
+// pullRequestStatus gives the status of a job that opened a pull
+// request which hasn't been merged yet, for when the job has dropped
+// out of the status cache.
+func (d *Daemon) pullRequestStatus(id job.ID) (job.Status, bool) {
+	d.pullRequestsMu.Lock()
+	defer d.pullRequestsMu.Unlock()
+	url, ok := d.pullRequests[id]
+	if !ok {
+		return job.Status{}, false
+	}
+	return job.Status{
+		StatusString: job.StatusSucceeded,
+		Result:       event.CommitEventMetadata{PullRequest: url},
+	}, true
+}
+
+// pullRequestMerged is called when a sync comes across the commit
+// for a pull request, i.e., one with a note naming the branch it was
+// proposed on. The pull request is forgotten, and if it was for an
+// automated release, so are the image updates it proposed.
+func (d *Daemon) pullRequestMerged(n *git.Note, revision string, logger log.Logger) {
+	d.pullRequestsMu.Lock()
+	url := d.pullRequests[n.JobID]
+	delete(d.pullRequests, n.JobID)
+	d.pullRequestsMu.Unlock()
+	logger.Log("info", "pull request merged", "branch", n.Branch, "job", n.JobID, "pullrequest", url, "revision", revision)
+
+	auto, ok := n.Spec.Spec.(update.Automated)
+	if !ok {
+		return
+	}
+	d.automatedMu.Lock()
+	defer d.automatedMu.Unlock()
+	for _, change := range auto.Changes {
+		delete(d.proposedImages, proposal{change.ServiceID, change.Container.Name, change.ImageID})
+	}
+}
@@ -0,0 +1,34 @@
+package daemon
+
+import (
+	"github.com/pkg/errors"
+
+	fluxerr "github.com/weaveworks/flux/errors"
+	"github.com/weaveworks/flux/release"
+	"github.com/weaveworks/flux/update"
+)
+
+var ErrReadOnly = &fluxerr.Error{
+	Type: fluxerr.User,
+	Err:  errors.New("fluxd is in read-only mode; changes to the git repo are not allowed"),
+	Help: `Read-only mode
+
+This fluxd is running with --git-readonly, so it only syncs the
+cluster with the git repo, and never commits to it. Releases, changes
+to policies, and rollbacks have to be made by committing to the repo
+directly. You can still list images and plan (dry-run) releases.
+
+`,
+}
+
+// writesToRepo says whether carrying out the update spec given would
+// mean committing to the repo.
+func writesToRepo(spec update.Spec) bool {
+	switch s := spec.Spec.(type) {
+	case release.Changes:
+		return s.ReleaseKind() != update.ReleaseKindPlan
+	case update.FreezeSpec:
+		return false
+	}
+	return true
+}
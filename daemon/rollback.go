@@ -0,0 +1,221 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+
+	"github.com/weaveworks/flux"
+	"github.com/weaveworks/flux/cluster"
+	"github.com/weaveworks/flux/event"
+	"github.com/weaveworks/flux/git"
+	"github.com/weaveworks/flux/job"
+	"github.com/weaveworks/flux/policy"
+	"github.com/weaveworks/flux/release"
+	"github.com/weaveworks/flux/update"
+)
+
+// The lock message recorded for a rollback, if none is given
+const rollbackLockMsg = "rolled back"
+
+// rollback reverts a controller's images to what they were before
+// one or more previous releases, as recorded in the notes on commits,
+// and locks the controller so that automation doesn't undo it.
+func (d *Daemon) rollback(spec update.Spec, rollback update.RollbackSpec) DaemonJobFunc {
+	return func(ctx context.Context, jobID job.ID, working *git.Checkout, logger log.Logger) (*event.CommitEventMetadata, error) {
+		updates, err := rollbackImages(ctx, working, rollback)
+		if err != nil {
+			return nil, err
+		}
+		result := update.Result{
+			rollback.ServiceID: update.ControllerResult{
+				Status:       update.ReleaseStatusSuccess,
+				PerContainer: updates,
+			},
+		}
+
+		// A rollback is a release, as far as the gate is concerned
+		if d.Gate != nil {
+			approved, err := release.Approve(d.Gate, update.Rollback, spec.Cause, []flux.ResourceID{rollback.ServiceID}, result, logger)
+			if err != nil {
+				return nil, err
+			}
+			if !approved.Contains(rollback.ServiceID) {
+				d.logRejections(result, logger)
+				return &event.CommitEventMetadata{
+					Spec:   &spec,
+					Result: result,
+				}, nil
+			}
+		}
+
+		lock := policy.Set{}.Add(policy.Locked)
+		if spec.Cause.User != "" {
+			lock = lock.Set(policy.LockedUser, spec.Cause.User)
+		}
+		msg := rollbackLockMsg
+		if spec.Cause.Message != "" {
+			msg = fmt.Sprintf("%s: %s", rollbackLockMsg, spec.Cause.Message)
+		}
+		lock = lock.Set(policy.LockedMsg, msg)
+
+		if err := cluster.UpdateManifest(d.Manifests, working.ManifestDir(), rollback.ServiceID, func(def []byte) ([]byte, error) {
+			for _, u := range updates {
+				var err error
+				if def, err = d.Manifests.UpdateDefinition(def, u.Container, u.Target); err != nil {
+					return nil, errors.Wrapf(err, "updating container %s", u.Container)
+				}
+			}
+			return d.Manifests.UpdatePolicies(def, policy.Update{
+				Add:    lock,
+				Remove: policy.Set{}.Add(policy.LockedUntil),
+			})
+		}); err != nil {
+			return nil, err
+		}
+
+		commitAuthor := ""
+		if d.Checkout.Config.SetAuthor {
+			commitAuthor = spec.Cause.User
+		}
+		commitMsg, err := d.commitMessage(jobID, spec, result, rollbackCommitMessage(rollback, updates, spec.Cause))
+		if err != nil {
+			return nil, err
+		}
+		commitAction := &git.CommitAction{Author: commitAuthor, Message: commitMsg}
+		metadata := &event.CommitEventMetadata{
+			Spec:   &spec,
+			Result: result,
+		}
+		metadata.Revision, metadata.PullRequest, metadata.PushRetries, err = d.commitAndPush(ctx, working, commitAction, &git.Note{JobID: jobID, Spec: spec, Result: result})
+		if err != nil {
+			return metadata, err
+		}
+		return metadata, nil
+	}
+}
+
+// rollbackImages looks back through the commits for releases to the
+// controller, and works out which image each container should go
+// back to. The container updates returned have the image running now
+// as Current, and the image to roll back to as Target.
+func rollbackImages(ctx context.Context, working *git.Checkout, rollback update.RollbackSpec) ([]update.ContainerUpdate, error) {
+	steps := rollback.Steps
+	switch {
+	case steps < 0:
+		return nil, errors.New("number of steps to roll back must be positive")
+	case steps > 0 && rollback.ToRevision != "":
+		return nil, errors.New("give either a number of steps or a revision to roll back to, not both")
+	case steps == 0 && rollback.ToRevision == "":
+		steps = 1
+	}
+
+	noted, err := working.NoteRevList(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading list of notes")
+	}
+	commits, err := working.CommitsBefore(ctx, "HEAD")
+	if err != nil {
+		return nil, errors.Wrap(err, "reading commit history")
+	}
+
+	var containers []string
+	updates := map[string]update.ContainerUpdate{}
+	var found int
+	var reached bool
+	for _, commit := range commits {
+		atRevision := rollback.ToRevision != "" && strings.HasPrefix(commit.Revision, rollback.ToRevision)
+		released, err := releasedIn(ctx, working, noted, commit.Revision, rollback)
+		if err != nil {
+			return nil, err
+		}
+		if atRevision && released == nil {
+			return nil, fmt.Errorf("revision %s did not release to %s", rollback.ToRevision, rollback.ServiceID)
+		}
+		if released == nil {
+			continue
+		}
+
+		// Going back in time, so each release overrides the target
+		// of any later release, and the current image is that given
+		// by the most recent release.
+		for _, u := range released {
+			if existing, ok := updates[u.Container]; ok {
+				existing.Target = u.Current
+				updates[u.Container] = existing
+				continue
+			}
+			containers = append(containers, u.Container)
+			updates[u.Container] = update.ContainerUpdate{
+				Container: u.Container,
+				Current:   u.Target,
+				Target:    u.Current,
+			}
+		}
+		found++
+		if atRevision {
+			reached = true
+			break
+		}
+		if found == steps {
+			break
+		}
+	}
+
+	switch {
+	case rollback.ToRevision != "" && !reached:
+		return nil, fmt.Errorf("revision %s not found in history", rollback.ToRevision)
+	case found == 0:
+		return nil, fmt.Errorf("no previous releases of %s found", rollback.ServiceID)
+	case found < steps:
+		return nil, fmt.Errorf("only %d previous release(s) of %s found", found, rollback.ServiceID)
+	}
+
+	var result []update.ContainerUpdate
+	for _, container := range containers {
+		result = append(result, updates[container])
+	}
+	return result, nil
+}
+
+// releasedIn returns the container updates made to the controller by
+// a release in the given revision, or nil if there weren't any. A
+// rollback counts as a release, so that rolling back again undoes it.
+func releasedIn(ctx context.Context, working *git.Checkout, noted map[string]struct{}, revision string, rollback update.RollbackSpec) ([]update.ContainerUpdate, error) {
+	if _, ok := noted[revision]; !ok {
+		return nil, nil
+	}
+	note, err := working.GetNote(ctx, revision)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading note for revision %s", revision)
+	}
+	if note == nil {
+		return nil, nil
+	}
+	switch note.Spec.Type {
+	case update.Images, update.Auto, update.Rollback:
+	default:
+		return nil, nil
+	}
+	r, ok := note.Result[rollback.ServiceID]
+	if !ok || r.Status != update.ReleaseStatusSuccess || len(r.PerContainer) == 0 {
+		return nil, nil
+	}
+	return r.PerContainer, nil
+}
+
+func rollbackCommitMessage(rollback update.RollbackSpec, updates []update.ContainerUpdate, cause update.Cause) string {
+	msg := &bytes.Buffer{}
+	if cause.Message != "" {
+		fmt.Fprintf(msg, "%s\n\n", cause.Message)
+	}
+	fmt.Fprintf(msg, "Roll back %s\n", rollback.ServiceID)
+	for _, u := range updates {
+		fmt.Fprintf(msg, "\n- %s: %s -> %s", u.Container, u.Current, u.Target)
+	}
+	return msg.String()
+}
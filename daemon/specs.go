@@ -0,0 +1,111 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+
+	"github.com/weaveworks/flux"
+	"github.com/weaveworks/flux/event"
+	"github.com/weaveworks/flux/git"
+	"github.com/weaveworks/flux/job"
+	"github.com/weaveworks/flux/policy"
+	"github.com/weaveworks/flux/update"
+)
+
+// selectControllers resolves a resource spec to the controllers
+// defined in the manifests under dir that it picks out. It is an
+// error for a pattern or label selector to match nothing, since an
+// empty selection would otherwise be taken to mean everything.
+func (d *Daemon) selectControllers(dir string, spec update.ResourceSpec) ([]flux.ResourceID, error) {
+	if !spec.IsSelection() {
+		id, err := spec.AsID()
+		if err != nil {
+			return nil, errors.Wrap(err, "treating service spec as ID")
+		}
+		return []flux.ResourceID{id}, nil
+	}
+
+	defined, err := d.Manifests.FindDefinedServices(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "finding defined controllers")
+	}
+	resources, err := d.Manifests.LoadManifests(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading resources from repo")
+	}
+
+	var ids flux.ResourceIDs
+	for id := range defined {
+		var labels map[string]string
+		if res, ok := resources[id.String()]; ok {
+			labels = res.Labels()
+		}
+		if spec.Matches(id, labels) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no controllers match %s", spec)
+	}
+	ids.Sort()
+	return ids, nil
+}
+
+// expandReleaseSpec replaces any patterns or label selectors in the
+// release spec with the IDs of the controllers they pick out.
+func (d *Daemon) expandReleaseSpec(dir string, s update.ReleaseSpec) (update.ReleaseSpec, error) {
+	var specs []update.ResourceSpec
+	for _, spec := range s.ServiceSpecs {
+		if !spec.IsSelection() {
+			specs = append(specs, spec)
+			continue
+		}
+		ids, err := d.selectControllers(dir, spec)
+		if err != nil {
+			return s, err
+		}
+		for _, id := range ids {
+			specs = append(specs, update.MakeResourceSpec(id))
+		}
+	}
+	s.ServiceSpecs = specs
+	return s, nil
+}
+
+// updatePoliciesBySpec resolves the resource specs against the
+// manifests in the working clone, then updates the policies of the
+// controllers picked out.
+func (d *Daemon) updatePoliciesBySpec(spec update.Spec, updates update.PolicyUpdatesBySpec) DaemonJobFunc {
+	return func(ctx context.Context, jobID job.ID, working *git.Checkout, logger log.Logger) (*event.CommitEventMetadata, error) {
+		resolved := policy.Updates{}
+		for resourceSpec, u := range updates {
+			ids, err := d.selectControllers(working.ManifestDir(), resourceSpec)
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range ids {
+				resolved[id] = mergePolicyUpdates(resolved[id], u)
+			}
+		}
+		policySpec := update.Spec{Type: update.Policy, Cause: spec.Cause, Spec: resolved}
+		return d.updatePolicy(policySpec, resolved)(ctx, jobID, working, logger)
+	}
+}
+
+// mergePolicyUpdates combines two updates to the same controller, as
+// when it is picked out by more than one spec.
+func mergePolicyUpdates(a, b policy.Update) policy.Update {
+	merged := policy.Update{Add: policy.Set{}, Remove: policy.Set{}}
+	for _, u := range []policy.Update{a, b} {
+		for p, v := range u.Add {
+			merged.Add = merged.Add.Set(p, v)
+		}
+		for p, v := range u.Remove {
+			merged.Remove = merged.Remove.Set(p, v)
+		}
+	}
+	return merged
+}
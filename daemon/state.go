@@ -0,0 +1,52 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// StateStore keeps small pieces of state under keys, somewhere they
+// survive a restart.
+type StateStore interface {
+	// Get gives the value recorded for the key, and whether there
+	// is one.
+	Get(ctx context.Context, key string) (string, bool, error)
+	// Set records the value for the key.
+	Set(ctx context.Context, key, value string) error
+}
+
+// loadState decodes the JSON recorded for the key into the value
+// given, and says whether there was anything recorded. Without a
+// StateStore, there never is.
+func (d *Daemon) loadState(key string, v interface{}) (bool, error) {
+	if d.StateStore == nil {
+		return false, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), gitOpTimeout)
+	defer cancel()
+	value, ok, err := d.StateStore.Get(ctx, key)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		return false, errors.Wrapf(err, "decoding state %q", key)
+	}
+	return true, nil
+}
+
+// storeState records the value for the key as JSON, if there's a
+// StateStore.
+func (d *Daemon) storeState(key string, v interface{}) error {
+	if d.StateStore == nil {
+		return nil
+	}
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), gitOpTimeout)
+	defer cancel()
+	return d.StateStore.Set(ctx, key, string(value))
+}
@@ -0,0 +1,200 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+
+	"github.com/weaveworks/flux"
+	"github.com/weaveworks/flux/cluster"
+	"github.com/weaveworks/flux/event"
+	"github.com/weaveworks/flux/git"
+	"github.com/weaveworks/flux/resource"
+	fluxsync "github.com/weaveworks/flux/sync"
+)
+
+// syncOutcome classifies how applying a revision to the cluster went.
+type syncOutcome int
+
+const (
+	syncSucceeded syncOutcome = iota
+	// some resources failed, but the rest were applied
+	syncPartial
+	// nothing was applied, so the revision doesn't count as synced
+	syncFailed
+)
+
+// classifySync says how a sync went, given the error it returned and
+// the resources it was applying. An error other than a
+// cluster.SyncError means the sync couldn't be carried out at all
+// (e.g., the cluster couldn't be reached); so does a SyncError
+// accounting for every resource.
+func classifySync(err error, resources map[string]resource.Resource) syncOutcome {
+	if err == nil {
+		return syncSucceeded
+	}
+	errs, ok := errors.Cause(err).(cluster.SyncError)
+	if !ok {
+		return syncFailed
+	}
+	for id := range resources {
+		if _, failed := errs[id]; !failed {
+			return syncPartial
+		}
+	}
+	return syncFailed
+}
+
+// syncRevision applies the manifests in the working clone, as
+// checked out at rev, to the cluster. Failures are reported with
+// reference to the commits given (i.e., those being synced, newest
+// first). It returns an error only if nothing could be synced; if
+// only some resources failed, the revision still counts as synced.
+func (d *Daemon) syncRevision(working *git.Checkout, rev string, commits []event.Commit, logger log.Logger) error {
+	started := time.Now().UTC()
+	full := d.FullSyncInterval <= 0 || started.Sub(d.lastFullSync) >= d.FullSyncInterval
+	resources, err := d.Manifests.LoadManifests(working.ManifestDir())
+	if err != nil {
+		err = errors.Wrap(err, "loading resources from repo")
+	} else if full {
+		// TODO supply deletes argument from somewhere (command-line?)
+		err = fluxsync.Sync(d.Manifests, resources, d.Cluster, false, logger)
+	} else {
+		err = fluxsync.SyncChanged(d.Manifests, resources, d.Cluster, false, logger)
+	}
+
+	outcome := classifySync(err, resources)
+	if full && outcome != syncFailed {
+		d.lastFullSync = started
+	}
+	if outcome == syncSucceeded {
+		d.reportedSyncFailure = ""
+		return nil
+	}
+	logger.Log("revision", rev, "err", err)
+	d.reportSyncFailure(started, rev, err, outcome == syncFailed, commits, logger)
+	if outcome == syncPartial {
+		return nil
+	}
+	return err
+}
+
+// syncEachCommit syncs the commits given (newest first) one at a
+// time, oldest first, so that a commit that can't be synced doesn't
+// hide whether the commits after it can be. It gives the newest
+// revision that was synced, or "" if none were, along with the error
+// from syncing the newest commit, if that failed. The working clone
+// is left checked out at the newest commit.
+func (d *Daemon) syncEachCommit(ctx context.Context, working *git.Checkout, commits []event.Commit, logger log.Logger) (string, error) {
+	var synced string
+	var err error
+	for i := len(commits) - 1; i >= 0; i-- {
+		rev := commits[i].Revision
+		ctx, cancel := context.WithTimeout(ctx, gitOpTimeout)
+		err = working.CheckoutRevision(ctx, rev)
+		cancel()
+		if err != nil {
+			return synced, err
+		}
+		if err = d.syncRevision(working, rev, commits[i:i+1], logger); err == nil {
+			synced = rev
+		}
+	}
+	return synced, err
+}
+
+// reportSyncFailure logs an event for a sync that failed, wholly or
+// in part. Each resource that failed is given with the newest of the
+// commits which changed it, if any did. The same failure is reported
+// only once, rather than at every sync, until a sync succeeds.
+func (d *Daemon) reportSyncFailure(started time.Time, rev string, err error, utter bool, commits []event.Commit, logger log.Logger) {
+	metadata := &event.SyncFailedEventMetadata{
+		Revision: rev,
+		Utter:    utter,
+	}
+	var serviceIDs []flux.ResourceID
+	if errs, ok := errors.Cause(err).(cluster.SyncError); ok {
+		for id, resErr := range errs {
+			resID, parseErr := flux.ParseResourceID(id)
+			if parseErr != nil {
+				logger.Log("resource", id, "err", parseErr)
+				continue
+			}
+			serviceIDs = append(serviceIDs, resID)
+			metadata.Errors = append(metadata.Errors, event.ResourceError{
+				ID:     resID,
+				Error:  resErr.Error(),
+				Commit: changedIn(commits, resID),
+			})
+		}
+		sort.Slice(metadata.Errors, func(i, j int) bool {
+			return metadata.Errors[i].ID.String() < metadata.Errors[j].ID.String()
+		})
+	} else {
+		metadata.Error = err.Error()
+	}
+
+	// Leave the revision out, so that the same errors persisting
+	// through later commits aren't reported again
+	key := fmt.Sprint(utter, metadata.Error)
+	for _, e := range metadata.Errors {
+		key += "\n" + e.ID.String() + ": " + e.Error
+	}
+	if key == d.reportedSyncFailure {
+		return
+	}
+	d.reportedSyncFailure = key
+
+	logLevel := event.LogLevelWarn
+	if utter {
+		logLevel = event.LogLevelError
+	}
+	if err := d.LogEvent(event.Event{
+		ServiceIDs: serviceIDs,
+		Type:       event.EventSyncFailed,
+		StartedAt:  started,
+		EndedAt:    time.Now().UTC(),
+		LogLevel:   logLevel,
+		Metadata:   metadata,
+	}); err != nil {
+		logger.Log("err", err)
+	}
+}
+
+// changedIn gives the newest of the commits (given newest first) that
+// changed the resource, or nil if none did.
+func changedIn(commits []event.Commit, id flux.ResourceID) *event.Commit {
+	for i := range commits {
+		for _, changed := range commits[i].ServiceIDs {
+			if changed == id {
+				c := commits[i]
+				return &c
+			}
+		}
+	}
+	return nil
+}
+
+// commitIndex gives the index of the commit with the revision given.
+func commitIndex(commits []git.Commit, rev string) int {
+	for i := range commits {
+		if commits[i].Revision == rev {
+			return i
+		}
+	}
+	return len(commits)
+}
+
+// Used in log messages for the revisions not synced
+func revisionList(commits []git.Commit) string {
+	revs := make([]string, len(commits))
+	for i, c := range commits {
+		revs[i] = c.Revision
+	}
+	return strings.Join(revs, ",")
+}
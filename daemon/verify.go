@@ -0,0 +1,115 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/weaveworks/flux/event"
+	"github.com/weaveworks/flux/git"
+	"github.com/weaveworks/flux/gpg"
+)
+
+// verifiedRevision checks the signatures on the commits since the
+// revision last synced, oldest first, and gives the newest revision
+// up to which every commit is signed by a trusted key, along with the
+// commits after that (newest first). Only the commits made on the
+// branch are checked, following the first parent of each merge: a
+// merge signed by a trusted key vouches for what it merged. Before
+// the first sync there is no record of which commits were trusted, so
+// it gives the newest signed commit instead, or if there's none, an
+// empty revision along with all the commits.
+func (d *Daemon) verifiedRevision(ctx context.Context, working *git.Checkout, syncedRev string) (string, []git.Commit, error) {
+	// Read the keys each time, so that changes to the secret they
+	// come from take effect without a restart.
+	keyRing, err := gpg.ReadKeyRing(d.TrustedKeys)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var commits []git.Commit
+	if syncedRev != "" {
+		ctx, cancel := context.WithTimeout(ctx, gitOpTimeout)
+		commits, err = working.FirstParentCommitsBetween(ctx, syncedRev, "HEAD")
+		cancel()
+	}
+	if syncedRev == "" || isUnknownRevision(err) {
+		ctx, cancel := context.WithTimeout(ctx, gitOpTimeout)
+		commits, err = working.FirstParentCommitsBefore(ctx, "HEAD")
+		cancel()
+		if err != nil {
+			return "", nil, err
+		}
+		for i, c := range commits {
+			err := verifyCommit(ctx, working, c.Revision, keyRing)
+			switch {
+			case err == nil:
+				return c.Revision, commits[:i], nil
+			case !git.IsUnverified(err):
+				return "", nil, err
+			}
+		}
+		// Nothing can be synced; this is reported like any other
+		// unverified commits, rather than as an error.
+		return "", commits, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	for i := len(commits) - 1; i >= 0; i-- {
+		err := verifyCommit(ctx, working, commits[i].Revision, keyRing)
+		if err == nil {
+			continue
+		}
+		if !git.IsUnverified(err) {
+			return "", nil, err
+		}
+		if i == len(commits)-1 {
+			return syncedRev, commits, nil
+		}
+		return commits[i+1].Revision, commits[:i+1], nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, gitOpTimeout)
+	defer cancel()
+	rev, err := working.HeadRevision(ctx)
+	return rev, nil, err
+}
+
+// verifyCommit checks the signature on a commit, giving each its own
+// timeout since there may be many to check.
+func verifyCommit(ctx context.Context, working *git.Checkout, rev string, keyRing openpgp.EntityList) error {
+	ctx, cancel := context.WithTimeout(ctx, gitOpTimeout)
+	defer cancel()
+	_, err := working.VerifyCommit(ctx, rev, keyRing)
+	return err
+}
+
+// reportUnverified logs an event for commits that won't be synced
+// because they aren't signed by a trusted key. It's reported once for
+// each new HEAD, rather than at every sync.
+func (d *Daemon) reportUnverified(unverified []git.Commit, logger log.Logger) {
+	if len(unverified) == 0 || unverified[0].Revision == d.reportedUnverified {
+		return
+	}
+	d.reportedUnverified = unverified[0].Revision
+	revs := make([]string, len(unverified))
+	for i, c := range unverified {
+		revs[i] = c.Revision
+	}
+	logger.Log("warning", "not syncing commits not signed by a trusted key", "revisions", strings.Join(revs, ","))
+	now := time.Now().UTC()
+	if err := d.LogEvent(event.Event{
+		Type:      event.EventUnverifiedCommits,
+		StartedAt: now,
+		EndedAt:   now,
+		LogLevel:  event.LogLevelWarn,
+		Message:   fmt.Sprintf("Not syncing %d commit(s) not signed by a trusted key, up to %s", len(unverified), unverified[0].Revision),
+	}); err != nil {
+		logger.Log("err", err)
+	}
+}
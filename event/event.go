@@ -15,15 +15,20 @@ import (
 
 // These are all the types of events.
 const (
-	EventCommit       = "commit"
-	EventSync         = "sync"
-	EventRelease      = "release"
-	EventAutoRelease  = "autorelease"
-	EventAutomate     = "automate"
-	EventDeautomate   = "deautomate"
-	EventLock         = "lock"
-	EventUnlock       = "unlock"
-	EventUpdatePolicy = "update_policy"
+	EventCommit            = "commit"
+	EventSync              = "sync"
+	EventRelease           = "release"
+	EventAutoRelease       = "autorelease"
+	EventAutomate          = "automate"
+	EventDeautomate        = "deautomate"
+	EventLock              = "lock"
+	EventUnlock            = "unlock"
+	EventUpdatePolicy      = "update_policy"
+	EventCanaryFailed      = "canary_failed"
+	EventRollback          = "rollback"
+	EventReleaseRejected   = "release_rejected"
+	EventUnverifiedCommits = "unverified_commits"
+	EventSyncFailed        = "sync_failed"
 
 	// This is used to label e.g., commits that we _don't_ consider an event in themselves.
 	NoneOfTheAbove = "other"
@@ -122,6 +127,13 @@ func (e Event) String() string {
 	case EventAutoRelease:
 		metadata := e.Metadata.(*AutoReleaseEventMetadata)
 		strImageIDs := metadata.Result.ImageIDs()
+		if len(strImageIDs) == 0 && metadata.Revision == "" && len(strServiceIDs) > 0 {
+			// Nothing was released; the changes were held back
+			return fmt.Sprintf(
+				"Automated release to %s held back",
+				strings.Join(strServiceIDs, ", "),
+			)
+		}
 		if len(strImageIDs) == 0 {
 			strImageIDs = []string{"no image changes"}
 		}
@@ -153,6 +165,16 @@ func (e Event) String() string {
 			svcStr = strings.Join(strServiceIDs, ", ")
 		}
 		return fmt.Sprintf("Sync: %s, %s", revStr, svcStr)
+	case EventSyncFailed:
+		metadata := e.Metadata.(*SyncFailedEventMetadata)
+		what := "some resources failed"
+		if metadata.Utter {
+			what = "nothing synced"
+		}
+		if len(strServiceIDs) > 0 {
+			what = fmt.Sprintf("%s: %s", what, strings.Join(strServiceIDs, ", "))
+		}
+		return fmt.Sprintf("Sync failed: %s, %s", shortRevision(metadata.Revision), what)
 	case EventAutomate:
 		return fmt.Sprintf("Automated: %s", strings.Join(strServiceIDs, ", "))
 	case EventDeautomate:
@@ -180,6 +202,13 @@ type CommitEventMetadata struct {
 	Revision string        `json:"revision,omitempty"`
 	Spec     *update.Spec  `json:"spec"`
 	Result   update.Result `json:"result,omitempty"`
+	// PullRequest is the URL of the pull request proposing the
+	// commit, if it wasn't pushed directly.
+	PullRequest string `json:"pullRequest,omitempty"`
+	// PushRetries is how many times the commit had to be rebased (or
+	// the update redone) because the branch moved on while the job
+	// was running.
+	PushRetries int `json:"pushRetries,omitempty"`
 }
 
 func (c CommitEventMetadata) ShortRevision() string {
@@ -193,6 +222,23 @@ func (c CommitEventMetadata) ShortRevision() string {
 type Commit struct {
 	Revision string `json:"revision"`
 	Message  string `json:"message"`
+	// These are left out of events from older daemons
+	Author    *CommitSignature `json:"author,omitempty"`
+	Committer *CommitSignature `json:"committer,omitempty"`
+	// The files changed in the commit, and the resources defined in
+	// them; these are left out for an initial sync.
+	Files      []string          `json:"files,omitempty"`
+	ServiceIDs []flux.ResourceID `json:"serviceIDs,omitempty"`
+	// URL, if the daemon was told how to make one, links to the
+	// commit in e.g., the git host's web interface.
+	URL string `json:"url,omitempty"`
+}
+
+// CommitSignature says who authored or committed a commit, and when.
+type CommitSignature struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	Time  time.Time `json:"time"`
 }
 
 // SyncEventMetadata is the metadata for when new a commit is synced to the cluster
@@ -224,6 +270,30 @@ func (ev *SyncEventMetadata) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// SyncFailedEventMetadata is the metadata for when a sync fails,
+// either utterly or for some of the resources
+type SyncFailedEventMetadata struct {
+	// The revision that was being synced
+	Revision string `json:"revision"`
+	// Utter is true if nothing could be synced, in which case the
+	// revision is not recorded as synced
+	Utter bool `json:"utter,omitempty"`
+	// Error is the reason for an utter failure, when it wasn't down
+	// to particular resources
+	Error string `json:"error,omitempty"`
+	// Errors has a ResourceError for each resource that failed
+	Errors []ResourceError `json:"errors,omitempty"`
+}
+
+// ResourceError is the error from syncing a particular resource,
+// along with the commit which last changed it, if that was among the
+// commits being synced.
+type ResourceError struct {
+	ID     flux.ResourceID `json:"id"`
+	Error  string          `json:"error"`
+	Commit *Commit         `json:"commit,omitempty"`
+}
+
 type ReleaseEventCommon struct {
 	Revision string        // the revision which has the changes for the release
 	Result   update.Result `json:"result"`
@@ -294,6 +364,13 @@ func (e *Event) UnmarshalJSON(in []byte) error {
 		}
 		e.Metadata = &metadata
 		break
+	case EventSyncFailed:
+		var metadata SyncFailedEventMetadata
+		if err := json.Unmarshal(wireEvent.MetadataBytes, &metadata); err != nil {
+			return err
+		}
+		e.Metadata = &metadata
+		break
 	default:
 		if len(wireEvent.MetadataBytes) > 0 {
 			var metadata UnknownEventMetadata
@@ -325,6 +402,10 @@ func (cem *SyncEventMetadata) Type() string {
 	return EventSync
 }
 
+func (sfm *SyncFailedEventMetadata) Type() string {
+	return EventSyncFailed
+}
+
 func (rem *ReleaseEventMetadata) Type() string {
 	return EventRelease
 }
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"testing"
 
+	"github.com/weaveworks/flux"
 	"github.com/weaveworks/flux/update"
 )
 
@@ -44,6 +45,39 @@ func TestEvent_ParseReleaseMetaData(t *testing.T) {
 	}
 }
 
+func TestEvent_ParseSyncFailedMetadata(t *testing.T) {
+	id := flux.MustParseResourceID("default:deployment/helloworld")
+	origEvent := Event{
+		Type:       EventSyncFailed,
+		ServiceIDs: []flux.ResourceID{id},
+		Metadata: &SyncFailedEventMetadata{
+			Revision: "abcdef0123456789",
+			Errors: []ResourceError{
+				{ID: id, Error: "invalid spec", Commit: &Commit{Revision: "abcdef0123456789"}},
+			},
+		},
+	}
+
+	bytes, _ := json.Marshal(origEvent)
+
+	e := Event{}
+	err := e.UnmarshalJSON(bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch r := e.Metadata.(type) {
+	case *SyncFailedEventMetadata:
+		if len(r.Errors) != 1 || r.Errors[0].ID != id || r.Errors[0].Commit == nil {
+			t.Fatal("Sync failed event wasn't marshalled/unmarshalled")
+		}
+	default:
+		t.Fatal("Wrong event type unmarshalled")
+	}
+	if s := e.String(); s != "Sync failed: abcdef0, some resources failed: default:deployment/helloworld" {
+		t.Errorf("unexpected description of event: %q", s)
+	}
+}
+
 func TestEvent_ParseNoMetadata(t *testing.T) {
 	origEvent := Event{
 		Type: EventLock,
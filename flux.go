@@ -265,6 +265,9 @@ type Container struct {
 	Name      string
 	Current   Image
 	Available []Image
+	// Policies in effect for this container, taking into account
+	// those scoped to the container
+	Policies map[string]string `json:",omitempty"`
 }
 
 // --- config types
@@ -289,4 +292,16 @@ type GitRemoteConfig struct {
 type GitConfig struct {
 	Remote       GitRemoteConfig `json:"remote"`
 	PublicSSHKey ssh.PublicKey   `json:"publicSSHKey"`
+	// Auth is how the daemon authenticates to the remote; one of
+	// the GitAuth values, or empty if it predates reporting this.
+	Auth string `json:"auth,omitempty"`
+	// KnownHosts are the entries SSH host keys are checked against,
+	// if the daemon has been given them.
+	KnownHosts []ssh.KnownHost `json:"knownHosts,omitempty"`
 }
+
+const (
+	GitAuthSSH   = "ssh"
+	GitAuthHTTPS = "https"
+	GitAuthNone  = "none"
+)
@@ -0,0 +1,24 @@
+// Package forge has the interface for proposing changes to a git
+// repo as pull requests (or merge requests, or whatever a particular
+// git hosting service calls them), rather than pushing them directly.
+package forge
+
+import (
+	"context"
+)
+
+// PullRequest describes a change to be proposed: the branch with the
+// change, and the branch it should be merged into.
+type PullRequest struct {
+	Title string
+	Body  string
+	Head  string
+	Base  string
+}
+
+// Client opens pull requests with a git hosting service.
+type Client interface {
+	// OpenPullRequest proposes the change, and returns a URL at
+	// which it can be viewed.
+	OpenPullRequest(context.Context, PullRequest) (string, error)
+}
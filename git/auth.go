@@ -0,0 +1,150 @@
+package git
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/weaveworks/flux"
+	"github.com/weaveworks/flux/ssh"
+)
+
+// Credentials supply the username and password (or token) to use
+// for HTTPS remotes.
+type Credentials interface {
+	Credentials() (username, password string, err error)
+}
+
+// SecretCredentials reads credentials from the files `username` and
+// `token` (or `password`) in a directory, as when a Kubernetes
+// secret is mounted as a volume. The files are read whenever the
+// credentials are needed, so an updated secret takes effect without
+// restarting. The username may be left out, since it's not checked
+// by most hosts when given a token.
+type SecretCredentials struct {
+	Dir string
+}
+
+func (s SecretCredentials) Credentials() (string, string, error) {
+	username, err := s.read("username")
+	if err != nil && !os.IsNotExist(err) {
+		return "", "", errors.Wrap(err, "reading git username")
+	}
+	if username == "" {
+		username = "git"
+	}
+	password, err := s.read("token")
+	if os.IsNotExist(err) {
+		password, err = s.read("password")
+	}
+	if err != nil {
+		return "", "", errors.Wrap(err, "reading git token or password")
+	}
+	return username, password, nil
+}
+
+func (s SecretCredentials) read(name string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(s.Dir, name))
+	return strings.TrimSpace(string(b)), err
+}
+
+// Auth is what's used to authenticate to the upstream repo: the key
+// for SSH URLs, or the credentials for HTTPS URLs. A nil *Auth means
+// no authentication, e.g., for local clones.
+type Auth struct {
+	KeyRing     ssh.KeyRing
+	Credentials Credentials
+	// KnownHosts is the path to a known_hosts file. If given, SSH
+	// hosts must present a key listed there; otherwise, whatever
+	// the environment provides is used.
+	KnownHosts string
+}
+
+// Mode says which way of authenticating will be used for the URL
+// given.
+func (a *Auth) Mode(repoURL string) string {
+	if isHTTP(repoURL) {
+		if a != nil && a.Credentials != nil {
+			return flux.GitAuthHTTPS
+		}
+		return flux.GitAuthNone
+	}
+	if a != nil && a.KeyRing != nil {
+		return flux.GitAuthSSH
+	}
+	return flux.GitAuthNone
+}
+
+func isHTTP(repoURL string) bool {
+	return strings.HasPrefix(repoURL, "https://") || strings.HasPrefix(repoURL, "http://")
+}
+
+// RedactURL removes any credentials included in the URL given, so it
+// can be logged or reported.
+func RedactURL(repoURL string) string {
+	u, err := url.Parse(repoURL)
+	if err != nil || u.User == nil || !isHTTP(repoURL) {
+		return repoURL
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "redacted")
+	} else {
+		u.User = url.User("redacted")
+	}
+	return u.String()
+}
+
+// redact removes the secrets given from a message, e.g., one
+// reported by git, which may include the URL it was given.
+func redact(msg string, secrets ...string) string {
+	for _, s := range secrets {
+		if s != "" {
+			msg = strings.Replace(msg, s, "redacted", -1)
+		}
+	}
+	return msg
+}
+
+// urlSecret gives the password or token included in a URL, if any.
+func urlSecret(repoURL string) string {
+	u, err := url.Parse(repoURL)
+	if err != nil || u.User == nil || !isHTTP(repoURL) {
+		return ""
+	}
+	if p, ok := u.User.Password(); ok {
+		return p
+	}
+	return u.User.Username()
+}
+
+// redactError removes the secrets given from the error's message.
+// The error is kept as the cause, so what kind of error it is can
+// still be checked (e.g., with errors.Cause).
+func redactError(err error, secrets ...string) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	if redacted := redact(msg, secrets...); redacted != msg {
+		return &redactedError{msg: redacted, cause: err}
+	}
+	return err
+}
+
+// redactedError is an error with its message redacted.
+type redactedError struct {
+	msg   string
+	cause error
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Cause() error {
+	return e.cause
+}
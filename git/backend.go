@@ -0,0 +1,144 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+const (
+	// ExecBackend runs the git (and ssh) binaries for each operation.
+	ExecBackend = "exec"
+	// GoBackend does git operations in-process, so needs no binaries.
+	GoBackend = "go"
+)
+
+var (
+	ErrUnknownRevision = errors.New("unknown revision")
+	ErrRefNotFound     = errors.New("couldn't find remote ref")
+	ErrNoNote          = errors.New("no note found for object")
+	// ErrFileNotFound means a file is not in the commit asked about.
+	ErrFileNotFound = errors.New("file not found in commit")
+	// ErrHostKeyVerification means the SSH host didn't present a key
+	// we know for it.
+	ErrHostKeyVerification = errors.New("host key verification failed")
+	// ErrNonFastForward means a push was refused because upstream
+	// has commits we don't.
+	ErrNonFastForward = errors.New("push is not a fast-forward")
+	// ErrRebaseConflict means local commits could not be replayed
+	// on the upstream branch without conflicts.
+	ErrRebaseConflict = errors.New("conflict rebasing on upstream")
+	// ErrNotSigned means a commit has no signature.
+	ErrNotSigned = errors.New("commit is not signed")
+	// ErrUntrustedSignature means a commit's signature could not be
+	// checked against the keys trusted.
+	ErrUntrustedSignature = errors.New("commit signature is not from a trusted key")
+	// ErrSigningUnsupported means the backend can't sign commits.
+	ErrSigningUnsupported = errors.New("signing is not supported by this git backend")
+	// ErrShallowUnsupported means the backend can't make shallow or
+	// sparse clones.
+	ErrShallowUnsupported = errors.New("shallow and sparse clones are not supported by this git backend")
+)
+
+// CloneOptions say how much of a repo to clone. The zero value means
+// a full clone.
+type CloneOptions struct {
+	// Depth, if greater than zero, is how many commits of history
+	// to fetch.
+	Depth int
+	// SparsePath, if not empty, is the only directory whose files
+	// are checked out.
+	SparsePath string
+	// Shared means the clone may use the objects of the (local)
+	// repo it is cloned from, rather than copying them. Backends
+	// that can't do that make an ordinary clone.
+	Shared bool
+}
+
+// Backend does the git operations that a Repo and its Checkouts need,
+// on the clone in the directory given. Implementations report
+// missing revisions, refs and notes with the errors above (possibly
+// wrapped), so that callers need not interpret error messages.
+type Backend interface {
+	// Clone the branch given from the URL given, into a directory
+	// under workingDir, returning the path to the clone.
+	Clone(ctx context.Context, workingDir string, auth *Auth, repoURL, repoBranch string, opts CloneOptions) (string, error)
+	// Config sets the user and email used for commits in the clone,
+	// and the GPG key to sign them with, if signingKey is not empty.
+	Config(ctx context.Context, dir, user, email, signingKey string) error
+	// Commit all changes to tracked files.
+	Commit(ctx context.Context, dir string, commitAction *CommitAction) error
+	// HasChanges says whether there are uncommitted changes to
+	// tracked files under subdir.
+	HasChanges(ctx context.Context, dir, subdir string) bool
+	// Push the refs given to upstream.
+	Push(ctx context.Context, auth *Auth, dir, upstream string, refs []string) error
+	// Pull fast-forwards the branch given from upstream.
+	Pull(ctx context.Context, auth *Auth, dir, upstream, branch string) error
+	// Rebase replays local commits on top of the branch given from
+	// upstream. If that can't be done cleanly, it leaves the clone
+	// as it was and returns ErrRebaseConflict.
+	Rebase(ctx context.Context, auth *Auth, dir, upstream, branch string) error
+	// CheckoutRevision updates the files to those at the revision
+	// given, detaching HEAD.
+	CheckoutRevision(ctx context.Context, dir, rev string) error
+	// Fetch the refspec given, and all tags, from upstream. It is not
+	// an error for the refspec to be missing upstream.
+	Fetch(ctx context.Context, auth *Auth, dir, upstream, refspec string) error
+	// Deepen fetches depth more commits of the branch's history
+	// into a shallow clone, or if depth is zero, all the rest of it.
+	Deepen(ctx context.Context, auth *Auth, dir, upstream, branch string, depth int) error
+	// IsAncestor says whether the commit ancestor is reachable from
+	// rev, as far as the history in the clone goes.
+	IsAncestor(ctx context.Context, dir, ancestor, rev string) (bool, error)
+	RefExists(ctx context.Context, dir, ref string) (bool, error)
+	// RefRevision gives the commit a ref (or other revision) refers to.
+	RefRevision(ctx context.Context, dir, ref string) (string, error)
+	// Log gives the commits in the revision range given which touch
+	// subdir (or all of them, if subdir is empty), most recent first,
+	// with the first line of their messages.
+	Log(ctx context.Context, dir, revisions, subdir string) ([]Commit, error)
+	// FirstParentLog is like Log, but follows only the first parent
+	// of each merge, i.e., gives the commits made on the branch
+	// itself rather than those merged into it.
+	FirstParentLog(ctx context.Context, dir, revisions, subdir string) ([]Commit, error)
+	// CommitFiles gives the files under subdir changed by the
+	// commit, compared with its first parent.
+	CommitFiles(ctx context.Context, dir, rev, subdir string) ([]string, error)
+	// FileAt gives the contents of the file at path, relative to the
+	// top of the repo, as of the commit given.
+	FileAt(ctx context.Context, dir, rev, path string) ([]byte, error)
+	// ChangedFiles gives the files under subdir that are present and
+	// differ from those at ref.
+	ChangedFiles(ctx context.Context, dir, subdir, ref string) ([]string, error)
+	// MoveTagAndPush points the annotated tag given at ref, signed
+	// with signingKey if that is not empty, and force-pushes it to
+	// upstream.
+	MoveTagAndPush(ctx context.Context, dir string, auth *Auth, tag, ref, msg, upstream, signingKey string) error
+	// VerifyCommit checks the commit's signature against the keys
+	// given, returning the ID of the key that signed it. An unsigned
+	// commit gives ErrNotSigned, and a commit signed by some other
+	// key ErrUntrustedSignature.
+	VerifyCommit(ctx context.Context, dir, rev string, keyRing openpgp.EntityList) (string, error)
+	// NotesRef gives the full ref for a shorthand notes ref.
+	NotesRef(ctx context.Context, dir, ref string) (string, error)
+	AddNote(ctx context.Context, dir, rev, notesRef string, note *Note) error
+	// GetNote returns (nil, nil) if there is no note for rev.
+	GetNote(ctx context.Context, dir, notesRef, rev string) (*Note, error)
+	// NoteRevList gives the revisions that have a note.
+	NoteRevList(ctx context.Context, dir, notesRef string) (map[string]struct{}, error)
+}
+
+// NewBackend gives the backend named, either ExecBackend or
+// GoBackend.
+func NewBackend(name string) (Backend, error) {
+	switch name {
+	case ExecBackend:
+		return execBackend{}, nil
+	case GoBackend:
+		return goBackend{}, nil
+	}
+	return nil, fmt.Errorf("unknown git backend %q; expected %q or %q", name, ExecBackend, GoBackend)
+}
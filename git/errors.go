@@ -1,7 +1,7 @@
 package git
 
 import (
-	"errors"
+	"github.com/pkg/errors"
 
 	fluxerr "github.com/weaveworks/flux/errors"
 )
@@ -21,6 +21,9 @@ described in
 }
 
 func CloningError(url string, actual error) error {
+	if errors.Cause(actual) == ErrHostKeyVerification {
+		return HostKeyError(url, actual)
+	}
 	return &fluxerr.Error{
 		Type: fluxerr.User,
 		Err:  actual,
@@ -45,6 +48,9 @@ cross-check with the fingerprint given by
 }
 
 func PushError(url string, actual error) error {
+	if errors.Cause(actual) == ErrHostKeyVerification {
+		return HostKeyError(url, actual)
+	}
 	return &fluxerr.Error{
 		Type: fluxerr.User,
 		Err:  actual,
@@ -76,3 +82,68 @@ check the box to allow write access.
 `,
 	}
 }
+
+func HostKeyError(url string, actual error) error {
+	return &fluxerr.Error{
+		Type: fluxerr.User,
+		Err:  actual,
+		Help: `Could not verify the host key of your git repository
+
+The SSH host for your git repository,
+
+    ` + url + `
+
+did not present a host key that is listed as known for it. Either the
+host is missing from the known_hosts file given to fluxd, or its key
+has changed since the file was written.
+
+If the host has legitimately changed its key (or is new to the file),
+get its current key, e.g., with
+
+    ssh-keyscan <host>
+
+check the fingerprint against that published by your git host, and
+add it to the known_hosts file (or the ConfigMap it comes from). To see
+the entries fluxd is using, run
+
+    fluxctl identity --known-hosts
+
+If you did not expect the key to change, do not update the file until
+you have found out why, since it may mean the connection is being
+intercepted.
+
+`,
+	}
+}
+
+// IsNonFastForward says whether the error is from a push that was
+// refused because upstream has moved on, in which case it is worth
+// rebasing and pushing again.
+func IsNonFastForward(err error) bool {
+	return causeIs(err, ErrNonFastForward)
+}
+
+// IsRebaseConflict says whether the error is from a rebase that could
+// not be done cleanly.
+func IsRebaseConflict(err error) bool {
+	return causeIs(err, ErrRebaseConflict)
+}
+
+// IsFileNotFound says whether the error is from looking for a file in
+// a commit that doesn't have it.
+func IsFileNotFound(err error) bool {
+	return causeIs(err, ErrFileNotFound)
+}
+
+// IsUnverified says whether the error is from checking a commit that
+// is unsigned, or not signed by a trusted key.
+func IsUnverified(err error) bool {
+	return causeIs(err, ErrNotSigned) || causeIs(err, ErrUntrustedSignature)
+}
+
+func causeIs(err, target error) bool {
+	if ferr, ok := err.(*fluxerr.Error); ok {
+		err = ferr.Err
+	}
+	return errors.Cause(err) == target
+}
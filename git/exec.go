@@ -0,0 +1,107 @@
+package git
+
+import (
+	"context"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// execBackend does git operations by running the git binary, which
+// in turn runs ssh for remote operations.
+type execBackend struct{}
+
+func (execBackend) Clone(ctx context.Context, workingDir string, auth *Auth, repoURL, repoBranch string, opts CloneOptions) (string, error) {
+	return clone(ctx, workingDir, auth, repoURL, repoBranch, opts)
+}
+
+func (execBackend) Config(ctx context.Context, dir, user, email, signingKey string) error {
+	return config(ctx, dir, user, email, signingKey)
+}
+
+func (execBackend) Commit(ctx context.Context, dir string, commitAction *CommitAction) error {
+	return commit(ctx, dir, commitAction)
+}
+
+func (execBackend) HasChanges(ctx context.Context, dir, subdir string) bool {
+	return check(ctx, dir, subdir)
+}
+
+func (execBackend) Push(ctx context.Context, auth *Auth, dir, upstream string, refs []string) error {
+	return push(ctx, auth, dir, upstream, refs)
+}
+
+func (execBackend) Pull(ctx context.Context, auth *Auth, dir, upstream, branch string) error {
+	return pull(ctx, auth, dir, upstream, branch)
+}
+
+func (execBackend) Rebase(ctx context.Context, auth *Auth, dir, upstream, branch string) error {
+	return rebase(ctx, auth, dir, upstream, branch)
+}
+
+func (execBackend) CheckoutRevision(ctx context.Context, dir, rev string) error {
+	return checkoutRevision(ctx, dir, rev)
+}
+
+func (execBackend) Fetch(ctx context.Context, auth *Auth, dir, upstream, refspec string) error {
+	return fetch(ctx, auth, dir, upstream, refspec)
+}
+
+func (execBackend) Deepen(ctx context.Context, auth *Auth, dir, upstream, branch string, depth int) error {
+	return deepen(ctx, auth, dir, upstream, branch, depth)
+}
+
+func (execBackend) IsAncestor(ctx context.Context, dir, ancestor, rev string) (bool, error) {
+	return isAncestor(ctx, dir, ancestor, rev)
+}
+
+func (execBackend) RefExists(ctx context.Context, dir, ref string) (bool, error) {
+	return refExists(ctx, dir, ref)
+}
+
+func (execBackend) RefRevision(ctx context.Context, dir, ref string) (string, error) {
+	return refRevision(ctx, dir, ref)
+}
+
+func (execBackend) Log(ctx context.Context, dir, revisions, subdir string) ([]Commit, error) {
+	return onelinelog(ctx, dir, revisions, subdir)
+}
+
+func (execBackend) FirstParentLog(ctx context.Context, dir, revisions, subdir string) ([]Commit, error) {
+	return onelinelog(ctx, dir, revisions, subdir, "--first-parent")
+}
+
+func (execBackend) CommitFiles(ctx context.Context, dir, rev, subdir string) ([]string, error) {
+	return commitFiles(ctx, dir, rev, subdir)
+}
+
+func (execBackend) FileAt(ctx context.Context, dir, rev, path string) ([]byte, error) {
+	return fileAt(ctx, dir, rev, path)
+}
+
+func (execBackend) ChangedFiles(ctx context.Context, dir, subdir, ref string) ([]string, error) {
+	return changedFiles(ctx, dir, subdir, ref)
+}
+
+func (execBackend) MoveTagAndPush(ctx context.Context, dir string, auth *Auth, tag, ref, msg, upstream, signingKey string) error {
+	return moveTagAndPush(ctx, dir, auth, tag, ref, msg, upstream, signingKey)
+}
+
+func (execBackend) VerifyCommit(ctx context.Context, dir, rev string, keyRing openpgp.EntityList) (string, error) {
+	return verifyCommit(ctx, dir, rev, keyRing)
+}
+
+func (execBackend) NotesRef(ctx context.Context, dir, ref string) (string, error) {
+	return getNotesRef(ctx, dir, ref)
+}
+
+func (execBackend) AddNote(ctx context.Context, dir, rev, notesRef string, note *Note) error {
+	return addNote(ctx, dir, rev, notesRef, note)
+}
+
+func (execBackend) GetNote(ctx context.Context, dir, notesRef, rev string) (*Note, error) {
+	return getNote(ctx, dir, notesRef, rev)
+}
+
+func (execBackend) NoteRevList(ctx context.Context, dir, notesRef string) (map[string]struct{}, error) {
+	return noteRevList(ctx, dir, notesRef)
+}
@@ -1,7 +1,9 @@
 package gittest
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"reflect"
 	"testing"
@@ -128,3 +130,322 @@ func TestCheckout(t *testing.T) {
 	defer anotherCheckout.Clean()
 	check(checkout)
 }
+
+func TestCommitAndPushBranch(t *testing.T) {
+	repo, cleanup := Repo(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	params := git.Config{
+		UserName:  "example",
+		UserEmail: "example@example.com",
+		SyncTag:   "flux-test",
+		NotesRef:  "fluxtest",
+	}
+	checkout, err := repo.Clone(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkout.Clean()
+
+	before, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	working, err := checkout.WorkingClone(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer working.Clean()
+
+	changedFile := ""
+	for file, _ := range testfiles.Files {
+		changedFile = file
+		break
+	}
+	if err := ioutil.WriteFile(filepath.Join(working.ManifestDir(), changedFile), []byte("PROPOSED CHANGE"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	note := git.Note{
+		JobID:  job.ID("jobID1234"),
+		Branch: "flux/jobID1234",
+		Spec: update.Spec{
+			Type: update.Images,
+			Spec: update.ReleaseSpec{},
+		},
+	}
+	commitAction := &git.CommitAction{Author: "", Message: "Proposed change"}
+	if err := working.CommitAndPushBranch(ctx, commitAction, &note, note.Branch); err != nil {
+		t.Fatal(err)
+	}
+
+	// The branch we're syncing should be untouched
+	if err := checkout.Pull(ctx); err != nil {
+		t.Fatal(err)
+	}
+	after, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before != after {
+		t.Errorf("expected %s to be unchanged at %s, but it is at %s", repo.Branch, before, after)
+	}
+
+	// .. and the change should be on the new branch, with the note
+	proposed := repo
+	proposed.Branch = note.Branch
+	branchCheckout, err := proposed.Clone(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer branchCheckout.Clean()
+
+	contents, err := ioutil.ReadFile(filepath.Join(branchCheckout.ManifestDir(), changedFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "PROPOSED CHANGE" {
+		t.Error("contents on branch are not what we committed")
+	}
+	rev, err := branchCheckout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotNote, err := branchCheckout.GetNote(ctx, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotNote == nil || !reflect.DeepEqual(*gotNote, note) {
+		t.Errorf("note is not what we supplied when committing: %#v", gotNote)
+	}
+}
+
+func TestRebaseAndPush(t *testing.T) {
+	checkout, cleanup := Checkout(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	var files []string
+	for file := range testfiles.Files {
+		files = append(files, file)
+	}
+	if len(files) < 2 {
+		t.Fatal("expected at least two test files")
+	}
+
+	commitChange := func(file, contents string) *git.Checkout {
+		working, err := checkout.WorkingClone(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(working.ManifestDir(), file), []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return working
+	}
+
+	first := commitChange(files[0], "FIRST CHANGE")
+	defer first.Clean()
+	second := commitChange(files[1], "SECOND CHANGE")
+	defer second.Clean()
+	conflicting := commitChange(files[0], "CONFLICTING CHANGE")
+	defer conflicting.Clean()
+
+	if err := first.CommitAndPush(ctx, &git.CommitAction{Message: "First"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	note := git.Note{
+		JobID: job.ID("second"),
+		Spec: update.Spec{
+			Type: update.Images,
+			Spec: update.ReleaseSpec{},
+		},
+	}
+	err := second.CommitAndPush(ctx, &git.CommitAction{Message: "Second"}, &note)
+	if !git.IsNonFastForward(err) {
+		t.Fatalf("expected non-fast-forward error, got %v", err)
+	}
+	if err := second.Rebase(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Push(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkout.Pull(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for file, expected := range map[string]string{
+		files[0]: "FIRST CHANGE",
+		files[1]: "SECOND CHANGE",
+	} {
+		contents, err := ioutil.ReadFile(filepath.Join(checkout.ManifestDir(), file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != expected {
+			t.Errorf("expected %s to contain %q, got %q", file, expected, contents)
+		}
+	}
+	head, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotNote, err := checkout.GetNote(ctx, head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotNote == nil || gotNote.JobID != note.JobID {
+		t.Errorf("expected note for job %s on rebased commit, got %#v", note.JobID, gotNote)
+	}
+
+	// A change to the same file can't be rebased, and should be left
+	// as it was.
+	err = conflicting.CommitAndPush(ctx, &git.CommitAction{Message: "Conflicting"}, nil)
+	if !git.IsNonFastForward(err) {
+		t.Fatalf("expected non-fast-forward error, got %v", err)
+	}
+	before, err := conflicting.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conflicting.Rebase(ctx); !git.IsRebaseConflict(err) {
+		t.Fatalf("expected rebase conflict, got %v", err)
+	}
+	after, err := conflicting.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before != after {
+		t.Errorf("expected HEAD to be left at %s after conflict, got %s", before, after)
+	}
+}
+
+func TestShallowSparseClone(t *testing.T) {
+	repo, cleanup := Repo(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	params := git.Config{
+		UserName:  "example",
+		UserEmail: "example@example.com",
+		SyncTag:   "flux-test",
+		NotesRef:  "fluxtest",
+	}
+	full, err := repo.Clone(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer full.Clean()
+	initial, err := full.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add some history, with files both in and outside the path
+	// we'll check out
+	for i := 0; i < 3; i++ {
+		for _, dir := range []string{"dev", "other"} {
+			if err := os.MkdirAll(filepath.Join(full.Dir, dir), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(full.Dir, dir, "app.yaml"), []byte(fmt.Sprintf("revision: %d\n", i)), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, args := range [][]string{
+			{"add", "--all"},
+			{"commit", "-m", fmt.Sprintf("Commit %d", i)},
+			{"push", repo.URL, "master"},
+		} {
+			if err := execCommand("git", append([]string{"-C", full.Dir}, args...)...); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Local clones ignore the depth, so use a file URL
+	shallowRepo := repo
+	shallowRepo.URL = "file://" + repo.URL
+	shallowRepo.Path = "dev"
+	shallowRepo.Depth = 1
+	shallowRepo.Sparse = true
+	checkout, err := shallowRepo.Clone(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkout.Clean()
+
+	working, err := checkout.WorkingClone(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer working.Clean()
+
+	for _, c := range []*git.Checkout{checkout, working} {
+		if _, err := os.Stat(filepath.Join(c.Dir, "dev", "app.yaml")); err != nil {
+			t.Errorf("expected files under the path to be checked out: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(c.Dir, "other")); !os.IsNotExist(err) {
+			t.Errorf("expected files outside the path not to be checked out, got %v", err)
+		}
+	}
+
+	// The commits since the initial revision are beyond the depth
+	// cloned, so more history must be fetched. The working clone
+	// gets it by way of the checkout it was made from ...
+	commits, err := working.CommitsBetween(ctx, initial, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 3 {
+		t.Errorf("expected 3 commits since the initial revision, got %+v", commits)
+	}
+
+	// Looking back through all the commits before a revision (as
+	// when finding a release to roll back, or a job's commit) needs
+	// all the history, not just enough to reach some other revision.
+	fresh, err := shallowRepo.Clone(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Clean()
+	freshWorking, err := fresh.WorkingClone(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer freshWorking.Clean()
+	for _, c := range []*git.Checkout{freshWorking, fresh} {
+		commits, err := c.CommitsBefore(ctx, "HEAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(commits) < 3 {
+			t.Errorf("expected at least the 3 commits since the initial revision, got %+v", commits)
+		}
+	}
+
+	// ... so neither that checkout nor another working clone need
+	// go upstream for it again.
+	if err := os.Rename(repo.URL, repo.URL+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Rename(repo.URL+".moved", repo.URL)
+	another, err := checkout.WorkingClone(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer another.Clean()
+	for _, c := range []*git.Checkout{checkout, another} {
+		commits, err := c.CommitsBetween(ctx, initial, "HEAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(commits) != 3 {
+			t.Errorf("expected 3 commits since the initial revision, got %+v", commits)
+		}
+	}
+}
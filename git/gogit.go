@@ -0,0 +1,1188 @@
+package git
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/ssh/knownhosts"
+	gogit "gopkg.in/src-d/go-git.v4"
+	gitconfig "gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/server"
+	gitssh "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+
+	"github.com/weaveworks/flux"
+)
+
+// We clone from local paths too (e.g., in WorkingClone); serve those
+// in-process rather than running git-upload-pack and friends.
+func init() {
+	client.InstallProtocol("file", server.DefaultServer)
+}
+
+// anonymousRemote is the name given to remotes made up on the spot
+// for an upstream URL, as git does for `git push <url>`.
+const anonymousRemote = "anonymous"
+
+// goBackend does git operations in-process using go-git, so it needs
+// neither the git nor the ssh binary. It keeps the same repository
+// layout as the git binary would, so a clone made by one backend can
+// be used by the other.
+type goBackend struct{}
+
+// Clone can't make shallow or sparse clones; and, since objects are
+// not shared with the repo cloned from, Shared makes no difference.
+func (goBackend) Clone(ctx context.Context, workingDir string, auth *Auth, repoURL, repoBranch string, cloneOpts CloneOptions) (string, error) {
+	if cloneOpts.Depth > 0 || cloneOpts.SparsePath != "" {
+		return "", ErrShallowUnsupported
+	}
+	repoPath := filepath.Join(workingDir, "repo")
+	method, err := authMethod(auth, repoURL)
+	if err != nil {
+		return "", err
+	}
+	opts := &gogit.CloneOptions{
+		URL:  repoURL,
+		Auth: method,
+	}
+	if repoBranch != "" {
+		opts.ReferenceName = plumbing.ReferenceName("refs/heads/" + repoBranch)
+	}
+	if _, err := gogit.PlainCloneContext(ctx, repoPath, false, opts); err != nil {
+		return "", errors.Wrap(remoteError(err, repoURL), "git clone")
+	}
+	return repoPath, nil
+}
+
+func (goBackend) Config(ctx context.Context, dir, user, email, signingKey string) error {
+	if signingKey != "" {
+		return ErrSigningUnsupported
+	}
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+	conf, err := repo.Config()
+	if err != nil {
+		return errors.Wrap(err, "reading git config")
+	}
+	conf.Raw.Section("user").
+		SetOption("name", user).
+		SetOption("email", email)
+	return errors.Wrap(repo.Storer.SetConfig(conf), "setting git config")
+}
+
+func (goBackend) Commit(ctx context.Context, dir string, commitAction *CommitAction) error {
+	repo, worktree, err := openWorktree(dir)
+	if err != nil {
+		return err
+	}
+	committer, err := signature(repo)
+	if err != nil {
+		return err
+	}
+	author := committer
+	if commitAction.Author != "" {
+		author = parseSignature(commitAction.Author, committer.When)
+	}
+	_, err = worktree.Commit(commitAction.Message, &gogit.CommitOptions{
+		All:       true,
+		Author:    &author,
+		Committer: &committer,
+	})
+	return errors.Wrap(err, "git commit")
+}
+
+func (goBackend) HasChanges(ctx context.Context, dir, subdir string) bool {
+	_, worktree, err := openWorktree(dir)
+	if err != nil {
+		// As with the git binary, assume there are changes, so that
+		// the attempt to commit them reports the problem.
+		return true
+	}
+	status, err := worktree.Status()
+	if err != nil {
+		return true
+	}
+	for path, s := range status {
+		if s.Worktree == gogit.Unmodified || s.Worktree == gogit.Untracked {
+			continue
+		}
+		if underPath(path, subdir) {
+			return true
+		}
+	}
+	return false
+}
+
+func (goBackend) Push(ctx context.Context, auth *Auth, dir, upstream string, refs []string) error {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+	var specs []gitconfig.RefSpec
+	for _, ref := range refs {
+		spec, err := pushRefSpec(repo, ref)
+		if err != nil {
+			return err
+		}
+		specs = append(specs, spec)
+	}
+	if err := pushRefSpecs(ctx, repo, auth, upstream, specs); err != nil {
+		return errors.Wrap(remoteError(err, upstream), fmt.Sprintf("git push %s %s", RedactURL(upstream), refs))
+	}
+	return nil
+}
+
+func (goBackend) Pull(ctx context.Context, auth *Auth, dir, upstream, branch string) error {
+	repo, worktree, err := openWorktree(dir)
+	if err != nil {
+		return err
+	}
+	remote, err := remoteNamed(repo, upstream)
+	if err != nil {
+		return err
+	}
+	method, err := authMethod(auth, upstream)
+	if err != nil {
+		return err
+	}
+	err = worktree.PullContext(ctx, &gogit.PullOptions{
+		RemoteName:    remote,
+		ReferenceName: plumbing.ReferenceName("refs/heads/" + branch),
+		SingleBranch:  true,
+		Auth:          method,
+	})
+	if err != nil && err != gogit.NoErrAlreadyUpToDate {
+		return errors.Wrap(remoteError(err, upstream), fmt.Sprintf("git pull --ff-only %s %s", RedactURL(upstream), branch))
+	}
+	return nil
+}
+
+// Rebase replays the local commits on the upstream branch by
+// writing the files each changed over the upstream tree. Since
+// go-git can't merge changes within a file, any file changed both
+// locally and upstream counts as a conflict.
+func (goBackend) Rebase(ctx context.Context, auth *Auth, dir, upstream, branch string) error {
+	repo, worktree, err := openWorktree(dir)
+	if err != nil {
+		return err
+	}
+	remoteAuth, err := authMethod(auth, upstream)
+	if err != nil {
+		return err
+	}
+	// The clone's origin may not be upstream (e.g., for a working
+	// clone), so fetch from upstream directly.
+	tracking := plumbing.ReferenceName("refs/remotes/" + anonymousRemote + "/" + branch)
+	remote, forget, err := anonymous(repo, upstream)
+	if err != nil {
+		return err
+	}
+	defer forget()
+	err = remote.FetchContext(ctx, &gogit.FetchOptions{
+		RemoteName: anonymousRemote,
+		RefSpecs:   []gitconfig.RefSpec{gitconfig.RefSpec("+refs/heads/" + branch + ":" + string(tracking))},
+		Auth:       remoteAuth,
+	})
+	if err != nil && err != gogit.NoErrAlreadyUpToDate {
+		return errors.Wrap(remoteError(err, upstream), fmt.Sprintf("git fetch %s %s", RedactURL(upstream), branch))
+	}
+
+	ontoRef, err := repo.Reference(tracking, true)
+	if err != nil {
+		return err
+	}
+	onto, err := repo.CommitObject(ontoRef.Hash())
+	if err != nil {
+		return err
+	}
+	head, err := resolveCommit(repo, "HEAD")
+	if err != nil {
+		return err
+	}
+
+	// The commits to replay are those in HEAD but not upstream,
+	// oldest first; base is where they fork from upstream.
+	upstreamCommits := map[plumbing.Hash]bool{}
+	if err := object.NewCommitPreorderIter(onto, nil, nil).ForEach(func(c *object.Commit) error {
+		upstreamCommits[c.Hash] = true
+		return ctx.Err()
+	}); err != nil {
+		return err
+	}
+	var replay []*object.Commit
+	base := head
+	for !upstreamCommits[base.Hash] {
+		if base.NumParents() != 1 {
+			return errors.Wrap(ErrRebaseConflict, "cannot replay commit "+base.Hash.String())
+		}
+		replay = append([]*object.Commit{base}, replay...)
+		if base, err = base.Parent(0); err != nil {
+			return err
+		}
+	}
+
+	upstreamChanged, err := changedBetween(base, onto)
+	if err != nil {
+		return err
+	}
+	changes := make([]object.Changes, len(replay))
+	for i, c := range replay {
+		parent, err := c.Parent(0)
+		if err != nil {
+			return err
+		}
+		if changes[i], err = diffCommits(parent, c); err != nil {
+			return err
+		}
+		for _, change := range changes[i] {
+			for _, name := range []string{change.From.Name, change.To.Name} {
+				if upstreamChanged[name] {
+					return errors.Wrap(ErrRebaseConflict, "both changed "+name)
+				}
+			}
+		}
+	}
+
+	if err := worktree.Reset(&gogit.ResetOptions{Commit: onto.Hash, Mode: gogit.HardReset}); err != nil {
+		return err
+	}
+	committer, err := signature(repo)
+	if err != nil {
+		return err
+	}
+	for i, c := range replay {
+		tree, err := c.Tree()
+		if err != nil {
+			return err
+		}
+		for _, change := range changes[i] {
+			if change.From.Name != "" && change.From.Name != change.To.Name {
+				if err := os.Remove(filepath.Join(dir, change.From.Name)); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+			if change.To.Name == "" {
+				continue
+			}
+			if err := writeFile(dir, tree, change.To.Name); err != nil {
+				return err
+			}
+			if _, err := worktree.Add(change.To.Name); err != nil {
+				return err
+			}
+		}
+		author := c.Author
+		if _, err := worktree.Commit(c.Message, &gogit.CommitOptions{
+			All:       true,
+			Author:    &author,
+			Committer: &committer,
+		}); err != nil {
+			return errors.Wrap(err, "replaying commit "+c.Hash.String())
+		}
+	}
+	return nil
+}
+
+func diffCommits(from, to *object.Commit) (object.Changes, error) {
+	fromTree, err := from.Tree()
+	if err != nil {
+		return nil, err
+	}
+	toTree, err := to.Tree()
+	if err != nil {
+		return nil, err
+	}
+	return object.DiffTree(fromTree, toTree)
+}
+
+// changedBetween gives the paths of all files changed between the
+// commits given.
+func changedBetween(from, to *object.Commit) (map[string]bool, error) {
+	changes, err := diffCommits(from, to)
+	if err != nil {
+		return nil, err
+	}
+	changed := map[string]bool{}
+	for _, change := range changes {
+		for _, name := range []string{change.From.Name, change.To.Name} {
+			if name != "" {
+				changed[name] = true
+			}
+		}
+	}
+	return changed, nil
+}
+
+// writeFile writes the file from the tree given into the working
+// directory.
+func writeFile(dir string, tree *object.Tree, name string) error {
+	file, err := tree.File(name)
+	if err != nil {
+		return err
+	}
+	contents, err := file.Contents()
+	if err != nil {
+		return err
+	}
+	mode, err := file.Mode.ToOSFileMode()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(contents), mode)
+}
+
+func (goBackend) CheckoutRevision(ctx context.Context, dir, rev string) error {
+	repo, worktree, err := openWorktree(dir)
+	if err != nil {
+		return err
+	}
+	commit, err := resolveCommit(repo, rev)
+	if err != nil {
+		return err
+	}
+	// Giving a hash rather than a branch detaches HEAD
+	err = worktree.Checkout(&gogit.CheckoutOptions{Hash: commit.Hash, Force: true})
+	return errors.Wrap(err, "git checkout "+rev)
+}
+
+func (goBackend) Fetch(ctx context.Context, auth *Auth, dir, upstream, refspec string) error {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+	method, err := authMethod(auth, upstream)
+	if err != nil {
+		return err
+	}
+	remote, forget, err := anonymous(repo, upstream)
+	if err != nil {
+		return err
+	}
+	defer forget()
+	err = remote.FetchContext(ctx, &gogit.FetchOptions{
+		RemoteName: anonymousRemote,
+		RefSpecs:   []gitconfig.RefSpec{fetchRefSpec(refspec)},
+		Tags:       gogit.AllTags,
+		Auth:       method,
+	})
+	if err == gogit.NoErrAlreadyUpToDate || noMatchingRef(err) {
+		return nil
+	}
+	return errors.Wrap(remoteError(err, upstream), fmt.Sprintf("git fetch --tags %s %s", RedactURL(upstream), refspec))
+}
+
+func (goBackend) Deepen(ctx context.Context, auth *Auth, dir, upstream, branch string, depth int) error {
+	return ErrShallowUnsupported
+}
+
+func (goBackend) IsAncestor(ctx context.Context, dir, ancestor, rev string) (bool, error) {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return false, err
+	}
+	a, err := resolveCommit(repo, ancestor)
+	if err != nil {
+		return false, err
+	}
+	c, err := resolveCommit(repo, rev)
+	if err != nil {
+		return false, err
+	}
+	errFound := errors.New("found")
+	err = object.NewCommitPreorderIter(c, nil, nil).ForEach(func(c *object.Commit) error {
+		if c.Hash == a.Hash {
+			return errFound
+		}
+		return ctx.Err()
+	})
+	if err == errFound {
+		return true, nil
+	}
+	return false, err
+}
+
+func (goBackend) RefExists(ctx context.Context, dir, ref string) (bool, error) {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return false, err
+	}
+	if _, err := resolveCommit(repo, ref); err != nil {
+		if errors.Cause(err) == ErrUnknownRevision {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (goBackend) RefRevision(ctx context.Context, dir, ref string) (string, error) {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return "", err
+	}
+	commit, err := resolveCommit(repo, ref)
+	if err != nil {
+		return "", err
+	}
+	return commit.Hash.String(), nil
+}
+
+// Log walks back from the (second) revision given, leaving out
+// anything reachable from the first revision if given a range. A
+// commit counts as touching subdir if the tree at subdir differs from
+// that in its first parent.
+func (goBackend) Log(ctx context.Context, dir, revisions, subdir string) ([]Commit, error) {
+	return goLog(ctx, dir, revisions, subdir, false)
+}
+
+func (goBackend) FirstParentLog(ctx context.Context, dir, revisions, subdir string) ([]Commit, error) {
+	return goLog(ctx, dir, revisions, subdir, true)
+}
+
+// goLog gives the commits in the range given which touch subdir,
+// most recent first; if firstParent is true, only the first parent
+// of each merge is followed.
+func goLog(ctx context.Context, dir, revisions, subdir string, firstParent bool) ([]Commit, error) {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	from, exclude := revisions, ""
+	if i := strings.Index(revisions, ".."); i >= 0 {
+		exclude, from = revisions[:i], revisions[i+2:]
+	}
+	head, err := resolveCommit(repo, from)
+	if err != nil {
+		return nil, err
+	}
+	excluded := map[plumbing.Hash]bool{}
+	if exclude != "" {
+		base, err := resolveCommit(repo, exclude)
+		if err != nil {
+			return nil, err
+		}
+		if err := object.NewCommitPreorderIter(base, nil, nil).ForEach(func(c *object.Commit) error {
+			excluded[c.Hash] = true
+			return ctx.Err()
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	subdir = strings.Trim(subdir, "/")
+	var found []*object.Commit
+	visit := func(c *object.Commit) error {
+		ok, err := touches(c, subdir)
+		if ok {
+			found = append(found, c)
+		}
+		if err != nil {
+			return err
+		}
+		return ctx.Err()
+	}
+	if firstParent {
+		// The first parents are already most recent first
+		for c := head; !excluded[c.Hash]; {
+			if err := visit(c); err != nil {
+				return nil, err
+			}
+			if c.NumParents() == 0 {
+				break
+			}
+			if c, err = c.Parent(0); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		if err := object.NewCommitPreorderIter(head, excluded, nil).ForEach(visit); err != nil {
+			return nil, err
+		}
+		// git log gives the most recent first
+		sort.SliceStable(found, func(i, j int) bool {
+			return found[i].Committer.When.After(found[j].Committer.When)
+		})
+	}
+	commits := make([]Commit, len(found))
+	for i, c := range found {
+		commits[i] = Commit{
+			Revision:  c.Hash.String(),
+			Message:   strings.SplitN(strings.TrimSpace(c.Message), "\n", 2)[0],
+			Author:    Signature{Name: c.Author.Name, Email: c.Author.Email, When: c.Author.When.UTC()},
+			Committer: Signature{Name: c.Committer.Name, Email: c.Committer.Email, When: c.Committer.When.UTC()},
+		}
+	}
+	return commits, nil
+}
+
+func (goBackend) CommitFiles(ctx context.Context, dir, rev, subdir string) ([]string, error) {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := resolveCommit(repo, rev)
+	if err != nil {
+		return nil, err
+	}
+	var changed map[string]bool
+	if commit.NumParents() == 0 {
+		changed = map[string]bool{}
+		tree, err := commit.Tree()
+		if err != nil {
+			return nil, err
+		}
+		if err := tree.Files().ForEach(func(f *object.File) error {
+			changed[f.Name] = true
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	} else {
+		parent, err := commit.Parent(0)
+		if err != nil {
+			return nil, err
+		}
+		if changed, err = changedBetween(parent, commit); err != nil {
+			return nil, err
+		}
+	}
+	var files []string
+	for name := range changed {
+		if underPath(name, subdir) {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (goBackend) FileAt(ctx context.Context, dir, rev, path string) ([]byte, error) {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := resolveCommit(repo, rev)
+	if err != nil {
+		return nil, err
+	}
+	file, err := commit.File(path)
+	if err == object.ErrFileNotFound {
+		return nil, errors.Wrapf(ErrFileNotFound, "%s in %s", path, rev)
+	}
+	if err != nil {
+		return nil, err
+	}
+	contents, err := file.Contents()
+	return []byte(contents), err
+}
+
+// ChangedFiles compares the commit at ref with HEAD, then adds
+// anything changed but not yet committed, so that like `git diff
+// <ref>` it compares with the working tree.
+func (goBackend) ChangedFiles(ctx context.Context, dir, subPath, ref string) ([]string, error) {
+	if len(subPath) > 0 && subPath[0] == '/' {
+		return []string{}, errors.New("git subdirectory should not have leading forward slash")
+	}
+	repo, worktree, err := openWorktree(dir)
+	if err != nil {
+		return nil, err
+	}
+	base, err := resolveCommit(repo, ref)
+	if err != nil {
+		return nil, err
+	}
+	head, err := resolveCommit(repo, "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	baseTree, err := base.Tree()
+	if err != nil {
+		return nil, err
+	}
+	headTree, err := head.Tree()
+	if err != nil {
+		return nil, err
+	}
+	changes, err := object.DiffTree(baseTree, headTree)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := map[string]bool{}
+	for _, change := range changes {
+		// Only report files that are still there; i.e., not deletions
+		if name := change.To.Name; name != "" && underPath(name, subPath) {
+			changed[name] = true
+		}
+	}
+	status, err := worktree.Status()
+	if err != nil {
+		return nil, err
+	}
+	for name, s := range status {
+		switch {
+		case s.Worktree == gogit.Deleted, s.Staging == gogit.Deleted:
+			delete(changed, name)
+		case s.Worktree == gogit.Untracked:
+		case s.Worktree == gogit.Unmodified && s.Staging == gogit.Unmodified:
+		default:
+			if underPath(name, subPath) {
+				changed[name] = true
+			}
+		}
+	}
+
+	files := make([]string, 0, len(changed))
+	for name := range changed {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (goBackend) MoveTagAndPush(ctx context.Context, dir string, auth *Auth, tag, ref, msg, upstream, signingKey string) error {
+	if signingKey != "" {
+		return ErrSigningUnsupported
+	}
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+	target, err := resolveCommit(repo, ref)
+	if err != nil {
+		return errors.Wrap(err, "moving tag "+tag)
+	}
+	tagger, err := signature(repo)
+	if err != nil {
+		return err
+	}
+	tagHash, err := storeObject(repo, &object.Tag{
+		Name:       tag,
+		Tagger:     tagger,
+		Message:    msg + "\n",
+		TargetType: plumbing.CommitObject,
+		Target:     target.Hash,
+	})
+	if err != nil {
+		return errors.Wrap(err, "moving tag "+tag)
+	}
+	tagRef := plumbing.ReferenceName("refs/tags/" + tag)
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(tagRef, tagHash)); err != nil {
+		return errors.Wrap(err, "moving tag "+tag)
+	}
+	spec := gitconfig.RefSpec("+" + string(tagRef) + ":" + string(tagRef))
+	if err := pushRefSpecs(ctx, repo, auth, upstream, []gitconfig.RefSpec{spec}); err != nil {
+		return errors.Wrap(remoteError(err, upstream), "pushing tag to origin")
+	}
+	return nil
+}
+
+func (goBackend) VerifyCommit(ctx context.Context, dir, rev string, keyRing openpgp.EntityList) (string, error) {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return "", err
+	}
+	commit, err := resolveCommit(repo, rev)
+	if err != nil {
+		return "", err
+	}
+	// The signature is over the commit as it was before the
+	// signature was added.
+	withoutSig := *commit
+	withoutSig.PGPSignature = ""
+	unsigned := &plumbing.MemoryObject{}
+	if err := withoutSig.Encode(unsigned); err != nil {
+		return "", err
+	}
+	reader, err := unsigned.Reader()
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	signed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	return checkSignature(keyRing, signed, []byte(commit.PGPSignature))
+}
+
+// NotesRef expands the ref given as `git notes --ref` does.
+func (goBackend) NotesRef(ctx context.Context, dir, ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, "refs/notes/"):
+		return ref, nil
+	case strings.HasPrefix(ref, "notes/"):
+		return "refs/" + ref, nil
+	}
+	return "refs/notes/" + ref, nil
+}
+
+// go-git doesn't know about notes, so we deal with the notes ref
+// directly. It points at a commit, the tree of which has a blob for
+// each note, named for the object annotated -- possibly split into
+// directories by leading digits, if git has rearranged the tree.
+
+func (goBackend) AddNote(ctx context.Context, dir, rev, notesRef string, note *Note) error {
+	b, err := json.Marshal(note)
+	if err != nil {
+		return err
+	}
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+	target, err := resolveCommit(repo, rev)
+	if err != nil {
+		return err
+	}
+
+	notesCommit, notes, err := notesTree(repo, notesRef)
+	if err != nil {
+		return err
+	}
+	var entries []object.TreeEntry
+	var parents []plumbing.Hash
+	if notes != nil {
+		if f, err := noteFile(notes, target.Hash); err != nil {
+			return err
+		} else if f != nil {
+			return fmt.Errorf("cannot add notes: found existing notes for object %s", target.Hash)
+		}
+		entries = append(entries, notes.Entries...)
+		parents = append(parents, notesCommit.Hash)
+	}
+
+	blob, err := storeBlob(repo, append(b, '\n'))
+	if err != nil {
+		return err
+	}
+	entries = append(entries, object.TreeEntry{
+		Name: target.Hash.String(),
+		Mode: filemode.Regular,
+		Hash: blob,
+	})
+	// git sorts tree entries as though directory names end with "/"
+	sortName := func(e object.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return sortName(entries[i]) < sortName(entries[j])
+	})
+	treeHash, err := storeObject(repo, &object.Tree{Entries: entries})
+	if err != nil {
+		return err
+	}
+
+	sig, err := signature(repo)
+	if err != nil {
+		return err
+	}
+	commitHash, err := storeObject(repo, &object.Commit{
+		Author:       sig,
+		Committer:    sig,
+		Message:      "Notes added by 'git notes add'\n",
+		TreeHash:     treeHash,
+		ParentHashes: parents,
+	})
+	if err != nil {
+		return err
+	}
+	return repo.Storer.SetReference(plumbing.NewHashReference(plumbing.ReferenceName(notesRef), commitHash))
+}
+
+func (goBackend) GetNote(ctx context.Context, dir, notesRef, rev string) (*Note, error) {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return nil, err
+	}
+	target, err := resolveCommit(repo, rev)
+	if err != nil {
+		return nil, err
+	}
+	_, notes, err := notesTree(repo, notesRef)
+	if err != nil || notes == nil {
+		return nil, err
+	}
+	f, err := noteFile(notes, target.Hash)
+	if err != nil || f == nil {
+		return nil, err
+	}
+	contents, err := f.Contents()
+	if err != nil {
+		return nil, err
+	}
+	var note Note
+	if err := json.NewDecoder(strings.NewReader(contents)).Decode(&note); err != nil {
+		return nil, err
+	}
+	return &note, nil
+}
+
+func (goBackend) NoteRevList(ctx context.Context, dir, notesRef string) (map[string]struct{}, error) {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]struct{}{}
+	_, notes, err := notesTree(repo, notesRef)
+	if err != nil || notes == nil {
+		return result, err
+	}
+	err = notes.Files().ForEach(func(f *object.File) error {
+		result[strings.Replace(f.Name, "/", "", -1)] = struct{}{}
+		return nil
+	})
+	return result, err
+}
+
+// notesTree gives the commit the notes ref points at, and its tree;
+// or nils, if there are no notes yet.
+func notesTree(repo *gogit.Repository, notesRef string) (*object.Commit, *object.Tree, error) {
+	ref, err := repo.Reference(plumbing.ReferenceName(notesRef), true)
+	if err == plumbing.ErrReferenceNotFound {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	commit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, nil, err
+	}
+	tree, err := commit.Tree()
+	return commit, tree, err
+}
+
+// noteFile finds the note for the object given, or returns nil if
+// there is none.
+func noteFile(notes *object.Tree, obj plumbing.Hash) (*object.File, error) {
+	hex := obj.String()
+	for _, name := range []string{
+		hex,
+		hex[:2] + "/" + hex[2:],
+		hex[:2] + "/" + hex[2:4] + "/" + hex[4:],
+	} {
+		f, err := notes.File(name)
+		if err == object.ErrFileNotFound || err == object.ErrDirectoryNotFound {
+			continue
+		}
+		return f, err
+	}
+	return nil, nil
+}
+
+// resolveCommit gives the commit a revision refers to, peeling
+// annotated tags as git rev-list does.
+func resolveCommit(repo *gogit.Repository, rev string) (*object.Commit, error) {
+	for _, name := range []string{rev, "refs/" + rev, "refs/tags/" + rev, "refs/heads/" + rev, "refs/remotes/" + rev} {
+		ref, err := repo.Reference(plumbing.ReferenceName(name), true)
+		if err == plumbing.ErrReferenceNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return peel(repo, rev, ref.Hash())
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(rev))
+	if err == plumbing.ErrReferenceNotFound || err == plumbing.ErrObjectNotFound {
+		return nil, errors.Wrap(ErrUnknownRevision, rev)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return peel(repo, rev, *hash)
+}
+
+func peel(repo *gogit.Repository, rev string, hash plumbing.Hash) (*object.Commit, error) {
+	if tag, err := repo.TagObject(hash); err == nil {
+		return tag.Commit()
+	}
+	commit, err := repo.CommitObject(hash)
+	if err == plumbing.ErrObjectNotFound {
+		return nil, errors.Wrap(ErrUnknownRevision, rev)
+	}
+	return commit, err
+}
+
+// touches says whether the commit changed anything under subdir,
+// compared to its first parent.
+func touches(c *object.Commit, subdir string) (bool, error) {
+	if subdir == "" {
+		return true, nil
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		return false, err
+	}
+	after := entryHash(tree, subdir)
+	if c.NumParents() == 0 {
+		return after != plumbing.ZeroHash, nil
+	}
+	parent, err := c.Parent(0)
+	if err != nil {
+		return false, err
+	}
+	parentTree, err := parent.Tree()
+	if err != nil {
+		return false, err
+	}
+	return after != entryHash(parentTree, subdir), nil
+}
+
+func entryHash(tree *object.Tree, path string) plumbing.Hash {
+	entry, err := tree.FindEntry(path)
+	if err != nil {
+		return plumbing.ZeroHash
+	}
+	return entry.Hash
+}
+
+func underPath(name, dir string) bool {
+	dir = strings.Trim(dir, "/")
+	return dir == "" || name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+func openWorktree(dir string) (*gogit.Repository, *gogit.Worktree, error) {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	worktree, err := repo.Worktree()
+	return repo, worktree, err
+}
+
+// signature gives the user and email configured for the repo, as
+// committer (and author, unless told otherwise).
+func signature(repo *gogit.Repository) (object.Signature, error) {
+	conf, err := repo.Config()
+	if err != nil {
+		return object.Signature{}, errors.Wrap(err, "reading git config")
+	}
+	user := conf.Raw.Section("user")
+	return object.Signature{
+		Name:  user.Option("name"),
+		Email: user.Option("email"),
+		When:  time.Now(),
+	}, nil
+}
+
+// parseSignature reads an author given as `Name <email>`, as git
+// would take it; anything else is used as the name.
+func parseSignature(author string, when time.Time) object.Signature {
+	sig := object.Signature{Name: author, When: when}
+	lt, gt := strings.Index(author, "<"), strings.LastIndex(author, ">")
+	if lt >= 0 && gt > lt {
+		sig.Name = strings.TrimSpace(author[:lt])
+		sig.Email = author[lt+1 : gt]
+	}
+	return sig
+}
+
+// pushRefSpec turns a ref as given to git push -- a branch name, a
+// full ref, or src:dst -- into a full refspec. A source of HEAD is
+// resolved to the branch checked out.
+func pushRefSpec(repo *gogit.Repository, ref string) (gitconfig.RefSpec, error) {
+	src, dst := ref, ""
+	if i := strings.Index(ref, ":"); i >= 0 {
+		src, dst = ref[:i], ref[i+1:]
+	}
+	srcRef := plumbing.ReferenceName(src)
+	switch {
+	case src == "HEAD":
+		head, err := repo.Head()
+		if err != nil {
+			return "", err
+		}
+		srcRef = head.Name()
+	case !strings.HasPrefix(src, "refs/"):
+		srcRef = plumbing.ReferenceName("refs/heads/" + src)
+	}
+	if dst == "" {
+		dst = string(srcRef)
+	}
+	return gitconfig.RefSpec(string(srcRef) + ":" + dst), nil
+}
+
+// fetchRefSpec turns a refspec as given to git fetch into a full
+// refspec. We only fetch single refs to get tags, so a short name is
+// taken to be a tag, and updated even if it has moved.
+func fetchRefSpec(refspec string) gitconfig.RefSpec {
+	if strings.Contains(refspec, ":") {
+		return gitconfig.RefSpec(refspec)
+	}
+	ref := refspec
+	if !strings.HasPrefix(ref, "refs/") {
+		ref = "refs/tags/" + ref
+	}
+	return gitconfig.RefSpec("+" + ref + ":" + ref)
+}
+
+func pushRefSpecs(ctx context.Context, repo *gogit.Repository, auth *Auth, upstream string, specs []gitconfig.RefSpec) error {
+	method, err := authMethod(auth, upstream)
+	if err != nil {
+		return err
+	}
+	remote, forget, err := anonymous(repo, upstream)
+	if err != nil {
+		return err
+	}
+	defer forget()
+	err = remote.PushContext(ctx, &gogit.PushOptions{
+		RemoteName: anonymousRemote,
+		RefSpecs:   specs,
+		Auth:       method,
+	})
+	if err == gogit.NoErrAlreadyUpToDate {
+		return nil
+	}
+	return err
+}
+
+// anonymous gives a remote for the upstream URL given, as git makes
+// up for `git fetch <url>`. go-git will only fetch from and push to
+// remotes in the repo's config, so it's recorded there until forget
+// is called.
+func anonymous(repo *gogit.Repository, upstream string) (remote *gogit.Remote, forget func(), err error) {
+	// in case it was left behind by a process that didn't finish
+	repo.DeleteRemote(anonymousRemote)
+	remote, err = repo.CreateRemote(&gitconfig.RemoteConfig{
+		Name: anonymousRemote,
+		URLs: []string{upstream},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return remote, func() { repo.DeleteRemote(anonymousRemote) }, nil
+}
+
+// noMatchingRef says whether the error is from fetching a ref that
+// the remote doesn't have; go-git doesn't give that its own type.
+func noMatchingRef(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "couldn't find remote ref")
+}
+
+// remoteNamed gives the name of the remote with the URL given. Unlike
+// git, go-git will only pull from a named remote.
+func remoteNamed(repo *gogit.Repository, url string) (string, error) {
+	remotes, err := repo.Remotes()
+	if err != nil {
+		return "", err
+	}
+	for _, remote := range remotes {
+		for _, u := range remote.Config().URLs {
+			if u == url {
+				return remote.Config().Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no remote with URL %s", RedactURL(url))
+}
+
+// authMethod gives the credentials for the URL given: the key from
+// the keyring for SSH URLs, or the username and password (or token)
+// for HTTPS URLs.
+func authMethod(auth *Auth, url string) (transport.AuthMethod, error) {
+	switch auth.Mode(url) {
+	case flux.GitAuthHTTPS:
+		username, password, err := auth.Credentials.Credentials()
+		if err != nil {
+			return nil, err
+		}
+		return &githttp.BasicAuth{Username: username, Password: password}, nil
+	case flux.GitAuthSSH:
+		endpoint, err := transport.NewEndpoint(url)
+		if err != nil {
+			return nil, errors.New("cannot parse git URL " + RedactURL(url))
+		}
+		if endpoint.Protocol != "ssh" {
+			return nil, nil
+		}
+		user := endpoint.User
+		if user == "" {
+			user = "git"
+		}
+		_, privateKeyPath := auth.KeyRing.KeyPair()
+		keys, err := gitssh.NewPublicKeysFromFile(user, privateKeyPath, "")
+		if err != nil {
+			return nil, errors.Wrap(err, "reading private key")
+		}
+		if auth.KnownHosts != "" {
+			keys.HostKeyCallback, err = knownhosts.New(auth.KnownHosts)
+			if err != nil {
+				return nil, errors.Wrap(err, "reading known hosts")
+			}
+		}
+		return keys, nil
+	}
+	return nil, nil
+}
+
+// remoteError makes an error from talking to the upstream fit to
+// report: without credentials, and marked if it was because of the
+// host key.
+func remoteError(err error, upstream string) error {
+	if err == nil {
+		return nil
+	}
+	err = redactError(err, urlSecret(upstream))
+	// The SSH handshake keeps only the message of the error from
+	// checking the host key.
+	switch msg := err.Error(); {
+	case strings.Contains(msg, "knownhosts: "):
+		return errors.Wrap(ErrHostKeyVerification, msg)
+	case strings.Contains(msg, "non-fast-forward"), errors.Cause(err) == gogit.ErrForceNeeded:
+		return errors.Wrap(ErrNonFastForward, msg)
+	}
+	return err
+}
+
+func storeObject(repo *gogit.Repository, o interface {
+	Encode(plumbing.EncodedObject) error
+}) (plumbing.Hash, error) {
+	obj := repo.Storer.NewEncodedObject()
+	if err := o.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return repo.Storer.SetEncodedObject(obj)
+}
+
+func storeBlob(repo *gogit.Repository, content []byte) (plumbing.Hash, error) {
+	obj := repo.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err := w.Write(content); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if err := w.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return repo.Storer.SetEncodedObject(obj)
+}
@@ -0,0 +1,300 @@
+package git
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/weaveworks/flux/cluster/kubernetes/testfiles"
+	"github.com/weaveworks/flux/job"
+	"github.com/weaveworks/flux/update"
+)
+
+// The go backend must be able to work on repos the git binary has
+// made, and vice versa, so these check it against the exec backend.
+
+func TestGoBackend_Notes(t *testing.T) {
+	newDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	if err := createRepo(newDir, []string{"another"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	exec, gogit := execBackend{}, goBackend{}
+
+	execNotesRef, err := exec.NotesRef(ctx, newDir, testNoteRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	goNotesRef, _ := gogit.NotesRef(ctx, newDir, testNoteRef)
+	if goNotesRef != execNotesRef {
+		t.Fatalf("expected notes ref %q, got %q", execNotesRef, goNotesRef)
+	}
+
+	// one note added by git, one by go-git
+	idHEAD_1, err := testNote(newDir, "HEAD~1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	note := &Note{JobID: job.ID("go"), Spec: update.Spec{Type: update.Auto}}
+	if err := gogit.AddNote(ctx, newDir, "HEAD", goNotesRef, note); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, b := range []Backend{exec, gogit} {
+		revs, err := b.NoteRevList(ctx, newDir, goNotesRef)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(revs) != 2 {
+			t.Fatalf("%T: expected two notes, got %v", b, revs)
+		}
+		head, err := b.GetNote(ctx, newDir, goNotesRef, "HEAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head == nil || head.JobID != "go" {
+			t.Fatalf("%T: expected note for HEAD, got %+v", b, head)
+		}
+		prev, err := b.GetNote(ctx, newDir, goNotesRef, "HEAD~1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prev == nil || prev.JobID != idHEAD_1 {
+			t.Fatalf("%T: expected note for HEAD~1, got %+v", b, prev)
+		}
+	}
+
+	if err := gogit.AddNote(ctx, newDir, "HEAD", goNotesRef, note); err == nil {
+		t.Fatal("expected error adding a second note to HEAD")
+	}
+}
+
+func TestGoBackend_Log(t *testing.T) {
+	newDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	if err := createRepo(newDir, []string{"dev", "prod"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateDirAndCommit(newDir, "dev", testfiles.FilesUpdated); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateDirAndCommit(newDir, "prod", testfiles.FilesUpdated); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	exec, gogit := execBackend{}, goBackend{}
+
+	for _, c := range []struct{ revisions, subdir string }{
+		{"HEAD", ""},
+		{"HEAD", "dev"},
+		{"HEAD~2..HEAD", ""},
+		{"HEAD~2..HEAD", "prod"},
+	} {
+		expected, err := exec.Log(ctx, newDir, c.revisions, c.subdir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := gogit.Log(ctx, newDir, c.revisions, c.subdir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("log %s -- %s: expected %v, got %v", c.revisions, c.subdir, expected, got)
+		}
+	}
+}
+
+func TestGoBackend_FirstParentLog(t *testing.T) {
+	newDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	if err := createRepo(newDir, []string{"dev", "prod"}); err != nil {
+		t.Fatal(err)
+	}
+	// A commit on a branch, merged after a commit on the trunk
+	if err := execCommand("git", "-C", newDir, "checkout", "-q", "-b", "side"); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateDirAndCommit(newDir, "dev", testfiles.FilesUpdated); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	side, err := refRevision(ctx, newDir, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := execCommand("git", "-C", newDir, "checkout", "-q", "-"); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateDirAndCommit(newDir, "prod", testfiles.FilesUpdated); err != nil {
+		t.Fatal(err)
+	}
+	if err := execCommand("git", "-C", newDir, "merge", "--no-ff", "-m", "Merge side", "side"); err != nil {
+		t.Fatal(err)
+	}
+	exec, gogit := execBackend{}, goBackend{}
+
+	for _, c := range []struct{ revisions, subdir string }{
+		{"HEAD", ""},
+		{"HEAD", "dev"},
+		{"HEAD~2..HEAD", ""},
+	} {
+		expected, err := exec.FirstParentLog(ctx, newDir, c.revisions, c.subdir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, commit := range expected {
+			if commit.Revision == side {
+				t.Errorf("log %s -- %s: expected commit merged from branch to be left out", c.revisions, c.subdir)
+			}
+		}
+		got, err := gogit.FirstParentLog(ctx, newDir, c.revisions, c.subdir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("log %s -- %s: expected %v, got %v", c.revisions, c.subdir, expected, got)
+		}
+	}
+}
+
+func TestGoBackend_CommitFiles(t *testing.T) {
+	newDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	if err := createRepo(newDir, []string{"dev", "prod"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateDirAndCommit(newDir, "dev", testfiles.FilesUpdated); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	exec, gogit := execBackend{}, goBackend{}
+
+	for _, c := range []struct{ rev, subdir string }{
+		{"HEAD", ""},
+		{"HEAD", "dev"},
+		{"HEAD", "prod"},
+		{"HEAD~1", ""},
+		{"HEAD~3", "dev"},
+	} {
+		expected, err := exec.CommitFiles(ctx, newDir, c.rev, c.subdir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := gogit.CommitFiles(ctx, newDir, c.rev, c.subdir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(expected) != len(got) || (len(expected) > 0 && !reflect.DeepEqual(expected, got)) {
+			t.Errorf("files in %s -- %s: expected %v, got %v", c.rev, c.subdir, expected, got)
+		}
+	}
+
+	files, err := gogit.CommitFiles(ctx, newDir, "HEAD", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Error("expected files changed in dev/ at HEAD")
+	}
+	for _, f := range files {
+		if !strings.HasPrefix(f, "dev/") {
+			t.Errorf("expected only files under dev/, got %s", f)
+		}
+	}
+}
+
+func TestGoBackend_FileAt(t *testing.T) {
+	newDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	if err := createRepo(newDir, []string{"dev"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateDirAndCommit(newDir, "dev", testfiles.FilesUpdated); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	exec, gogit := execBackend{}, goBackend{}
+
+	files, err := exec.CommitFiles(ctx, newDir, "HEAD", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("expected files changed in dev/ at HEAD")
+	}
+	for _, rev := range []string{"HEAD", "HEAD~1"} {
+		for _, f := range files {
+			expected, err := exec.FileAt(ctx, newDir, rev, f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := gogit.FileAt(ctx, newDir, rev, f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(expected) != string(got) {
+				t.Errorf("%s at %s: expected %q, got %q", f, rev, expected, got)
+			}
+		}
+	}
+	if string(mustFileAt(t, gogit, newDir, "HEAD", files[0])) == string(mustFileAt(t, gogit, newDir, "HEAD~1", files[0])) {
+		t.Errorf("expected %s to differ between HEAD and HEAD~1", files[0])
+	}
+
+	for _, backend := range []Backend{exec, gogit} {
+		if _, err := backend.FileAt(ctx, newDir, "HEAD", "dev/no-such-file.yaml"); !IsFileNotFound(err) {
+			t.Errorf("%T: expected file not found error, got %v", backend, err)
+		}
+	}
+}
+
+func mustFileAt(t *testing.T, backend Backend, dir, rev, path string) []byte {
+	contents, err := backend.FileAt(context.Background(), dir, rev, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents
+}
+
+func TestGoBackend_UnknownRevision(t *testing.T) {
+	newDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	if err := createRepo(newDir, []string{"dev"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	gogit := goBackend{}
+
+	head, err := gogit.RefRevision(ctx, newDir, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := refRevision(ctx, newDir, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != expected {
+		t.Fatalf("expected HEAD to be %s, got %s", expected, head)
+	}
+
+	if _, err = gogit.Log(ctx, newDir, "no-such-tag..HEAD", ""); errors.Cause(err) != ErrUnknownRevision {
+		t.Fatalf("expected ErrUnknownRevision, got %v", err)
+	}
+	ok, err := gogit.RefExists(ctx, newDir, "no-such-tag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("expected ref not to exist")
+	}
+}
@@ -0,0 +1,75 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+
+	fluxmetrics "github.com/weaveworks/flux/metrics"
+)
+
+// The kinds of clone, for labelling metrics
+const (
+	upstreamClone = "upstream"
+	workingClone  = "working"
+)
+
+var (
+	// Cloning from upstream takes as long as the network does; working
+	// clones are local, so should be much quicker.
+	cloneDuration = prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+		Namespace: "flux",
+		Subsystem: "git",
+		Name:      "clone_duration_seconds",
+		Help:      "Duration of cloning the git repo, in seconds.",
+		Buckets:   []float64{0.1, 0.5, 1, 2, 5, 10, 20, 30, 60, 120, 240},
+	}, []string{fluxmetrics.LabelCloneKind, fluxmetrics.LabelSuccess})
+
+	cloneSize = prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+		Namespace: "flux",
+		Subsystem: "git",
+		Name:      "clone_size_bytes",
+		Help:      "Size on disk of the most recent clone of the git repo, in bytes.",
+	}, []string{fluxmetrics.LabelCloneKind})
+
+	deepenDuration = prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+		Namespace: "flux",
+		Subsystem: "git",
+		Name:      "deepen_duration_seconds",
+		Help:      "Duration of fetching more history into a shallow clone, in seconds.",
+		Buckets:   []float64{0.1, 0.5, 1, 2, 5, 10, 20, 30, 60, 120},
+	}, []string{fluxmetrics.LabelSuccess})
+)
+
+// dirSize adds up the sizes of the files under dir. Objects borrowed
+// from another repo (in a shared clone) don't count.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func observeClone(kind string, started time.Time, dir string, err error) {
+	cloneDuration.With(
+		fluxmetrics.LabelCloneKind, kind,
+		fluxmetrics.LabelSuccess, fmt.Sprint(err == nil),
+	).Observe(time.Since(started).Seconds())
+	if err != nil {
+		return
+	}
+	if size, err := dirSize(dir); err == nil {
+		cloneSize.With(fluxmetrics.LabelCloneKind, kind).Set(float64(size))
+	}
+}
@@ -9,4 +9,7 @@ type Note struct {
 	JobID  job.ID        `json:"jobID"`
 	Spec   update.Spec   `json:"spec"`
 	Result update.Result `json:"result"`
+	// The branch the commit was pushed to, if it was proposed as a
+	// pull request rather than pushed to the branch being synced.
+	Branch string `json:"branch,omitempty"`
 }
@@ -7,21 +7,31 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"context"
 
 	"github.com/pkg/errors"
-	"github.com/weaveworks/flux/ssh"
+	"golang.org/x/crypto/openpgp"
 )
 
-func config(ctx context.Context, workingDir, user, email string) error {
-	for k, v := range map[string]string{
+func config(ctx context.Context, workingDir, user, email, signingKey string) error {
+	settings := map[string]string{
 		"user.name":  user,
 		"user.email": email,
-	} {
+	}
+	if signingKey != "" {
+		// Setting this for the clone means commits made by rebasing
+		// are signed too.
+		settings["user.signingkey"] = signingKey
+		settings["commit.gpgsign"] = "true"
+	}
+	for k, v := range settings {
 		if err := execGitCmd(ctx, workingDir, nil, nil, "config", k, v); err != nil {
 			return errors.Wrap(err, "setting git config")
 		}
@@ -29,19 +39,53 @@ func config(ctx context.Context, workingDir, user, email string) error {
 	return nil
 }
 
-func clone(ctx context.Context, workingDir string, keyRing ssh.KeyRing, repoURL, repoBranch string) (path string, err error) {
+func clone(ctx context.Context, workingDir string, auth *Auth, repoURL, repoBranch string, opts CloneOptions) (path string, err error) {
 	repoPath := filepath.Join(workingDir, "repo")
 	args := []string{"clone"}
 	if repoBranch != "" {
 		args = append(args, "--branch", repoBranch)
 	}
+	if opts.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(opts.Depth))
+	}
+	if opts.Shared {
+		args = append(args, "--shared")
+	}
+	if opts.SparsePath != "" {
+		args = append(args, "--no-checkout")
+	}
 	args = append(args, repoURL, repoPath)
-	if err := execGitCmd(ctx, workingDir, keyRing, nil, args...); err != nil {
+	if err := execGitCmd(ctx, workingDir, auth, nil, args...); err != nil {
 		return "", errors.Wrap(err, "git clone")
 	}
+	if opts.SparsePath != "" {
+		if err := sparseCheckout(ctx, repoPath, opts.SparsePath); err != nil {
+			return "", err
+		}
+	}
 	return repoPath, nil
 }
 
+// sparseCheckout populates a clone made with --no-checkout with only
+// the files under path.
+func sparseCheckout(ctx context.Context, repoPath, path string) error {
+	if err := execGitCmd(ctx, repoPath, nil, nil, "config", "core.sparseCheckout", "true"); err != nil {
+		return errors.Wrap(err, "setting git config")
+	}
+	infoDir := filepath.Join(repoPath, ".git", "info")
+	if err := os.MkdirAll(infoDir, 0755); err != nil {
+		return err
+	}
+	pattern := "/" + strings.Trim(path, "/") + "/\n"
+	if err := ioutil.WriteFile(filepath.Join(infoDir, "sparse-checkout"), []byte(pattern), 0644); err != nil {
+		return err
+	}
+	if err := execGitCmd(ctx, repoPath, nil, nil, "read-tree", "-mu", "HEAD"); err != nil {
+		return errors.Wrap(err, "git read-tree -mu HEAD")
+	}
+	return nil
+}
+
 func commit(ctx context.Context, workingDir string, commitAction *CommitAction) error {
 	commitAuthor := commitAction.Author
 	if commitAuthor != "" {
@@ -65,33 +109,73 @@ func commit(ctx context.Context, workingDir string, commitAction *CommitAction)
 }
 
 // push the refs given to the upstream repo
-func push(ctx context.Context, keyRing ssh.KeyRing, workingDir, upstream string, refs []string) error {
+func push(ctx context.Context, auth *Auth, workingDir, upstream string, refs []string) error {
 	args := append([]string{"push", upstream}, refs...)
-	if err := execGitCmd(ctx, workingDir, keyRing, nil, args...); err != nil {
-		return errors.Wrap(err, fmt.Sprintf("git push %s %s", upstream, refs))
+	if err := execGitCmd(ctx, workingDir, auth, nil, args...); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("git push %s %s", RedactURL(upstream), refs))
 	}
 	return nil
 }
 
 // pull the specific ref from upstream
-func pull(ctx context.Context, keyRing ssh.KeyRing, workingDir, upstream, ref string) error {
-	if err := execGitCmd(ctx, workingDir, keyRing, nil, "pull", "--ff-only", upstream, ref); err != nil {
-		return errors.Wrap(err, fmt.Sprintf("git pull --ff-only %s %s", upstream, ref))
+func pull(ctx context.Context, auth *Auth, workingDir, upstream, ref string) error {
+	if err := execGitCmd(ctx, workingDir, auth, nil, "pull", "--ff-only", upstream, ref); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("git pull --ff-only %s %s", RedactURL(upstream), ref))
+	}
+	return nil
+}
+
+// rebase the local commits on the branch from upstream
+func rebase(ctx context.Context, auth *Auth, workingDir, upstream, branch string) error {
+	if err := execGitCmd(ctx, workingDir, auth, nil, "pull", "--rebase", upstream, branch); err != nil {
+		// If there's a rebase to abort, it was the rebase that
+		// failed rather than fetching.
+		if execGitCmd(ctx, workingDir, nil, nil, "rebase", "--abort") == nil {
+			return errors.Wrap(ErrRebaseConflict, err.Error())
+		}
+		return errors.Wrap(err, fmt.Sprintf("git pull --rebase %s %s", RedactURL(upstream), branch))
 	}
 	return nil
 }
 
-func fetch(ctx context.Context, keyRing ssh.KeyRing, workingDir, upstream, refspec string) error {
-	if err := execGitCmd(ctx, workingDir, keyRing, nil, "fetch", "--tags", upstream, refspec); err != nil &&
-		!strings.Contains(err.Error(), "Couldn't find remote ref") {
-		return errors.Wrap(err, fmt.Sprintf("git fetch --tags %s %s", upstream, refspec))
+func checkoutRevision(ctx context.Context, workingDir, rev string) error {
+	if err := execGitCmd(ctx, workingDir, nil, nil, "checkout", "--quiet", "--detach", rev); err != nil {
+		return errors.Wrap(err, "git checkout "+rev)
 	}
 	return nil
 }
 
+func fetch(ctx context.Context, auth *Auth, workingDir, upstream, refspec string) error {
+	if err := execGitCmd(ctx, workingDir, auth, nil, "fetch", "--tags", upstream, refspec); err != nil &&
+		errors.Cause(err) != ErrRefNotFound {
+		return errors.Wrap(err, fmt.Sprintf("git fetch --tags %s %s", RedactURL(upstream), refspec))
+	}
+	return nil
+}
+
+// deepen fetches more of the history of a shallow clone
+func deepen(ctx context.Context, auth *Auth, workingDir, upstream, branch string, depth int) error {
+	arg := "--unshallow"
+	if depth > 0 {
+		arg = "--deepen=" + strconv.Itoa(depth)
+	}
+	if err := execGitCmd(ctx, workingDir, auth, nil, "fetch", arg, upstream, branch); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("git fetch %s %s %s", arg, RedactURL(upstream), branch))
+	}
+	return nil
+}
+
+func isAncestor(ctx context.Context, workingDir, ancestor, rev string) (bool, error) {
+	out := &bytes.Buffer{}
+	if err := execGitCmd(ctx, workingDir, nil, out, "rev-list", "--max-count=1", ancestor, "--not", rev); err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(out.String()) == "", nil
+}
+
 func refExists(ctx context.Context, workingDir, ref string) (bool, error) {
 	if err := execGitCmd(ctx, workingDir, nil, nil, "rev-list", ref); err != nil {
-		if strings.Contains(err.Error(), "unknown revision") {
+		if errors.Cause(err) == ErrUnknownRevision {
 			return false, nil
 		}
 		return false, err
@@ -120,7 +204,7 @@ func addNote(ctx context.Context, workingDir, rev, notesRef string, note *Note)
 func getNote(ctx context.Context, workingDir, notesRef, rev string) (*Note, error) {
 	out := &bytes.Buffer{}
 	if err := execGitCmd(ctx, workingDir, nil, out, "notes", "--ref", notesRef, "show", rev); err != nil {
-		if strings.Contains(strings.ToLower(err.Error()), "no note found for object") {
+		if errors.Cause(err) == ErrNoNote {
 			return nil, nil
 		}
 		return nil, err
@@ -168,22 +252,28 @@ func revlist(ctx context.Context, path, ref string) ([]string, error) {
 	return splitList(out.String()), nil
 }
 
+// The fields of each commit given by onelinelog, separated by NULs:
+// revision, author name, email and time, committer name, email and
+// time, and the first line of the message.
+const logFormat = "--format=%H%x00%an%x00%ae%x00%at%x00%cn%x00%ce%x00%ct%x00%s"
+
 // Return the revisions and one-line log commit messages
 // subdir argument ... corresponds to the git-path flag supplied to weave-flux-agent
-func onelinelog(ctx context.Context, path, refspec, subdir string) ([]Commit, error) {
+func onelinelog(ctx context.Context, path, refspec, subdir string, flags ...string) ([]Commit, error) {
 	out := &bytes.Buffer{}
+	args := append(append([]string{"log", logFormat}, flags...), refspec)
 
 	// we need to distinguish whether subdir is populated or not,
 	// because supplying an empty string to execGitCmd results in git complaining about
 	// >> ambiguous argument '' <<
 	if subdir != "" {
-		if err := execGitCmd(ctx, path, nil, out, "log", "--oneline", "--no-abbrev-commit", refspec, subdir); err != nil {
+		if err := execGitCmd(ctx, path, nil, out, append(args, subdir)...); err != nil {
 			return nil, err
 		}
 		return splitLog(out.String())
 	}
 
-	if err := execGitCmd(ctx, path, nil, out, "log", "--oneline", "--no-abbrev-commit", refspec); err != nil {
+	if err := execGitCmd(ctx, path, nil, out, args...); err != nil {
 		return nil, err
 	}
 
@@ -194,13 +284,36 @@ func splitLog(s string) ([]Commit, error) {
 	lines := splitList(s)
 	commits := make([]Commit, len(lines))
 	for i, m := range lines {
-		revAndMessage := strings.SplitN(m, " ", 2)
-		commits[i].Revision = revAndMessage[0]
-		commits[i].Message = revAndMessage[1]
+		fields := strings.SplitN(m, "\x00", 8)
+		if len(fields) != 8 {
+			return nil, fmt.Errorf("unexpected git log output: %q", m)
+		}
+		author, err := logSignature(fields[1], fields[2], fields[3])
+		if err != nil {
+			return nil, err
+		}
+		committer, err := logSignature(fields[4], fields[5], fields[6])
+		if err != nil {
+			return nil, err
+		}
+		commits[i] = Commit{
+			Revision:  fields[0],
+			Message:   fields[7],
+			Author:    author,
+			Committer: committer,
+		}
 	}
 	return commits, nil
 }
 
+func logSignature(name, email, timestamp string) (Signature, error) {
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return Signature{}, errors.Wrap(err, "parsing commit time")
+	}
+	return Signature{Name: name, Email: email, When: time.Unix(secs, 0).UTC()}, nil
+}
+
 func splitList(s string) []string {
 	outStr := strings.TrimSpace(s)
 	if outStr == "" {
@@ -210,16 +323,52 @@ func splitList(s string) []string {
 }
 
 // Move the tag to the ref given and push that tag upstream
-func moveTagAndPush(ctx context.Context, path string, keyRing ssh.KeyRing, tag, ref, msg, upstream string) error {
-	if err := execGitCmd(ctx, path, nil, nil, "tag", "--force", "-a", "-m", msg, tag, ref); err != nil {
+func moveTagAndPush(ctx context.Context, path string, auth *Auth, tag, ref, msg, upstream, signingKey string) error {
+	args := []string{"tag", "--force", "-a", "-m", msg}
+	if signingKey != "" {
+		args = append(args, "--local-user", signingKey)
+	}
+	if err := execGitCmd(ctx, path, nil, nil, append(args, tag, ref)...); err != nil {
 		return errors.Wrap(err, "moving tag "+tag)
 	}
-	if err := execGitCmd(ctx, path, keyRing, nil, "push", "--force", upstream, "tag", tag); err != nil {
+	if err := execGitCmd(ctx, path, auth, nil, "push", "--force", upstream, "tag", tag); err != nil {
 		return errors.Wrap(err, "pushing tag to origin")
 	}
 	return nil
 }
 
+// verifyCommit checks the signature on a commit in-process, rather
+// than with `git verify-commit`, so that the keys trusted needn't be
+// imported into gpg's keyring (and thereby trusted for anything else).
+func verifyCommit(ctx context.Context, path, rev string, keyRing openpgp.EntityList) (string, error) {
+	out := &bytes.Buffer{}
+	if err := execGitCmd(ctx, path, nil, out, "cat-file", "commit", rev); err != nil {
+		return "", err
+	}
+	signed, signature := splitSignature(out.Bytes())
+	return checkSignature(keyRing, signed, signature)
+}
+
+func commitFiles(ctx context.Context, path, rev, subdir string) ([]string, error) {
+	out := &bytes.Buffer{}
+	args := []string{"show", "-m", "--first-parent", "--name-only", "--format=", rev, "--"}
+	if subdir != "" {
+		args = append(args, subdir)
+	}
+	if err := execGitCmd(ctx, path, nil, out, args...); err != nil {
+		return nil, err
+	}
+	return splitList(out.String()), nil
+}
+
+func fileAt(ctx context.Context, path, rev, file string) ([]byte, error) {
+	out := &bytes.Buffer{}
+	if err := execGitCmd(ctx, path, nil, out, "show", rev+":"+file); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
 func changedFiles(ctx context.Context, path, subPath, ref string) ([]string, error) {
 	// Remove leading slash if present. diff doesn't work when using github style root paths.
 	if len(subPath) > 0 && subPath[0] == '/' {
@@ -235,13 +384,35 @@ func changedFiles(ctx context.Context, path, subPath, ref string) ([]string, err
 	return splitList(out.String()), nil
 }
 
-func execGitCmd(ctx context.Context, dir string, keyRing ssh.KeyRing, out io.Writer, args ...string) error {
+func execGitCmd(ctx context.Context, dir string, auth *Auth, out io.Writer, args ...string) error {
+	env := env(auth)
+	var secrets []string
+	for _, arg := range args {
+		secrets = append(secrets, urlSecret(arg))
+	}
+	if auth != nil && auth.Credentials != nil {
+		username, password, err := auth.Credentials.Credentials()
+		if err != nil {
+			return err
+		}
+		// The helper answers git's request for credentials from
+		// the environment, so they don't appear in the arguments.
+		args = append([]string{"-c", "credential.helper=", "-c", credentialHelper}, args...)
+		env = append(env, "FLUX_GIT_USERNAME="+username, "FLUX_GIT_PASSWORD="+password)
+		secrets = append(secrets, password)
+	}
+
+	// gpg is run by git when signing, and needs to find its keyring
+	if home := gnupgHome(); home != "" {
+		env = append(env, "GNUPGHOME="+home)
+	}
+
 	c := exec.CommandContext(ctx, "git", args...)
 
 	if dir != "" {
 		c.Dir = dir
 	}
-	c.Env = env(keyRing)
+	c.Env = env
 	c.Stdout = ioutil.Discard
 	if out != nil {
 		c.Stdout = out
@@ -251,25 +422,40 @@ func execGitCmd(ctx context.Context, dir string, keyRing ssh.KeyRing, out io.Wri
 
 	err := c.Run()
 	if err != nil {
+		stderr := errOut.String()
 		msg := findErrorMessage(errOut)
-		if msg != "" {
-			err = errors.New(msg)
+		switch {
+		case hostKeyFailed(stderr):
+			// ssh explains itself on lines before git's "fatal:"
+			err = errors.Wrap(ErrHostKeyVerification, redact(msg, secrets...))
+		case pushRejected(stderr):
+			err = errors.Wrap(ErrNonFastForward, redact(msg, secrets...))
+		case msg != "":
+			err = typedError(redact(msg, secrets...))
 		}
 	}
 	if ctx.Err() == context.DeadlineExceeded {
-		return errors.Wrap(ctx.Err(), fmt.Sprintf("running git command: %s %v", "git", args))
+		return errors.Wrap(ctx.Err(), redact(fmt.Sprintf("running git command: %s %v", "git", args), secrets...))
 	} else if ctx.Err() == context.Canceled {
-		return errors.Wrap(ctx.Err(), fmt.Sprintf("context was unexpectedly cancelled when running git command: %s %v", "git", args))
+		return errors.Wrap(ctx.Err(), redact(fmt.Sprintf("context was unexpectedly cancelled when running git command: %s %v", "git", args), secrets...))
 	}
 	return err
 }
 
-func env(keyRing ssh.KeyRing) []string {
+const credentialHelper = `credential.helper=!f() { echo "username=${FLUX_GIT_USERNAME}"; echo "password=${FLUX_GIT_PASSWORD}"; }; f`
+
+func env(auth *Auth) []string {
 	base := `GIT_SSH_COMMAND=ssh -o LogLevel=error`
-	if keyRing == nil {
+	if auth == nil {
 		return []string{base}
 	}
-	_, privateKeyPath := keyRing.KeyPair()
+	if auth.KnownHosts != "" {
+		base = fmt.Sprintf("%s -o StrictHostKeyChecking=yes -o UserKnownHostsFile=%q", base, auth.KnownHosts)
+	}
+	if auth.KeyRing == nil {
+		return []string{base, "GIT_TERMINAL_PROMPT=0"}
+	}
+	_, privateKeyPath := auth.KeyRing.KeyPair()
 	return []string{fmt.Sprintf("%s -i %q", base, privateKeyPath), "GIT_TERMINAL_PROMPT=0"}
 }
 
@@ -279,6 +465,35 @@ func check(ctx context.Context, workingDir, subdir string) bool {
 	return execGitCmd(ctx, workingDir, nil, nil, "diff", "--quiet", "--", subdir) != nil
 }
 
+// typedError turns the message git gave into one of the errors
+// callers can check for, if it is one of those, keeping the message.
+func typedError(msg string) error {
+	lower := strings.ToLower(msg)
+	switch {
+	case strings.Contains(lower, "unknown revision"), strings.Contains(lower, "bad revision"), strings.Contains(lower, "bad object"):
+		return errors.Wrap(ErrUnknownRevision, msg)
+	case strings.Contains(lower, "couldn't find remote ref"):
+		return errors.Wrap(ErrRefNotFound, msg)
+	case strings.Contains(lower, "no note found for object"):
+		return errors.Wrap(ErrNoNote, msg)
+	case strings.Contains(lower, "does not exist in"), strings.Contains(lower, "exists on disk, but not in"):
+		return errors.Wrap(ErrFileNotFound, msg)
+	}
+	return errors.New(msg)
+}
+
+func hostKeyFailed(stderr string) bool {
+	return strings.Contains(stderr, "Host key verification failed") ||
+		strings.Contains(stderr, "REMOTE HOST IDENTIFICATION HAS CHANGED")
+}
+
+// pushRejected says whether git refused to push because upstream has
+// moved on; it reports that per ref, before the error.
+func pushRejected(stderr string) bool {
+	return strings.Contains(stderr, "[rejected]") &&
+		(strings.Contains(stderr, "non-fast-forward") || strings.Contains(stderr, "fetch first"))
+}
+
 func findErrorMessage(output io.Reader) string {
 	sc := bufio.NewScanner(output)
 	for sc.Scan() {
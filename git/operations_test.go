@@ -7,9 +7,13 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/pkg/errors"
+
 	"github.com/weaveworks/flux/cluster/kubernetes/testfiles"
+	fluxerr "github.com/weaveworks/flux/errors"
 	"github.com/weaveworks/flux/job"
 	"github.com/weaveworks/flux/update"
 )
@@ -86,8 +90,8 @@ func testNote(dir, rev string) (job.ID, error) {
 	id := job.ID(fmt.Sprintf("%v", noteIdCounter))
 	noteIdCounter += 1
 	err := addNote(context.Background(), dir, rev, testNoteRef, &Note{
-		id,
-		update.Spec{
+		JobID: id,
+		Spec: update.Spec{
 			update.Auto,
 			update.Cause{
 				"message",
@@ -95,7 +99,7 @@ func testNote(dir, rev string) (job.ID, error) {
 			},
 			update.Automated{},
 		},
-		update.Result{},
+		Result: update.Result{},
 	})
 	return id, err
 }
@@ -176,6 +180,14 @@ func TestOnelinelog_NoGitpath(t *testing.T) {
 	if len(commits) != 2 {
 		t.Fatal(err)
 	}
+	for _, c := range commits {
+		if c.Author.Name != "operations_test_user" || c.Committer.Email != "example@example.com" {
+			t.Errorf("unexpected author/committer for %s: %+v, %+v", c.Revision, c.Author, c.Committer)
+		}
+		if c.Author.When.IsZero() {
+			t.Errorf("expected author time for %s", c.Revision)
+		}
+	}
 }
 
 func TestOnelinelog_WithGitpath(t *testing.T) {
@@ -215,7 +227,7 @@ func createRepo(dir string, subdirs []string) error {
 	if err = execCommand("git", "-C", dir, "init"); err != nil {
 		return err
 	}
-	if err := config(context.Background(), dir, "operations_test_user", "example@example.com"); err != nil {
+	if err := config(context.Background(), dir, "operations_test_user", "example@example.com", ""); err != nil {
 		return err
 	}
 
@@ -273,3 +285,48 @@ func updateDirAndCommit(dir, subdir string, filesUpdated map[string]string) erro
 	}
 	return nil
 }
+
+func TestRefRevision_UnknownRevision(t *testing.T) {
+	newDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	if err := createRepo(newDir, []string{"dev"}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := refRevision(context.Background(), newDir, "no-such-tag")
+	if errors.Cause(err) != ErrUnknownRevision {
+		t.Fatalf("expected ErrUnknownRevision, got %v", err)
+	}
+	ok, err := refExists(context.Background(), newDir, "no-such-tag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("expected ref not to exist")
+	}
+}
+
+func TestHostKeyFailure(t *testing.T) {
+	stderr := `@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@
+@    WARNING: REMOTE HOST IDENTIFICATION HAS CHANGED!     @
+@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@
+Host key verification failed.
+fatal: Could not read from remote repository.
+`
+	if !hostKeyFailed(stderr) {
+		t.Fatal("expected host key failure to be detected")
+	}
+	if hostKeyFailed("fatal: repository 'x' not found") {
+		t.Fatal("did not expect host key failure")
+	}
+
+	err := CloningError("git@example.com:org/repo", errors.Wrap(ErrHostKeyVerification, "fatal: Could not read from remote repository."))
+	fluxErr, ok := err.(*fluxerr.Error)
+	if !ok {
+		t.Fatalf("expected flux error, got %T", err)
+	}
+	if !strings.Contains(fluxErr.Help, "known_hosts") {
+		t.Errorf("expected help to mention known_hosts, got:\n%s", fluxErr.Help)
+	}
+}
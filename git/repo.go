@@ -1,7 +1,7 @@
 package git
 
 import (
-	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -10,7 +10,11 @@ import (
 	"context"
 	"time"
 
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+
 	"github.com/weaveworks/flux"
+	fluxmetrics "github.com/weaveworks/flux/metrics"
 	"github.com/weaveworks/flux/ssh"
 )
 
@@ -26,6 +30,44 @@ var (
 type Repo struct {
 	flux.GitRemoteConfig
 	KeyRing ssh.KeyRing
+	// Credentials are used instead of the key for HTTPS URLs.
+	Credentials Credentials
+	// KnownHosts, if given, is the path to the known_hosts file SSH
+	// hosts are checked against.
+	KnownHosts string
+	// Backend does the git operations; if nil, the git binary is
+	// used.
+	Backend Backend
+	// Depth, if greater than zero, makes clones shallow, with only
+	// that many commits of history; more is fetched when needed.
+	Depth int
+	// Sparse means only the files under Path are checked out.
+	Sparse bool
+}
+
+func (r Repo) auth() *Auth {
+	return &Auth{KeyRing: r.KeyRing, Credentials: r.Credentials, KnownHosts: r.KnownHosts}
+}
+
+// AuthMode says how we authenticate to the repo; one of the
+// flux.GitAuth values.
+func (r Repo) AuthMode() string {
+	return r.auth().Mode(r.URL)
+}
+
+func (r Repo) backend() Backend {
+	if r.Backend == nil {
+		return execBackend{}
+	}
+	return r.Backend
+}
+
+func (r Repo) cloneOptions() CloneOptions {
+	opts := CloneOptions{Depth: r.Depth}
+	if r.Sparse {
+		opts.SparsePath = r.Path
+	}
+	return opts
 }
 
 // Checkout is a local clone of the remote repo.
@@ -34,6 +76,9 @@ type Checkout struct {
 	Dir  string
 	Config
 	realNotesRef string
+	// origin is the checkout this was cloned from, if it's a working
+	// clone.
+	origin *Checkout
 	sync.RWMutex
 }
 
@@ -45,11 +90,24 @@ type Config struct {
 	UserName  string
 	UserEmail string
 	SetAuthor bool
+	// SigningKey is the ID of the GPG key to sign commits and the
+	// sync tag with; if empty, they are not signed.
+	SigningKey string
 }
 
 type Commit struct {
 	Revision string
-	Message  string
+	// Message is the first line of the commit message.
+	Message   string
+	Author    Signature
+	Committer Signature
+}
+
+// Signature says who made (or committed) a commit, and when.
+type Signature struct {
+	Name  string
+	Email string
+	When  time.Time
 }
 
 // CommitAction - struct holding commit information
@@ -69,22 +127,25 @@ func (r Repo) Clone(ctx context.Context, c Config) (*Checkout, error) {
 		return nil, err
 	}
 
-	repoDir, err := clone(ctx, workingDir, r.KeyRing, r.URL, r.Branch)
+	backend := r.backend()
+	started := time.Now()
+	repoDir, err := backend.Clone(ctx, workingDir, r.auth(), r.URL, r.Branch, r.cloneOptions())
+	observeClone(upstreamClone, started, repoDir, err)
 	if err != nil {
-		return nil, CloningError(r.URL, err)
+		return nil, CloningError(RedactURL(r.URL), err)
 	}
 
-	if err := config(ctx, repoDir, c.UserName, c.UserEmail); err != nil {
+	if err := backend.Config(ctx, repoDir, c.UserName, c.UserEmail, c.SigningKey); err != nil {
 		return nil, err
 	}
 
-	notesRef, err := getNotesRef(ctx, repoDir, c.NotesRef)
+	notesRef, err := backend.NotesRef(ctx, repoDir, c.NotesRef)
 	if err != nil {
 		return nil, err
 	}
 
 	// this fetches and updates the local ref, so we'll see notes
-	if err := fetch(ctx, r.KeyRing, repoDir, r.URL, notesRef+":"+notesRef); err != nil {
+	if err := backend.Fetch(ctx, r.auth(), repoDir, r.URL, notesRef+":"+notesRef); err != nil {
 		return nil, err
 	}
 
@@ -98,7 +159,8 @@ func (r Repo) Clone(ctx context.Context, c Config) (*Checkout, error) {
 
 // WorkingClone makes a(nother) clone of the repository to use for
 // e.g., rewriting files, so we can keep a pristine clone for reading
-// out of.
+// out of. It shares the objects of this clone rather than copying
+// them, and is shallow or sparse if this clone is.
 func (c *Checkout) WorkingClone(ctx context.Context) (*Checkout, error) {
 	c.Lock()
 	defer c.Unlock()
@@ -107,25 +169,37 @@ func (c *Checkout) WorkingClone(ctx context.Context) (*Checkout, error) {
 		return nil, err
 	}
 
-	repoDir, err := clone(ctx, workingDir, nil, c.Dir, c.repo.Branch)
+	backend := c.repo.backend()
+	opts := c.repo.cloneOptions()
+	// A local clone of a shallow clone is shallow anyway
+	opts.Depth = 0
+	opts.Shared = true
+	started := time.Now()
+	repoDir, err := backend.Clone(ctx, workingDir, nil, c.Dir, c.repo.Branch, opts)
+	observeClone(workingClone, started, repoDir, err)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := config(ctx, repoDir, c.UserName, c.UserEmail); err != nil {
+	if err := backend.Config(ctx, repoDir, c.UserName, c.UserEmail, c.SigningKey); err != nil {
 		return nil, err
 	}
 
 	// this fetches and updates the local ref, so we'll see notes
-	if err := fetch(ctx, nil, repoDir, c.Dir, c.realNotesRef+":"+c.realNotesRef); err != nil {
+	if err := backend.Fetch(ctx, nil, repoDir, c.Dir, c.realNotesRef+":"+c.realNotesRef); err != nil {
 		return nil, err
 	}
 
+	origin := c
+	if c.origin != nil {
+		origin = c.origin
+	}
 	return &Checkout{
 		repo:         c.repo,
 		Dir:          repoDir,
 		Config:       c.Config,
 		realNotesRef: c.realNotesRef,
+		origin:       origin,
 	}, nil
 }
 
@@ -144,51 +218,115 @@ func (c *Checkout) ManifestDir() string {
 // CommitAndPush commits changes made in this checkout, along with any
 // extra data as a note, and pushes the commit and note to the remote repo.
 func (c *Checkout) CommitAndPush(ctx context.Context, commitAction *CommitAction, note *Note) error {
+	return c.commitAndPush(ctx, commitAction, note, c.repo.Branch)
+}
+
+// CommitAndPushBranch is like CommitAndPush, but pushes the commit to
+// a new branch rather than the branch we're using, e.g., so that it
+// can be proposed as a pull request.
+func (c *Checkout) CommitAndPushBranch(ctx context.Context, commitAction *CommitAction, note *Note, branch string) error {
+	return c.commitAndPush(ctx, commitAction, note, "HEAD:refs/heads/"+branch)
+}
+
+// Branch is the branch this checkout is following (and to which
+// changes are ordinarily pushed).
+func (c *Checkout) Branch() string {
+	return c.repo.Branch
+}
+
+func (c *Checkout) commitAndPush(ctx context.Context, commitAction *CommitAction, note *Note, ref string) error {
 	c.Lock()
 	defer c.Unlock()
-	if !check(ctx, c.Dir, c.repo.Path) {
+	backend := c.repo.backend()
+	if !backend.HasChanges(ctx, c.Dir, c.repo.Path) {
 		return ErrNoChanges
 	}
-	if err := commit(ctx, c.Dir, commitAction); err != nil {
+	if err := backend.Commit(ctx, c.Dir, commitAction); err != nil {
 		return err
 	}
 
 	if note != nil {
-		rev, err := refRevision(ctx, c.Dir, "HEAD")
+		rev, err := backend.RefRevision(ctx, c.Dir, "HEAD")
 		if err != nil {
 			return err
 		}
-		if err := addNote(ctx, c.Dir, rev, c.realNotesRef, note); err != nil {
+		if err := backend.AddNote(ctx, c.Dir, rev, c.realNotesRef, note); err != nil {
 			return err
 		}
 	}
 
-	refs := []string{c.repo.Branch}
-	ok, err := refExists(ctx, c.Dir, c.realNotesRef)
+	return c.push(ctx, ref)
+}
+
+// Push pushes the branch we're using, and the notes, to the remote
+// repo; e.g., to retry after a failed push and a Rebase.
+func (c *Checkout) Push(ctx context.Context) error {
+	c.Lock()
+	defer c.Unlock()
+	return c.push(ctx, c.repo.Branch)
+}
+
+func (c *Checkout) push(ctx context.Context, ref string) error {
+	backend := c.repo.backend()
+	refs := []string{ref}
+	ok, err := backend.RefExists(ctx, c.Dir, c.realNotesRef)
 	if ok {
 		refs = append(refs, c.realNotesRef)
 	} else if err != nil {
 		return err
 	}
 
-	if err := push(ctx, c.repo.KeyRing, c.Dir, c.repo.URL, refs); err != nil {
-		return PushError(c.repo.URL, err)
+	if err := backend.Push(ctx, c.repo.auth(), c.Dir, c.repo.URL, refs); err != nil {
+		return PushError(RedactURL(c.repo.URL), err)
 	}
 	return nil
 }
 
+// Rebase replays the commits made in this checkout on top of the
+// latest commits on the branch, e.g., after a push has failed because
+// someone else pushed first. The note on HEAD, if any, is moved to
+// the replayed commit, and notes are brought up to date with the
+// remote repo. If the commits can't be replayed cleanly, the checkout
+// is left as it was and the error is (or wraps) ErrRebaseConflict.
+func (c *Checkout) Rebase(ctx context.Context) error {
+	c.Lock()
+	defer c.Unlock()
+	backend := c.repo.backend()
+	note, err := backend.GetNote(ctx, c.Dir, c.realNotesRef, "HEAD")
+	if err != nil {
+		return err
+	}
+	if err := backend.Rebase(ctx, c.repo.auth(), c.Dir, c.repo.URL, c.repo.Branch); err != nil {
+		return err
+	}
+	// Our notes ref may now be behind upstream's, and pushing it
+	// would fail too; so take theirs and re-add the note.
+	if err := backend.Fetch(ctx, c.repo.auth(), c.Dir, c.repo.URL, "+"+c.realNotesRef+":"+c.realNotesRef); err != nil {
+		return err
+	}
+	if note == nil {
+		return nil
+	}
+	rev, err := backend.RefRevision(ctx, c.Dir, "HEAD")
+	if err != nil {
+		return err
+	}
+	return backend.AddNote(ctx, c.Dir, rev, c.realNotesRef, note)
+}
+
 // GetNote gets a note for the revision specified, or nil if there is no such note.
 func (c *Checkout) GetNote(ctx context.Context, rev string) (*Note, error) {
 	c.RLock()
 	defer c.RUnlock()
-	return getNote(ctx, c.Dir, c.realNotesRef, rev)
+	return c.repo.backend().GetNote(ctx, c.Dir, c.realNotesRef, rev)
 }
 
 // Pull fetches the latest commits on the branch we're using, and the latest notes
 func (c *Checkout) Pull(ctx context.Context) error {
 	c.Lock()
 	defer c.Unlock()
-	if err := pull(ctx, c.repo.KeyRing, c.Dir, c.repo.URL, c.repo.Branch); err != nil {
+	backend := c.repo.backend()
+	if err := backend.Pull(ctx, c.repo.auth(), c.Dir, c.repo.URL, c.repo.Branch); err != nil {
 		return err
 	}
 	for _, ref := range []string{
@@ -198,7 +336,7 @@ func (c *Checkout) Pull(ctx context.Context) error {
 		// this fetches and updates the local ref, so we'll see the new
 		// notes; but it's possible that the upstream doesn't have this
 		// ref.
-		if err := fetch(ctx, c.repo.KeyRing, c.Dir, c.repo.URL, ref); err != nil {
+		if err := backend.Fetch(ctx, c.repo.auth(), c.Dir, c.repo.URL, ref); err != nil {
 			return err
 		}
 	}
@@ -208,38 +346,106 @@ func (c *Checkout) Pull(ctx context.Context) error {
 func (c *Checkout) HeadRevision(ctx context.Context) (string, error) {
 	c.RLock()
 	defer c.RUnlock()
-	return refRevision(ctx, c.Dir, "HEAD")
+	return c.repo.backend().RefRevision(ctx, c.Dir, "HEAD")
 }
 
 func (c *Checkout) TagRevision(ctx context.Context, tag string) (string, error) {
 	c.RLock()
 	defer c.RUnlock()
-	return refRevision(ctx, c.Dir, tag)
+	return c.repo.backend().RefRevision(ctx, c.Dir, tag)
 }
 
 func (c *Checkout) CommitsBetween(ctx context.Context, ref1, ref2 string) ([]Commit, error) {
+	if err := c.ensureHistory(ctx, ref1, ref2); err != nil {
+		return nil, err
+	}
 	c.RLock()
 	defer c.RUnlock()
-	return onelinelog(ctx, c.Dir, ref1+".."+ref2, c.repo.GitRemoteConfig.Path)
+	return c.repo.backend().Log(ctx, c.Dir, ref1+".."+ref2, c.repo.GitRemoteConfig.Path)
 }
 
 func (c *Checkout) CommitsBefore(ctx context.Context, ref string) ([]Commit, error) {
+	if err := c.ensureFullHistory(ctx); err != nil {
+		return nil, err
+	}
+	c.RLock()
+	defer c.RUnlock()
+	return c.repo.backend().Log(ctx, c.Dir, ref, c.repo.GitRemoteConfig.Path)
+}
+
+// FirstParentCommitsBetween is like CommitsBetween, but gives only
+// the commits made on the branch, following the first parent of each
+// merge rather than the commits merged.
+func (c *Checkout) FirstParentCommitsBetween(ctx context.Context, ref1, ref2 string) ([]Commit, error) {
+	if err := c.ensureHistory(ctx, ref1, ref2); err != nil {
+		return nil, err
+	}
+	c.RLock()
+	defer c.RUnlock()
+	return c.repo.backend().FirstParentLog(ctx, c.Dir, ref1+".."+ref2, c.repo.GitRemoteConfig.Path)
+}
+
+// FirstParentCommitsBefore is like CommitsBefore, but gives only the
+// commits made on the branch, as FirstParentCommitsBetween does.
+func (c *Checkout) FirstParentCommitsBefore(ctx context.Context, ref string) ([]Commit, error) {
+	if err := c.ensureFullHistory(ctx); err != nil {
+		return nil, err
+	}
 	c.RLock()
 	defer c.RUnlock()
-	return onelinelog(ctx, c.Dir, ref, c.repo.GitRemoteConfig.Path)
+	return c.repo.backend().FirstParentLog(ctx, c.Dir, ref, c.repo.GitRemoteConfig.Path)
 }
 
 func (c *Checkout) MoveTagAndPush(ctx context.Context, ref, msg string) error {
 	c.Lock()
 	defer c.Unlock()
-	return moveTagAndPush(ctx, c.Dir, c.repo.KeyRing, c.SyncTag, ref, msg, c.repo.URL)
+	return c.repo.backend().MoveTagAndPush(ctx, c.Dir, c.repo.auth(), c.SyncTag, ref, msg, c.repo.URL, c.SigningKey)
+}
+
+// CommitFiles gives the files under the path changed by the commit
+// given (compared with its first parent), relative to the top of the
+// repo. Unlike ChangedFiles, this includes files since deleted.
+func (c *Checkout) CommitFiles(ctx context.Context, rev string) ([]string, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.repo.backend().CommitFiles(ctx, c.Dir, rev, c.repo.Path)
+}
+
+// FileAt gives the contents of the file at path, relative to the top
+// of the repo, as of the revision given. If the file isn't there at
+// that revision, the error says so (see IsFileNotFound).
+func (c *Checkout) FileAt(ctx context.Context, rev, path string) ([]byte, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.repo.backend().FileAt(ctx, c.Dir, rev, path)
+}
+
+// VerifyCommit checks the signature on the commit given against the
+// keys given, returning the ID of the key that signed it. If the
+// commit is unsigned, or not signed by one of the keys, the error
+// says so (see IsUnverified).
+func (c *Checkout) VerifyCommit(ctx context.Context, rev string, keyRing openpgp.EntityList) (string, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.repo.backend().VerifyCommit(ctx, c.Dir, rev, keyRing)
+}
+
+// CheckoutRevision puts the files as they were at the revision given
+// in the checkout, leaving HEAD detached at that revision.
+func (c *Checkout) CheckoutRevision(ctx context.Context, rev string) error {
+	c.Lock()
+	defer c.Unlock()
+	return c.repo.backend().CheckoutRevision(ctx, c.Dir, rev)
 }
 
 // ChangedFiles does a git diff listing changed files
 func (c *Checkout) ChangedFiles(ctx context.Context, ref string) ([]string, error) {
+	if err := c.ensureHistory(ctx, ref, "HEAD"); err != nil {
+		return nil, err
+	}
 	c.Lock()
 	defer c.Unlock()
-	list, err := changedFiles(ctx, c.Dir, c.repo.Path, ref)
+	list, err := c.repo.backend().ChangedFiles(ctx, c.Dir, c.repo.Path, ref)
 	if err == nil {
 		for i, file := range list {
 			list[i] = filepath.Join(c.Dir, file)
@@ -248,8 +454,117 @@ func (c *Checkout) ChangedFiles(ctx context.Context, ref string) ([]string, erro
 	return list, err
 }
 
+// The most commits to fetch at a time when deepening a shallow clone;
+// past this, the rest of the history is fetched.
+const maxDeepen = 1000
+
+// ensureHistory fetches more history into a shallow clone until ref1
+// is an ancestor of ref2 (or the clone is no longer shallow), so that
+// the range between them can be worked out. If the clone is not
+// shallow, or ref1 isn't in the history at all, this does nothing
+// more than look.
+//
+// A working clone doesn't fetch from upstream itself; rather, the
+// checkout it was made from is deepened, and the working clone takes
+// what it needs from that. That way the history fetched is kept for
+// the working clones that come after, and once the checkout has been
+// unshallowed (e.g., because ref1 is not reachable at all), it stays
+// so.
+func (c *Checkout) ensureHistory(ctx context.Context, ref1, ref2 string) error {
+	if c.repo.Depth <= 0 {
+		return nil
+	}
+	if c.origin != nil {
+		return c.ensureHistoryFromOrigin(ctx, ref1, ref2)
+	}
+	c.Lock()
+	defer c.Unlock()
+	backend := c.repo.backend()
+	depth := c.repo.Depth
+	for c.shallow() {
+		ok, err := backend.IsAncestor(ctx, c.Dir, ref1, ref2)
+		if ok {
+			return nil
+		}
+		if err != nil && errors.Cause(err) != ErrUnknownRevision {
+			return err
+		}
+		if depth > maxDeepen {
+			depth = 0
+		}
+		started := time.Now()
+		err = backend.Deepen(ctx, c.repo.auth(), c.Dir, c.repo.URL, c.repo.Branch, depth)
+		deepenDuration.With(fluxmetrics.LabelSuccess, fmt.Sprint(err == nil)).Observe(time.Since(started).Seconds())
+		if err != nil || depth == 0 {
+			return err
+		}
+		depth *= 2
+	}
+	return nil
+}
+
+func (c *Checkout) ensureHistoryFromOrigin(ctx context.Context, ref1, ref2 string) error {
+	// The working clone's HEAD may be behind the origin's (e.g.,
+	// if an earlier revision is checked out), but not ahead of it
+	// in any way that matters for this.
+	if err := c.origin.ensureHistory(ctx, ref1, "HEAD"); err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	if !c.shallow() {
+		return nil
+	}
+	backend := c.repo.backend()
+	ok, err := backend.IsAncestor(ctx, c.Dir, ref1, ref2)
+	if ok || (err != nil && errors.Cause(err) != ErrUnknownRevision) {
+		return err
+	}
+	// Fetching from a shallow clone with --unshallow gets as much
+	// history as it has; and the objects are shared, so it's cheap.
+	c.origin.RLock()
+	defer c.origin.RUnlock()
+	return backend.Deepen(ctx, nil, c.Dir, c.origin.Dir, c.repo.Branch, 0)
+}
+
+// ensureFullHistory fetches all the rest of the history into a
+// shallow clone, for when every commit before a revision is wanted
+// rather than those in a range. As with ensureHistory, a working
+// clone gets it by way of the checkout it was made from.
+func (c *Checkout) ensureFullHistory(ctx context.Context) error {
+	if c.repo.Depth <= 0 {
+		return nil
+	}
+	if c.origin != nil {
+		if err := c.origin.ensureFullHistory(ctx); err != nil {
+			return err
+		}
+	}
+	c.Lock()
+	defer c.Unlock()
+	if !c.shallow() {
+		return nil
+	}
+	backend := c.repo.backend()
+	if c.origin != nil {
+		c.origin.RLock()
+		defer c.origin.RUnlock()
+		return backend.Deepen(ctx, nil, c.Dir, c.origin.Dir, c.repo.Branch, 0)
+	}
+	started := time.Now()
+	err := backend.Deepen(ctx, c.repo.auth(), c.Dir, c.repo.URL, c.repo.Branch, 0)
+	deepenDuration.With(fluxmetrics.LabelSuccess, fmt.Sprint(err == nil)).Observe(time.Since(started).Seconds())
+	return err
+}
+
+// shallow says whether the clone is missing history.
+func (c *Checkout) shallow() bool {
+	_, err := os.Stat(filepath.Join(c.Dir, ".git", "shallow"))
+	return err == nil
+}
+
 func (c *Checkout) NoteRevList(ctx context.Context) (map[string]struct{}, error) {
 	c.Lock()
 	defer c.Unlock()
-	return noteRevList(ctx, c.Dir, c.realNotesRef)
+	return c.repo.backend().NoteRevList(ctx, c.Dir, c.realNotesRef)
 }
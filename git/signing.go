@@ -0,0 +1,76 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/weaveworks/flux/gpg"
+)
+
+// checkSignature checks the detached signature over the signed
+// content against the keys given, returning the ID of the key that
+// made it.
+func checkSignature(keyRing openpgp.EntityList, signed, signature []byte) (string, error) {
+	if len(signature) == 0 {
+		return "", ErrNotSigned
+	}
+	signer, err := openpgp.CheckArmoredDetachedSignature(keyRing, bytes.NewReader(signed), bytes.NewReader(signature))
+	if err != nil {
+		return "", errors.Wrap(ErrUntrustedSignature, err.Error())
+	}
+	return gpg.KeyID(signer), nil
+}
+
+// splitSignature separates the signature from a raw commit object, as
+// given by `git cat-file commit`, returning the content that was
+// signed and the signature (which is empty if there isn't one). The
+// signature is in the header "gpgsig", continued over lines that
+// start with a space.
+func splitSignature(raw []byte) ([]byte, []byte) {
+	var signed, signature bytes.Buffer
+	inSignature, inHeaders := false, true
+	sc := bufio.NewScanner(bytes.NewReader(raw))
+	sc.Buffer(nil, len(raw)+1)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case !inHeaders:
+		case line == "":
+			inHeaders, inSignature = false, false
+		case strings.HasPrefix(line, "gpgsig "):
+			inSignature = true
+			signature.WriteString(strings.TrimPrefix(line, "gpgsig ") + "\n")
+			continue
+		case inSignature && strings.HasPrefix(line, " "):
+			signature.WriteString(line[1:] + "\n")
+			continue
+		default:
+			inSignature = false
+		}
+		signed.WriteString(line + "\n")
+	}
+	// Every line was written with a newline, including the last,
+	// which may not have had one
+	if len(raw) > 0 && !bytes.HasSuffix(raw, []byte("\n")) {
+		signed.Truncate(signed.Len() - 1)
+	}
+	return signed.Bytes(), signature.Bytes()
+}
+
+// gnupgHome gives the directory gpg keeps its keyring in, so it can
+// be passed to git (and thereby gpg) when signing.
+func gnupgHome() string {
+	if home := os.Getenv("GNUPGHOME"); home != "" {
+		return home
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		return filepath.Join(home, ".gnupg")
+	}
+	return ""
+}
@@ -0,0 +1,95 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/weaveworks/flux/cluster/kubernetes/testfiles"
+)
+
+const unsignedCommit = `tree 9bedf67800b2923982bdf60c89c57ce6fd2d9a1c
+parent 1b2d4ea3cd4bbbc0a5e5f6e3e3f3d2b0c8d6ae0f
+author Flux <support@weave.works> 1518000000 +0000
+committer Flux <support@weave.works> 1518000000 +0000
+
+Release image
+
+With a body.
+`
+
+// signCommit adds a signature to the raw commit given, as git does.
+func signCommit(t *testing.T, signer *openpgp.Entity, raw string) string {
+	sig := &bytes.Buffer{}
+	if err := openpgp.ArmoredDetachSign(sig, signer, strings.NewReader(raw), nil); err != nil {
+		t.Fatal(err)
+	}
+	header := "gpgsig " + strings.Replace(strings.TrimSpace(sig.String()), "\n", "\n ", -1) + "\n"
+	i := strings.Index(raw, "\n\n")
+	return raw[:i+1] + header + raw[i+1:]
+}
+
+func TestCheckSignature(t *testing.T) {
+	trusted, err := openpgp.NewEntity("Trusted", "", "trusted@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := openpgp.NewEntity("Other", "", "other@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyRing := openpgp.EntityList{trusted}
+
+	signed, signature := splitSignature([]byte(signCommit(t, trusted, unsignedCommit)))
+	if string(signed) != unsignedCommit {
+		t.Fatalf("expected signed content to be the commit without its signature, got:\n%s", signed)
+	}
+	keyID, err := checkSignature(keyRing, signed, signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID != trusted.PrimaryKey.KeyIdString() {
+		t.Errorf("expected signer %s, got %s", trusted.PrimaryKey.KeyIdString(), keyID)
+	}
+
+	signed, signature = splitSignature([]byte(signCommit(t, other, unsignedCommit)))
+	if _, err := checkSignature(keyRing, signed, signature); errors.Cause(err) != ErrUntrustedSignature {
+		t.Errorf("expected ErrUntrustedSignature, got %v", err)
+	}
+
+	// tampering with the commit invalidates the signature
+	tampered := strings.Replace(signCommit(t, trusted, unsignedCommit), "Release image", "Release other image", 1)
+	signed, signature = splitSignature([]byte(tampered))
+	if _, err := checkSignature(keyRing, signed, signature); errors.Cause(err) != ErrUntrustedSignature {
+		t.Errorf("expected ErrUntrustedSignature, got %v", err)
+	}
+
+	signed, signature = splitSignature([]byte(unsignedCommit))
+	if _, err := checkSignature(keyRing, signed, signature); errors.Cause(err) != ErrNotSigned {
+		t.Errorf("expected ErrNotSigned, got %v", err)
+	}
+}
+
+func TestVerifyCommit_Unsigned(t *testing.T) {
+	newDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	if err := createRepo(newDir, []string{"dev"}); err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := openpgp.NewEntity("Trusted", "", "trusted@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, b := range []Backend{execBackend{}, goBackend{}} {
+		_, err := b.VerifyCommit(ctx, newDir, "HEAD", openpgp.EntityList{trusted})
+		if !IsUnverified(err) {
+			t.Errorf("%T: expected unsigned commit to be unverified, got %v", b, err)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package git
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// TagSyncState records the revision last synced as the sync tag in
+// the repo. It implements sync.State.
+type TagSyncState struct {
+	Checkout *Checkout
+}
+
+func (s TagSyncState) GetRevision(ctx context.Context) (string, error) {
+	rev, err := s.Checkout.TagRevision(ctx, s.Checkout.SyncTag)
+	if errors.Cause(err) == ErrUnknownRevision {
+		return "", nil
+	}
+	return rev, err
+}
+
+func (s TagSyncState) UpdateMarker(ctx context.Context, revision string) error {
+	return s.Checkout.MoveTagAndPush(ctx, revision, "Sync pointer")
+}
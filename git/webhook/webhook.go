@@ -0,0 +1,344 @@
+// Package webhook understands the notifications git hosts send when
+// commits are pushed to a repo, so that a push can trigger a sync
+// straight away rather than waiting for the next poll.
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/weaveworks/flux"
+)
+
+var (
+	// ErrInvalidSignature means the request was not signed (or
+	// given a token) with the secret, so can't be trusted.
+	ErrInvalidSignature = errors.New("webhook signature does not match the secret")
+	// ErrNoSecret means no secret has been configured, so no
+	// webhook can be trusted.
+	ErrNoSecret = errors.New("no webhook secret has been configured")
+	// ErrTooLarge means the request body was over MaxBodySize, so
+	// wasn't read.
+	ErrTooLarge = errors.New("webhook body is too large")
+)
+
+// MaxBodySize is the most of a request body that is read. Pushes with
+// many commits make for large bodies, but not this large.
+const MaxBodySize = 5 << 20
+
+// Push is what we need to know about a push to decide whether to
+// sync.
+type Push struct {
+	// Branches are the branches pushed to; usually one, but it may
+	// be none (e.g., if tags were pushed) or, from some hosts,
+	// several.
+	Branches []string
+	// Files are the files changed by the commits pushed, or nil if
+	// the host didn't say (or gave only some of them).
+	Files []string
+}
+
+// Relevant says whether the push could have changed the files under
+// path in the branch given.
+func (p Push) Relevant(branch, path string) bool {
+	if !contains(p.Branches, branch) {
+		return false
+	}
+	path = strings.Trim(path, "/")
+	if p.Files == nil || path == "" {
+		return true
+	}
+	for _, f := range p.Files {
+		if f == path || strings.HasPrefix(f, path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse checks the request is from a git host that knows the secret,
+// and reads the push it describes. GitHub, GitLab and Bitbucket
+// (Cloud and Server) webhooks are recognised by their headers;
+// anything else is treated as a generic webhook, which has a JSON
+// body with the fields "ref" (e.g., "refs/heads/master") and,
+// optionally, "files" (a list of paths changed), and the HMAC-SHA256
+// of the body, keyed with the secret, in the header X-Signature. If
+// the request is for some event other than a push (e.g., a ping when
+// the webhook is created), the Push returned is nil. A body over
+// MaxBodySize is refused with ErrTooLarge.
+func Parse(r *http.Request, secret string) (*Push, error) {
+	if secret == "" {
+		return nil, ErrNoSecret
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, MaxBodySize))
+	if err != nil {
+		if len(body) >= MaxBodySize {
+			return nil, ErrTooLarge
+		}
+		return nil, err
+	}
+
+	switch {
+	case r.Header.Get("X-GitHub-Event") != "":
+		if !validSignature(r, body, secret, "X-Hub-Signature-256", "X-Hub-Signature") {
+			return nil, ErrInvalidSignature
+		}
+		if r.Header.Get("X-GitHub-Event") != "push" {
+			return nil, nil
+		}
+		return parseGitHub(body)
+	case r.Header.Get("X-Gitlab-Event") != "":
+		token := r.Header.Get("X-Gitlab-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			return nil, ErrInvalidSignature
+		}
+		if r.Header.Get("X-Gitlab-Event") != "Push Hook" {
+			return nil, nil
+		}
+		return parseGitLab(body)
+	case r.Header.Get("X-Event-Key") != "":
+		if !validSignature(r, body, secret, "X-Hub-Signature") {
+			return nil, ErrInvalidSignature
+		}
+		switch r.Header.Get("X-Event-Key") {
+		case "repo:push":
+			return parseBitbucketCloud(body)
+		case "repo:refs_changed":
+			return parseBitbucketServer(body)
+		}
+		return nil, nil
+	}
+	if !validSignature(r, body, secret, "X-Signature") {
+		return nil, ErrInvalidSignature
+	}
+	return parseGeneric(body)
+}
+
+// validSignature checks the first of the headers given that is
+// present holds the HMAC of the body. The digest may be prefixed
+// with the algorithm, as "sha1=" or "sha256="; otherwise, SHA256 is
+// assumed.
+func validSignature(r *http.Request, body []byte, secret string, headers ...string) bool {
+	for _, header := range headers {
+		sig := r.Header.Get(header)
+		if sig == "" {
+			continue
+		}
+		newHash := sha256.New
+		if strings.HasPrefix(sig, "sha1=") {
+			newHash = sha1.New
+		}
+		if i := strings.Index(sig, "="); i >= 0 {
+			sig = sig[i+1:]
+		}
+		expected, err := hex.DecodeString(sig)
+		if err != nil {
+			return false
+		}
+		return hmac.Equal(expected, digest(newHash, secret, body))
+	}
+	return false
+}
+
+func digest(newHash func() hash.Hash, secret string, body []byte) []byte {
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func contains(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+// branches gives the branch named by each ref, leaving out tags and
+// other refs.
+func branches(refs ...string) []string {
+	var bs []string
+	for _, ref := range refs {
+		if strings.HasPrefix(ref, "refs/heads/") {
+			bs = append(bs, strings.TrimPrefix(ref, "refs/heads/"))
+		}
+	}
+	return bs
+}
+
+type commitFiles struct {
+	Added    []string `json:"added"`
+	Modified []string `json:"modified"`
+	Removed  []string `json:"removed"`
+}
+
+// GitHub and GitLab give at most this many commits in a push event.
+const maxCommitsGiven = 20
+
+// filesOf gives the files changed by the commits, or nil if there are
+// no commits to go by (e.g., a force push to an earlier commit),
+// meaning any path may have changed.
+func filesOf(commits []commitFiles) []string {
+	if len(commits) == 0 {
+		return nil
+	}
+	files := []string{}
+	for _, c := range commits {
+		files = append(files, c.Added...)
+		files = append(files, c.Modified...)
+		files = append(files, c.Removed...)
+	}
+	return files
+}
+
+func parseGitHub(body []byte) (*Push, error) {
+	var payload struct {
+		Ref     string        `json:"ref"`
+		Commits []commitFiles `json:"commits"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	push := &Push{Branches: branches(payload.Ref)}
+	if len(payload.Commits) < maxCommitsGiven {
+		push.Files = filesOf(payload.Commits)
+	}
+	return push, nil
+}
+
+func parseGitLab(body []byte) (*Push, error) {
+	var payload struct {
+		Ref          string        `json:"ref"`
+		Commits      []commitFiles `json:"commits"`
+		TotalCommits int           `json:"total_commits_count"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	push := &Push{Branches: branches(payload.Ref)}
+	if payload.TotalCommits == len(payload.Commits) {
+		push.Files = filesOf(payload.Commits)
+	}
+	return push, nil
+}
+
+// Bitbucket doesn't say which files changed, so any push to the
+// branch is relevant.
+
+func parseBitbucketCloud(body []byte) (*Push, error) {
+	var payload struct {
+		Push struct {
+			Changes []struct {
+				New *struct {
+					Type string `json:"type"`
+					Name string `json:"name"`
+				} `json:"new"`
+			} `json:"changes"`
+		} `json:"push"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	push := &Push{}
+	for _, c := range payload.Push.Changes {
+		if c.New != nil && c.New.Type == "branch" {
+			push.Branches = append(push.Branches, c.New.Name)
+		}
+	}
+	return push, nil
+}
+
+func parseBitbucketServer(body []byte) (*Push, error) {
+	var payload struct {
+		Changes []struct {
+			RefID string `json:"refId"`
+		} `json:"changes"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	var refs []string
+	for _, c := range payload.Changes {
+		refs = append(refs, c.RefID)
+	}
+	return &Push{Branches: branches(refs...)}, nil
+}
+
+func parseGeneric(body []byte) (*Push, error) {
+	var payload struct {
+		Ref   string   `json:"ref"`
+		Files []string `json:"files"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	return &Push{Branches: branches(payload.Ref), Files: payload.Files}, nil
+}
+
+// Target is what is asked to sync by a webhook: e.g., the daemon, or
+// the daemon for an instance in the service. It has the methods of
+// remote.Platform needed.
+type Target interface {
+	GitRepoConfig(ctx context.Context, regenerate bool) (flux.GitConfig, error)
+	SyncNotify(context.Context) error
+}
+
+// Notify reads the webhook in the request, and if it's for a push
+// relevant to the branch and path the target syncs, asks it to sync.
+// It returns whether a sync was asked for.
+func Notify(ctx context.Context, r *http.Request, secret string, target Target) (bool, error) {
+	push, err := Parse(r, secret)
+	if err != nil || push == nil {
+		return false, err
+	}
+	config, err := target.GitRepoConfig(ctx, false)
+	if err != nil {
+		return false, err
+	}
+	if !push.Relevant(config.Remote.Branch, config.Remote.Path) {
+		return false, nil
+	}
+	return true, target.SyncNotify(ctx)
+}
+
+// NewHandler gives an http.Handler that receives webhooks with
+// Notify. It responds with 202 Accepted if a sync was asked for, 204
+// No Content if the webhook was not relevant, 401 Unauthorized if it
+// was not signed with the secret, and 413 Request Entity Too Large if
+// the body was over MaxBodySize.
+func NewHandler(secret string, target Target, logger log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "expected POST", http.StatusMethodNotAllowed)
+			return
+		}
+		synced, err := Notify(r.Context(), r, secret, target)
+		switch {
+		case err == ErrInvalidSignature || err == ErrNoSecret:
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case err == ErrTooLarge:
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		case err != nil:
+			logger.Log("err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case synced:
+			logger.Log("info", "sync requested by webhook")
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+}
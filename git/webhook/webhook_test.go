@@ -0,0 +1,202 @@
+package webhook
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/weaveworks/flux"
+)
+
+const secret = "s3cr3t"
+
+func request(body string, headers map[string]string) *http.Request {
+	r := httptest.NewRequest("POST", "/api/flux/v6/git-push", strings.NewReader(body))
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return r
+}
+
+func sign(body string) string {
+	return hex.EncodeToString(digest(sha256.New, secret, []byte(body)))
+}
+
+const githubPush = `{
+  "ref": "refs/heads/master",
+  "commits": [
+    {"added": ["dev/new.yaml"], "modified": [], "removed": []},
+    {"added": [], "modified": ["README.md"], "removed": ["prod/old.yaml"]}
+  ]
+}`
+
+func TestParse_GitHub(t *testing.T) {
+	push, err := Parse(request(githubPush, map[string]string{
+		"X-GitHub-Event":      "push",
+		"X-Hub-Signature-256": "sha256=" + sign(githubPush),
+	}), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		branch, path string
+		relevant     bool
+	}{
+		{"master", "", true},
+		{"master", "dev", true},
+		{"master", "/prod/", true},
+		{"master", "staging", false},
+		{"develop", "", false},
+	} {
+		if got := push.Relevant(c.branch, c.path); got != c.relevant {
+			t.Errorf("branch %q, path %q: expected relevant to be %v", c.branch, c.path, c.relevant)
+		}
+	}
+
+	if _, err := Parse(request(githubPush, map[string]string{
+		"X-GitHub-Event":      "push",
+		"X-Hub-Signature-256": "sha256=" + sign("something else"),
+	}), secret); err != ErrInvalidSignature {
+		t.Errorf("expected ErrInvalidSignature, got %v", err)
+	}
+
+	// A push without commits, e.g., a force push to an earlier
+	// commit, says nothing about which files changed
+	noCommits := `{"ref": "refs/heads/master", "commits": []}`
+	push, err = Parse(request(noCommits, map[string]string{
+		"X-GitHub-Event":      "push",
+		"X-Hub-Signature-256": "sha256=" + sign(noCommits),
+	}), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !push.Relevant("master", "dev") {
+		t.Errorf("expected push without commits to be relevant to any path")
+	}
+
+	ping := `{"zen": "Keep it logically awesome."}`
+	push, err = Parse(request(ping, map[string]string{
+		"X-GitHub-Event":      "ping",
+		"X-Hub-Signature-256": "sha256=" + sign(ping),
+	}), secret)
+	if err != nil || push != nil {
+		t.Errorf("expected ping to be ignored, got %+v, %v", push, err)
+	}
+}
+
+func TestParse_GitLab(t *testing.T) {
+	body := `{"ref": "refs/heads/master", "total_commits_count": 30, "commits": [{"modified": ["README.md"]}]}`
+	push, err := Parse(request(body, map[string]string{
+		"X-Gitlab-Event": "Push Hook",
+		"X-Gitlab-Token": secret,
+	}), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Not all commits were given, so any path may have changed
+	if !push.Relevant("master", "dev") {
+		t.Error("expected push with commits left out to be relevant to any path")
+	}
+
+	if _, err := Parse(request(body, map[string]string{
+		"X-Gitlab-Event": "Push Hook",
+		"X-Gitlab-Token": "wrong",
+	}), secret); err != ErrInvalidSignature {
+		t.Errorf("expected ErrInvalidSignature, got %v", err)
+	}
+}
+
+func TestParse_Bitbucket(t *testing.T) {
+	body := `{"push": {"changes": [{"new": {"type": "tag", "name": "v1"}}, {"new": {"type": "branch", "name": "master"}}]}}`
+	push, err := Parse(request(body, map[string]string{
+		"X-Event-Key":     "repo:push",
+		"X-Hub-Signature": "sha256=" + sign(body),
+	}), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !push.Relevant("master", "dev") || push.Relevant("v1", "") {
+		t.Errorf("expected push to branch master only, got %+v", push)
+	}
+}
+
+func TestParse_Generic(t *testing.T) {
+	body := `{"ref": "refs/heads/master", "files": ["dev/app.yaml"]}`
+	push, err := Parse(request(body, map[string]string{
+		"X-Signature": sign(body),
+	}), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !push.Relevant("master", "dev") || push.Relevant("master", "prod") {
+		t.Errorf("expected push to master touching dev only, got %+v", push)
+	}
+
+	if _, err := Parse(request(body, nil), ""); err != ErrNoSecret {
+		t.Errorf("expected ErrNoSecret, got %v", err)
+	}
+}
+
+type target struct {
+	config flux.GitConfig
+	synced bool
+}
+
+func (t *target) GitRepoConfig(context.Context, bool) (flux.GitConfig, error) {
+	return t.config, nil
+}
+
+func (t *target) SyncNotify(context.Context) error {
+	t.synced = true
+	return nil
+}
+
+func TestHandler(t *testing.T) {
+	for _, c := range []struct {
+		path     string
+		code     int
+		expected bool
+	}{
+		{"dev", http.StatusAccepted, true},
+		{"staging", http.StatusNoContent, false},
+	} {
+		tgt := &target{config: flux.GitConfig{Remote: flux.GitRemoteConfig{Branch: "master", Path: c.path}}}
+		handler := NewHandler(secret, tgt, log.NewNopLogger())
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, request(githubPush, map[string]string{
+			"X-GitHub-Event":      "push",
+			"X-Hub-Signature-256": "sha256=" + sign(githubPush),
+		}))
+		if w.Code != c.code {
+			t.Errorf("path %q: expected status %d, got %d", c.path, c.code, w.Code)
+		}
+		if tgt.synced != c.expected {
+			t.Errorf("path %q: expected sync requested to be %v", c.path, c.expected)
+		}
+	}
+
+	tgt := &target{}
+	w := httptest.NewRecorder()
+	NewHandler(secret, tgt, log.NewNopLogger()).ServeHTTP(w, request(githubPush, map[string]string{
+		"X-GitHub-Event":  "push",
+		"X-Hub-Signature": "sha1=0000",
+	}))
+	if w.Code != http.StatusUnauthorized || tgt.synced {
+		t.Errorf("expected unsigned webhook to be refused, got status %d", w.Code)
+	}
+
+	body := `{"ref": "refs/heads/master", "files": ["` + strings.Repeat("a", MaxBodySize) + `"]}`
+	w = httptest.NewRecorder()
+	NewHandler(secret, tgt, log.NewNopLogger()).ServeHTTP(w, request(body, map[string]string{
+		"X-Signature": sign(body),
+	}))
+	if w.Code != http.StatusRequestEntityTooLarge || tgt.synced {
+		t.Errorf("expected oversize webhook to be refused, got status %d", w.Code)
+	}
+}
@@ -0,0 +1,100 @@
+package gpg
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+)
+
+// ReadKeyRing reads the public keys in the file at the path given,
+// or in each file in the directory at the path given, as when a
+// Kubernetes secret or ConfigMap is mounted as a volume. Keys may be
+// ASCII-armored or binary.
+func ReadKeyRing(path string) (openpgp.EntityList, error) {
+	files, err := keyFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	var keyRing openpgp.EntityList
+	for _, file := range files {
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading GPG keys")
+		}
+		var entities openpgp.EntityList
+		if strings.HasPrefix(strings.TrimSpace(string(bs)), "-----BEGIN") {
+			entities, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(bs))
+		} else {
+			entities, err = openpgp.ReadKeyRing(bytes.NewReader(bs))
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing GPG keys in %s", file)
+		}
+		keyRing = append(keyRing, entities...)
+	}
+	if len(keyRing) == 0 {
+		return nil, fmt.Errorf("no GPG keys found in %s", path)
+	}
+	return keyRing, nil
+}
+
+// ImportKeys imports the keys in the file at the path given, or in
+// each file in the directory at the path given, into gpg's keyring;
+// e.g., so that git can sign with a secret key.
+func ImportKeys(path string) error {
+	files, err := keyFiles(path)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		cmd := exec.Command("gpg", "--batch", "--import", file)
+		out := &bytes.Buffer{}
+		cmd.Stderr = out
+		if err := cmd.Run(); err != nil {
+			return errors.Wrapf(err, "importing GPG keys from %s: %s", file, strings.TrimSpace(out.String()))
+		}
+	}
+	return nil
+}
+
+// KeyID gives the ID of the key, as gpg would print it.
+func KeyID(entity *openpgp.Entity) string {
+	return entity.PrimaryKey.KeyIdString()
+}
+
+// keyFiles gives the path given if it's a file, or the regular files
+// in it if it's a directory. Hidden files are skipped, since that's
+// where Kubernetes keeps the data for mounted volumes.
+func keyFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading GPG keys")
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading GPG keys")
+	}
+	var files []string
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		file := filepath.Join(path, info.Name())
+		// Mounted secrets are symlinks to files under the hidden
+		// directory, so follow them.
+		if info, err := os.Stat(file); err == nil && info.Mode().IsRegular() {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
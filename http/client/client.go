@@ -61,6 +61,15 @@ func (c *Client) UpdateImages(ctx context.Context, s update.ReleaseSpec, cause u
 	for _, ex := range s.Excludes {
 		args = append(args, "exclude", ex.String())
 	}
+	for _, c := range s.Containers {
+		args = append(args, "container", c)
+	}
+	if s.Canary {
+		args = append(args, "canary", "true")
+	}
+	if s.Soak != 0 {
+		args = append(args, "soak", s.Soak.String())
+	}
 	if cause.Message != "" {
 		args = append(args, "message", cause.Message)
 	}
@@ -98,6 +107,33 @@ func (c *Client) UpdatePolicies(ctx context.Context, updates policy.Updates, cau
 	return res, c.methodWithResp(ctx, "PATCH", &res, "UpdatePolicies", updates, args...)
 }
 
+func (c *Client) UpdatePoliciesBySpec(ctx context.Context, updates update.PolicyUpdatesBySpec, cause update.Cause) (job.ID, error) {
+	args := []string{"user", cause.User}
+	if cause.Message != "" {
+		args = append(args, "message", cause.Message)
+	}
+	var res job.ID
+	return res, c.methodWithResp(ctx, "PATCH", &res, "UpdatePoliciesBySpec", updates, args...)
+}
+
+func (c *Client) UpdateFreeze(ctx context.Context, freeze update.FreezeSpec, cause update.Cause) (job.ID, error) {
+	args := []string{"user", cause.User}
+	if cause.Message != "" {
+		args = append(args, "message", cause.Message)
+	}
+	var res job.ID
+	return res, c.methodWithResp(ctx, "PUT", &res, "UpdateFreeze", freeze, args...)
+}
+
+func (c *Client) Rollback(ctx context.Context, rollback update.RollbackSpec, cause update.Cause) (job.ID, error) {
+	args := []string{"user", cause.User}
+	if cause.Message != "" {
+		args = append(args, "message", cause.Message)
+	}
+	var res job.ID
+	return res, c.methodWithResp(ctx, "POST", &res, "Rollback", rollback, args...)
+}
+
 func (c *Client) LogEvent(ctx context.Context, event event.Event) error {
 	return c.PostWithBody(ctx, "LogEvent", event)
 }
@@ -121,6 +157,12 @@ func (c *Client) PublicSSHKey(ctx context.Context, regenerate bool) (ssh.PublicK
 	return res, err
 }
 
+func (c *Client) GitRepoConfig(ctx context.Context) (flux.GitConfig, error) {
+	var res flux.GitConfig
+	err := c.Get(ctx, &res, "GitRepoConfig")
+	return res, err
+}
+
 // --- Request helpers
 
 // post is a simple query-param only post request
@@ -3,6 +3,7 @@ package daemon
 import (
 	"encoding/json"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
@@ -49,11 +50,15 @@ func NewHandler(d remote.Platform, r *mux.Router) http.Handler {
 	r.Get("SyncStatus").HandlerFunc(handle.SyncStatus)
 	r.Get("UpdateImages").HandlerFunc(handle.UpdateImages)
 	r.Get("UpdatePolicies").HandlerFunc(handle.UpdatePolicies)
+	r.Get("UpdatePoliciesBySpec").HandlerFunc(handle.UpdatePoliciesBySpec)
+	r.Get("UpdateFreeze").HandlerFunc(handle.UpdateFreeze)
+	r.Get("Rollback").HandlerFunc(handle.Rollback)
 	r.Get("ListServices").HandlerFunc(handle.ListServices)
 	r.Get("ListImages").HandlerFunc(handle.ListImages)
 	r.Get("Export").HandlerFunc(handle.Export)
 	r.Get("GetPublicSSHKey").HandlerFunc(handle.GetPublicSSHKey)
 	r.Get("RegeneratePublicSSHKey").HandlerFunc(handle.RegeneratePublicSSHKey)
+	r.Get("GitRepoConfig").HandlerFunc(handle.GitRepoConfig)
 
 	return middleware.Instrument{
 		RouteMatcher: r,
@@ -150,11 +155,22 @@ func (s HTTPServer) UpdateImages(w http.ResponseWriter, r *http.Request) {
 		excludes = append(excludes, s)
 	}
 
+	var soak time.Duration
+	if v := r.FormValue("soak"); v != "" {
+		if soak, err = time.ParseDuration(v); err != nil {
+			transport.WriteError(w, r, http.StatusBadRequest, errors.Wrapf(err, "parsing soak duration %q", v))
+			return
+		}
+	}
+
 	spec := update.ReleaseSpec{
 		ServiceSpecs: serviceSpecs,
 		ImageSpec:    imageSpec,
 		Kind:         releaseKind,
 		Excludes:     excludes,
+		Containers:   r.Form["container"],
+		Canary:       r.FormValue("canary") == "true",
+		Soak:         soak,
 	}
 	cause := update.Cause{
 		User:    r.FormValue("user"),
@@ -189,6 +205,69 @@ func (s HTTPServer) UpdatePolicies(w http.ResponseWriter, r *http.Request) {
 	transport.JSONResponse(w, r, jobID)
 }
 
+func (s HTTPServer) UpdatePoliciesBySpec(w http.ResponseWriter, r *http.Request) {
+	var updates update.PolicyUpdatesBySpec
+	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
+		transport.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	cause := update.Cause{
+		User:    r.FormValue("user"),
+		Message: r.FormValue("message"),
+	}
+
+	jobID, err := s.daemon.UpdateManifests(r.Context(), update.Spec{Type: update.PolicyBySpec, Cause: cause, Spec: updates})
+	if err != nil {
+		transport.ErrorResponse(w, r, err)
+		return
+	}
+
+	transport.JSONResponse(w, r, jobID)
+}
+
+func (s HTTPServer) UpdateFreeze(w http.ResponseWriter, r *http.Request) {
+	var freeze update.FreezeSpec
+	if err := json.NewDecoder(r.Body).Decode(&freeze); err != nil {
+		transport.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	cause := update.Cause{
+		User:    r.FormValue("user"),
+		Message: r.FormValue("message"),
+	}
+
+	jobID, err := s.daemon.UpdateManifests(r.Context(), update.Spec{Type: update.Freeze, Cause: cause, Spec: freeze})
+	if err != nil {
+		transport.ErrorResponse(w, r, err)
+		return
+	}
+
+	transport.JSONResponse(w, r, jobID)
+}
+
+func (s HTTPServer) Rollback(w http.ResponseWriter, r *http.Request) {
+	var rollback update.RollbackSpec
+	if err := json.NewDecoder(r.Body).Decode(&rollback); err != nil {
+		transport.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	cause := update.Cause{
+		User:    r.FormValue("user"),
+		Message: r.FormValue("message"),
+	}
+
+	jobID, err := s.daemon.UpdateManifests(r.Context(), update.Spec{Type: update.Rollback, Cause: cause, Spec: rollback})
+	if err != nil {
+		transport.ErrorResponse(w, r, err)
+		return
+	}
+
+	transport.JSONResponse(w, r, jobID)
+}
+
 func (s HTTPServer) ListServices(w http.ResponseWriter, r *http.Request) {
 	namespace := mux.Vars(r)["namespace"]
 	res, err := s.daemon.ListServices(r.Context(), namespace)
@@ -218,6 +297,15 @@ func (s HTTPServer) GetPublicSSHKey(w http.ResponseWriter, r *http.Request) {
 	transport.JSONResponse(w, r, res.PublicSSHKey)
 }
 
+func (s HTTPServer) GitRepoConfig(w http.ResponseWriter, r *http.Request) {
+	res, err := s.daemon.GitRepoConfig(r.Context(), false)
+	if err != nil {
+		transport.ErrorResponse(w, r, err)
+		return
+	}
+	transport.JSONResponse(w, r, res)
+}
+
 func (s HTTPServer) RegeneratePublicSSHKey(w http.ResponseWriter, r *http.Request) {
 	_, err := s.daemon.GitRepoConfig(r.Context(), true)
 	if err != nil {
@@ -34,12 +34,16 @@ func NewAPIRouter() *mux.Router {
 
 	r.NewRoute().Name("UpdateImages").Methods("POST").Path("/v6/update-images").Queries("service", "{service}", "image", "{image}", "kind", "{kind}")
 	r.NewRoute().Name("UpdatePolicies").Methods("PATCH").Path("/v6/policies")
+	r.NewRoute().Name("UpdatePoliciesBySpec").Methods("PATCH").Path("/v6/policies-by-spec")
+	r.NewRoute().Name("UpdateFreeze").Methods("PUT").Path("/v6/freeze")
+	r.NewRoute().Name("Rollback").Methods("POST").Path("/v6/rollback")
 	r.NewRoute().Name("SyncNotify").Methods("POST").Path("/v6/sync")
 	r.NewRoute().Name("JobStatus").Methods("GET").Path("/v6/jobs").Queries("id", "{id}")
 	r.NewRoute().Name("SyncStatus").Methods("GET").Path("/v6/sync").Queries("ref", "{ref}")
 	r.NewRoute().Name("Export").Methods("HEAD", "GET").Path("/v6/export")
 	r.NewRoute().Name("GetPublicSSHKey").Methods("GET").Path("/v6/identity.pub")
 	r.NewRoute().Name("RegeneratePublicSSHKey").Methods("POST").Path("/v6/identity.pub")
+	r.NewRoute().Name("GitRepoConfig").Methods("GET").Path("/v6/git-repo-config")
 
 	return r // TODO 404 though?
 }
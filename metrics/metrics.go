@@ -14,4 +14,10 @@ const (
 	LabelReleaseType = "release_type"
 	LabelReleaseKind = "release_kind"
 	LabelStage       = "stage"
+
+	// Labels for git metrics
+	LabelCloneKind = "kind"
+
+	// Labels for cluster metrics
+	LabelResourceKind = "kind"
 )
@@ -2,6 +2,7 @@ package policy
 
 import (
 	"encoding/json"
+	"fmt"
 	"strings"
 
 	"github.com/weaveworks/flux"
@@ -14,6 +15,18 @@ const (
 	LockedMsg  = Policy("locked_msg")
 	Automated  = Policy("automated")
 	TagAll     = Policy("tag_all")
+	// LockedUntil is when a lock expires, in RFC3339 format; after
+	// that, the daemon will unlock the controller.
+	LockedUntil = Policy("locked_until")
+	// Window restricts automated releases to the times given by a
+	// schedule; see package schedule for the format.
+	Window = Policy("window")
+	// MinAge is how old an image must be before it will be released
+	// automatically, e.g., "30m".
+	MinAge = Policy("min_age")
+	// Canary marks a controller as one that gets new images first,
+	// in a staged release.
+	Canary = Policy("canary")
 )
 
 // Policy is an string, denoting the current deployment policy of a service,
@@ -22,7 +35,7 @@ type Policy string
 
 func Boolean(policy Policy) bool {
 	switch policy {
-	case Locked, Automated, Ignore:
+	case Locked, Automated, Ignore, Canary:
 		return true
 	}
 	return false
@@ -36,6 +49,21 @@ func Tag(policy Policy) bool {
 	return strings.HasPrefix(string(policy), "tag.")
 }
 
+// ContainerPolicy gives the form of a boolean policy (automated,
+// locked, ignore) that applies only to the named container, e.g.,
+// `locked.sidecar`.
+func ContainerPolicy(p Policy, container string) Policy {
+	return Policy(string(p) + "." + container)
+}
+
+// The policies that can be given for individual containers (besides
+// tag filters, which are always per container)
+var containerScoped = []Policy{Automated, Locked, Ignore}
+
+// The policies that apply only to a controller as a whole; these are
+// in effect for all its containers.
+var controllerScoped = []Policy{LockedUser, LockedMsg, LockedUntil, TagAll, Window, MinAge, Canary}
+
 type Updates map[flux.ResourceID]Update
 
 type Update struct {
@@ -90,6 +118,13 @@ func clone(s Set) Set {
 	return newMap
 }
 
+// Without returns a copy of the set with the policy given removed
+func (s Set) Without(p Policy) Set {
+	s = clone(s)
+	delete(s, p)
+	return s
+}
+
 // Contains method determines if a resource has a particular policy present
 func (s Set) Contains(needle Policy) bool {
 	for p := range s {
@@ -105,6 +140,89 @@ func (s Set) Get(p Policy) (string, bool) {
 	return v, ok
 }
 
+// ForContainer returns the policies in effect for a particular
+// container. Container-scoped policies override those given for the
+// controller as a whole; e.g., `automated.sidecar: "false"` will
+// exclude the container named sidecar from automation, even if the
+// controller is automated, and `locked.sidecar: "false"` leaves it
+// unlocked when the controller is locked. Policies that can only be
+// given for the controller as a whole apply to every container,
+// except that the details of a lock (who, why and until when) are
+// kept only if the container is locked by the controller's lock.
+func (s Set) ForContainer(container string) Set {
+	result := Set{}
+	var lockedByController bool
+	for _, p := range containerScoped {
+		v, ok := s.Get(ContainerPolicy(p, container))
+		switch {
+		case ok && v == "true":
+			result[p] = v
+		case ok:
+			// explicitly switched off for this container
+		case s.Contains(p):
+			result[p] = s[p]
+			lockedByController = lockedByController || p == Locked
+		}
+	}
+	for _, p := range controllerScoped {
+		v, ok := s.Get(p)
+		if !ok {
+			continue
+		}
+		switch p {
+		case LockedUser, LockedMsg, LockedUntil:
+			if lockedByController {
+				result[p] = v
+			}
+		default:
+			result[p] = v
+		}
+	}
+	if pattern, ok := s.Get(TagPrefix(container)); ok {
+		result[TagPrefix(container)] = pattern
+	}
+	return result
+}
+
+// CheckContainerPolicies returns an error if the set has a
+// container-scoped form of a policy that can only be given for a
+// controller as a whole, e.g., `window.sidecar`.
+func (s Set) CheckContainerPolicies() error {
+	for p := range s {
+		for _, whole := range controllerScoped {
+			if strings.HasPrefix(string(p), string(whole)+".") {
+				return fmt.Errorf("policy %q cannot be given for a single container (in %q)", whole, p)
+			}
+		}
+	}
+	return nil
+}
+
+// AnyContainerExempt returns true if the container-scoped form of the
+// policy given is explicitly switched off for at least one container,
+// overriding the policy for the controller.
+func (s Set) AnyContainerExempt(p Policy) bool {
+	prefix := string(p) + "."
+	for k, v := range s {
+		if strings.HasPrefix(string(k), prefix) && v != "true" {
+			return true
+		}
+	}
+	return false
+}
+
+// AnyContainer returns true if the container-scoped form of the
+// policy given is switched on for at least one container.
+func (s Set) AnyContainer(p Policy) bool {
+	prefix := string(p) + "."
+	for k, v := range s {
+		if strings.HasPrefix(string(k), prefix) && v == "true" {
+			return true
+		}
+	}
+	return false
+}
+
 func (s Set) ToStringMap() map[string]string {
 	m := map[string]string{}
 	for p, v := range s {
@@ -147,3 +265,15 @@ func (s ResourceMap) OnlyWithPolicy(p Policy) ResourceMap {
 	}
 	return newMap
 }
+
+// OnlyWithContainerPolicy is like OnlyWithPolicy, but also includes
+// resources for which the policy is switched on for any container.
+func (s ResourceMap) OnlyWithContainerPolicy(p Policy) ResourceMap {
+	newMap := ResourceMap{}
+	for k, v := range s {
+		if _, ok := v[p]; ok || v.AnyContainer(p) {
+			newMap[k] = v
+		}
+	}
+	return newMap
+}
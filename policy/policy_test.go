@@ -45,3 +45,62 @@ func TestJSON(t *testing.T) {
 		t.Errorf("Parsing equivalent list did not preserve policy. Expected:\n%#v\nGot:\n%#v\n", policy, policy2)
 	}
 }
+
+func TestForContainer(t *testing.T) {
+	controller := Set{}.Add(Automated).
+		Set(ContainerPolicy(Automated, "proxy"), "false").
+		Set(ContainerPolicy(Locked, "app"), "true").
+		Set(TagPrefix("app"), "glob:master-*")
+
+	app := controller.ForContainer("app")
+	if !(app.Contains(Automated) && app.Contains(Locked)) {
+		t.Errorf("expected app container to be automated and locked, got %s", app)
+	}
+	if v, _ := app.Get(TagPrefix("app")); v != "glob:master-*" {
+		t.Errorf("expected app container to keep its tag filter, got %s", app)
+	}
+
+	proxy := controller.ForContainer("proxy")
+	if proxy.Contains(Automated) || proxy.Contains(Locked) {
+		t.Errorf("expected proxy container to be neither automated nor locked, got %s", proxy)
+	}
+
+	if !controller.AnyContainer(Locked) || controller.AnyContainer(Ignore) {
+		t.Errorf("unexpected result from AnyContainer for %s", controller)
+	}
+}
+
+func TestForContainerOverridesLock(t *testing.T) {
+	controller := Set{}.Add(Locked).
+		Set(LockedUser, "Jane Doe").
+		Set(TagAll, "glob:*").
+		Set(ContainerPolicy(Locked, "proxy"), "false")
+
+	app := controller.ForContainer("app")
+	if !app.Contains(Locked) || !app.Contains(LockedUser) {
+		t.Errorf("expected app container to be locked by the controller lock, got %s", app)
+	}
+	proxy := controller.ForContainer("proxy")
+	if proxy.Contains(Locked) || proxy.Contains(LockedUser) {
+		t.Errorf("expected the unlock of proxy container to override the controller lock, got %s", proxy)
+	}
+	for _, c := range []Set{app, proxy} {
+		if v, _ := c.Get(TagAll); v != "glob:*" {
+			t.Errorf("expected the controller's tag filter to apply to every container, got %s", c)
+		}
+	}
+	if !controller.AnyContainerExempt(Locked) || controller.AnyContainerExempt(Automated) {
+		t.Errorf("unexpected result from AnyContainerExempt for %s", controller)
+	}
+}
+
+func TestCheckContainerPolicies(t *testing.T) {
+	ok := Set{}.Add(ContainerPolicy(Locked, "app")).Set(TagPrefix("app"), "glob:*").Set(LockedMsg, "testing")
+	if err := ok.CheckContainerPolicies(); err != nil {
+		t.Error(err)
+	}
+	bad := Set{}.Set(ContainerPolicy(LockedMsg, "app"), "testing")
+	if err := bad.CheckContainerPolicies(); err == nil {
+		t.Errorf("expected error for %s", bad)
+	}
+}
@@ -0,0 +1,95 @@
+package release
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+
+	"github.com/weaveworks/flux"
+	"github.com/weaveworks/flux/approval"
+	"github.com/weaveworks/flux/update"
+)
+
+// How long to wait for the gate to decide on a release
+var approvalTimeout = 20 * time.Second
+
+// approve puts the updates to the gate, and returns those that were
+// approved. The others are marked as skipped in the results, giving
+// the reason. If the gate can't be reached, the release fails; it's
+// not safe to assume approval.
+func (rc *ReleaseContext) approve(changes Changes, updates []*update.ControllerUpdate, results update.Result, logger log.Logger) ([]*update.ControllerUpdate, error) {
+	if len(updates) == 0 {
+		return updates, nil
+	}
+
+	var ids []flux.ResourceID
+	for _, u := range updates {
+		ids = append(ids, u.ResourceID)
+	}
+	approvedIDs, err := Approve(rc.gate, changes.ReleaseType(), rc.cause, ids, results, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	var approved []*update.ControllerUpdate
+	for _, u := range updates {
+		if approvedIDs.Contains(u.ResourceID) {
+			approved = append(approved, u)
+		}
+	}
+	return approved, nil
+}
+
+// Approve puts the updates to the controllers given, as they are in
+// the results, to the gate; it's for changes that aren't calculated
+// as releases, e.g., rollbacks, as well as for releases. It returns
+// the controllers whose updates were approved, and marks the others
+// as skipped in the results, giving the reason.
+func Approve(gate approval.Gate, releaseType update.ReleaseType, cause update.Cause, ids []flux.ResourceID, results update.Result, logger log.Logger) (flux.ResourceIDSet, error) {
+	req := approval.Request{
+		Type:  releaseType,
+		Cause: cause,
+	}
+	for _, id := range ids {
+		req.Updates = append(req.Updates, approval.ControllerUpdate{
+			ID:         id,
+			Containers: results[id].PerContainer,
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), approvalTimeout)
+	defer cancel()
+	res, err := gate.Review(ctx, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "asking for approval of release")
+	}
+
+	approved := flux.ResourceIDSet{}
+	for _, id := range ids {
+		verdict := res.For(id)
+		result := results[id]
+		switch verdict.Decision {
+		case approval.Approve:
+			approved.Add([]flux.ResourceID{id})
+			continue
+		case approval.Reject:
+			result.Error = withReason(update.Rejected, verdict.Reason)
+		default:
+			result.Error = withReason(update.ApprovalDeferred, verdict.Reason)
+		}
+		result.Status = update.ReleaseStatusSkipped
+		results[id] = result
+		logger.Log("service", id, "decision", verdict.Decision, "reason", verdict.Reason)
+	}
+	return approved, nil
+}
+
+func withReason(msg, reason string) string {
+	if reason == "" {
+		return msg
+	}
+	return fmt.Sprintf("%s: %s", msg, reason)
+}
@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/weaveworks/flux"
+	"github.com/weaveworks/flux/approval"
 	"github.com/weaveworks/flux/cluster"
 	"github.com/weaveworks/flux/git"
 	"github.com/weaveworks/flux/policy"
@@ -19,6 +20,10 @@ type ReleaseContext struct {
 	manifests cluster.Manifests
 	repo      *git.Checkout
 	registry  registry.Registry
+	// If there's a gate, releases must be approved by it before
+	// they are written
+	gate  approval.Gate
+	cause update.Cause
 }
 
 func NewReleaseContext(c cluster.Cluster, m cluster.Manifests, reg registry.Registry, repo *git.Checkout) *ReleaseContext {
@@ -30,6 +35,13 @@ func NewReleaseContext(c cluster.Cluster, m cluster.Manifests, reg registry.Regi
 	}
 }
 
+// RequireApproval has the updates of releases made in this context
+// put to the gate given, on behalf of the cause given, before they are
+// written.
+func (rc *ReleaseContext) RequireApproval(gate approval.Gate, cause update.Cause) {
+	rc.gate, rc.cause = gate, cause
+}
+
 func (rc *ReleaseContext) Registry() registry.Registry {
 	return rc.registry
 }
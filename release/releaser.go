@@ -32,6 +32,15 @@ func Release(rc *ReleaseContext, changes Changes, logger log.Logger) (results up
 		return nil, err
 	}
 
+	if rc.gate != nil && changes.ReleaseKind() == update.ReleaseKindExecute {
+		timer := update.NewStageTimer("approval")
+		updates, err = rc.approve(changes, updates, results, logger)
+		timer.ObserveDuration()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	err = ApplyChanges(rc, updates, logger)
 	return results, err
 }
@@ -1,6 +1,7 @@
 package release
 
 import (
+	"context"
 	"reflect"
 	"testing"
 	"time"
@@ -8,11 +9,14 @@ import (
 	"github.com/go-kit/kit/log"
 
 	"github.com/weaveworks/flux"
+	"github.com/weaveworks/flux/approval"
 	"github.com/weaveworks/flux/cluster"
 	"github.com/weaveworks/flux/cluster/kubernetes"
 	"github.com/weaveworks/flux/git"
 	"github.com/weaveworks/flux/git/gittest"
+	"github.com/weaveworks/flux/policy"
 	"github.com/weaveworks/flux/registry"
+	"github.com/weaveworks/flux/schedule"
 	"github.com/weaveworks/flux/update"
 )
 
@@ -399,3 +403,346 @@ func testRelease(t *testing.T, name string, ctx *ReleaseContext, spec update.Rel
 		t.Errorf("%s - expected:\n%#v, got:\n%#v", name, expected, results)
 	}
 }
+
+func Test_AutomatedWindow(t *testing.T) {
+	mockCluster := &cluster.Mock{
+		AllServicesFunc: func(string) ([]cluster.Controller, error) {
+			return allSvcs, nil
+		},
+		SomeServicesFunc: func([]flux.ResourceID) ([]cluster.Controller, error) {
+			return []cluster.Controller{
+				hwSvc,
+			}, nil
+		},
+	}
+
+	// A Saturday
+	saturday := time.Date(2017, time.November, 11, 12, 0, 0, 0, time.UTC)
+	weekdays := schedule.MustParse("* * * * mon-fri")
+
+	for _, tst := range []struct {
+		Name     string
+		Changes  *update.Automated
+		Expected update.Result
+	}{
+		{
+			Name: "frozen",
+			Changes: &update.Automated{
+				Frozen: true,
+				Now:    saturday,
+			},
+			Expected: update.Result{
+				hwSvcID: update.ControllerResult{
+					Status: update.ReleaseStatusSkipped,
+					Error:  update.ChangesFrozen,
+				},
+				flux.MustParseResourceID("default:deployment/locked-service"): update.ControllerResult{
+					Status: update.ReleaseStatusIgnored,
+					Error:  update.NotIncluded,
+				},
+				flux.MustParseResourceID("default:deployment/test-service"): update.ControllerResult{
+					Status: update.ReleaseStatusIgnored,
+					Error:  update.NotIncluded,
+				},
+			},
+		}, {
+			Name: "outside window",
+			Changes: &update.Automated{
+				DefaultWindow: weekdays,
+				Now:           saturday,
+			},
+			Expected: update.Result{
+				hwSvcID: update.ControllerResult{
+					Status: update.ReleaseStatusSkipped,
+					Error:  update.OutsideWindow,
+				},
+				flux.MustParseResourceID("default:deployment/locked-service"): update.ControllerResult{
+					Status: update.ReleaseStatusIgnored,
+					Error:  update.NotIncluded,
+				},
+				flux.MustParseResourceID("default:deployment/test-service"): update.ControllerResult{
+					Status: update.ReleaseStatusIgnored,
+					Error:  update.NotIncluded,
+				},
+			},
+		}, {
+			Name: "rate limited",
+			Changes: &update.Automated{
+				Now:                saturday,
+				RecentReleases:     map[flux.ResourceID]int{hwSvcID: 2},
+				MaxReleasesPerHour: 2,
+			},
+			Expected: update.Result{
+				hwSvcID: update.ControllerResult{
+					Status: update.ReleaseStatusSkipped,
+					Error:  update.RateLimited,
+				},
+				flux.MustParseResourceID("default:deployment/locked-service"): update.ControllerResult{
+					Status: update.ReleaseStatusIgnored,
+					Error:  update.NotIncluded,
+				},
+				flux.MustParseResourceID("default:deployment/test-service"): update.ControllerResult{
+					Status: update.ReleaseStatusIgnored,
+					Error:  update.NotIncluded,
+				},
+			},
+		}, {
+			// helloworld isn't annotated as automated in the repo
+			Name: "not automated",
+			Changes: &update.Automated{
+				Now: saturday,
+			},
+			Expected: update.Result{
+				hwSvcID: update.ControllerResult{
+					Status: update.ReleaseStatusSkipped,
+					Error:  update.NotAutomated,
+				},
+				flux.MustParseResourceID("default:deployment/locked-service"): update.ControllerResult{
+					Status: update.ReleaseStatusIgnored,
+					Error:  update.NotIncluded,
+				},
+				flux.MustParseResourceID("default:deployment/test-service"): update.ControllerResult{
+					Status: update.ReleaseStatusIgnored,
+					Error:  update.NotIncluded,
+				},
+			},
+		},
+	} {
+		checkout, cleanup := setup(t)
+		defer cleanup()
+		ctx := &ReleaseContext{
+			cluster:   mockCluster,
+			manifests: mockManifests,
+			registry:  mockRegistry,
+			repo:      checkout,
+		}
+		tst.Changes.Add(hwSvcID, hwSvc.Containers.Containers[0], newImageID)
+		results, err := Release(ctx, tst.Changes, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tst.Expected, results) {
+			t.Errorf("%s - expected:\n%#v, got:\n%#v", tst.Name, tst.Expected, results)
+		}
+	}
+}
+
+func Test_StagedRelease(t *testing.T) {
+	mockCluster := &cluster.Mock{
+		AllServicesFunc: func(string) ([]cluster.Controller, error) {
+			return allSvcs, nil
+		},
+		SomeServicesFunc: func([]flux.ResourceID) ([]cluster.Controller, error) {
+			return allSvcs, nil
+		},
+	}
+
+	for _, tst := range []struct {
+		Name     string
+		Stage    update.Stage
+		Expected update.Result
+	}{
+		{
+			Name:  "canaries",
+			Stage: update.StageCanaries,
+			Expected: update.Result{
+				hwSvcID: update.ControllerResult{
+					Status: update.ReleaseStatusSuccess,
+					PerContainer: []update.ContainerUpdate{
+						update.ContainerUpdate{
+							Container: container,
+							Current:   oldImageID,
+							Target:    newImageID,
+						},
+					},
+				},
+				testSvc.ID: update.ControllerResult{
+					Status: update.ReleaseStatusSkipped,
+					Error:  update.AwaitingCanary,
+				},
+			},
+		}, {
+			Name:  "remainder",
+			Stage: update.StageRemainder,
+			Expected: update.Result{
+				hwSvcID: update.ControllerResult{
+					Status: update.ReleaseStatusSkipped,
+					Error:  update.ReleasedAsCanary,
+				},
+			},
+		},
+	} {
+		checkout, cleanup := setup(t)
+		defer cleanup()
+		if err := cluster.UpdateManifest(mockManifests, checkout.ManifestDir(), hwSvcID, func(def []byte) ([]byte, error) {
+			return mockManifests.UpdatePolicies(def, policy.Update{Add: policy.Set{}.Add(policy.Canary)})
+		}); err != nil {
+			t.Fatal(err)
+		}
+		ctx := &ReleaseContext{
+			cluster:   mockCluster,
+			manifests: mockManifests,
+			registry:  mockRegistry,
+			repo:      checkout,
+		}
+		spec := update.ReleaseSpec{
+			ServiceSpecs: []update.ResourceSpec{update.ResourceSpecAll},
+			ImageSpec:    update.ImageSpecLatest,
+			Kind:         update.ReleaseKindExecute,
+			Canary:       true,
+			Stage:        tst.Stage,
+		}
+		results, err := Release(ctx, spec, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for id, expected := range tst.Expected {
+			if !reflect.DeepEqual(expected, results[id]) {
+				t.Errorf("%s - expected %s:\n%#v, got:\n%#v", tst.Name, id, expected, results[id])
+			}
+		}
+	}
+}
+
+func Test_StagedByNamespace(t *testing.T) {
+	mockCluster := &cluster.Mock{
+		AllServicesFunc: func(string) ([]cluster.Controller, error) {
+			return allSvcs, nil
+		},
+		SomeServicesFunc: func([]flux.ResourceID) ([]cluster.Controller, error) {
+			return allSvcs, nil
+		},
+	}
+	// The test controllers are all in the default namespace
+	order := []string{"staging", "default"}
+
+	for _, tst := range []struct {
+		Name     string
+		Stage    update.Stage
+		Expected update.ControllerResult
+	}{
+		{
+			Name:  "earlier namespace",
+			Stage: update.NextStage("", order),
+			Expected: update.ControllerResult{
+				Status: update.ReleaseStatusSkipped,
+				Error:  update.AwaitingStage,
+			},
+		}, {
+			Name:  "this namespace",
+			Stage: update.NextStage(update.NamespaceStage("staging"), order),
+			Expected: update.ControllerResult{
+				Status: update.ReleaseStatusSuccess,
+				PerContainer: []update.ContainerUpdate{
+					update.ContainerUpdate{
+						Container: container,
+						Current:   oldImageID,
+						Target:    newImageID,
+					},
+				},
+			},
+		}, {
+			Name:  "remainder",
+			Stage: update.NextStage(update.NamespaceStage("default"), order),
+			Expected: update.ControllerResult{
+				Status: update.ReleaseStatusSkipped,
+				Error:  update.ReleasedInStage,
+			},
+		},
+	} {
+		checkout, cleanup := setup(t)
+		defer cleanup()
+		ctx := &ReleaseContext{
+			cluster:   mockCluster,
+			manifests: mockManifests,
+			registry:  mockRegistry,
+			repo:      checkout,
+		}
+		spec := update.ReleaseSpec{
+			ServiceSpecs:   []update.ResourceSpec{update.ResourceSpecAll},
+			ImageSpec:      update.ImageSpecLatest,
+			Kind:           update.ReleaseKindExecute,
+			NamespaceOrder: order,
+			Stage:          tst.Stage,
+		}
+		results, err := Release(ctx, spec, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tst.Expected, results[hwSvcID]) {
+			t.Errorf("%s - expected:\n%#v, got:\n%#v", tst.Name, tst.Expected, results[hwSvcID])
+		}
+	}
+}
+
+type gateFunc func(approval.Request) (approval.Response, error)
+
+func (f gateFunc) Review(_ context.Context, req approval.Request) (approval.Response, error) {
+	return f(req)
+}
+
+func Test_ApprovalGate(t *testing.T) {
+	mockCluster := &cluster.Mock{
+		AllServicesFunc: func(string) ([]cluster.Controller, error) {
+			return allSvcs, nil
+		},
+		SomeServicesFunc: func([]flux.ResourceID) ([]cluster.Controller, error) {
+			return allSvcs, nil
+		},
+	}
+	checkout, cleanup := setup(t)
+	defer cleanup()
+	ctx := &ReleaseContext{
+		cluster:   mockCluster,
+		manifests: mockManifests,
+		registry:  mockRegistry,
+		repo:      checkout,
+	}
+
+	var asked approval.Request
+	ctx.RequireApproval(gateFunc(func(req approval.Request) (approval.Response, error) {
+		asked = req
+		return approval.Response{
+			Decision: approval.Reject,
+			Reason:   "CVE-2018-0001",
+		}, nil
+	}), update.Cause{User: "jane"})
+
+	spec := update.ReleaseSpec{
+		ServiceSpecs: []update.ResourceSpec{update.ResourceSpecAll},
+		ImageSpec:    update.ImageSpecLatest,
+		Kind:         update.ReleaseKindExecute,
+	}
+	results, err := Release(ctx, spec, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if asked.Cause.User != "jane" || len(asked.Updates) != 1 || asked.Updates[0].ID != hwSvcID {
+		t.Errorf("expected approval to be asked for update to %s, got %#v", hwSvcID, asked)
+	}
+	expected := update.ControllerResult{
+		Status: update.ReleaseStatusSkipped,
+		Error:  update.Rejected + ": CVE-2018-0001",
+		PerContainer: []update.ContainerUpdate{
+			update.ContainerUpdate{
+				Container: container,
+				Current:   oldImageID,
+				Target:    newImageID,
+			},
+		},
+	}
+	if !reflect.DeepEqual(expected, results[hwSvcID]) {
+		t.Errorf("expected %s:\n%#v, got:\n%#v", hwSvcID, expected, results[hwSvcID])
+	}
+
+	// Dry runs aren't put to the gate
+	asked = approval.Request{}
+	spec.Kind = update.ReleaseKindPlan
+	if _, err := Release(ctx, spec, log.NewNopLogger()); err != nil {
+		t.Fatal(err)
+	}
+	if len(asked.Updates) > 0 {
+		t.Error("did not expect approval to be asked for a dry run")
+	}
+}
@@ -0,0 +1,236 @@
+// Package schedule parses and evaluates deployment windows, which
+// say when automated changes may be released.
+//
+// A window is written like a crontab entry, with five fields for the
+// minute, hour, day of the month, month, and day of the week; a time
+// is inside the window if it matches all the fields (or, as with
+// cron, either of the day fields if both are restricted). For
+// example, the window below (under the names of its fields)
+//
+//	minute hour day-of-month month day-of-week
+//	*      9-16 *            *     mon-fri
+//
+// is open during office hours on weekdays. A window can be prefixed
+// with a time zone, e.g., `TZ=Europe/London * 9-16 * * mon-fri`;
+// otherwise it is in UTC. Several windows can be given, separated by
+// semicolons, in which case the schedule is open if any of the
+// windows is open.
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Schedule is a set of windows; a nil or empty Schedule is always
+// open.
+type Schedule []window
+
+type window struct {
+	spec     string
+	location *time.Location
+	minute   field
+	hour     field
+	dom      field
+	month    field
+	dow      field
+}
+
+// field is a set of permitted values, and whether the field was
+// given as a wildcard (which matters for the day fields).
+type field struct {
+	values map[int]bool
+	any    bool
+}
+
+type bounds struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteBounds = bounds{0, 59, nil}
+	hourBounds   = bounds{0, 23, nil}
+	domBounds    = bounds{1, 31, nil}
+	monthBounds  = bounds{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// Sunday can be 0 or 7, as with cron
+	dowBounds = bounds{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// Parse parses a schedule given as one or more windows separated by
+// semicolons.
+func Parse(spec string) (Schedule, error) {
+	var s Schedule
+	for _, w := range strings.Split(spec, ";") {
+		w = strings.TrimSpace(w)
+		if w == "" {
+			continue
+		}
+		parsed, err := parseWindow(w)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing window %q", w)
+		}
+		s = append(s, parsed)
+	}
+	if len(s) == 0 {
+		return nil, errors.New("no windows given")
+	}
+	return s, nil
+}
+
+// MustParse is Parse, but panics if the schedule can't be parsed.
+func MustParse(spec string) Schedule {
+	s, err := Parse(spec)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func parseWindow(spec string) (window, error) {
+	w := window{spec: spec, location: time.UTC}
+	fields := strings.Fields(spec)
+	if len(fields) > 0 && (strings.HasPrefix(fields[0], "TZ=") || strings.HasPrefix(fields[0], "CRON_TZ=")) {
+		name := fields[0][strings.Index(fields[0], "=")+1:]
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			return w, errors.Wrapf(err, "loading time zone %q", name)
+		}
+		w.location = loc
+		fields = fields[1:]
+	}
+	if len(fields) != 5 {
+		return w, fmt.Errorf("expected 5 fields (minute, hour, day of month, month, day of week), got %d", len(fields))
+	}
+
+	var err error
+	if w.minute, err = parseField(fields[0], minuteBounds); err != nil {
+		return w, errors.Wrap(err, "minute")
+	}
+	if w.hour, err = parseField(fields[1], hourBounds); err != nil {
+		return w, errors.Wrap(err, "hour")
+	}
+	if w.dom, err = parseField(fields[2], domBounds); err != nil {
+		return w, errors.Wrap(err, "day of month")
+	}
+	if w.month, err = parseField(fields[3], monthBounds); err != nil {
+		return w, errors.Wrap(err, "month")
+	}
+	if w.dow, err = parseField(fields[4], dowBounds); err != nil {
+		return w, errors.Wrap(err, "day of week")
+	}
+	if w.dow.values[7] {
+		w.dow.values[0] = true
+	}
+	return w, nil
+}
+
+func parseField(spec string, b bounds) (field, error) {
+	f := field{values: map[int]bool{}, any: spec == "*"}
+	for _, part := range strings.Split(spec, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i > -1 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return f, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := b.min, b.max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			ends := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = b.value(ends[0]); err != nil {
+				return f, err
+			}
+			if hi, err = b.value(ends[1]); err != nil {
+				return f, err
+			}
+			if hi < lo {
+				return f, fmt.Errorf("range %q is backwards", part)
+			}
+		default:
+			v, err := b.value(part)
+			if err != nil {
+				return f, err
+			}
+			lo = v
+			if step == 1 {
+				hi = v
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			f.values[v] = true
+		}
+	}
+	return f, nil
+}
+
+func (b bounds) value(s string) (int, error) {
+	if v, ok := b.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number", s)
+	}
+	if v < b.min || v > b.max {
+		return 0, fmt.Errorf("%d is outside %d-%d", v, b.min, b.max)
+	}
+	return v, nil
+}
+
+// Open says whether the time given falls inside any of the windows
+// of the schedule.
+func (s Schedule) Open(t time.Time) bool {
+	if len(s) == 0 {
+		return true
+	}
+	for _, w := range s {
+		if w.open(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w window) open(t time.Time) bool {
+	t = t.In(w.location)
+	if !w.minute.values[t.Minute()] || !w.hour.values[t.Hour()] || !w.month.values[int(t.Month())] {
+		return false
+	}
+	dom, dow := w.dom.values[t.Day()], w.dow.values[int(t.Weekday())]
+	// This is how cron treats the day fields: if both are
+	// restricted, either can match.
+	switch {
+	case w.dom.any && w.dow.any:
+		return true
+	case w.dom.any:
+		return dow
+	case w.dow.any:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+func (s Schedule) String() string {
+	var specs []string
+	for _, w := range s {
+		specs = append(specs, w.spec)
+	}
+	return strings.Join(specs, "; ")
+}
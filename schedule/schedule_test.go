@@ -0,0 +1,72 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 17-9 * * *",
+		"* * * * funday",
+		"*/0 * * * *",
+		"TZ=Not/AZone * * * * *",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("expected error parsing %q, got none", spec)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	// A Monday
+	monday := time.Date(2017, time.November, 6, 10, 30, 0, 0, time.UTC)
+	saturday := time.Date(2017, time.November, 11, 10, 30, 0, 0, time.UTC)
+
+	for _, c := range []struct {
+		spec string
+		at   time.Time
+		open bool
+	}{
+		{"* * * * *", saturday, true},
+		{"* 9-16 * * mon-fri", monday, true},
+		{"* 9-16 * * mon-fri", saturday, false},
+		{"* 9-16 * * mon-fri", monday.Add(7 * time.Hour), false},
+		{"0-29 * * * *", monday, false},
+		{"*/15 * * * *", monday, true},
+		{"*/20 * * * *", monday, false},
+		{"* * * * 0,6", saturday, true},
+		{"* * * * 7", saturday.Add(24 * time.Hour), true},
+		{"* * * nov *", monday, true},
+		{"* * * dec *", monday, false},
+		// Either day field matches, when both are given
+		{"* * 6 * sat", monday, true},
+		{"* * 7 * sat", monday, false},
+		// 10:30 UTC is 05:30 in New York
+		{"TZ=America/New_York * 9-16 * * *", monday, false},
+		{"TZ=America/New_York * 5 * * *", monday, true},
+		// Any window will do
+		{"* * * * sun; * 10 * * *", saturday, true},
+		{"* * * * sun; * 11 * * *", saturday, false},
+	} {
+		s, err := Parse(c.spec)
+		if err != nil {
+			t.Errorf("parsing %q: %s", c.spec, err)
+			continue
+		}
+		if got := s.Open(c.at); got != c.open {
+			t.Errorf("%q open at %s: expected %v, got %v", c.spec, c.at, c.open, got)
+		}
+	}
+}
+
+func TestNilScheduleOpen(t *testing.T) {
+	var s Schedule
+	if !s.Open(time.Now()) {
+		t.Error("expected nil schedule to be open")
+	}
+}
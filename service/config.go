@@ -12,8 +12,16 @@ type NotifierConfig struct {
 	NotifyEvents []string `json:"notifyEvents" yaml:"notifyEvents"`
 }
 
+// GitWebhookConfig is for receiving webhooks from the git host when
+// commits are pushed; they are only accepted if signed with (or, for
+// GitLab, given) the secret.
+type GitWebhookConfig struct {
+	Secret string `json:"secret" yaml:"secret"`
+}
+
 type InstanceConfig struct {
-	Slack NotifierConfig `json:"slack" yaml:"slack"`
+	Slack      NotifierConfig   `json:"slack" yaml:"slack"`
+	GitWebhook GitWebhookConfig `json:"gitWebhook" yaml:"gitWebhook"`
 }
 
 type untypedConfig map[string]interface{}
@@ -8,7 +8,7 @@ import (
 func TestConfig_Patch(t *testing.T) {
 
 	uic := InstanceConfig{
-		NotifierConfig{
+		Slack: NotifierConfig{
 			HookURL: "existingurl",
 		},
 	}
@@ -21,6 +21,7 @@ import (
 	"github.com/weaveworks/flux"
 	fluxerr "github.com/weaveworks/flux/errors"
 	"github.com/weaveworks/flux/event"
+	"github.com/weaveworks/flux/git/webhook"
 	transport "github.com/weaveworks/flux/http"
 	"github.com/weaveworks/flux/http/httperror"
 	"github.com/weaveworks/flux/http/websocket"
@@ -68,6 +69,9 @@ func NewServiceRouter() *mux.Router {
 	r.NewRoute().Name("PatchConfig").Methods("PATCH").Path("/v6/config")
 	r.NewRoute().Name("PostIntegrationsGithub").Methods("POST").Path("/v6/integrations/github").Queries("owner", "{owner}", "repository", "{repository}")
 	r.NewRoute().Name("IsConnected").Methods("HEAD", "GET").Path("/v6/ping")
+	// Webhooks from git hosts can't be given the instance in a
+	// header, so it's in the path.
+	r.NewRoute().Name("GitPushHook").Methods("POST").Path("/v6/integrations/git-push/{instance}")
 
 	// We assume every request that doesn't match a route is a client
 	// calling an old or hitherto unsupported API.
@@ -88,6 +92,9 @@ func NewHandler(s api.Service, r *mux.Router, logger log.Logger) http.Handler {
 		"UpdateImages":             handle.UpdateImages,
 		"UpdatePolicies":           handle.UpdatePolicies,
 		"UpdatePoliciesV4":         handle.UpdatePolicies,
+		"UpdatePoliciesBySpec":     handle.UpdatePoliciesBySpec,
+		"UpdateFreeze":             handle.UpdateFreeze,
+		"Rollback":                 handle.Rollback,
 		"LogEvent":                 handle.LogEvent,
 		"History":                  handle.History,
 		"HistoryV3":                handle.History,
@@ -112,6 +119,8 @@ func NewHandler(s api.Service, r *mux.Router, logger log.Logger) http.Handler {
 		"SyncStatus":               handle.SyncStatus,
 		"GetPublicSSHKey":          handle.GetPublicSSHKey,
 		"RegeneratePublicSSHKey":   handle.RegeneratePublicSSHKey,
+		"GitRepoConfig":            handle.GitRepoConfig,
+		"GitPushHook":              handle.GitPushHook,
 	} {
 		handler := logging(handlerMethod, log.With(logger, "method", method))
 		r.Get(method).Handler(handler)
@@ -197,11 +206,22 @@ func (s HTTPService) UpdateImages(w http.ResponseWriter, r *http.Request) {
 		excludes = append(excludes, s)
 	}
 
+	var soak time.Duration
+	if v := r.FormValue("soak"); v != "" {
+		if soak, err = time.ParseDuration(v); err != nil {
+			transport.WriteError(w, r, http.StatusBadRequest, errors.Wrapf(err, "parsing soak duration %q", v))
+			return
+		}
+	}
+
 	jobID, err := s.service.UpdateImages(ctx, update.ReleaseSpec{
 		ServiceSpecs: serviceSpecs,
 		ImageSpec:    imageSpec,
 		Kind:         releaseKind,
 		Excludes:     excludes,
+		Containers:   r.Form["container"],
+		Canary:       r.FormValue("canary") == "true",
+		Soak:         soak,
 	}, update.Cause{
 		User:    r.FormValue("user"),
 		Message: r.FormValue("message"),
@@ -267,6 +287,69 @@ func (s HTTPService) UpdatePolicies(w http.ResponseWriter, r *http.Request) {
 	transport.JSONResponse(w, r, jobID)
 }
 
+func (s HTTPService) UpdatePoliciesBySpec(w http.ResponseWriter, r *http.Request) {
+	ctx := getRequestContext(r)
+
+	var updates update.PolicyUpdatesBySpec
+	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
+		transport.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	jobID, err := s.service.UpdatePoliciesBySpec(ctx, updates, update.Cause{
+		User:    r.FormValue("user"),
+		Message: r.FormValue("message"),
+	})
+	if err != nil {
+		transport.ErrorResponse(w, r, err)
+		return
+	}
+
+	transport.JSONResponse(w, r, jobID)
+}
+
+func (s HTTPService) UpdateFreeze(w http.ResponseWriter, r *http.Request) {
+	ctx := getRequestContext(r)
+
+	var freeze update.FreezeSpec
+	if err := json.NewDecoder(r.Body).Decode(&freeze); err != nil {
+		transport.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	jobID, err := s.service.UpdateFreeze(ctx, freeze, update.Cause{
+		User:    r.FormValue("user"),
+		Message: r.FormValue("message"),
+	})
+	if err != nil {
+		transport.ErrorResponse(w, r, err)
+		return
+	}
+
+	transport.JSONResponse(w, r, jobID)
+}
+
+func (s HTTPService) Rollback(w http.ResponseWriter, r *http.Request) {
+	ctx := getRequestContext(r)
+
+	var rollback update.RollbackSpec
+	if err := json.NewDecoder(r.Body).Decode(&rollback); err != nil {
+		transport.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	jobID, err := s.service.Rollback(ctx, rollback, update.Cause{
+		User:    r.FormValue("user"),
+		Message: r.FormValue("message"),
+	})
+	if err != nil {
+		transport.ErrorResponse(w, r, err)
+		return
+	}
+
+	transport.JSONResponse(w, r, jobID)
+}
+
 func (s HTTPService) LogEvent(w http.ResponseWriter, r *http.Request) {
 	ctx := getRequestContext(r)
 
@@ -420,6 +503,39 @@ func (s HTTPService) PostIntegrationsGithub(w http.ResponseWriter, r *http.Reque
 	w.WriteHeader(http.StatusOK)
 }
 
+func (s HTTPService) GitPushHook(w http.ResponseWriter, r *http.Request) {
+	instID := service.InstanceID(mux.Vars(r)["instance"])
+	ctx := context.WithValue(r.Context(), service.InstanceIDKey, instID)
+
+	config, err := s.service.GetConfig(ctx, "")
+	if err != nil {
+		transport.ErrorResponse(w, r, err)
+		return
+	}
+	synced, err := webhook.Notify(ctx, r, config.GitWebhook.Secret, webhookTarget{s.service})
+	switch {
+	case err == webhook.ErrInvalidSignature || err == webhook.ErrNoSecret:
+		transport.WriteError(w, r, http.StatusUnauthorized, err)
+	case err == webhook.ErrTooLarge:
+		transport.WriteError(w, r, http.StatusRequestEntityTooLarge, err)
+	case err != nil:
+		transport.ErrorResponse(w, r, err)
+	case synced:
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// webhookTarget adapts the service to what webhooks need.
+type webhookTarget struct {
+	api.Service
+}
+
+func (t webhookTarget) GitRepoConfig(ctx context.Context, _ bool) (flux.GitConfig, error) {
+	return t.Service.GitRepoConfig(ctx)
+}
+
 func (s HTTPService) Status(w http.ResponseWriter, r *http.Request) {
 	ctx := getRequestContext(r)
 	status, err := s.service.Status(ctx)
@@ -540,6 +656,17 @@ func (s HTTPService) GetPublicSSHKey(w http.ResponseWriter, r *http.Request) {
 	transport.JSONResponse(w, r, publicSSHKey)
 }
 
+func (s HTTPService) GitRepoConfig(w http.ResponseWriter, r *http.Request) {
+	ctx := getRequestContext(r)
+	config, err := s.service.GitRepoConfig(ctx)
+	if err != nil {
+		transport.ErrorResponse(w, r, err)
+		return
+	}
+
+	transport.JSONResponse(w, r, config)
+}
+
 func (s HTTPService) RegeneratePublicSSHKey(w http.ResponseWriter, r *http.Request) {
 	ctx := getRequestContext(r)
 	_, err := s.service.PublicSSHKey(ctx, true)
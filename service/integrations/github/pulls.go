@@ -0,0 +1,96 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	gh "github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+
+	"github.com/weaveworks/flux/forge"
+)
+
+// PullRequests opens pull requests on a particular GitHub repository.
+type PullRequests struct {
+	client *gh.Client
+	owner  string
+	repo   string
+}
+
+var _ forge.Client = &PullRequests{}
+
+// NewPullRequests makes a forge client for the GitHub repository
+// given by the git URL, using the OAuth token to authenticate. If
+// apiURL is not empty, it is used instead of the public GitHub API,
+// e.g., for GitHub Enterprise.
+func NewPullRequests(token, gitURL, apiURL string) (*PullRequests, error) {
+	owner, repo, err := OwnerAndRepo(gitURL)
+	if err != nil {
+		return nil, err
+	}
+	ts := oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: token},
+	)
+	client := gh.NewClient(oauth2.NewClient(oauth2.NoContext, ts))
+	if apiURL != "" {
+		if !strings.HasSuffix(apiURL, "/") {
+			apiURL += "/"
+		}
+		if client.BaseURL, err = url.Parse(apiURL); err != nil {
+			return nil, fmt.Errorf("parsing GitHub API URL %q: %s", apiURL, err)
+		}
+	}
+	return &PullRequests{
+		client: client,
+		owner:  owner,
+		repo:   repo,
+	}, nil
+}
+
+// OpenPullRequest opens a pull request and returns its URL.
+func (p *PullRequests) OpenPullRequest(ctx context.Context, pr forge.PullRequest) (string, error) {
+	// This is PullRequests.Create, but with the context attached to
+	// the request, since this version of the client doesn't take one.
+	req, err := p.client.NewRequest("POST", fmt.Sprintf("repos/%v/%v/pulls", p.owner, p.repo), &gh.NewPullRequest{
+		Title: &pr.Title,
+		Body:  &pr.Body,
+		Head:  &pr.Head,
+		Base:  &pr.Base,
+	})
+	if err != nil {
+		return "", err
+	}
+	created := new(gh.PullRequest)
+	resp, err := p.client.Do(req.WithContext(ctx), created)
+	if err != nil {
+		if resp != nil {
+			return "", parseError(resp, err)
+		}
+		return "", err
+	}
+	if created.HTMLURL == nil {
+		return "", fmt.Errorf("no URL given for pull request")
+	}
+	return *created.HTMLURL, nil
+}
+
+// OwnerAndRepo extracts the owner and repository name from a GitHub
+// git URL, in either the SSH form (git@github.com:owner/repo.git) or
+// the HTTPS form (https://github.com/owner/repo).
+func OwnerAndRepo(gitURL string) (string, string, error) {
+	var path string
+	if u, err := url.Parse(gitURL); err == nil && u.Scheme != "" {
+		path = u.Path
+	} else if i := strings.Index(gitURL, ":"); i > -1 {
+		path = gitURL[i+1:]
+	} else {
+		return "", "", fmt.Errorf("cannot find repository in git URL %q", gitURL)
+	}
+	parts := strings.Split(strings.TrimSuffix(strings.Trim(path, "/"), ".git"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("cannot find owner and repository in git URL %q", gitURL)
+	}
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,76 @@
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/weaveworks/flux/forge"
+)
+
+func TestOwnerAndRepo(t *testing.T) {
+	for _, c := range []struct {
+		url, owner, repo string
+	}{
+		{"git@github.com:weaveworks/flux-example", "weaveworks", "flux-example"},
+		{"git@github.com:weaveworks/flux-example.git", "weaveworks", "flux-example"},
+		{"ssh://git@github.com/weaveworks/flux-example.git", "weaveworks", "flux-example"},
+		{"https://github.com/weaveworks/flux-example", "weaveworks", "flux-example"},
+	} {
+		owner, repo, err := OwnerAndRepo(c.url)
+		if err != nil {
+			t.Errorf("%s: %s", c.url, err)
+			continue
+		}
+		if owner != c.owner || repo != c.repo {
+			t.Errorf("%s: expected %s/%s, got %s/%s", c.url, c.owner, c.repo, owner, repo)
+		}
+	}
+
+	for _, url := range []string{"", "flux-example", "git@github.com:flux-example"} {
+		if _, _, err := OwnerAndRepo(url); err == nil {
+			t.Errorf("%q: expected error, got none", url)
+		}
+	}
+}
+
+func TestOpenPullRequest(t *testing.T) {
+	var got map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/repos/weaveworks/flux-example/pulls" {
+			http.NotFound(w, r)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"number": 1, "html_url": "https://github.com/weaveworks/flux-example/pull/1"}`))
+	}))
+	defer server.Close()
+
+	prs, err := NewPullRequests("token", "git@github.com:weaveworks/flux-example", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := prs.OpenPullRequest(context.Background(), forge.PullRequest{
+		Title: "Release things",
+		Body:  "Please merge",
+		Head:  "flux/job",
+		Base:  "master",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "https://github.com/weaveworks/flux-example/pull/1" {
+		t.Errorf("unexpected pull request URL %q", url)
+	}
+	for k, v := range map[string]string{"title": "Release things", "body": "Please merge", "head": "flux/job", "base": "master"} {
+		if got[k] != v {
+			t.Errorf("expected %s to be %q, got %q", k, v, got[k])
+		}
+	}
+}
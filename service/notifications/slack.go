@@ -208,7 +208,11 @@ func slackCommitsAttachment(ev *event.SyncEventMetadata) SlackAttachment {
 	fmt.Fprintln(buf, "```")
 
 	for i := range ev.Commits {
-		fmt.Fprintf(buf, "%s %s\n", ev.Commits[i].Revision[:7], ev.Commits[i].Message)
+		fmt.Fprintf(buf, "%s %s", ev.Commits[i].Revision[:7], ev.Commits[i].Message)
+		if author := ev.Commits[i].Author; author != nil {
+			fmt.Fprintf(buf, " (%s)", author.Name)
+		}
+		fmt.Fprintln(buf)
 	}
 	fmt.Fprintln(buf, "```")
 	return SlackAttachment{
@@ -167,6 +167,45 @@ func (s *Server) UpdatePolicies(ctx context.Context, updates policy.Updates, cau
 	return inst.Platform.UpdateManifests(ctx, update.Spec{Type: update.Policy, Cause: cause, Spec: updates})
 }
 
+func (s *Server) UpdatePoliciesBySpec(ctx context.Context, updates update.PolicyUpdatesBySpec, cause update.Cause) (job.ID, error) {
+	instID, err := getInstanceID(ctx)
+	if err != nil {
+		return "", err
+	}
+	inst, err := s.instancer.Get(instID)
+	if err != nil {
+		return "", errors.Wrapf(err, "getting instance "+string(instID))
+	}
+
+	return inst.Platform.UpdateManifests(ctx, update.Spec{Type: update.PolicyBySpec, Cause: cause, Spec: updates})
+}
+
+func (s *Server) UpdateFreeze(ctx context.Context, freeze update.FreezeSpec, cause update.Cause) (job.ID, error) {
+	instID, err := getInstanceID(ctx)
+	if err != nil {
+		return "", err
+	}
+	inst, err := s.instancer.Get(instID)
+	if err != nil {
+		return "", errors.Wrapf(err, "getting instance "+string(instID))
+	}
+
+	return inst.Platform.UpdateManifests(ctx, update.Spec{Type: update.Freeze, Cause: cause, Spec: freeze})
+}
+
+func (s *Server) Rollback(ctx context.Context, rollback update.RollbackSpec, cause update.Cause) (job.ID, error) {
+	instID, err := getInstanceID(ctx)
+	if err != nil {
+		return "", err
+	}
+	inst, err := s.instancer.Get(instID)
+	if err != nil {
+		return "", errors.Wrapf(err, "getting instance "+string(instID))
+	}
+
+	return inst.Platform.UpdateManifests(ctx, update.Spec{Type: update.Rollback, Cause: cause, Spec: rollback})
+}
+
 func (s *Server) SyncNotify(ctx context.Context) (err error) {
 	instID, err := getInstanceID(ctx)
 	if err != nil {
@@ -363,6 +402,20 @@ func (s *Server) PublicSSHKey(ctx context.Context, regenerate bool) (ssh.PublicK
 	return gitRepoConfig.PublicSSHKey, nil
 }
 
+func (s *Server) GitRepoConfig(ctx context.Context) (flux.GitConfig, error) {
+	instID, err := getInstanceID(ctx)
+	if err != nil {
+		return flux.GitConfig{}, err
+	}
+
+	inst, err := s.instancer.Get(instID)
+	if err != nil {
+		return flux.GitConfig{}, errors.Wrapf(err, "getting instance "+string(instID))
+	}
+
+	return inst.Platform.GitRepoConfig(ctx, false)
+}
+
 // RegisterDaemon handles a daemon connection. It blocks until the
 // daemon is disconnected.
 //
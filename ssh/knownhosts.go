@@ -0,0 +1,62 @@
+package ssh
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// KnownHost is an entry in a known_hosts file: the hosts (or hashed
+// hosts) it applies to, and the key they must present.
+type KnownHost struct {
+	Hosts       []string `json:"hosts"`
+	KeyType     string   `json:"keyType"`
+	Fingerprint string   `json:"fingerprint"`
+	// Marker is "revoked" or "cert-authority" if the entry was so
+	// marked, and empty otherwise.
+	Marker string `json:"marker,omitempty"`
+}
+
+func (h KnownHost) String() string {
+	s := strings.Join(h.Hosts, ",") + " " + h.KeyType + " " + h.Fingerprint
+	if h.Marker != "" {
+		s = "@" + h.Marker + " " + s
+	}
+	return s
+}
+
+// ReadKnownHosts reads and checks the known_hosts file at the path
+// given, returning its entries.
+func ReadKnownHosts(path string) ([]KnownHost, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading known hosts")
+	}
+	return ParseKnownHosts(bytes)
+}
+
+// ParseKnownHosts parses entries in the format of known_hosts,
+// skipping blank lines and comments.
+func ParseKnownHosts(in []byte) ([]KnownHost, error) {
+	var hosts []KnownHost
+	for len(in) > 0 {
+		marker, hostnames, key, _, rest, err := ssh.ParseKnownHosts(in)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing known hosts")
+		}
+		hosts = append(hosts, KnownHost{
+			Hosts:       hostnames,
+			KeyType:     key.Type(),
+			Fingerprint: ssh.FingerprintSHA256(key),
+			Marker:      marker,
+		})
+		in = rest
+	}
+	return hosts, nil
+}
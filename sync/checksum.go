@@ -0,0 +1,51 @@
+package sync
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+
+	"github.com/weaveworks/flux/cluster"
+	"github.com/weaveworks/flux/resource"
+)
+
+// checksummed is implemented by resources that can say the checksum
+// recorded when they were applied (see cluster.SyncAction).
+type checksummed interface {
+	SyncChecksum() string
+}
+
+// checksum gives a checksum of the definition of a resource.
+func checksum(res resource.Resource) string {
+	sum := sha1.Sum(res.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+// addChecksums gives each apply action the checksum of the definition
+// in the repo, so it can be recorded in the cluster. If skipUnchanged
+// is set, actions for resources that have the same checksum recorded
+// in the cluster are dropped, since applying them would make no
+// difference. Only the resources given from the cluster can be
+// compared, and those are the namespaces and workloads (see
+// cluster.Cluster.Export); anything else is always applied. It returns
+// how many were dropped.
+func addChecksums(repoResources, clusterResources map[string]resource.Resource, skipUnchanged bool, sync *cluster.SyncDef) int {
+	var skipped int
+	actions := sync.Actions[:0]
+	for _, action := range sync.Actions {
+		res, ok := repoResources[action.ResourceID]
+		if len(action.Apply) == 0 || !ok {
+			actions = append(actions, action)
+			continue
+		}
+		action.Checksum = checksum(res)
+		if skipUnchanged && len(action.Delete) == 0 {
+			if cres, ok := clusterResources[action.ResourceID].(checksummed); ok && cres.SyncChecksum() == action.Checksum {
+				skipped++
+				continue
+			}
+		}
+		actions = append(actions, action)
+	}
+	sync.Actions = actions
+	return skipped
+}
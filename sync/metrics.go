@@ -0,0 +1,42 @@
+package sync
+
+import (
+	"github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+
+	"github.com/weaveworks/flux/cluster"
+	fluxmetrics "github.com/weaveworks/flux/metrics"
+)
+
+// The actions counted
+const (
+	actionApply  = "apply"
+	actionDelete = "delete"
+	actionSkip   = "skip"
+)
+
+var (
+	syncResources = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Namespace: "flux",
+		Subsystem: "sync",
+		Name:      "resources_total",
+		Help:      "Count of resources applied, deleted, or skipped as unchanged, in syncs.",
+	}, []string{fluxmetrics.LabelAction})
+)
+
+// countActions records how many resources a sync will apply and
+// delete, and how many it skipped.
+func countActions(sync cluster.SyncDef, skipped int) {
+	var applied, deleted int
+	for _, action := range sync.Actions {
+		if len(action.Apply) > 0 {
+			applied++
+		}
+		if len(action.Delete) > 0 {
+			deleted++
+		}
+	}
+	syncResources.With(fluxmetrics.LabelAction, actionApply).Add(float64(applied))
+	syncResources.With(fluxmetrics.LabelAction, actionDelete).Add(float64(deleted))
+	syncResources.With(fluxmetrics.LabelAction, actionSkip).Add(float64(skipped))
+}
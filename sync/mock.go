@@ -35,6 +35,10 @@ func (rs rsc) Policy() policy.Set {
 	return p
 }
 
+func (rs rsc) Labels() map[string]string {
+	return nil
+}
+
 func (ri rscIgnorePolicy) Policy() policy.Set {
 	p := policy.Set{}
 	p[policy.Ignore] = "true"
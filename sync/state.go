@@ -0,0 +1,24 @@
+package sync
+
+import (
+	"context"
+)
+
+const (
+	// GitTagState records sync progress by moving a tag in the git
+	// repo, which needs write access to the repo.
+	GitTagState = "git"
+	// KubernetesState records sync progress in the cluster, so the
+	// repo can be read-only, and shared by clusters without each
+	// leaving a tag.
+	KubernetesState = "kubernetes"
+)
+
+// State is where the revision last synced is recorded.
+type State interface {
+	// GetRevision gives the revision last synced, or the empty
+	// string if there is no record of a sync.
+	GetRevision(ctx context.Context) (string, error)
+	// UpdateMarker records the revision given as synced.
+	UpdateMarker(ctx context.Context, revision string) error
+}
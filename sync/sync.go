@@ -11,6 +11,19 @@ import (
 
 // Sync synchronises the cluster to the files in a directory
 func Sync(m cluster.Manifests, repoResources map[string]resource.Resource, clus cluster.Cluster, deletes bool, logger log.Logger) error {
+	return doSync(m, repoResources, clus, deletes, false, logger)
+}
+
+// SyncChanged is like Sync, except that it skips applying resources
+// whose definitions in the repo are the same as when they were last
+// applied, according to the checksums recorded in the cluster. Since
+// that won't undo changes made to the cluster by other means, it's
+// worth doing a full Sync every so often.
+func SyncChanged(m cluster.Manifests, repoResources map[string]resource.Resource, clus cluster.Cluster, deletes bool, logger log.Logger) error {
+	return doSync(m, repoResources, clus, deletes, true, logger)
+}
+
+func doSync(m cluster.Manifests, repoResources map[string]resource.Resource, clus cluster.Cluster, deletes, skipUnchanged bool, logger log.Logger) error {
 	// Get a map of resources defined in the cluster
 	clusterBytes, err := clus.Export()
 
@@ -56,6 +69,8 @@ func Sync(m cluster.Manifests, repoResources map[string]resource.Resource, clus
 		prepareSyncApply(logger, clusterResources, id, res, &sync)
 	}
 
+	skipped := addChecksums(repoResources, clusterResources, skipUnchanged, &sync)
+	countActions(sync, skipped)
 	return clus.Sync(sync)
 }
 
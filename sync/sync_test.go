@@ -17,6 +17,7 @@ import (
 
 	"github.com/weaveworks/flux/cluster"
 	"github.com/weaveworks/flux/cluster/kubernetes"
+	kresource "github.com/weaveworks/flux/cluster/kubernetes/resource"
 	"github.com/weaveworks/flux/cluster/kubernetes/testfiles"
 	"github.com/weaveworks/flux/git"
 	"github.com/weaveworks/flux/git/gittest"
@@ -249,6 +250,61 @@ func TestPrepareSyncApply(t *testing.T) {
 	}
 }
 
+func TestAddChecksums(t *testing.T) {
+	def := `---
+kind: Deployment
+metadata:
+  name: helloworld
+  namespace: default
+spec:
+  replicas: 1
+`
+	repoResources, err := kresource.ParseMultidoc([]byte(def), "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := "default:deployment/helloworld"
+	sum := checksum(repoResources[id])
+
+	clusterDef := func(annotation string) map[string]resource.Resource {
+		res, err := kresource.ParseMultidoc([]byte(`---
+kind: Deployment
+metadata:
+  name: helloworld
+  namespace: default
+  annotations:
+    `+kresource.ChecksumAnnotation+`: `+annotation+`
+`), "exported")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	for _, c := range []struct {
+		msg           string
+		clusRes       map[string]resource.Resource
+		skipUnchanged bool
+		skipped       int
+	}{
+		{"not in cluster", map[string]resource.Resource{}, true, 0},
+		{"unchanged, full sync", clusterDef(sum), false, 0},
+		{"unchanged", clusterDef(sum), true, 1},
+		{"changed", clusterDef("deadbeef"), true, 0},
+	} {
+		sync := &cluster.SyncDef{}
+		prepareSyncApply(log.NewNopLogger(), c.clusRes, id, repoResources[id], sync)
+		skipped := addChecksums(repoResources, c.clusRes, c.skipUnchanged, sync)
+		if skipped != c.skipped || len(sync.Actions) != 1-c.skipped {
+			t.Errorf("%s: expected %d skipped, got %d skipped and actions %+v", c.msg, c.skipped, skipped, sync.Actions)
+			continue
+		}
+		if len(sync.Actions) == 1 && sync.Actions[0].Checksum != sum {
+			t.Errorf("%s: expected checksum %s, got %q", c.msg, sum, sync.Actions[0].Checksum)
+		}
+	}
+}
+
 // ---
 
 var gitconf = git.Config{
@@ -3,14 +3,37 @@ package update
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/weaveworks/flux"
 	"github.com/weaveworks/flux/cluster"
+	"github.com/weaveworks/flux/policy"
+	"github.com/weaveworks/flux/schedule"
 )
 
 type Automated struct {
 	Changes []Change
+
+	// These say when the changes may be released. They're supplied
+	// by the daemon at the time of the release, so aren't recorded
+	// with it.
+	DefaultWindow schedule.Schedule `json:"-"`
+	Frozen        bool              `json:"-"`
+	Now           time.Time         `json:"-"`
+	// How many automated releases each controller has had in the
+	// last hour, and how many it's allowed.
+	RecentReleases     map[flux.ResourceID]int `json:"-"`
+	MaxReleasesPerHour int                     `json:"-"`
+	// Controllers for which there are new images, but which are held
+	// back for some reason (e.g., the images are too new); these are
+	// reported as skipped in the result.
+	Deferred map[flux.ResourceID]string `json:"-"`
+	// Stage is filled in by the daemon when the release is staged,
+	// because some of the controllers are canaries, or automated
+	// releases are staged by namespace (in the NamespaceOrder).
+	Stage          Stage    `json:",omitempty"`
+	NamespaceOrder []string `json:",omitempty"`
 }
 
 type Change struct {
@@ -23,23 +46,33 @@ func (a *Automated) Add(service flux.ResourceID, container cluster.Container, im
 	a.Changes = append(a.Changes, Change{service, container, image})
 }
 
+// Defer records that a controller has changes being held back, and
+// why.
+func (a *Automated) Defer(service flux.ResourceID, reason string) {
+	if a.Deferred == nil {
+		a.Deferred = map[flux.ResourceID]string{}
+	}
+	a.Deferred[service] = reason
+}
+
 func (a *Automated) CalculateRelease(rc ReleaseContext, logger log.Logger) ([]*ControllerUpdate, Result, error) {
-	filters, err := a.filters(rc)
+	services, err := rc.ServicesWithPolicies()
 	if err != nil {
 		return nil, nil, err
 	}
 
 	result := Result{}
-	updates, err := rc.SelectServices(result, filters...)
+	updates, err := rc.SelectServices(result, a.filters(services)...)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	a.markSkipped(result)
-	updates, err = a.calculateImageUpdates(rc, updates, result, logger)
+	updates, err = a.calculateImageUpdates(rc, updates, services, result, logger)
 	if err != nil {
 		return nil, nil, err
 	}
+	a.MarkDeferred(result)
 
 	return updates, result, err
 }
@@ -72,10 +105,32 @@ func (a *Automated) Images() []flux.ImageID {
 	return images
 }
 
-func (a *Automated) filters(rc ReleaseContext) ([]ControllerFilter, error) {
-	return []ControllerFilter{
+func (a *Automated) filters(services policy.ResourceMap) []ControllerFilter {
+	filters := []ControllerFilter{
 		&IncludeFilter{a.serviceIDs()},
-	}, nil
+		&LockedFilter{services.OnlyWithContainerPolicy(policy.Locked)},
+		&WindowFilter{
+			Policies:      services,
+			DefaultWindow: a.DefaultWindow,
+			Frozen:        a.Frozen,
+			Now:           a.now(),
+		},
+		&RateLimitFilter{
+			Recent:     a.RecentReleases,
+			MaxPerHour: a.MaxReleasesPerHour,
+		},
+	}
+	if a.Stage != "" {
+		filters = append(filters, &StageFilter{services.OnlyWithPolicy(policy.Canary), a.NamespaceOrder, a.Stage})
+	}
+	return filters
+}
+
+func (a *Automated) now() time.Time {
+	if a.Now.IsZero() {
+		return time.Now()
+	}
+	return a.Now
 }
 
 func (a *Automated) markSkipped(results Result) {
@@ -89,7 +144,20 @@ func (a *Automated) markSkipped(results Result) {
 	}
 }
 
-func (a *Automated) calculateImageUpdates(rc ReleaseContext, candidates []*ControllerUpdate, result Result, logger log.Logger) ([]*ControllerUpdate, error) {
+// MarkDeferred reports the controllers that had changes held back,
+// unless they have been dealt with otherwise.
+func (a *Automated) MarkDeferred(results Result) {
+	for id, reason := range a.Deferred {
+		if _, ok := results[id]; !ok {
+			results[id] = ControllerResult{
+				Status: ReleaseStatusSkipped,
+				Error:  reason,
+			}
+		}
+	}
+}
+
+func (a *Automated) calculateImageUpdates(rc ReleaseContext, candidates []*ControllerUpdate, services policy.ResourceMap, result Result, logger log.Logger) ([]*ControllerUpdate, error) {
 	updates := []*ControllerUpdate{}
 
 	serviceMap := a.serviceMap()
@@ -105,12 +173,32 @@ func (a *Automated) calculateImageUpdates(rc ReleaseContext, candidates []*Contr
 
 		changes := serviceMap[u.ResourceID]
 		containerUpdates := []ContainerUpdate{}
+		var lockedContainers, unautomatedContainers bool
 		for _, container := range containers {
 			currentImageID, err := flux.ParseImageID(container.Image)
 			if err != nil {
 				return nil, err
 			}
 
+			// The policies may have changed since the automated
+			// changes were calculated, so check again that the
+			// container is still automated and not locked.
+			cp := services[u.ResourceID].ForContainer(container.Name)
+			locked := cp.Contains(policy.Locked) || cp.Contains(policy.Ignore)
+			if locked || !cp.Contains(policy.Automated) {
+				for _, change := range changes {
+					if change.Container.Name != container.Name {
+						continue
+					}
+					if locked {
+						lockedContainers = true
+					} else {
+						unautomatedContainers = true
+					}
+				}
+				continue
+			}
+
 			for _, change := range changes {
 				if change.Container.Name != container.Name {
 					continue
@@ -136,6 +224,16 @@ func (a *Automated) calculateImageUpdates(rc ReleaseContext, candidates []*Contr
 				Status:       ReleaseStatusSuccess,
 				PerContainer: containerUpdates,
 			}
+		} else if lockedContainers {
+			result[u.ResourceID] = ControllerResult{
+				Status: ReleaseStatusSkipped,
+				Error:  Locked,
+			}
+		} else if unautomatedContainers {
+			result[u.ResourceID] = ControllerResult{
+				Status: ReleaseStatusSkipped,
+				Error:  NotAutomated,
+			}
 		} else {
 			result[u.ResourceID] = ControllerResult{
 				Status: ReleaseStatusIgnored,
@@ -1,17 +1,34 @@
 package update
 
-import "github.com/weaveworks/flux"
+import (
+	"time"
+
+	"github.com/weaveworks/flux"
+	"github.com/weaveworks/flux/policy"
+	"github.com/weaveworks/flux/schedule"
+)
 
 const (
-	Locked          = "locked"
-	NotIncluded     = "not included"
-	Excluded        = "excluded"
-	DifferentImage  = "a different image"
-	NotInCluster    = "not running in cluster"
-	NotInRepo       = "not found in repository"
-	ImageNotFound   = "cannot find one or more images"
-	ImageUpToDate   = "image(s) up to date"
-	DoesNotUseImage = "does not use image(s)"
+	Locked           = "locked"
+	NotAutomated     = "not automated"
+	NotIncluded      = "not included"
+	Excluded         = "excluded"
+	DifferentImage   = "a different image"
+	NotInCluster     = "not running in cluster"
+	NotInRepo        = "not found in repository"
+	ImageNotFound    = "cannot find one or more images"
+	ImageUpToDate    = "image(s) up to date"
+	DoesNotUseImage  = "does not use image(s)"
+	OutsideWindow    = "outside its deployment window"
+	ChangesFrozen    = "frozen (automated releases are suspended)"
+	NotOldEnough     = "waiting for new image(s) to reach minimum age"
+	RateLimited      = "at the limit of automated releases per hour"
+	AwaitingCanary   = "waiting for canary release to succeed"
+	ReleasedAsCanary = "released as a canary"
+	AwaitingStage    = "waiting for release to earlier namespace(s) to succeed"
+	ReleasedInStage  = "released in an earlier stage"
+	Rejected         = "rejected by approval gate"
+	ApprovalDeferred = "approval deferred"
 )
 
 type SpecificImageFilter struct {
@@ -73,18 +90,167 @@ func (f *IncludeFilter) Filter(u ControllerUpdate) ControllerResult {
 	}
 }
 
+// LockedFilter skips controllers that are locked, either as a whole
+// or in every one of their containers. A controller with only some of
+// its containers locked gets through; it's then up to the release to
+// leave those containers alone.
 type LockedFilter struct {
-	IDs []flux.ResourceID
+	Policies policy.ResourceMap
 }
 
 func (f *LockedFilter) Filter(u ControllerUpdate) ControllerResult {
-	for _, id := range f.IDs {
-		if u.ResourceID == id {
+	policies, ok := f.Policies[u.ResourceID]
+	if !ok {
+		return ControllerResult{}
+	}
+	locked := policies.Contains(policy.Locked)
+	if containers := u.Controller.ContainersOrNil(); len(containers) > 0 {
+		locked = true
+		for _, c := range containers {
+			if !policies.ForContainer(c.Name).Contains(policy.Locked) {
+				locked = false
+				break
+			}
+		}
+	}
+	if locked {
+		return ControllerResult{
+			Status: ReleaseStatusSkipped,
+			Error:  Locked,
+		}
+	}
+	return ControllerResult{}
+}
+
+// WindowFilter skips controllers when automated releases are frozen,
+// or when it is not within the controller's deployment window. The
+// window comes from the controller's policy if it has one, or
+// otherwise the default window.
+type WindowFilter struct {
+	Policies      policy.ResourceMap
+	DefaultWindow schedule.Schedule
+	Frozen        bool
+	Now           time.Time
+
+	// the windows from policies, each parsed once since many
+	// controllers may have the same window
+	parsed map[string]parsedWindow
+}
+
+type parsedWindow struct {
+	window schedule.Schedule
+	err    error
+}
+
+func (f *WindowFilter) Filter(u ControllerUpdate) ControllerResult {
+	if f.Frozen {
+		return ControllerResult{
+			Status: ReleaseStatusSkipped,
+			Error:  ChangesFrozen,
+		}
+	}
+	window := f.DefaultWindow
+	if spec, ok := f.Policies[u.ResourceID].Get(policy.Window); ok {
+		parsed, ok := f.parsed[spec]
+		if !ok {
+			parsed.window, parsed.err = schedule.Parse(spec)
+			if f.parsed == nil {
+				f.parsed = map[string]parsedWindow{}
+			}
+			f.parsed[spec] = parsed
+		}
+		if parsed.err != nil {
 			return ControllerResult{
-				Status: ReleaseStatusSkipped,
-				Error:  Locked,
+				Status: ReleaseStatusFailed,
+				Error:  "invalid deployment window: " + parsed.err.Error(),
 			}
 		}
+		window = parsed.window
+	}
+	if !window.Open(f.Now) {
+		return ControllerResult{
+			Status: ReleaseStatusSkipped,
+			Error:  OutsideWindow,
+		}
+	}
+	return ControllerResult{}
+}
+
+// RateLimitFilter skips controllers that have already had the
+// maximum number of automated releases in the last hour. A maximum
+// of zero means there's no limit.
+type RateLimitFilter struct {
+	Recent     map[flux.ResourceID]int
+	MaxPerHour int
+}
+
+func (f *RateLimitFilter) Filter(u ControllerUpdate) ControllerResult {
+	if f.MaxPerHour > 0 && f.Recent[u.ResourceID] >= f.MaxPerHour {
+		return ControllerResult{
+			Status: ReleaseStatusSkipped,
+			Error:  RateLimited,
+		}
+	}
+	return ControllerResult{}
+}
+
+// StageFilter confines a release to one stage of a staged release:
+// either only the canaries, or only the controllers that aren't
+// canaries; or if the release is staged by namespace, only the
+// controllers in the namespace for the stage (or for the remainder,
+// those in none of the namespaces).
+type StageFilter struct {
+	Canaries   policy.ResourceMap
+	Namespaces []string
+	Stage      Stage
+}
+
+func (f *StageFilter) Filter(u ControllerUpdate) ControllerResult {
+	if len(f.Namespaces) > 0 {
+		return f.filterByNamespace(u)
+	}
+	_, canary := f.Canaries[u.ResourceID]
+	switch {
+	case f.Stage == StageCanaries && !canary:
+		return ControllerResult{
+			Status: ReleaseStatusSkipped,
+			Error:  AwaitingCanary,
+		}
+	case f.Stage == StageRemainder && canary:
+		return ControllerResult{
+			Status: ReleaseStatusSkipped,
+			Error:  ReleasedAsCanary,
+		}
+	}
+	return ControllerResult{}
+}
+
+func (f *StageFilter) filterByNamespace(u ControllerUpdate) ControllerResult {
+	// Namespaces not in the order come last, with the remainder
+	position := func(namespace string) int {
+		for i := range f.Namespaces {
+			if f.Namespaces[i] == namespace {
+				return i
+			}
+		}
+		return len(f.Namespaces)
+	}
+	current := len(f.Namespaces)
+	if ns, ok := f.Stage.Namespace(); ok {
+		current = position(ns)
+	}
+	ns, _, _ := u.ResourceID.Components()
+	switch pos := position(ns); {
+	case pos < current:
+		return ControllerResult{
+			Status: ReleaseStatusSkipped,
+			Error:  ReleasedInStage,
+		}
+	case pos > current:
+		return ControllerResult{
+			Status: ReleaseStatusSkipped,
+			Error:  AwaitingStage,
+		}
 	}
 	return ControllerResult{}
 }
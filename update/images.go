@@ -3,6 +3,7 @@ package update
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
@@ -22,12 +23,24 @@ type ImageMap map[string][]flux.Image
 // descending order of latestness.) If no such image exists, returns nil,
 // and the caller can decide whether that's an error or not.
 func (m ImageMap) LatestImage(repo, tagGlob string) *flux.Image {
+	return m.LatestImageCreatedBefore(repo, tagGlob, time.Time{})
+}
+
+// LatestImageCreatedBefore is like LatestImage, but only considers
+// images created before the time given, e.g., to let images soak for
+// a while before they are released. Images with no creation time
+// aren't considered, since their age can't be known. A zero time
+// means any image will do.
+func (m ImageMap) LatestImageCreatedBefore(repo, tagGlob string, before time.Time) *flux.Image {
 	for _, image := range m[repo] {
 		_, _, tag := image.ID.Components()
 		// Ignore latest if and only if it's not what the user wants.
 		if !strings.EqualFold(tagGlob, "latest") && strings.EqualFold(tag, "latest") {
 			continue
 		}
+		if !before.IsZero() && (image.CreatedAt.IsZero() || !image.CreatedAt.Before(before)) {
+			continue
+		}
 		if glob.Glob(tagGlob, tag) {
 			return &image
 		}
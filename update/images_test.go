@@ -0,0 +1,47 @@
+package update
+
+import (
+	"testing"
+	"time"
+
+	"github.com/weaveworks/flux"
+)
+
+func TestLatestImageCreatedBefore(t *testing.T) {
+	now := time.Now()
+	mustImage := func(s string, created time.Time) flux.Image {
+		id, err := flux.ParseImageID(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return flux.Image{ID: id, CreatedAt: created}
+	}
+	repo := "quay.io/weaveworks/helloworld"
+	images := ImageMap{
+		repo: []flux.Image{
+			mustImage(repo+":3", now.Add(-10*time.Minute)),
+			mustImage(repo+":unknown", time.Time{}),
+			mustImage(repo+":2", now.Add(-time.Hour)),
+			mustImage(repo+":1", now.Add(-2*time.Hour)),
+		},
+	}
+
+	for _, c := range []struct {
+		before   time.Time
+		expected string
+	}{
+		{time.Time{}, repo + ":3"},
+		{now, repo + ":3"},
+		{now.Add(-30 * time.Minute), repo + ":2"},
+		{now.Add(-90 * time.Minute), repo + ":1"},
+		{now.Add(-3 * time.Hour), ""},
+	} {
+		latest := images.LatestImageCreatedBefore(repo, "*", c.before)
+		switch {
+		case latest == nil && c.expected != "":
+			t.Errorf("before %s: expected %s, got nothing", c.before, c.expected)
+		case latest != nil && latest.ID.String() != c.expected:
+			t.Errorf("before %s: expected %q, got %s", c.before, c.expected, latest.ID)
+		}
+	}
+}
@@ -2,7 +2,9 @@ package update
 
 import (
 	"fmt"
+	"path"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -42,6 +44,59 @@ func ParseReleaseKind(s string) (ReleaseKind, error) {
 	}
 }
 
+// Stage says which part of a staged release is being done: the
+// canaries, which get the new image(s) first; or in a release staged
+// by namespace, the controllers in one of the namespaces; or the
+// remainder, which get them once the stages before have proven
+// themselves. The zero value means the release is not (yet) split
+// into stages.
+type Stage string
+
+const (
+	StageCanaries  Stage = "canaries"
+	StageRemainder Stage = "remainder"
+
+	stageNamespacePrefix = "namespace:"
+)
+
+// NamespaceStage gives the stage, in a release staged by namespace,
+// that releases to the controllers in the namespace given.
+func NamespaceStage(namespace string) Stage {
+	return Stage(stageNamespacePrefix + namespace)
+}
+
+// Namespace gives the namespace released to in the stage, if it's a
+// stage of a release staged by namespace.
+func (s Stage) Namespace() (string, bool) {
+	if !strings.HasPrefix(string(s), stageNamespacePrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(string(s), stageNamespacePrefix), true
+}
+
+// NextStage gives the stage that comes after the one given, in a
+// release staged by the namespaces given (or canaries first, if
+// there are no namespaces); or the empty stage if it's the last.
+func NextStage(stage Stage, namespaces []string) Stage {
+	switch {
+	case stage == "" && len(namespaces) > 0:
+		return NamespaceStage(namespaces[0])
+	case stage == "":
+		return StageCanaries
+	case stage == StageCanaries:
+		return StageRemainder
+	}
+	if ns, ok := stage.Namespace(); ok {
+		for i := range namespaces {
+			if namespaces[i] == ns && i+1 < len(namespaces) {
+				return NamespaceStage(namespaces[i+1])
+			}
+		}
+		return StageRemainder
+	}
+	return ""
+}
+
 const UserAutomated = "<automated>"
 
 type ReleaseContext interface {
@@ -58,6 +113,23 @@ type ReleaseSpec struct {
 	ImageSpec    ImageSpec
 	Kind         ReleaseKind
 	Excludes     []flux.ResourceID
+	// Containers, if not empty, confines the release to the
+	// containers named
+	Containers []string `json:",omitempty"`
+	// Canary asks for the release to be staged: controllers with
+	// the canary policy are released to first, and the rest only
+	// once the canaries are ready and have soaked for a while (Soak,
+	// or the daemon's default if that's zero).
+	Canary bool `json:",omitempty"`
+	// NamespaceOrder asks for the release to be staged by namespace
+	// instead: the controllers in each namespace given are released
+	// to in turn, each once those before are ready and have soaked;
+	// controllers in other namespaces are released to last.
+	NamespaceOrder []string      `json:",omitempty"`
+	Soak           time.Duration `json:",omitempty"`
+	// Stage is filled in by the daemon when carrying out a staged
+	// release.
+	Stage Stage `json:",omitempty"`
 }
 
 // ReleaseType gives a one-word description of the release, mainly
@@ -73,8 +145,13 @@ func (s ReleaseSpec) ReleaseType() ReleaseType {
 
 func (s ReleaseSpec) CalculateRelease(rc ReleaseContext, logger log.Logger) ([]*ControllerUpdate, Result, error) {
 	results := Result{}
+	services, err := rc.ServicesWithPolicies()
+	if err != nil {
+		return nil, nil, err
+	}
+
 	timer := NewStageTimer("select_services")
-	updates, err := s.selectServices(rc, results)
+	updates, err := s.selectServices(rc, services, results)
 	timer.ObserveDuration()
 	if err != nil {
 		return nil, nil, err
@@ -82,7 +159,7 @@ func (s ReleaseSpec) CalculateRelease(rc ReleaseContext, logger log.Logger) ([]*
 	s.markSkipped(results)
 
 	timer = NewStageTimer("lookup_images")
-	updates, err = s.calculateImageUpdates(rc, updates, results, logger)
+	updates, err = s.calculateImageUpdates(rc, updates, services, results, logger)
 	timer.ObserveDuration()
 	if err != nil {
 		return nil, nil, err
@@ -106,9 +183,9 @@ func (s ReleaseSpec) CommitMessage() string {
 // Take the spec given in the job, and figure out which services are
 // in question based on the running services and those defined in the
 // repo. Fill in the release results along the way.
-func (s ReleaseSpec) selectServices(rc ReleaseContext, results Result) ([]*ControllerUpdate, error) {
+func (s ReleaseSpec) selectServices(rc ReleaseContext, services policy.ResourceMap, results Result) ([]*ControllerUpdate, error) {
 	// Build list of filters
-	filtList, err := s.filters(rc)
+	filtList, err := s.filters(services)
 	if err != nil {
 		return nil, err
 	}
@@ -120,7 +197,7 @@ func (s ReleaseSpec) selectServices(rc ReleaseContext, results Result) ([]*Contr
 }
 
 // filters converts a ReleaseSpec (and Lock config) into ServiceFilters
-func (s ReleaseSpec) filters(rc ReleaseContext) ([]ControllerFilter, error) {
+func (s ReleaseSpec) filters(services policy.ResourceMap) ([]ControllerFilter, error) {
 	// Image filter
 	var filtList []ControllerFilter
 	if s.ImageSpec != ImageSpecLatest {
@@ -155,12 +232,13 @@ func (s ReleaseSpec) filters(rc ReleaseContext) ([]ControllerFilter, error) {
 	}
 
 	// Locked filter
-	services, err := rc.ServicesWithPolicies()
-	if err != nil {
-		return nil, err
+	lockedSet := services.OnlyWithContainerPolicy(policy.Locked)
+	filtList = append(filtList, &LockedFilter{lockedSet})
+
+	// Stage filter
+	if s.Stage != "" {
+		filtList = append(filtList, &StageFilter{services.OnlyWithPolicy(policy.Canary), s.NamespaceOrder, s.Stage})
 	}
-	lockedSet := services.OnlyWithPolicy(policy.Locked)
-	filtList = append(filtList, &LockedFilter{lockedSet.ToSlice()})
 	return filtList, nil
 }
 
@@ -188,7 +266,7 @@ func (s ReleaseSpec) markSkipped(results Result) {
 // however we do want to see if we *can* do the replacements, because
 // if not, it indicates there's likely some problem with the running
 // system vs the definitions given in the repo.)
-func (s ReleaseSpec) calculateImageUpdates(rc ReleaseContext, candidates []*ControllerUpdate, results Result, logger log.Logger) ([]*ControllerUpdate, error) {
+func (s ReleaseSpec) calculateImageUpdates(rc ReleaseContext, candidates []*ControllerUpdate, services policy.ResourceMap, results Result, logger log.Logger) ([]*ControllerUpdate, error) {
 	// Compile an `ImageMap` of all relevant images
 	var images ImageMap
 	var repo string
@@ -228,8 +306,12 @@ func (s ReleaseSpec) calculateImageUpdates(rc ReleaseContext, candidates []*Cont
 		// for the purpose of filtering the output.
 		ignoredOrSkipped := ReleaseStatusIgnored
 		var containerUpdates []ContainerUpdate
+		var lockedContainers bool
 
 		for _, container := range containers {
+			if !s.includesContainer(container.Name) {
+				continue
+			}
 			currentImageID, err := flux.ParseImageID(container.Image)
 			if err != nil {
 				// We may hope never to find a malformed image ID, but
@@ -252,6 +334,13 @@ func (s ReleaseSpec) calculateImageUpdates(rc ReleaseContext, candidates []*Cont
 				continue
 			}
 
+			// Leave alone any containers that have been locked, or
+			// are to be ignored, individually
+			if cp := services[u.ResourceID].ForContainer(container.Name); cp.Contains(policy.Locked) || cp.Contains(policy.Ignore) {
+				lockedContainers = true
+				continue
+			}
+
 			u.ManifestBytes, err = rc.Manifests().UpdateDefinition(u.ManifestBytes, container.Name, latestImage.ID)
 			if err != nil {
 				return nil, err
@@ -272,6 +361,11 @@ func (s ReleaseSpec) calculateImageUpdates(rc ReleaseContext, candidates []*Cont
 				Status:       ReleaseStatusSuccess,
 				PerContainer: containerUpdates,
 			}
+		case lockedContainers:
+			results[u.ResourceID] = ControllerResult{
+				Status: ReleaseStatusSkipped,
+				Error:  Locked,
+			}
 		case ignoredOrSkipped == ReleaseStatusSkipped:
 			results[u.ResourceID] = ControllerResult{
 				Status: ReleaseStatusSkipped,
@@ -293,11 +387,44 @@ func (s ReleaseSpec) calculateImageUpdates(rc ReleaseContext, candidates []*Cont
 	return updates, nil
 }
 
-type ResourceSpec string // ResourceID or "<all>"
+// includesContainer says whether the release applies to the named
+// container; if no containers are given, it applies to all of them.
+func (s ReleaseSpec) includesContainer(name string) bool {
+	if len(s.Containers) == 0 {
+		return true
+	}
+	for _, c := range s.Containers {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ResourceSpec picks out one or more resources. It is a ResourceID;
+// "<all>"; a pattern for resource IDs, with wildcards (`*`, `?`,
+// `[...]`) in any part, e.g., "prod:deployment/api-*"; or a label
+// selector prefixed with "label:", e.g., "label:team=payments". The
+// patterns and label selectors are resolved against the resources
+// defined in the repo.
+type ResourceSpec string
+
+const labelSpecPrefix = "label:"
 
 func ParseResourceSpec(s string) (ResourceSpec, error) {
-	if s == string(ResourceSpecAll) {
+	switch {
+	case s == string(ResourceSpecAll):
 		return ResourceSpecAll, nil
+	case strings.HasPrefix(s, labelSpecPrefix):
+		if _, err := ParseSelector(strings.TrimPrefix(s, labelSpecPrefix)); err != nil {
+			return "", errors.Wrap(err, "invalid service spec")
+		}
+		return ResourceSpec(s), nil
+	case isPattern(s):
+		if err := checkPattern(s); err != nil {
+			return "", errors.Wrap(err, "invalid service spec")
+		}
+		return ResourceSpec(s), nil
 	}
 	id, err := flux.ParseResourceID(s)
 	if err != nil {
@@ -314,6 +441,53 @@ func (s ResourceSpec) AsID() (flux.ResourceID, error) {
 	return flux.ParseResourceID(string(s))
 }
 
+// MakeLabelSpec makes a ResourceSpec picking out the resources
+// matching the label selector given.
+func MakeLabelSpec(selector string) (ResourceSpec, error) {
+	return ParseResourceSpec(labelSpecPrefix + selector)
+}
+
+// IsSelection says whether the spec is a pattern or label selector,
+// which must be resolved to the resources it matches, rather than an
+// ID or "<all>".
+func (s ResourceSpec) IsSelection() bool {
+	return strings.HasPrefix(string(s), labelSpecPrefix) || isPattern(string(s))
+}
+
+// Matches says whether the spec picks out the resource with the ID
+// and labels given.
+func (s ResourceSpec) Matches(id flux.ResourceID, labels map[string]string) bool {
+	switch {
+	case s == ResourceSpecAll:
+		return true
+	case strings.HasPrefix(string(s), labelSpecPrefix):
+		sel, err := ParseSelector(strings.TrimPrefix(string(s), labelSpecPrefix))
+		if err != nil {
+			return false
+		}
+		return sel.Matches(labels)
+	case isPattern(string(s)):
+		ok, _ := path.Match(string(s), id.String())
+		return ok
+	}
+	specID, err := s.AsID()
+	return err == nil && specID == id
+}
+
+func isPattern(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+func checkPattern(s string) error {
+	if _, err := path.Match(s, ""); err != nil {
+		return err
+	}
+	if !strings.Contains(s, ":") || !strings.Contains(s, "/") {
+		return fmt.Errorf("pattern %q is not of the form <namespace>:<kind>/<name>", s)
+	}
+	return nil
+}
+
 func (s ResourceSpec) String() string {
 	return string(s)
 }
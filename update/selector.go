@@ -0,0 +1,84 @@
+package update
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Selector is a simple label selector, as given to `kubectl -l`. It
+// is a comma-separated list of requirements, all of which must be
+// met; each is one of `key=value` (or `key==value`), `key!=value`,
+// `key` (the label is present), or `!key` (the label is absent).
+type Selector []requirement
+
+type requirement struct {
+	key   string
+	op    string
+	value string
+}
+
+const (
+	opEquals    = "="
+	opNotEquals = "!="
+	opExists    = "exists"
+	opNotExists = "!"
+)
+
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		var r requirement
+		switch {
+		case part == "":
+			return nil, errors.New("empty requirement in label selector")
+		case strings.Contains(part, "!="):
+			kv := strings.SplitN(part, "!=", 2)
+			r = requirement{strings.TrimSpace(kv[0]), opNotEquals, strings.TrimSpace(kv[1])}
+		case strings.Contains(part, "=="):
+			kv := strings.SplitN(part, "==", 2)
+			r = requirement{strings.TrimSpace(kv[0]), opEquals, strings.TrimSpace(kv[1])}
+		case strings.Contains(part, "="):
+			kv := strings.SplitN(part, "=", 2)
+			r = requirement{strings.TrimSpace(kv[0]), opEquals, strings.TrimSpace(kv[1])}
+		case strings.HasPrefix(part, "!"):
+			r = requirement{strings.TrimSpace(part[1:]), opNotExists, ""}
+		default:
+			r = requirement{part, opExists, ""}
+		}
+		if r.key == "" || strings.ContainsAny(r.key, "=! ") {
+			return nil, fmt.Errorf("invalid label name in requirement %q", part)
+		}
+		sel = append(sel, r)
+	}
+	return sel, nil
+}
+
+// Matches says whether the labels given meet all the requirements of
+// the selector.
+func (sel Selector) Matches(labels map[string]string) bool {
+	for _, r := range sel {
+		value, ok := labels[r.key]
+		switch r.op {
+		case opEquals:
+			if !ok || value != r.value {
+				return false
+			}
+		case opNotEquals:
+			if ok && value == r.value {
+				return false
+			}
+		case opExists:
+			if !ok {
+				return false
+			}
+		case opNotExists:
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+package update
+
+import (
+	"testing"
+
+	"github.com/weaveworks/flux"
+)
+
+func TestParseSelector(t *testing.T) {
+	for _, s := range []string{
+		"team=payments",
+		"team==payments,tier!=db",
+		"canary",
+		"!canary, team = payments",
+	} {
+		if _, err := ParseSelector(s); err != nil {
+			t.Errorf("expected %q to parse, got %v", s, err)
+		}
+	}
+	for _, s := range []string{
+		"",
+		"team=payments,",
+		"=payments",
+		"!",
+	} {
+		if _, err := ParseSelector(s); err == nil {
+			t.Errorf("expected %q not to parse", s)
+		}
+	}
+}
+
+func TestResourceSpecMatches(t *testing.T) {
+	api := flux.MustParseResourceID("prod:deployment/api-users")
+	web := flux.MustParseResourceID("prod:deployment/web")
+	devAPI := flux.MustParseResourceID("dev:deployment/api-users")
+	labels := map[flux.ResourceID]map[string]string{
+		api:    {"team": "payments", "tier": "backend"},
+		web:    {"team": "payments", "tier": "frontend"},
+		devAPI: {"team": "identity"},
+	}
+
+	for _, c := range []struct {
+		spec    string
+		matches []flux.ResourceID
+	}{
+		{"<all>", []flux.ResourceID{api, web, devAPI}},
+		{"prod:deployment/web", []flux.ResourceID{web}},
+		{"prod:deployment/api-*", []flux.ResourceID{api}},
+		{"*:deployment/api-*", []flux.ResourceID{api, devAPI}},
+		{"prod:*/*", []flux.ResourceID{api, web}},
+		{"label:team=payments", []flux.ResourceID{api, web}},
+		{"label:team=payments,tier!=frontend", []flux.ResourceID{api}},
+		{"label:!tier", []flux.ResourceID{devAPI}},
+	} {
+		spec, err := ParseResourceSpec(c.spec)
+		if err != nil {
+			t.Errorf("parsing %q: %v", c.spec, err)
+			continue
+		}
+		for _, id := range []flux.ResourceID{api, web, devAPI} {
+			expected := false
+			for _, m := range c.matches {
+				if m == id {
+					expected = true
+				}
+			}
+			if got := spec.Matches(id, labels[id]); got != expected {
+				t.Errorf("%q matching %s: expected %v, got %v", c.spec, id, expected, got)
+			}
+		}
+	}
+}
+
+func TestParseResourceSpecSelections(t *testing.T) {
+	for _, c := range []struct {
+		spec      string
+		selection bool
+	}{
+		{"<all>", false},
+		{"default:deployment/helloworld", false},
+		{"default:deployment/hello*", true},
+		{"label:app=helloworld", true},
+	} {
+		spec, err := ParseResourceSpec(c.spec)
+		if err != nil {
+			t.Errorf("parsing %q: %v", c.spec, err)
+			continue
+		}
+		if spec.IsSelection() != c.selection {
+			t.Errorf("%q: expected IsSelection() to be %v", c.spec, c.selection)
+		}
+	}
+
+	for _, s := range []string{
+		"hello*",
+		"default:deployment/[hello",
+		"label:",
+		"label:=helloworld",
+	} {
+		if _, err := ParseResourceSpec(s); err == nil {
+			t.Errorf("expected %q not to parse", s)
+		}
+	}
+}
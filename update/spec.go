@@ -4,13 +4,19 @@ import (
 	"encoding/json"
 	"errors"
 
+	"github.com/weaveworks/flux"
 	"github.com/weaveworks/flux/policy"
 )
 
 const (
-	Images = "image"
-	Policy = "policy"
-	Auto   = "auto"
+	Images   = "image"
+	Policy   = "policy"
+	Auto     = "auto"
+	Freeze   = "freeze"
+	Rollback = "rollback"
+	// Policy updates given by resource spec rather than by ID, so
+	// they can be resolved by the daemon
+	PolicyBySpec = "policy_by_spec"
 )
 
 // How did this update get triggered?
@@ -19,6 +25,25 @@ type Cause struct {
 	User    string
 }
 
+// FreezeSpec switches automated releases off (or back on again),
+// regardless of deployment windows.
+type FreezeSpec struct {
+	Frozen bool
+}
+
+// RollbackSpec says which controller to roll back, and how far: to
+// before the release made in a particular revision, or back a number
+// of releases. If neither is given, the last release is rolled back.
+type RollbackSpec struct {
+	ServiceID  flux.ResourceID
+	ToRevision string `json:",omitempty"`
+	Steps      int    `json:",omitempty"`
+}
+
+// PolicyUpdatesBySpec gives policy updates for the resources picked
+// out by each spec; e.g., all the controllers with a particular label.
+type PolicyUpdatesBySpec map[ResourceSpec]policy.Update
+
 // A tagged union for all (both) kinds of update. The type is just so
 // we know how to decode the rest of the struct.
 type Spec struct {
@@ -58,6 +83,24 @@ func (spec *Spec) UnmarshalJSON(in []byte) error {
 			return err
 		}
 		spec.Spec = update
+	case Freeze:
+		var update FreezeSpec
+		if err := json.Unmarshal(wire.SpecBytes, &update); err != nil {
+			return err
+		}
+		spec.Spec = update
+	case Rollback:
+		var update RollbackSpec
+		if err := json.Unmarshal(wire.SpecBytes, &update); err != nil {
+			return err
+		}
+		spec.Spec = update
+	case PolicyBySpec:
+		var update PolicyUpdatesBySpec
+		if err := json.Unmarshal(wire.SpecBytes, &update); err != nil {
+			return err
+		}
+		spec.Spec = update
 	default:
 		return errors.New("unknown spec type: " + wire.Type)
 	}